@@ -34,12 +34,22 @@ func StartServer(zaplogger *zap.Logger, port int) error {
 	_, ok := os.LookupEnv(constants.SkipPostgres) // only care if the flag exists in the environment
 	var userStore db.UserStore
 	var preferenceStore db.PreferenceStore
+	var rewardStore db.RewardStore
 	var messageCounter db.MessageCounter
+	var requestStore db.RequestStore
+	var viewerCounter db.ViewerRequestCounter
+	var dedupStore db.DedupStore
+	var streamStore db.StreamStore
 	if ok {
 		// use no-op implementations
 		userStore = &db.NoopUserStore{}
 		preferenceStore = &db.NoopPreferenceStore{}
+		rewardStore = &db.NoopRewardStore{}
 		messageCounter = &db.NoopMessageCounter{}
+		requestStore = &db.NoopRequestStore{}
+		viewerCounter = db.NewInMemoryViewerRequestCounter()
+		dedupStore = db.NewInMemoryDedupStore()
+		streamStore = &db.NoopStreamStore{}
 	} else {
 		// connect to Postgres DB
 		dbpool, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
@@ -50,7 +60,12 @@ func StartServer(zaplogger *zap.Logger, port int) error {
 
 		userStore = db.NewPostgresUserStore(dbpool)
 		preferenceStore = db.NewPostgresPreferenceStore(dbpool)
+		rewardStore = db.NewPostgresRewardStore(dbpool)
 		messageCounter = db.NewPostgresMessageCounter(dbpool)
+		requestStore = db.NewPostgresRequestStore(dbpool)
+		viewerCounter = db.NewPostgresViewerRequestCounter(dbpool)
+		dedupStore = db.NewPostgresDedupStore(dbpool)
+		streamStore = db.NewPostgresStreamStore(dbpool)
 	}
 
 	r := chi.NewRouter()
@@ -82,6 +97,9 @@ func StartServer(zaplogger *zap.Logger, port int) error {
 		return err
 	}
 
+	// sign the Twitch ID cookie so that nobody can act as another user
+	util.SetCookieSecret(twitchConfig.ClientSecret)
+
 	spotifyConfig, err := util.LoadSpotifyConfigs()
 	if err != nil {
 		zap.L().Error("failed to load Spotify configurations ", zap.Error(err))
@@ -100,30 +118,55 @@ func StartServer(zaplogger *zap.Logger, port int) error {
 	}
 	zap.L().Debug(fmt.Sprintf("Currently serving song requests for %d/%d users", numOnboarded, numAllowed))
 
+	holdExpiry := api.DefaultHoldExpiry
+	if d, err := time.ParseDuration(util.GetFromEnvOrDefault(constants.HeldRequestTTL, "")); err == nil && d > 0 {
+		holdExpiry = d
+	}
+
 	// ===== APIs =====
 	p := spotify.NewSpotifyPlayerQueue()
+	p.History = messageCounter
 	rhconfig := api.RewardHandlerConfig{
-		Secret:    s,
-		Publisher: p,
-		UserStore: userStore,
-		PrefStore: preferenceStore,
-		MsgCount:  messageCounter,
-		Twitch:    twitchConfig,
-		Spotify:   spotifyConfig,
+		Secret:        s,
+		Publisher:     p,
+		UserStore:     userStore,
+		PrefStore:     preferenceStore,
+		Rewards:       rewardStore,
+		MsgCount:      messageCounter,
+		Requests:      requestStore,
+		Dedup:         dedupStore,
+		ViewerCounter: viewerCounter,
+		Streams:       streamStore,
+		HoldExpiry:    holdExpiry,
+		Twitch:        twitchConfig,
+		Spotify:       spotifyConfig,
 	}
 	reward := api.NewRewardHandler(&rhconfig)
 
 	r.Post("/callback", reward.ChannelPointRedeem)
-
-	eventSub := api.NewEventSubHandler(userStore, preferenceStore, twitchConfig, redirectURL, s)
+	// pick up the requests that were saved, but not processed, before the last restart
+	reward.StartResume(time.Minute)
+	reward.StartDedupPurge(time.Hour)
+	reward.StartHoldFlush(30 * time.Second)
+	reward.StartPlaybackWatch(5 * time.Second)
+
+	pendingHandler := api.NewPendingRequestHandler(reward, redirectURL)
+	r.Post("/pending/approve", pendingHandler.ApproveRequest)
+	r.Post("/pending/reject", pendingHandler.RejectRequest)
+	pendingHandler.StartExpiry(time.Minute)
+
+	eventSub := api.NewEventSubHandler(userStore, preferenceStore, rewardStore, twitchConfig, redirectURL, s)
 	r.Post("/subscribe", eventSub.SubscribeToTopic)
+	r.Post("/rewards", eventSub.AddReward)
+	r.Post("/rewards/remove", eventSub.RemoveReward) // this is a POST because forms don't support DELETE
+	r.Post("/rewards/settings", eventSub.UpdateRewardSettings)
 
 	twitchRedirect := api.NewTwitchAuthZHandler(redirectURL, twitchConfig, userStore, preferenceStore)
 	spotifyRedirect := api.NewSpotifyAuthZHandler(redirectURL, spotifyConfig, userStore)
 	r.Get("/oauth/twitch", twitchRedirect.Authorize)
 	r.Get("/oauth/spotify", spotifyRedirect.Authorize)
 
-	userHandler := api.NewUserHandler(userStore, preferenceStore, redirectURL, twitchConfig, spotifyConfig)
+	userHandler := api.NewUserHandler(userStore, preferenceStore, rewardStore, redirectURL, twitchConfig, spotifyConfig)
 	r.Post("/revoke", userHandler.RevokeUserAccesses) // this is a POST because forms don't support DELETE
 
 	preferenceHandler := api.NewPreferenceHandler(preferenceStore, redirectURL)
@@ -137,10 +180,17 @@ func StartServer(zaplogger *zap.Logger, port int) error {
 	queueHandler := site.NewQueuePageRenderer(redirectURL, userStore, spotifyConfig)
 	r.Get("/queue/{id}", queueHandler.GetUserQueue)
 
+	pendingPage := site.NewPendingPageRenderer(redirectURL, userStore, requestStore, twitchConfig)
+	r.Get("/pending/{id}", pendingPage.PendingPage)
+
+	recapPage := site.NewRecapPageRenderer(redirectURL, streamStore, requestStore, messageCounter)
+	r.Get("/recap/{id}", recapPage.RecapPage)
+	r.Get("/recap/{id}/json", recapPage.RecapJSON)
+
 	// ===== Website Pages =====
 
-	home := site.NewHomePageRenderer(redirectURL, userStore, twitchConfig, spotifyConfig)
-	preferences := site.NewPreferencesRenderer(preferenceStore, redirectURL)
+	home := site.NewHomePageRenderer(redirectURL, userStore, requestStore, twitchConfig, spotifyConfig)
+	preferences := site.NewPreferencesRenderer(preferenceStore, rewardStore, userStore, twitchConfig, spotifyConfig, redirectURL)
 	r.Get("/", home.HomePage)
 	r.Get("/preferences", preferences.PreferencesPage)
 
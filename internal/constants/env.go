@@ -15,6 +15,8 @@ const (
 	SiteRedirectURL    = "SITE_REDIRECT_URL"
 	SpotifyStateKey    = "SPOTIFY_STATE"
 	TwitchStateKey     = "TWITCH_STATE"
+	// HeldRequestTTL is how long requests wait for the broadcaster's Spotify player, like "30m"
+	HeldRequestTTL = "HELD_REQUEST_TTL"
 
 	// Shared cookie
 	TwitchIDCookieKey = "TwitchSongRequests-Twitch-ID"
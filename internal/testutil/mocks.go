@@ -1,10 +1,14 @@
 package testutil
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"fmt"
 	"log"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/nicklaw5/helix/v2"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
@@ -12,6 +16,9 @@ import (
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
 	"github.com/saxypandabear/twitchsongrequests/pkg/users"
 	"github.com/zmb3/spotify/v2"
 )
@@ -20,21 +27,26 @@ type DummyPublisher struct {
 	Messages          chan string
 	ShouldFail        bool
 	IsMessageExplicit bool
+	// Err is returned instead of publishing, if it is set
+	Err error
 }
 
 var _ queue.Publisher = (*DummyPublisher)(nil)
 
-func (p DummyPublisher) Publish(client queue.Queuer, url string, pref *preferences.Preference) (spotify.ID, error) {
+func (p DummyPublisher) Publish(client queue.Queuer, url string, pref *preferences.Preference) (queue.Result, error) {
 	if p.ShouldFail {
-		return "", errors.New("oops")
+		return queue.Result{}, errors.New("oops")
+	}
+	if p.Err != nil {
+		return queue.Result{}, p.Err
 	}
 
 	if (pref == nil || !pref.ExplicitSongs) && p.IsMessageExplicit {
-		return "", errors.New("not allowed")
+		return queue.Result{}, errors.New("not allowed")
 	}
 
 	p.Messages <- url
-	return "something", nil
+	return queue.Result{TrackID: "something"}, nil
 }
 
 type MockReadCloser struct{}
@@ -53,32 +65,119 @@ type MockQueuer struct {
 	Messages     []spotify.ID
 	Explicit     bool
 	GetTrackFunc func(spotify.ID) (*spotify.FullTrack, error)
+	// Queue is what is returned as the user's Spotify queue
+	Queue *spotify.Queue
+	// SearchResults replaces the default search result when set
+	SearchResults []spotify.FullTrack
+	// Songs that are returned for album, playlist and artist links
+	AlbumTracks    []spotify.SimpleTrack
+	PlaylistTracks []spotify.PlaylistItem
+	TopTracks      []spotify.FullTrack
+	// QueueErr is returned when queueing a song, if it is set
+	QueueErr error
+	// Devices are the user's Spotify devices
+	Devices []spotify.PlayerDevice
+	// QueuedOn is the device ID that each song in Messages was queued on, or
+	// empty for the active device
+	QueuedOn []string
 }
 
 func (m *MockQueuer) QueueSong(ctx context.Context, trackID spotify.ID) error {
 	if m.ShouldFail {
 		return errors.New("expected to fail")
 	}
+	if m.QueueErr != nil {
+		return m.QueueErr
+	}
 
 	m.Messages = append(m.Messages, trackID)
 	return nil
 }
 
+func (m *MockQueuer) QueueSongOpt(ctx context.Context, trackID spotify.ID, opt *spotify.PlayOptions) error {
+	if err := m.QueueSong(ctx, trackID); err != nil {
+		return err
+	}
+	var device string
+	if opt != nil && opt.DeviceID != nil {
+		device = opt.DeviceID.String()
+	}
+	m.QueuedOn = append(m.QueuedOn, device)
+	return nil
+}
+
+func (m *MockQueuer) PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error) {
+	if m.ShouldFail {
+		return nil, errors.New("expected to fail")
+	}
+	return m.Devices, nil
+}
+
 func (m *MockQueuer) GetTrack(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.FullTrack, error) {
 	return m.GetTrackFunc(id)
 }
 
+func (m *MockQueuer) GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error) {
+	tracks := make([]*spotify.FullTrack, 0, len(ids))
+	for _, id := range ids {
+		t, err := m.GetTrackFunc(id)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, nil
+}
+
+func (m *MockQueuer) GetQueue(ctx context.Context) (*spotify.Queue, error) {
+	if m.Queue == nil {
+		return &spotify.Queue{}, nil
+	}
+	return m.Queue, nil
+}
+
+func (m *MockQueuer) GetAlbumTracks(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.SimpleTrackPage, error) {
+	if m.ShouldFail {
+		return nil, errors.New("expected to fail")
+	}
+	return &spotify.SimpleTrackPage{Tracks: m.AlbumTracks}, nil
+}
+
+func (m *MockQueuer) GetPlaylistItems(ctx context.Context, playlistID spotify.ID, opts ...spotify.RequestOption) (*spotify.PlaylistItemPage, error) {
+	if m.ShouldFail {
+		return nil, errors.New("expected to fail")
+	}
+	return &spotify.PlaylistItemPage{Items: m.PlaylistTracks}, nil
+}
+
+func (m *MockQueuer) GetArtistsTopTracks(ctx context.Context, artistID spotify.ID, country string) ([]spotify.FullTrack, error) {
+	if m.ShouldFail {
+		return nil, errors.New("expected to fail")
+	}
+	return m.TopTracks, nil
+}
+
 func (m *MockQueuer) Search(ctx context.Context, query string, t spotify.SearchType, opts ...spotify.RequestOption) (*spotify.SearchResult, error) {
 	if m.ShouldFail {
 		return nil, errors.New("expected to fail")
 	}
 
+	if m.SearchResults != nil {
+		return &spotify.SearchResult{
+			Tracks: &spotify.FullTrackPage{
+				Tracks: m.SearchResults,
+			},
+		}, nil
+	}
+
+	// by default, the search finds a song named after the query
 	return &spotify.SearchResult{
 		Tracks: &spotify.FullTrackPage{
 			Tracks: []spotify.FullTrack{
 				{
 					SimpleTrack: spotify.SimpleTrack{
-						ID: "abc123",
+						ID:   "abc123",
+						Name: query,
 					},
 				},
 			},
@@ -126,9 +225,10 @@ type DummyCallback struct {
 	CheckExecuted    chan bool
 }
 
-func (c *DummyCallback) Callback(a *util.AuthConfig, u db.UserStore, e *helix.EventSubChannelPointsCustomRewardRedemptionEvent, success bool) error {
-	log.Println("received callback request", success)
-	c.CallbackExecuted <- success
+// Callback sends whether the redemption was fulfilled
+func (c *DummyCallback) Callback(a *util.AuthConfig, u db.UserStore, e *helix.EventSubChannelPointsCustomRewardRedemptionEvent, status string) error {
+	log.Println("received callback request", status)
+	c.CallbackExecuted <- status == requests.RedemptionFulfilled
 	return nil
 }
 
@@ -141,9 +241,12 @@ var _ db.PreferenceStore = (*InMemoryPreferenceStore)(nil)
 
 type InMemoryPreferenceStore struct {
 	Data map[string]*preferences.Preference
+	mu   sync.Mutex
 }
 
 func (s *InMemoryPreferenceStore) GetPreference(id string) (*preferences.Preference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	p, ok := s.Data[id]
 	if !ok {
 		return nil, fmt.Errorf("user %s not found", id)
@@ -153,16 +256,37 @@ func (s *InMemoryPreferenceStore) GetPreference(id string) (*preferences.Prefere
 }
 
 func (s *InMemoryPreferenceStore) AddPreference(p *preferences.Preference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Data[p.TwitchID] = p
 	return nil
 }
 
 func (s *InMemoryPreferenceStore) UpdatePreference(p *preferences.Preference) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.Data[p.TwitchID] = p
 	return nil
 }
 
+func (s *InMemoryPreferenceStore) UpdatePausedRewards(id string, rewardIDs []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.Data[id]
+	if !ok {
+		return fmt.Errorf("user %s not found", id)
+	}
+	// the paused rewards are saved in the background, so a copy is stored rather than
+	// changing a preference someone else may be reading
+	updated := *p
+	updated.PausedRewards = rewardIDs
+	s.Data[id] = &updated
+	return nil
+}
+
 func (s *InMemoryPreferenceStore) DeletePreference(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	delete(s.Data, id)
 	return nil
 }
@@ -188,3 +312,294 @@ func (c *InMemoryMessageCounter) RunningCount(int) uint64 {
 func (c *InMemoryMessageCounter) MessagesForUser(string) []*metrics.Message {
 	return c.Msgs
 }
+
+func (c *InMemoryMessageCounter) MessagesForSession(sessionID string) []*metrics.Message {
+	msgs := make([]*metrics.Message, 0)
+	for _, m := range c.Msgs {
+		if m.SessionID == sessionID {
+			msgs = append(msgs, m)
+		}
+	}
+	return msgs
+}
+
+func (c *InMemoryMessageCounter) RecentTracks(broadcasterID string, since time.Time) []string {
+	tracks := make([]string, 0)
+	for i := len(c.Msgs) - 1; i >= 0; i-- {
+		m := c.Msgs[i]
+		if m.BroadcasterID == broadcasterID && m.Success == 1 && m.SpotifyTrack != "" &&
+			m.CreatedAt != nil && m.CreatedAt.After(since) {
+			tracks = append(tracks, m.SpotifyTrack)
+		}
+	}
+	return tracks
+}
+
+var _ db.RequestStore = (*InMemoryRequestStore)(nil)
+
+type InMemoryRequestStore struct {
+	Data map[string]*requests.Request
+	mu   sync.Mutex
+	// statuses are the saved statuses, since the requests in Data are shared with the
+	// handlers that change them
+	statuses map[string]string
+}
+
+func (s *InMemoryRequestStore) save(r *requests.Request) {
+	if s.statuses == nil {
+		s.statuses = make(map[string]string)
+	}
+	s.Data[r.ID] = r
+	s.statuses[r.ID] = r.Status
+}
+
+func (s *InMemoryRequestStore) GetRequest(id string) (*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.Data[id]
+	if !ok {
+		return nil, fmt.Errorf("request %s not found", id)
+	}
+	return r, nil
+}
+
+func (s *InMemoryRequestStore) AddRequest(r *requests.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save(r)
+	return nil
+}
+
+func (s *InMemoryRequestStore) UpdateRequest(r *requests.Request) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.save(r)
+	return nil
+}
+
+func (s *InMemoryRequestStore) TransitionRequest(r *requests.Request, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if status, ok := s.statuses[r.ID]; ok && status != from {
+		return db.ErrRequestChanged
+	}
+	s.save(r)
+	return nil
+}
+
+func (s *InMemoryRequestStore) RequestsForBroadcaster(id, status string) ([]*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*requests.Request, 0)
+	for _, r := range s.Data {
+		if r.BroadcasterID == id && r.Status == status {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs, nil
+}
+
+func (s *InMemoryRequestStore) CountViewerRequests(broadcasterID, viewerID, exceptID string, statuses []string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for _, r := range s.Data {
+		if r.BroadcasterID == broadcasterID && r.UserID == viewerID && r.ID != exceptID && slices.Contains(statuses, r.Status) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (s *InMemoryRequestStore) LatestRequests(id string, limit int) ([]*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*requests.Request, 0)
+	for _, r := range s.Data {
+		if r.BroadcasterID == id && r.CreatedAt != nil {
+			reqs = append(reqs, r)
+		}
+	}
+	slices.SortFunc(reqs, func(a, b *requests.Request) int {
+		return b.CreatedAt.Compare(*a.CreatedAt)
+	})
+	return reqs[:min(limit, len(reqs))], nil
+}
+
+func (s *InMemoryRequestStore) RequestsForSession(sessionID string) ([]*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*requests.Request, 0)
+	for _, r := range s.Data {
+		if r.SessionID == sessionID {
+			reqs = append(reqs, r)
+		}
+	}
+	slices.SortStableFunc(reqs, func(a, b *requests.Request) int {
+		if a.CreatedAt == nil || b.CreatedAt == nil {
+			return 0
+		}
+		return a.CreatedAt.Compare(*b.CreatedAt)
+	})
+	return reqs, nil
+}
+
+func (s *InMemoryRequestStore) StaleRequests(status string, before time.Time) ([]*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*requests.Request, 0)
+	for _, r := range s.Data {
+		if r.Status == status && r.CreatedAt != nil && r.CreatedAt.Before(before) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs, nil
+}
+
+func (s *InMemoryRequestStore) BroadcastersWithRequests(statuses []string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0)
+	for _, r := range s.Data {
+		if slices.Contains(statuses, r.Status) && !slices.Contains(ids, r.BroadcasterID) {
+			ids = append(ids, r.BroadcasterID)
+		}
+	}
+	return ids, nil
+}
+
+func (s *InMemoryRequestStore) OpenRequests(id string, statuses []string) ([]*requests.Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := make([]*requests.Request, 0)
+	for _, r := range s.Data {
+		if r.BroadcasterID == id && slices.Contains(statuses, r.Status) {
+			reqs = append(reqs, r)
+		}
+	}
+	return reqs, nil
+}
+
+var _ db.RewardStore = (*InMemoryRewardStore)(nil)
+
+type InMemoryRewardStore struct {
+	Data map[string]*rewards.Reward
+}
+
+func (s *InMemoryRewardStore) GetReward(id string) (*rewards.Reward, error) {
+	r, ok := s.Data[id]
+	if !ok {
+		return nil, fmt.Errorf("reward %s not found", id)
+	}
+	return r, nil
+}
+
+func (s *InMemoryRewardStore) RewardsForBroadcaster(broadcasterID string) ([]*rewards.Reward, error) {
+	rs := make([]*rewards.Reward, 0)
+	for _, r := range s.Data {
+		if r.BroadcasterID == broadcasterID {
+			rs = append(rs, r)
+		}
+	}
+	slices.SortFunc(rs, func(a, b *rewards.Reward) int {
+		return cmp.Compare(a.Cost, b.Cost)
+	})
+	return rs, nil
+}
+
+func (s *InMemoryRewardStore) AddReward(r *rewards.Reward) error {
+	s.Data[r.ID] = r
+	return nil
+}
+
+func (s *InMemoryRewardStore) UpdateReward(r *rewards.Reward) error {
+	s.Data[r.ID] = r
+	return nil
+}
+
+func (s *InMemoryRewardStore) DeleteReward(id string) error {
+	delete(s.Data, id)
+	return nil
+}
+
+var _ db.StreamStore = (*InMemoryStreamStore)(nil)
+
+// InMemoryStreamStore keeps each broadcaster's streams in the order they started
+type InMemoryStreamStore struct {
+	Data map[string][]*streams.Stream
+	mu   sync.Mutex
+}
+
+func (s *InMemoryStreamStore) StartStream(stream *streams.Stream) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.Data[stream.BroadcasterID] {
+		if existing.ID == stream.ID {
+			return nil
+		}
+		if existing.EndedAt == nil {
+			existing.EndedAt = stream.StartedAt
+		}
+	}
+	s.Data[stream.BroadcasterID] = append(s.Data[stream.BroadcasterID], stream)
+	return nil
+}
+
+func (s *InMemoryStreamStore) EndStream(broadcasterID string, endedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.Data[broadcasterID] {
+		if existing.EndedAt == nil {
+			existing.EndedAt = &endedAt
+		}
+	}
+	return nil
+}
+
+func (s *InMemoryStreamStore) LatestStream(broadcasterID string) (*streams.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := s.Data[broadcasterID]
+	if len(all) == 0 {
+		return nil, nil
+	}
+	return all[len(all)-1], nil
+}
+
+func (s *InMemoryStreamStore) GetStream(broadcasterID, streamID string) (*streams.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.Data[broadcasterID] {
+		if existing.ID == streamID {
+			return existing, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *InMemoryStreamStore) StreamsForBroadcaster(broadcasterID string, limit int) ([]*streams.Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all := make([]*streams.Stream, 0)
+	for i := len(s.Data[broadcasterID]) - 1; i >= 0 && len(all) < limit; i-- {
+		all = append(all, s.Data[broadcasterID][i])
+	}
+	return all, nil
+}
+
+func (s *InMemoryStreamStore) SaveRecap(streamID string, recap *streams.Recap) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// recaps are saved in the background, so a copy is stored rather than changing a
+	// stream someone else may be reading
+	for _, all := range s.Data {
+		for i, existing := range all {
+			if existing.ID == streamID {
+				updated := *existing
+				updated.Recap = recap
+				all[i] = &updated
+			}
+		}
+	}
+	return nil
+}
@@ -1,9 +1,14 @@
 package util
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"net/http"
 	"net/url"
+	"slices"
+	"strings"
 
 	"github.com/saxypandabear/twitchsongrequests/internal/constants"
 	"go.uber.org/zap"
@@ -20,6 +25,33 @@ type AuthConfig struct {
 	OAuth        *oauth2.Config
 }
 
+// ErrInvalidCookie means that the Twitch ID cookie wasn't signed by this server
+var ErrInvalidCookie = errors.New("invalid Twitch ID cookie")
+
+// cookieSecret signs the Twitch ID cookie, so that nobody can pass as another user by
+// setting the cookie themselves
+var cookieSecret []byte
+
+// SetCookieSecret sets the secret that the Twitch ID cookie is signed with.
+func SetCookieSecret(secret string) {
+	cookieSecret = []byte(secret)
+}
+
+// TwitchIDCookieValue encodes the user's Twitch ID for the Twitch ID cookie, followed
+// by its signature.
+func TwitchIDCookieValue(userID string) string {
+	id := base64.StdEncoding.EncodeToString([]byte(userID))
+	return id + "." + base64.RawURLEncoding.EncodeToString(signCookie(id))
+}
+
+func signCookie(value string) []byte {
+	mac := hmac.New(sha256.New, cookieSecret)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// GetUserIDFromRequest reads the user's Twitch ID from the Twitch ID cookie, and
+// checks that the cookie was signed by this server.
 func GetUserIDFromRequest(r *http.Request) (string, error) {
 	c, err := r.Cookie(constants.TwitchIDCookieKey)
 	if err != nil {
@@ -31,7 +63,16 @@ func GetUserIDFromRequest(r *http.Request) (string, error) {
 	}
 
 	zap.L().Debug("raw cookie value for Twitch ID", zap.String("cookie", c.Value))
-	idBytes, err := base64.StdEncoding.DecodeString(c.Value)
+	value, signature, ok := strings.Cut(c.Value, ".")
+	if !ok {
+		return "", ErrInvalidCookie
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, signCookie(value)) {
+		return "", ErrInvalidCookie
+	}
+
+	idBytes, err := base64.StdEncoding.DecodeString(value)
 	if err != nil {
 		return "", err
 	}
@@ -57,3 +98,15 @@ func GenerateAuthURL(host, path string, config *AuthConfig) string {
 
 	return u.String()
 }
+
+// MissingScopes returns the scopes in the space separated list of required scopes that
+// were not granted
+func MissingScopes(granted []string, required string) []string {
+	missing := make([]string, 0)
+	for _, s := range strings.Fields(required) {
+		if !slices.Contains(granted, s) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
@@ -1,9 +1,12 @@
 package util_test
 
 import (
+	"encoding/base64"
 	"fmt"
+	"net/http"
 	"testing"
 
+	"github.com/saxypandabear/twitchsongrequests/internal/constants"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/stretchr/testify/assert"
 )
@@ -22,3 +25,41 @@ func TestGenerateAuthURL(t *testing.T) {
 	actual := util.GenerateAuthURL("some-host.com", "/path", &c)
 	assert.Equal(t, expected, actual)
 }
+
+func TestMissingScopes(t *testing.T) {
+	assert.Empty(t, util.MissingScopes([]string{"bits:read", "channel:read:vips"}, "channel:read:vips bits:read"))
+	assert.Equal(t, []string{"moderator:read:followers"},
+		util.MissingScopes([]string{"bits:read", "channel:read:vips"}, "bits:read moderator:read:followers channel:read:vips"))
+}
+
+func TestGetUserIDFromRequest(t *testing.T) {
+	util.SetCookieSecret("secret")
+	defer util.SetCookieSecret("")
+
+	req, err := http.NewRequest("GET", "/", nil)
+	assert.NoError(t, err)
+	req.AddCookie(&http.Cookie{Name: constants.TwitchIDCookieKey, Value: util.TwitchIDCookieValue("12345")})
+
+	id, err := util.GetUserIDFromRequest(req)
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", id)
+}
+
+func TestGetUserIDFromRequestForgedCookie(t *testing.T) {
+	util.SetCookieSecret("secret")
+	defer util.SetCookieSecret("")
+
+	signed := util.TwitchIDCookieValue("12345")
+	util.SetCookieSecret("other secret")
+	forged := util.TwitchIDCookieValue("12345")
+	util.SetCookieSecret("secret")
+
+	for _, value := range []string{base64.StdEncoding.EncodeToString([]byte("12345")), forged, signed + "x"} {
+		req, err := http.NewRequest("GET", "/", nil)
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: constants.TwitchIDCookieKey, Value: value})
+
+		_, err = util.GetUserIDFromRequest(req)
+		assert.ErrorIs(t, err, util.ErrInvalidCookie)
+	}
+}
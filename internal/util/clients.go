@@ -2,13 +2,20 @@ package util
 
 import (
 	"context"
+	"net/http"
 
 	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/retry"
 	"github.com/zmb3/spotify/v2"
+	"go.uber.org/zap"
 	"golang.org/x/oauth2"
 )
 
+// GetNewSpotifyClient returns a Spotify client that is authorized with the token. Rate
+// limited and server error responses come back as retry.Error, so they can be retried.
 func GetNewSpotifyClient(ctx context.Context, a *AuthConfig, token *oauth2.Token) *spotify.Client {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{Transport: &retry.Transport{}})
 	return spotify.New(a.OAuth.Client(ctx, token))
 }
 
@@ -17,6 +24,37 @@ func RefreshSpotifyToken(ctx context.Context, a *AuthConfig, token *oauth2.Token
 	return source.Token()
 }
 
+// GetSpotifyClientForUser creates a Spotify client that acts on behalf of the given user.
+// The user's token is refreshed first, and the refreshed token is saved.
+func GetSpotifyClientForUser(ctx context.Context, userStore db.UserStore, a *AuthConfig, userID string) (*spotify.Client, error) {
+	tok, err := db.FetchSpotifyToken(userStore, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshed, err := RefreshSpotifyToken(ctx, a, tok)
+	if err != nil {
+		return nil, err
+	}
+
+	// store the refreshed token
+	u, err := userStore.GetUser(userID)
+	if err == nil {
+		u.SpotifyAccessToken = refreshed.AccessToken
+		u.SpotifyRefreshToken = refreshed.RefreshToken
+		u.SpotifyExpiry = &refreshed.Expiry
+
+		zap.L().Debug("saving updated Spotify credentials", zap.String("id", userID))
+
+		if err = userStore.UpdateUser(u); err != nil {
+			// if we got a valid token but failed to update the DB this is not necessarily fatal.
+			zap.L().Error("failed to update user's spotify token", zap.String("id", userID), zap.Error(err))
+		}
+	}
+
+	return GetNewSpotifyClient(ctx, a, refreshed), nil
+}
+
 func GetNewTwitchClient(a *AuthConfig) (*helix.Client, error) {
 	opt := helix.Options{
 		ClientID:     a.ClientID,
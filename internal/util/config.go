@@ -22,7 +22,7 @@ const (
 	SpotifyUserScope = "user-modify-playback-state user-read-playback-state user-read-email"
 	// TwitchUserScope is the set of permissions required to access the necessary
 	// Twitch APIs
-	TwitchUserScope = "channel:manage:redemptions"
+	TwitchUserScope = "channel:manage:redemptions moderation:read user:write:chat user:read:chat user:bot channel:bot bits:read channel:read:subscriptions channel:read:vips moderator:read:followers"
 )
 
 // LoadTwitchConfigs reads from environment variables in order to
@@ -0,0 +1,355 @@
+package util
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/retry"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"go.uber.org/zap"
+)
+
+// GetTwitchClientForUser creates a Twitch client that acts on behalf of the given user.
+// The user's access token is refreshed first, and the user is updated in place with the
+// new tokens, so the caller is responsible for persisting them.
+func GetTwitchClientForUser(auth *AuthConfig, u *users.User) (*helix.Client, error) {
+	client, err := GetNewTwitchClient(auth)
+	if err != nil {
+		return nil, err
+	}
+
+	client.SetUserAccessToken(u.TwitchAccessToken)
+	token, err := client.RefreshUserAccessToken(u.TwitchRefreshToken)
+	if err != nil {
+		return nil, err
+	}
+	if token.StatusCode >= 400 {
+		return nil, errors.New(token.ErrorMessage)
+	}
+	client.SetUserAccessToken(token.Data.AccessToken)
+
+	u.TwitchAccessToken = token.Data.AccessToken
+	u.TwitchRefreshToken = token.Data.RefreshToken
+
+	return client, nil
+}
+
+// GetTwitchClientForUserID looks up the user and creates a Twitch client that acts on
+// their behalf. The user's access token is refreshed first, and the refreshed tokens
+// are saved.
+func GetTwitchClientForUserID(auth *AuthConfig, userStore db.UserStore, userID string) (*helix.Client, error) {
+	u, err := userStore.GetUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := GetTwitchClientForUser(auth, u)
+	if err != nil {
+		return nil, err
+	}
+
+	// update user details for Twitch auth
+	if err = userStore.UpdateUser(u); err != nil {
+		// if we got a valid token but failed to update the DB this is not necessarily fatal.
+		zap.L().Error("failed to update Twitch credentials", zap.String("id", userID), zap.Error(err))
+	}
+	return client, nil
+}
+
+// IsModerator checks if the user is one of the broadcaster's moderators. The client
+// must be authorized as the broadcaster.
+func IsModerator(client *helix.Client, broadcasterID, userID string) (bool, error) {
+	res, err := client.GetModerators(&helix.GetModeratorsParams{
+		BroadcasterID: broadcasterID,
+		UserIDs:       []string{userID},
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.StatusCode >= 400 {
+		return false, errors.New(res.ErrorMessage)
+	}
+
+	for _, m := range res.Data.Moderators {
+		if m.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// RoleScopes are the Twitch scopes that are needed to look up each viewer role
+var RoleScopes = map[string]string{
+	preferences.RoleSubscriber: "channel:read:subscriptions",
+	preferences.RoleVIP:        "channel:read:vips",
+	preferences.RoleModerator:  "moderation:read",
+	preferences.RoleFollower:   "moderator:read:followers",
+}
+
+// ViewerRoles describes how a viewer is connected to a broadcaster's channel
+type ViewerRoles struct {
+	Subscriber bool
+	VIP        bool
+	Moderator  bool
+	// FollowedAt is when the viewer followed the channel, or nil if they don't follow it
+	FollowedAt *time.Time
+	// Unknown are the roles that weren't looked up, because the broadcaster hasn't
+	// granted the scopes that they need
+	Unknown []string
+}
+
+// Known checks if the role was looked up
+func (r *ViewerRoles) Known(role string) bool {
+	return !slices.Contains(r.Unknown, role)
+}
+
+// GrantedScopes looks up the scopes that the client's user access token was granted.
+func GrantedScopes(client *helix.Client) ([]string, error) {
+	ok, res, err := client.ValidateToken(client.GetUserAccessToken())
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New(res.ErrorMessage)
+	}
+	return res.Data.Scopes, nil
+}
+
+// GetViewerRoles looks up whether the viewer subscribes to, is a VIP or moderator of,
+// and follows the broadcaster's channel. The client must be authorized as the broadcaster.
+// Roles that need a scope that isn't in the granted scopes are left Unknown.
+func GetViewerRoles(client *helix.Client, broadcasterID, userID string, scopes []string) (*ViewerRoles, error) {
+	var roles ViewerRoles
+	granted := func(role string) bool {
+		if slices.Contains(scopes, RoleScopes[role]) {
+			return true
+		}
+		roles.Unknown = append(roles.Unknown, role)
+		return false
+	}
+
+	if granted(preferences.RoleSubscriber) {
+		subs, err := client.GetSubscriptions(&helix.SubscriptionsParams{
+			BroadcasterID: broadcasterID,
+			UserID:        []string{userID},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if subs.StatusCode >= 400 {
+			return nil, errors.New(subs.ErrorMessage)
+		}
+		for _, s := range subs.Data.Subscriptions {
+			if s.UserID == userID {
+				roles.Subscriber = true
+			}
+		}
+	}
+
+	if granted(preferences.RoleVIP) {
+		vips, err := client.GetChannelVips(&helix.GetChannelVipsParams{
+			BroadcasterID: broadcasterID,
+			UserID:        userID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if vips.StatusCode >= 400 {
+			return nil, errors.New(vips.ErrorMessage)
+		}
+		for _, v := range vips.Data.ChannelsVips {
+			if v.UserID == userID {
+				roles.VIP = true
+			}
+		}
+	}
+
+	if granted(preferences.RoleModerator) {
+		var err error
+		if roles.Moderator, err = IsModerator(client, broadcasterID, userID); err != nil {
+			return nil, err
+		}
+	}
+
+	if granted(preferences.RoleFollower) {
+		follows, err := client.GetChannelFollows(&helix.GetChannelFollowsParams{
+			BroadcasterID: broadcasterID,
+			UserID:        userID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if follows.StatusCode >= 400 {
+			return nil, errors.New(follows.ErrorMessage)
+		}
+		for _, f := range follows.Data.Channels {
+			if f.UserID == userID {
+				followedAt := f.Followed.Time
+				roles.FollowedAt = &followedAt
+			}
+		}
+	}
+
+	return &roles, nil
+}
+
+// CanManageRequests checks if the user is allowed to manage song requests for the
+// broadcaster, which is the broadcaster themselves or one of their moderators.
+func CanManageRequests(auth *AuthConfig, userStore db.UserStore, broadcasterID, userID string) (bool, error) {
+	if userID == "" {
+		return false, nil
+	}
+	if broadcasterID == userID {
+		return true, nil
+	}
+
+	client, err := GetTwitchClientForUserID(auth, userStore, broadcasterID)
+	if err != nil {
+		return false, err
+	}
+
+	return IsModerator(client, broadcasterID, userID)
+}
+
+// GetRewardSettings gets the settings of the broadcaster's rewards that were created by
+// this app, keyed by the reward ID. The client must be authorized as the broadcaster.
+func GetRewardSettings(client *helix.Client, broadcasterID string) (map[string]*rewards.Settings, error) {
+	res, err := client.GetCustomRewards(&helix.GetCustomRewardsParams{
+		BroadcasterID:         broadcasterID,
+		OnlyManageableRewards: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		return nil, errors.New(res.ErrorMessage)
+	}
+
+	settings := make(map[string]*rewards.Settings, len(res.Data.ChannelCustomRewards))
+	for _, r := range res.Data.ChannelCustomRewards {
+		settings[r.ID] = &rewards.Settings{
+			Title:               r.Title,
+			Prompt:              r.Prompt,
+			Cost:                r.Cost,
+			MaxPerStream:        limit(r.MaxPerStreamSetting.IsEnabled, r.MaxPerStreamSetting.MaxPerStream),
+			MaxPerUserPerStream: limit(r.MaxPerUserPerStreamSetting.IsEnabled, r.MaxPerUserPerStreamSetting.MaxPerUserPerStream),
+			GlobalCooldown:      limit(r.GlobalCooldownSetting.IsEnabled, r.GlobalCooldownSetting.GlobalCooldownSeconds),
+			BackgroundColor:     r.BackgroundColor,
+			Enabled:             r.IsEnabled,
+			Paused:              r.IsPaused,
+		}
+	}
+	return settings, nil
+}
+
+// limit is the value of a reward's limit, or 0 when the limit is turned off
+func limit(enabled bool, value int) int {
+	if !enabled {
+		return 0
+	}
+	return value
+}
+
+// UpdateRewardSettings changes how the reward is set up on Twitch. The reward still
+// requires the viewer to enter a song. The client must be authorized as the broadcaster.
+func UpdateRewardSettings(auth *AuthConfig, client *helix.Client, broadcasterID, rewardID string, s *rewards.Settings) error {
+	res, err := client.UpdateCustomReward(&helix.UpdateChannelCustomRewardsParams{
+		ID:                           rewardID,
+		BroadcasterID:                broadcasterID,
+		Title:                        s.Title,
+		Prompt:                       s.Prompt,
+		Cost:                         s.Cost,
+		IsEnabled:                    s.Enabled,
+		BackgroundColor:              s.BackgroundColor,
+		IsUserInputRequired:          true,
+		IsMaxPerStreamEnabled:        s.MaxPerStream > 0,
+		MaxPerStream:                 s.MaxPerStream,
+		IsMaxPerUserPerStreamEnabled: s.MaxPerUserPerStream > 0,
+		MaxPerUserPerStream:          s.MaxPerUserPerStream,
+		IsGlobalCooldownEnabled:      s.GlobalCooldown > 0,
+		GlobalCooldownSeconds:        s.GlobalCooldown,
+	})
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 400 {
+		return errors.New(res.ErrorMessage)
+	}
+	if len(res.Data.ChannelCustomRewards) > 0 && res.Data.ChannelCustomRewards[0].IsPaused == s.Paused {
+		return nil
+	}
+	return SetRewardPaused(auth, client, broadcasterID, rewardID, s.Paused)
+}
+
+// rewardClient makes the calls to Twitch that the Helix client can't
+var rewardClient = &http.Client{Timeout: 10 * time.Second}
+
+// SetRewardPaused pauses or unpauses the reward. The Helix client can't do this, because
+// its parameters for updating a reward don't have the paused state. The client must be
+// authorized as the broadcaster.
+func SetRewardPaused(auth *AuthConfig, client *helix.Client, broadcasterID, rewardID string, paused bool) error {
+	base := helix.DefaultAPIBaseURL
+	if auth.APIBaseURL != "" {
+		base = auth.APIBaseURL
+	}
+	query := url.Values{
+		"broadcaster_id": {broadcasterID},
+		"id":             {rewardID},
+	}
+
+	body, err := json.Marshal(map[string]bool{"is_paused": paused})
+	if err != nil {
+		return err
+	}
+
+	return retry.Do(context.Background(), retry.DefaultPolicy, func() error {
+		req, err := http.NewRequest(http.MethodPatch, base+"/channel_points/custom_rewards?"+query.Encode(), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Client-Id", auth.ClientID)
+		req.Header.Set("Authorization", "Bearer "+client.GetUserAccessToken())
+		req.Header.Set("Content-Type", "application/json")
+
+		res, err := rewardClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if err = retry.HelixError(&helix.ResponseCommon{StatusCode: res.StatusCode, Header: res.Header}); err != nil {
+			return fmt.Errorf("failed to set the reward's paused state: %w", err)
+		}
+		return nil
+	}, zap.String("id", broadcasterID), zap.String("reward", rewardID), zap.String("call", "UpdateCustomReward"))
+}
+
+// IsStreamLive asks Twitch whether the broadcaster is live right now
+func IsStreamLive(client *helix.Client, broadcasterID string) (bool, error) {
+	res, err := client.GetStreams(&helix.StreamsParams{
+		UserIDs: []string{broadcasterID},
+		Type:    "live",
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.StatusCode >= 400 {
+		return false, errors.New(res.ErrorMessage)
+	}
+	for _, s := range res.Data.Streams {
+		if s.UserID == broadcasterID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,175 @@
+package util_test
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/stretchr/testify/assert"
+)
+
+const customReward = `{"data": [{
+	"broadcaster_id": "12826",
+	"id": "abc-123",
+	"title": "Song Request",
+	"prompt": "Request a song",
+	"cost": 1000,
+	"background_color": "#9147FF",
+	"is_enabled": true,
+	"is_paused": false,
+	"is_user_input_required": true,
+	"max_per_stream_setting": {"is_enabled": false, "max_per_stream": 10},
+	"max_per_user_per_stream_setting": {"is_enabled": true, "max_per_user_per_stream": 2},
+	"global_cooldown_setting": {"is_enabled": true, "global_cooldown_seconds": 60}
+}]}`
+
+func newTwitchTestServer(t *testing.T, handler http.HandlerFunc) *util.AuthConfig {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &util.AuthConfig{ClientID: "client", APIBaseURL: srv.URL}
+}
+
+func TestGetRewardSettings(t *testing.T) {
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "12826", r.URL.Query().Get("broadcaster_id"))
+		assert.Equal(t, "true", r.URL.Query().Get("only_manageable_rewards"))
+		_, _ = w.Write([]byte(customReward))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	settings, err := util.GetRewardSettings(c, "12826")
+	assert.NoError(t, err)
+	assert.Equal(t, &rewards.Settings{
+		Title:               "Song Request",
+		Prompt:              "Request a song",
+		Cost:                1000,
+		MaxPerStream:        0, // the limit is turned off
+		MaxPerUserPerStream: 2,
+		GlobalCooldown:      60,
+		BackgroundColor:     "#9147FF",
+		Enabled:             true,
+	}, settings["abc-123"])
+}
+
+func TestUpdateRewardSettings(t *testing.T) {
+	var bodies []map[string]any
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		assert.Equal(t, "abc-123", r.URL.Query().Get("id"))
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		assert.Equal(t, "client", r.Header.Get("Client-Id"))
+
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var fields map[string]any
+		assert.NoError(t, json.Unmarshal(body, &fields))
+		bodies = append(bodies, fields)
+		_, _ = w.Write([]byte(customReward))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	err = util.UpdateRewardSettings(auth, c, "12826", "abc-123", &rewards.Settings{
+		Title:               "Song Request",
+		Cost:                500,
+		MaxPerUserPerStream: 3,
+		Enabled:             true,
+		Paused:              true,
+	})
+	assert.NoError(t, err)
+
+	// the reward is updated, and then paused since the update can't do that
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, float64(500), bodies[0]["cost"])
+	assert.Equal(t, true, bodies[0]["is_user_input_required"])
+	assert.Equal(t, true, bodies[0]["is_max_per_user_per_stream_enabled"])
+	assert.Equal(t, false, bodies[0]["is_global_cooldown_enabled"])
+	assert.Equal(t, map[string]any{"is_paused": true}, bodies[1])
+}
+
+func TestUpdateRewardSettingsAlreadyUnpaused(t *testing.T) {
+	calls := 0
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		_, _ = w.Write([]byte(customReward))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	assert.NoError(t, util.UpdateRewardSettings(auth, c, "12826", "abc-123", &rewards.Settings{Title: "Song Request", Cost: 500}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestSetRewardPausedRetries(t *testing.T) {
+	var bodies []map[string]any
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		var fields map[string]any
+		assert.NoError(t, json.Unmarshal(body, &fields))
+		bodies = append(bodies, fields)
+		if len(bodies) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(customReward))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	assert.NoError(t, util.SetRewardPaused(auth, c, "12826", "abc-123", true))
+	assert.Len(t, bodies, 2)
+	assert.Equal(t, map[string]any{"is_paused": true}, bodies[1])
+}
+
+func TestIsStreamLive(t *testing.T) {
+	live := map[string]bool{"12826": true}
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/streams", r.URL.Path)
+		id := r.URL.Query().Get("user_id")
+		if live[id] {
+			_, _ = w.Write([]byte(`{"data": [{"id": "123", "user_id": "` + id + `", "type": "live"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"data": []}`))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	isLive, err := util.IsStreamLive(c, "12826")
+	assert.NoError(t, err)
+	assert.True(t, isLive)
+
+	isLive, err = util.IsStreamLive(c, "1337")
+	assert.NoError(t, err)
+	assert.False(t, isLive)
+}
+
+func TestGetViewerRolesMissingScopes(t *testing.T) {
+	auth := newTwitchTestServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// the other roles need scopes that weren't granted
+		assert.Equal(t, "/channels/vips", r.URL.Path)
+		_, _ = w.Write([]byte(`{"data": [{"user_id": "1337", "user_login": "viewer", "user_name": "Viewer"}]}`))
+	})
+	c, err := util.GetNewTwitchClient(auth)
+	assert.NoError(t, err)
+	c.SetUserAccessToken("token")
+
+	roles, err := util.GetViewerRoles(c, "12826", "1337", []string{"channel:manage:redemptions", "channel:read:vips"})
+	assert.NoError(t, err)
+	assert.True(t, roles.VIP)
+	assert.True(t, roles.Known(preferences.RoleVIP))
+	assert.Equal(t, []string{preferences.RoleSubscriber, preferences.RoleModerator, preferences.RoleFollower}, roles.Unknown)
+}
@@ -2,12 +2,14 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"net/http"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/nicklaw5/helix/v2"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
@@ -15,6 +17,10 @@ import (
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/retry"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/saxypandabear/twitchsongrequests/pkg/worker"
 	"go.uber.org/zap"
 )
 
@@ -23,6 +29,17 @@ const (
 	verificationType  = "webhook_callback_verification"
 	revocationType    = "revocation"
 	messageTypeHeader = "Twitch-Eventsub-Message-Type"
+	messageIDHeader   = "Twitch-Eventsub-Message-Id"
+	timestampHeader   = "Twitch-Eventsub-Message-Timestamp"
+	// MaxMessageAge is how old an EventSub message can be before it is ignored.
+	// https://dev.twitch.tv/docs/eventsub/handling-webhook-events/#guarding-against-replay-attacks
+	MaxMessageAge = 10 * time.Minute
+	// DedupTTL is how long message and redemption IDs are remembered, which
+	// covers all of Twitch's retries for a message
+	DedupTTL = 24 * time.Hour
+	// DefaultHoldExpiry is how long a request is held for the broadcaster's Spotify
+	// player to be open, before it is refunded
+	DefaultHoldExpiry = 30 * time.Minute
 )
 
 type EventSubNotification struct {
@@ -33,10 +50,41 @@ type EventSubNotification struct {
 
 type RewardHandler struct {
 	config *RewardHandlerConfig
-
-	// OnSuccess is a callback function that executes after successfully
-	// publishing to the queue
+	// pool processes the saved requests after Twitch gets a response
+	pool *worker.Pool
+
+	// UpdateRedemption fulfills or cancels the redemption on Twitch, once the broadcaster's
+	// fulfillment policy decided what to do with it
+	UpdateRedemption func(auth *util.AuthConfig, userStore db.UserStore, event *helix.EventSubChannelPointsCustomRewardRedemptionEvent, status string) error
+	// OnSuccess is called instead of UpdateRedemption when it is set, with whether the
+	// redemption is fulfilled rather than refunded.
+	//
+	// Deprecated: set UpdateRedemption instead.
 	OnSuccess func(*util.AuthConfig, db.UserStore, *helix.EventSubChannelPointsCustomRewardRedemptionEvent, bool) error
+	// SendChat posts a message in the broadcaster's chat, to tell viewers how their
+	// requests turned out
+	SendChat func(auth *util.AuthConfig, userStore db.UserStore, broadcasterID, message string) error
+	// ActiveDevice checks if the broadcaster's Spotify player is open on a device,
+	// so that their held requests can be sent to it
+	ActiveDevice func(ctx context.Context, broadcasterID string) (bool, error)
+	// ViewerRoles looks up the viewer's roles in the broadcaster's channel, to check if
+	// they can redeem the song request reward
+	ViewerRoles func(broadcasterID, viewerID string) (*util.ViewerRoles, error)
+	roleCache   *viewerRolesCache
+	// IsLive checks if the broadcaster is live, for broadcasters that only take requests
+	// while live
+	IsLive func(broadcasterID string) (bool, error)
+	// StreamLive asks Twitch if the broadcaster is live, when the recorded streams don't
+	// show that they are
+	StreamLive func(broadcasterID string) (bool, error)
+	liveCache  *liveStatusCache
+	// PauseRewards pauses or unpauses the broadcaster's song request rewards when their
+	// stream goes offline or live, and returns the rewards that it changed
+	PauseRewards func(broadcasterID string, rewardIDs []string, paused bool) ([]string, error)
+	// NowPlaying finds what is on the broadcaster's Spotify player, to follow the requests
+	// that were sent to it as their songs play
+	NowPlaying func(ctx context.Context, broadcasterID string) (*Playback, error)
+	playback   *playbackWatch
 }
 
 type RewardHandlerConfig struct {
@@ -44,16 +92,50 @@ type RewardHandlerConfig struct {
 	Publisher queue.Publisher
 	UserStore db.UserStore
 	PrefStore db.PreferenceStore
-	MsgCount  db.MessageCounter
-	Twitch    *util.AuthConfig
-	Spotify   *util.AuthConfig
+	// Rewards are the broadcasters' song request rewards, besides the one in their preferences
+	Rewards  db.RewardStore
+	MsgCount db.MessageCounter
+	Requests db.RequestStore
+	// Dedup remembers the messages and redemptions that were already received
+	Dedup db.DedupStore
+	// ViewerCounter tracks each viewer's recent requests to enforce per-viewer limits
+	ViewerCounter db.ViewerRequestCounter
+	// Streams records when each broadcaster goes live and offline
+	Streams db.StreamStore
+	// HoldExpiry is how long a request waits for the broadcaster's Spotify player
+	// to be open. Defaults to DefaultHoldExpiry.
+	HoldExpiry time.Duration
+	Twitch     *util.AuthConfig
+	Spotify    *util.AuthConfig
 }
 
 func NewRewardHandler(config *RewardHandlerConfig) *RewardHandler {
-	return &RewardHandler{
-		config:    config,
-		OnSuccess: UpdateRedemptionStatus,
+	if config.HoldExpiry <= 0 {
+		config.HoldExpiry = DefaultHoldExpiry
+	}
+	if config.Rewards == nil {
+		config.Rewards = &db.NoopRewardStore{}
+	}
+	if config.Streams == nil {
+		config.Streams = &db.NoopStreamStore{}
 	}
+	h := RewardHandler{
+		config:           config,
+		UpdateRedemption: UpdateRedemptionStatus,
+		SendChat:         SendChatMessage,
+		roleCache:        newViewerRolesCache(),
+		liveCache:        newLiveStatusCache(),
+		playback:         newPlaybackWatch(),
+	}
+	h.ActiveDevice = h.hasActiveDevice
+	h.ViewerRoles = h.lookupViewerRoles
+	h.IsLive = h.isLive
+	h.StreamLive = h.askStreamLive
+	h.PauseRewards = h.pauseRewards
+	h.NowPlaying = h.nowPlaying
+	h.pool = worker.NewPool(worker.DefaultWorkers, worker.DefaultQueueSize, h.process)
+	h.pool.Start()
+	return &h
 }
 
 func (h *RewardHandler) ChannelPointRedeem(w http.ResponseWriter, r *http.Request) {
@@ -71,6 +153,19 @@ func (h *RewardHandler) ChannelPointRedeem(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// the timestamp is part of the signature, so a message can't be replayed with a newer one
+	sentAt, err := time.Parse(time.RFC3339, r.Header.Get(timestampHeader))
+	if err != nil {
+		zap.L().Error("invalid message timestamp", zap.String("timestamp", r.Header.Get(timestampHeader)), zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if time.Since(sentAt) > MaxMessageAge {
+		zap.L().Warn("dropping message that is too old", zap.String("message", r.Header.Get(messageIDHeader)), zap.Time("timestamp", sentAt))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	var vals EventSubNotification
 	if err = json.NewDecoder(bytes.NewReader(body)).Decode(&vals); err != nil {
 		zap.L().Error("failed to unmarshal request body", zap.Error(err))
@@ -101,6 +196,32 @@ func (h *RewardHandler) ChannelPointRedeem(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Twitch delivers notifications at least once, so a retry can repeat a message
+	// that was already handled
+	if msgID := r.Header.Get(messageIDHeader); msgID != "" && !h.firstDelivery("message:"+msgID) {
+		zap.L().Info("dropping duplicate message", zap.String("message", msgID))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	switch vals.Subscription.Type {
+	case helix.EventSubTypeChannelChatMessage:
+		h.chatMessage(w, vals.Event)
+		return
+	case helix.EventSubTypeChannelCheer:
+		h.cheer(w, r.Header.Get(messageIDHeader), vals.Event)
+		return
+	case helix.EventSubTypeChannelPointsCustomRewardUpdate:
+		h.rewardUpdate(w, vals.Event)
+		return
+	case helix.EventSubTypeStreamOnline:
+		h.streamOnline(w, vals.Event)
+		return
+	case helix.EventSubTypeStreamOffline:
+		h.streamOffline(w, vals.Event)
+		return
+	}
+
 	zap.L().Debug("Received event to consume", zap.String("event", string(vals.Event)))
 	var redeemEvent helix.EventSubChannelPointsCustomRewardRedemptionEvent
 	if err = json.NewDecoder(bytes.NewReader(vals.Event)).Decode(&redeemEvent); err != nil {
@@ -117,78 +238,520 @@ func (h *RewardHandler) ChannelPointRedeem(w http.ResponseWriter, r *http.Reques
 		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
 	}
 
-	if !IsValidReward(&redeemEvent, preferences) {
+	tiers, err := h.config.Rewards.RewardsForBroadcaster(userID)
+	if err != nil {
+		zap.L().Error("failed to get rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	if _, ok := IsValidReward(&redeemEvent, preferences, tiers); !ok {
 		zap.L().Debug("not a valid song request, so dropping", zap.String("id", userID), zap.String("broadcaster", broadcaster))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	tok, err := db.FetchSpotifyToken(h.config.UserStore, redeemEvent.BroadcasterUserID)
-	if err != nil {
-		zap.L().Error("failed to verify user for spotify access", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	if !h.firstDelivery("redemption:" + redeemEvent.ID) {
+		zap.L().Info("dropping duplicate redemption", zap.String("request", redeemEvent.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster))
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	refreshed, err := util.RefreshSpotifyToken(r.Context(), h.config.Spotify, tok)
+	// everything after this point can take longer than Twitch waits for a response, so
+	// save the request and process it in the background. If the request can't be saved,
+	// it's still processed, but won't be picked back up after a restart.
+	req := requestFromRedemption(&redeemEvent, requests.StatusRequested)
+	req.Source = requests.SourceReward
+	req.SessionID = h.sessionID(userID)
+	if err = h.config.Requests.AddRequest(req); err != nil {
+		zap.L().Error("failed to save request", zap.String("request", req.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write([]byte("ok")); err != nil {
+		zap.L().Error("failed to write response body", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	h.submit(req)
+}
+
+// firstDelivery reports whether the key wasn't seen before. If that can't be checked, it's
+// treated as new, because dropping a request is worse than queueing it twice.
+func (h *RewardHandler) firstDelivery(key string) bool {
+	ok, err := h.config.Dedup.Claim(key, DedupTTL)
 	if err != nil {
-		zap.L().Error("failed to get valid token", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "failed to get refreshed token")
+		zap.L().Error("failed to check for duplicate delivery", zap.String("key", key), zap.Error(err))
+		return true
+	}
+	return ok
+}
+
+// StartDedupPurge periodically forgets expired message and redemption IDs in the background
+func (h *RewardHandler) StartDedupPurge(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := h.config.Dedup.PurgeExpired(); err != nil {
+				zap.L().Error("failed to purge expired IDs", zap.Error(err))
+			}
+		}
+	}()
+}
+
+// submit hands the request to the worker pool. Requests that can't be submitted right
+// now are left for ResumeRequests to pick up.
+func (h *RewardHandler) submit(req *requests.Request) {
+	submit := h.pool.Submit
+	if h.prioritized(req) {
+		submit = h.pool.SubmitFirst
+	}
+	if !submit(req) {
+		zap.L().Warn("request was not submitted for processing", zap.String("request", req.ID), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin))
+	}
+}
+
+// prioritized checks if the request skips ahead of the broadcaster's other requests,
+// which cheers do when the broadcaster wants them to, and so do requests for a priority reward
+func (h *RewardHandler) prioritized(req *requests.Request) bool {
+	if req.Source != requests.SourceCheer {
+		reward := h.rewardFor(req)
+		return reward != nil && reward.Priority
+	}
+	pref, err := h.config.PrefStore.GetPreference(req.BroadcasterID)
+	return err == nil && pref != nil && pref.CheerPriority
+}
+
+// rewardFor finds the reward that was redeemed for the request, if it is one of the
+// broadcaster's rewards with its own rules. The reward in the preferences isn't one of them.
+func (h *RewardHandler) rewardFor(req *requests.Request) *rewards.Reward {
+	if !req.IsRedemption() || req.RewardID == "" {
+		return nil
+	}
+	tiers, err := h.config.Rewards.RewardsForBroadcaster(req.BroadcasterID)
+	if err != nil {
+		zap.L().Error("failed to get rewards", zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+		return nil
+	}
+	for _, r := range tiers {
+		if r.ID == req.RewardID {
+			return r
+		}
+	}
+	return nil
+}
+
+// ResumeRequests submits the saved requests that have not finished processing, like
+// the ones that were in flight when the server restarted.
+func (h *RewardHandler) ResumeRequests() {
+	for _, status := range []string{requests.StatusRequested, requests.StatusApproved} {
+		reqs, err := h.config.Requests.StaleRequests(status, time.Now())
+		if err != nil {
+			zap.L().Error("failed to get unprocessed requests", zap.String("status", status), zap.Error(err))
+			continue
+		}
+		for _, req := range reqs {
+			h.submit(req)
+		}
+	}
+}
+
+// StartResume resumes unprocessed requests now, and then periodically in the background
+func (h *RewardHandler) StartResume(interval time.Duration) {
+	h.ResumeRequests()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.ResumeRequests()
+		}
+	}()
+}
+
+// process runs on the worker pool. New requests are checked against the viewer's roles and limits,
+// and either held for approval or sent to the player. Approved and held requests are sent
+// to the player.
+func (h *RewardHandler) process(req *requests.Request) {
+	// the request may have been handled since it was submitted
+	if current, err := h.config.Requests.GetRequest(req.ID); err == nil && current != nil {
+		req = current
+	}
+	if req.Status != requests.StatusRequested && req.Status != requests.StatusApproved && req.Status != requests.StatusHeld {
 		return
 	}
+	userID := req.BroadcasterID
+	broadcaster := req.BroadcasterLogin
 
-	// store the refreshed token
-	u, err := h.config.UserStore.GetUser(userID)
-	if err == nil {
-		u.SpotifyAccessToken = refreshed.AccessToken
-		u.SpotifyRefreshToken = refreshed.RefreshToken
-		u.SpotifyExpiry = &refreshed.Expiry
+	pref, err := h.config.PrefStore.GetPreference(userID)
+	if err != nil {
+		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	// the reward's own rules take the place of the preferences
+	if reward := h.rewardFor(req); reward != nil {
+		pref = reward.Apply(pref)
+	}
+
+	// approved and held requests were already accepted, and counted against the viewer
+	accepted := req.Status != requests.StatusRequested
+	if !accepted {
+		// cheers were paid for with bits, which can't be refunded, so they can't be turned
+		// down by the viewer's roles and limits, or by the broadcaster
+		if req.Source != requests.SourceCheer {
+			if err = h.checkLive(req, pref); err != nil {
+				zap.L().Info("Rejected song request while the stream is offline",
+					zap.String("user", req.UserName),
+					zap.String("id", userID),
+					zap.String("broadcaster", broadcaster))
+				h.refund(req, requests.StatusFailed, requests.OutcomeRefused)
+				h.reply(nil, req, pref, queue.Result{}, err)
+				return
+			}
+
+			if err = h.checkEligibility(req, pref); err != nil {
+				zap.L().Info("Rejected song request from a viewer without a required role",
+					zap.String("user", req.UserName),
+					zap.String("id", userID),
+					zap.String("broadcaster", broadcaster),
+					zap.Error(err))
+				h.refund(req, requests.StatusFailed, requests.OutcomeRefused)
+				h.reply(nil, req, pref, queue.Result{}, err)
+				return
+			}
+
+			if err = CheckViewerLimits(h.config.ViewerCounter, h.config.Requests, h.config.Streams, pref, req, time.Now()); err != nil {
+				zap.L().Info("Rejected song request over the viewer's limits",
+					zap.String("user", req.UserName),
+					zap.String("id", userID),
+					zap.String("broadcaster", broadcaster),
+					zap.Error(err))
+				h.refund(req, requests.StatusFailed, requests.OutcomeRefused)
+				h.reply(nil, req, pref, queue.Result{}, err)
+				return
+			}
+
+			if pref != nil && pref.Moderated {
+				if !h.transition(req, requests.StatusPending) {
+					return
+				}
+				h.countRequest(req)
+				zap.L().Info("Saved song request for approval",
+					zap.String("user", req.UserName),
+					zap.String("uri", req.Input),
+					zap.String("id", userID),
+					zap.String("broadcaster", broadcaster))
+				return
+			}
+		}
+
+		// wait behind the requests that are already held, so that they're played in order
+		if held, err := h.config.Requests.RequestsForBroadcaster(userID, requests.StatusHeld); err == nil && len(held) > 0 {
+			if h.hold(req) {
+				h.countRequest(req)
+			}
+			return
+		}
+	}
+
+	// claim the request before sending it, so that it can't also be cancelled, or sent
+	// by another worker
+	if req.Status != requests.StatusApproved && !h.transition(req, requests.StatusApproved) {
+		return
+	}
+
+	c, err := util.GetSpotifyClientForUser(context.Background(), h.config.UserStore, h.config.Spotify, userID)
+	if err != nil {
+		zap.L().Error("failed to get Spotify client", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		if accepted {
+			h.refund(req, requests.StatusFailed, requests.OutcomeSystemError)
+		} else {
+			h.transition(req, requests.StatusFailed)
+		}
+		h.reply(nil, req, pref, queue.Result{}, err)
+		return
+	}
+
+	q := retry.NewQueuer(c, retry.DefaultPolicy, zap.String("id", userID), zap.String("broadcaster", broadcaster))
+	err = h.publish(q, req, pref)
+	if !accepted && (err == nil || req.Status == requests.StatusHeld) {
+		h.countRequest(req)
+	}
+}
+
+// countRequest counts the request against the viewer's limits. Cheers don't count, since
+// the limits don't apply to them, and anonymous cheers would all count as the same viewer.
+func (h *RewardHandler) countRequest(req *requests.Request) {
+	if req.Source == requests.SourceCheer {
+		return
+	}
+	h.config.ViewerCounter.AddViewerRequest(req.BroadcasterID, req.UserID, time.Now())
+}
+
+// hold parks the request until the broadcaster's Spotify player is open. It returns
+// false if something else handled the request first.
+func (h *RewardHandler) hold(req *requests.Request) bool {
+	if req.Status == requests.StatusHeld {
+		// still no device, so keep the time that it was first held
+		return true
+	}
 
-		zap.L().Debug("saving updated Spotify credentials", zap.String("id", userID), zap.String("broadcaster", broadcaster))
+	if !h.transition(req, requests.StatusHeld) {
+		return false
+	}
+
+	zap.L().Info("Holding song request until Spotify is open",
+		zap.String("request", req.ID),
+		zap.String("user", req.UserName),
+		zap.String("id", req.BroadcasterID),
+		zap.String("broadcaster", req.BroadcasterLogin))
+	return true
+}
+
+// FlushHeldRequests submits the held requests of every broadcaster whose Spotify player
+// is open again, and refunds the requests that were held for longer than the hold expiry.
+func (h *RewardHandler) FlushHeldRequests() {
+	held, err := h.config.Requests.StaleRequests(requests.StatusHeld, time.Now())
+	if err != nil {
+		zap.L().Error("failed to get held requests", zap.Error(err))
+		return
+	}
+
+	cutoff := time.Now().Add(-h.config.HoldExpiry)
+	byBroadcaster := make(map[string][]*requests.Request)
+	for _, req := range held {
+		since := req.UpdatedAt
+		if since == nil {
+			since = req.CreatedAt
+		}
+		if since != nil && since.Before(cutoff) {
+			h.refund(req, requests.StatusExpired, requests.OutcomeRefused)
+			continue
+		}
+		byBroadcaster[req.BroadcasterID] = append(byBroadcaster[req.BroadcasterID], req)
+	}
+
+	for id, reqs := range byBroadcaster {
+		active, err := h.ActiveDevice(context.Background(), id)
+		if err != nil {
+			zap.L().Error("failed to check for an active Spotify device", zap.String("id", id), zap.Error(err))
+			continue
+		}
+		if !active {
+			continue
+		}
+
+		slices.SortFunc(reqs, func(a, b *requests.Request) int {
+			if pa, pb := h.prioritized(a), h.prioritized(b); pa != pb {
+				if pa {
+					return -1
+				}
+				return 1
+			}
+			if a.CreatedAt == nil || b.CreatedAt == nil {
+				return 0
+			}
+			return a.CreatedAt.Compare(*b.CreatedAt)
+		})
+		zap.L().Info("Sending held song requests to Spotify", zap.String("id", id), zap.Int("count", len(reqs)))
+		for _, req := range reqs {
+			h.submit(req)
+		}
+	}
+}
 
-		if err = h.config.UserStore.UpdateUser(u); err != nil {
-			// if we got a valid token but failed to update the DB this is not necessarily fatal.
-			zap.L().Error("failed to update user's spotify token", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+// StartHoldFlush periodically flushes held requests in the background
+func (h *RewardHandler) StartHoldFlush(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.FlushHeldRequests()
 		}
+	}()
+}
+
+// hasActiveDevice checks if the broadcaster's Spotify player is open on any device, or
+// if their preferred device is online, since songs can be queued on it directly
+func (h *RewardHandler) hasActiveDevice(ctx context.Context, broadcasterID string) (bool, error) {
+	c, err := util.GetSpotifyClientForUser(ctx, h.config.UserStore, h.config.Spotify, broadcasterID)
+	if err != nil {
+		return false, err
 	}
 
-	c := util.GetNewSpotifyClient(r.Context(), h.config.Spotify, refreshed)
+	devices, err := c.PlayerDevices(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	var preferred string
+	if pref, err := h.config.PrefStore.GetPreference(broadcasterID); err == nil && pref != nil {
+		preferred = pref.DeviceID
+	}
+	for _, d := range devices {
+		if d.Active || (preferred != "" && d.ID.String() == preferred && !d.Restricted) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// publish attempts to queue the requested song, records the outcome, and then updates
+// the status of the request and the redemption. The returned error is the result of publishing.
+func (h *RewardHandler) publish(client queue.Queuer, req *requests.Request, pref *preferences.Preference) error {
+	redeemEvent := redemptionFromRequest(req)
+	userID := redeemEvent.BroadcasterUserID
+	broadcaster := redeemEvent.BroadcasterUserLogin
+
+	res, err := h.config.Publisher.Publish(client, redeemEvent.UserInput, pref)
+	if res.Name != "" {
+		req.TrackName = res.Name
+	}
+	if errors.Is(err, queue.ErrNoActiveDevice) {
+		// not a failure yet, so the redemption stays open
+		h.hold(req)
+		return err
+	}
 
-	sID, err := h.config.Publisher.Publish(c, redeemEvent.UserInput, preferences)
 	msg := metrics.Message{
 		CreatedAt:     &redeemEvent.RedeemedAt.Time,
 		BroadcasterID: redeemEvent.BroadcasterUserID,
-		SpotifyTrack:  sID.String(), // TODO: not sure if this works if it fails to parse..
+		SpotifyTrack:  res.TrackID.String(), // TODO: not sure if this works if it fails to parse..
+		OriginalTrack: res.OriginalTrackID.String(),
+		SessionID:     h.sessionID(userID),
+		UserName:      redeemEvent.UserName,
+		TrackName:     res.Name,
+		Artist:        res.Artist,
 	}
+	status := requests.StatusQueued
 	if err != nil {
+		status = requests.StatusFailed
 		zap.L().Error("failed to publish",
 			zap.String("input", redeemEvent.UserInput),
+			zap.String("kind", string(res.Kind)),
 			zap.String("id", userID),
 			zap.String("broadcaster", broadcaster),
 			zap.Error(err))
 	} else {
+		req.TrackID = res.TrackID.String()
+		req.Device = res.Device
 		msg.Success = 1
 		zap.L().Info("Submitted song request",
 			zap.String("user", redeemEvent.UserName),
 			zap.String("uri", redeemEvent.UserInput),
+			zap.String("device", res.Device),
 			zap.String("id", userID),
 			zap.String("broadcaster", broadcaster))
+		if res.OriginalTrackID != "" {
+			zap.L().Info("Substituted clean version of explicit song",
+				zap.String("original", res.OriginalTrackID.String()),
+				zap.String("track", res.TrackID.String()),
+				zap.String("id", userID),
+				zap.String("broadcaster", broadcaster))
+		}
 	}
 
 	h.config.MsgCount.AddMessage(&msg)
+	h.settleRedemption(req, pref, OutcomeOf(err))
+	// after publishing, attempt to update the status of the redemption
+	if h.transition(req, status) {
+		h.updateRedemption(req)
+	}
+
+	h.reply(client, req, pref, res, err)
+	return err
+}
 
-	// after publishing successfully, attempt to update the status of the
-	// redemption
-	if err = h.OnSuccess(h.config.Twitch, h.config.UserStore, &redeemEvent, err == nil); err != nil {
-		// don't need to fail fast here because this is housekeeping
-		zap.L().Error("failed to update Twitch reward redemption status", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+// refund closes out the request with the given status, and cancels the redemption so
+// the viewer gets their points back, unless the broadcaster's fulfillment policy keeps it.
+// Requests made in chat have nothing to refund. It returns false, without refunding, if
+// something else handled the request first.
+func (h *RewardHandler) refund(req *requests.Request, status string, outcome requests.Outcome) bool {
+	if req.IsRedemption() {
+		pref, err := h.config.PrefStore.GetPreference(req.BroadcasterID)
+		if err != nil {
+			zap.L().Error("failed to get user preferences", zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+		}
+		h.settleRedemption(req, pref, outcome)
+	}
+	if !h.transition(req, status) {
+		return false
+	}
+	if !req.IsRedemption() {
+		// bits can't be refunded, so at least tell the viewer what happened
+		if reason, ok := refundReasons[status]; ok && req.Source == requests.SourceCheer {
+			h.reply(nil, req, nil, queue.Result{}, reason)
+		}
+		return true
 	}
 
-	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write([]byte("ok")); err != nil {
-		zap.L().Error("failed to write response body", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	h.updateRedemption(req)
+	if req.Redemption != requests.RedemptionCanceled {
+		return true
+	}
+
+	zap.L().Info("Refunded song request",
+		zap.String("request", req.ID),
+		zap.String("status", status),
+		zap.String("id", req.BroadcasterID),
+		zap.String("broadcaster", req.BroadcasterLogin))
+	return true
+}
+
+// transition moves the request to the status and saves it, unless something else moved it
+// along first, like a moderator or the viewer cancelling it. It returns whether the request
+// was moved, and only then can its song be sent or its redemption be refunded.
+func (h *RewardHandler) transition(req *requests.Request, status string) bool {
+	from := req.Status
+	req.Status = status
+	err := h.config.Requests.TransitionRequest(req, from)
+	if err == nil {
+		return true
+	}
+
+	req.Status = from
+	if errors.Is(err, db.ErrRequestChanged) {
+		zap.L().Info("request was already handled", zap.String("request", req.ID), zap.String("from", from), zap.String("to", status), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin))
+	} else {
+		zap.L().Error("failed to update request", zap.String("request", req.ID), zap.String("to", status), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+	}
+	return false
+}
+
+// requestFromRedemption converts the redemption event into a request that can be persisted
+func requestFromRedemption(e *helix.EventSubChannelPointsCustomRewardRedemptionEvent, status string) *requests.Request {
+	r := requests.Request{
+		ID:               e.ID,
+		BroadcasterID:    e.BroadcasterUserID,
+		BroadcasterLogin: e.BroadcasterUserLogin,
+		RewardID:         e.Reward.ID,
+		UserID:           e.UserID,
+		UserLogin:        e.UserLogin,
+		UserName:         e.UserName,
+		Input:            e.UserInput,
+		Status:           status,
+	}
+	if !e.RedeemedAt.IsZero() {
+		r.CreatedAt = &e.RedeemedAt.Time
+	}
+	return &r
+}
+
+// redemptionFromRequest rebuilds the redemption event for a persisted request, so that
+// the redemption can be fulfilled or refunded.
+func redemptionFromRequest(r *requests.Request) *helix.EventSubChannelPointsCustomRewardRedemptionEvent {
+	e := helix.EventSubChannelPointsCustomRewardRedemptionEvent{
+		ID:                   r.ID,
+		BroadcasterUserID:    r.BroadcasterID,
+		BroadcasterUserLogin: r.BroadcasterLogin,
+		UserID:               r.UserID,
+		UserLogin:            r.UserLogin,
+		UserName:             r.UserName,
+		UserInput:            r.Input,
+		Reward: helix.EventSubReward{
+			ID: r.RewardID,
+		},
+	}
+	if r.CreatedAt != nil {
+		e.RedeemedAt = helix.Time{Time: *r.CreatedAt}
 	}
+	return &e
 }
 
 func IsVerificationRequest(r *http.Request) bool {
@@ -199,17 +762,37 @@ func IsRevocationRequest(r *http.Request) bool {
 	return revocationType == r.Header.Get(strings.ToLower(messageTypeHeader))
 }
 
-// IsValidReward ensures that the redemption event is a valid event that we want to consume.
+// IsValidReward ensures that the redemption event is a valid event that we want to consume,
+// and finds which of the broadcaster's rewards it is for. The reward is nil when it is the
+// reward in the preferences, whose rules are the preferences themselves.
 // Original implementation relies on the existence of a key word in the reward title. New implementation
-// verifies with the stored CustomRewardID for a user's preference.
-func IsValidReward(e *helix.EventSubChannelPointsCustomRewardRedemptionEvent, p *preferences.Preference) bool {
+// verifies with the stored CustomRewardID for a user's preference, or the broadcaster's other rewards.
+func IsValidReward(e *helix.EventSubChannelPointsCustomRewardRedemptionEvent, p *preferences.Preference, tiers []*rewards.Reward) (*rewards.Reward, bool) {
+	if e == nil {
+		return nil, false
+	}
+	for _, r := range tiers {
+		if e.Reward.ID == r.ID {
+			return r, true
+		}
+	}
 	if p != nil && p.CustomRewardID != "" {
-		return e.Reward.ID == p.CustomRewardID
+		return nil, e.Reward.ID == p.CustomRewardID
 	}
-	return e != nil && strings.Contains(e.Reward.Title, SongRequestsTitle)
+	return nil, strings.Contains(e.Reward.Title, SongRequestsTitle)
 }
 
-// DoNothingOnSuccess is a no-op to satisfy the function interface. See https://github.com/SaxyPandaBear/TwitchSongRequests/issues/133
+// DoNothingOnRedemption is a no-op to satisfy the function interface. See https://github.com/SaxyPandaBear/TwitchSongRequests/issues/133
+func DoNothingOnRedemption(auth *util.AuthConfig,
+	userStore db.UserStore,
+	event *helix.EventSubChannelPointsCustomRewardRedemptionEvent,
+	status string) error {
+	return nil
+}
+
+// DoNothingOnSuccess is a no-op to satisfy the function interface of OnSuccess.
+//
+// Deprecated: use DoNothingOnRedemption with UpdateRedemption.
 func DoNothingOnSuccess(auth *util.AuthConfig,
 	userStore db.UserStore,
 	event *helix.EventSubChannelPointsCustomRewardRedemptionEvent,
@@ -217,68 +800,40 @@ func DoNothingOnSuccess(auth *util.AuthConfig,
 	return nil
 }
 
-// UpdateRedemptionStatus attempts to update the status for the channel point redemption.
-// This is helpful so failed submissions should get refunded.
+// UpdateRedemptionStatus attempts to update the status for the channel point redemption,
+// to either requests.RedemptionFulfilled or requests.RedemptionCanceled. Canceling it
+// refunds the viewer's points.
 func UpdateRedemptionStatus(auth *util.AuthConfig,
 	userStore db.UserStore,
 	event *helix.EventSubChannelPointsCustomRewardRedemptionEvent,
-	success bool) error {
+	status string) error {
 	userID := event.BroadcasterUserID
 	broadcaster := event.BroadcasterUserLogin
 
-	client, err := util.GetNewTwitchClient(auth)
+	client, err := util.GetTwitchClientForUserID(auth, userStore, userID)
 	if err != nil {
-		zap.L().Error("failed to create Twitch client", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		zap.L().Error("failed to get Twitch client", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
 		return err
 	}
 
-	u, err := userStore.GetUser(event.BroadcasterUserID)
-	if err != nil {
-		zap.L().Error("failed to get user", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
-		return err
-	}
-
-	client.SetUserAccessToken(u.TwitchAccessToken)
-	token, err := client.RefreshUserAccessToken(u.TwitchRefreshToken)
-	if err != nil {
-		zap.L().Error("failed to refresh Twitch token", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
-		return err
-	}
-	client.SetUserAccessToken(token.Data.AccessToken)
-
 	req := helix.UpdateChannelCustomRewardsRedemptionStatusParams{
 		ID:            event.ID,
 		BroadcasterID: event.BroadcasterUserID,
 		RewardID:      event.Reward.ID,
+		Status:        status,
 	}
+	return retry.Do(context.Background(), retry.DefaultPolicy, func() error {
+		resp, err := client.UpdateChannelCustomRewardsRedemptionStatus(&req)
+		if err != nil {
+			return err
+		}
 
-	if success {
-		req.Status = "FULFILLED"
-	} else {
-		req.Status = "CANCELED"
-	}
-	resp, err := client.UpdateChannelCustomRewardsRedemptionStatus(&req)
-	if err != nil {
-		return err
-	}
-
-	zap.L().Debug("updated redemptions",
-		zap.String("id", userID),
-		zap.String("broadcaster", broadcaster),
-		zap.Int("status", resp.StatusCode),
-		zap.String("error", resp.ErrorMessage),
-		zap.Int("num", len(resp.Data.Redemptions)))
-	if resp.StatusCode >= 400 {
-		return errors.New(resp.ErrorMessage)
-	}
-
-	// update user details for Twitch auth
-	u.TwitchAccessToken = token.Data.AccessToken
-	u.TwitchRefreshToken = token.Data.RefreshToken
-	if err = userStore.UpdateUser(u); err != nil {
-		zap.L().Error("failed to update Twitch credentials", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
-		return err
-	}
-
-	return nil
+		zap.L().Debug("updated redemptions",
+			zap.String("id", userID),
+			zap.String("broadcaster", broadcaster),
+			zap.Int("status", resp.StatusCode),
+			zap.String("error", resp.ErrorMessage),
+			zap.Int("num", len(resp.Data.Redemptions)))
+		return retry.HelixError(&resp.ResponseCommon)
+	}, zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.String("call", "UpdateChannelCustomRewardsRedemptionStatus"))
 }
@@ -21,8 +21,11 @@ import (
 	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
 	"github.com/saxypandabear/twitchsongrequests/pkg/users"
 )
 
@@ -51,6 +54,7 @@ func getTestRewardHandler(publishSuccess bool) (
 	*testutil.InMemoryUserStore,
 	*testutil.InMemoryPreferenceStore,
 	*testutil.InMemoryMessageCounter,
+	*testutil.InMemoryRequestStore,
 	chan string,
 	chan bool) {
 	m := make(chan string)
@@ -69,6 +73,10 @@ func getTestRewardHandler(publishSuccess bool) (
 		Msgs: make([]*metrics.Message, 0),
 	}
 
+	reqs := testutil.InMemoryRequestStore{
+		Data: make(map[string]*requests.Request),
+	}
+
 	callbackChan := make(chan bool)
 	checkChan := make(chan bool)
 	c := testutil.DummyCallback{
@@ -77,16 +85,25 @@ func getTestRewardHandler(publishSuccess bool) (
 	}
 
 	rhc := api.RewardHandlerConfig{
-		dummySecret, &p, &u, &prefs, &messages, &util.AuthConfig{}, &util.AuthConfig{},
+		Secret:        dummySecret,
+		Publisher:     &p,
+		UserStore:     &u,
+		PrefStore:     &prefs,
+		MsgCount:      &messages,
+		Requests:      &reqs,
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: db.NewInMemoryViewerRequestCounter(),
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
 	}
 	rh := api.NewRewardHandler(&rhc)
-	rh.OnSuccess = c.Callback
+	rh.UpdateRedemption = c.Callback
 
-	return rh, &u, &prefs, &messages, m, callbackChan
+	return rh, &u, &prefs, &messages, &reqs, m, callbackChan
 }
 
 func TestPublishRedeem(t *testing.T) {
-	rh, u, prefs, counter, m, callbacks := getTestRewardHandler(true)
+	rh, u, prefs, counter, reqs, m, callbacks := getTestRewardHandler(true)
 
 	err := u.AddUser(&users.User{ // spoof a user so the test doesen't fail
 		TwitchID:            "12826",
@@ -154,10 +171,132 @@ func TestPublishRedeem(t *testing.T) {
 	assert.Len(t, counter.Msgs, 1)
 	cbMsg := counter.Msgs[0]
 	assert.Equal(t, 1, cbMsg.Success)
+
+	saved, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusQueued, saved.Status)
+	assert.Equal(t, userInput, saved.Input)
+}
+
+func TestPublishRedeemModerated(t *testing.T) {
+	rh, u, prefs, counter, reqs, m, callbacks := getTestRewardHandler(true)
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+	err = prefs.AddPreference(&preferences.Preference{
+		TwitchID:  "12826",
+		Moderated: true,
+	})
+	assert.NoError(t, err)
+
+	userInput := generateUserInput(t)
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
+	payload = strings.Replace(payload, rewardTitlePlaceholder, api.SongRequestsTitle, 1)
+
+	req, err := http.NewRequest("POST", "/callback", strings.NewReader(payload))
+	assert.NoError(t, err)
+
+	// spoof signature header
+	ts := time.Now().Format(time.RFC3339)
+	sig := deriveEventsubSignature(t, payload, eventSubMsgID, ts, dummySecret)
+	req.Header.Add(msgIDHeader, eventSubMsgID)
+	req.Header.Add(msgTimestampHeader, ts)
+	req.Header.Add(msgSignatureHeader, sig)
+
+	rr := httptest.NewRecorder()
+	api := http.HandlerFunc(rh.ChannelPointRedeem)
+
+	go func() {
+		api.ServeHTTP(rr, req)
+	}()
+
+	select {
+	case <-m:
+		t.Error("should not have queued a pending request")
+	case <-callbacks:
+		t.Error("should not have updated a pending redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, counter.Msgs)
+
+	pending, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusPending, pending.Status)
+	assert.Equal(t, "12826", pending.BroadcasterID)
+	assert.Equal(t, "bcd-234", pending.RewardID)
+	assert.Equal(t, "1337", pending.UserID)
+	assert.Equal(t, userInput, pending.Input)
+}
+
+func TestPublishRedeemOverViewerLimit(t *testing.T) {
+	rh, u, prefs, counter, reqs, m, callbacks := getTestRewardHandler(true)
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+	err = prefs.AddPreference(&preferences.Preference{
+		TwitchID:         "12826",
+		ViewerMaxPending: 1,
+	})
+	assert.NoError(t, err)
+	err = reqs.AddRequest(&requests.Request{
+		ID:            "xyz-789",
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Status:        requests.StatusPending,
+	})
+	assert.NoError(t, err)
+
+	userInput := generateUserInput(t)
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
+	payload = strings.Replace(payload, rewardTitlePlaceholder, api.SongRequestsTitle, 1)
+
+	req, err := http.NewRequest("POST", "/callback", strings.NewReader(payload))
+	assert.NoError(t, err)
+
+	// spoof signature header
+	ts := time.Now().Format(time.RFC3339)
+	sig := deriveEventsubSignature(t, payload, eventSubMsgID, ts, dummySecret)
+	req.Header.Add(msgIDHeader, eventSubMsgID)
+	req.Header.Add(msgTimestampHeader, ts)
+	req.Header.Add(msgSignatureHeader, sig)
+
+	rr := httptest.NewRecorder()
+	api := http.HandlerFunc(rh.ChannelPointRedeem)
+
+	go func() {
+		api.ServeHTTP(rr, req)
+	}()
+
+	var status bool
+	select {
+	case <-m:
+		t.Error("should not have queued a request over the viewer's limit")
+	case status = <-callbacks:
+		t.Log("found expected event")
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	assert.False(t, status)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, counter.Msgs)
 }
 
 func TestPublishRedeemEmptyBody(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -205,7 +344,7 @@ func TestPublishRedeemEmptyBody(t *testing.T) {
 }
 
 func TestPublishIncorrectRewardTitle(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(false)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(false)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -253,7 +392,7 @@ func TestPublishIncorrectRewardTitle(t *testing.T) {
 }
 
 func TestPublishNoAuthenticatedUser(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(false)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(false)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -301,7 +440,7 @@ func TestPublishNoAuthenticatedUser(t *testing.T) {
 }
 
 func TestPublishRedeemFails(t *testing.T) {
-	rh, u, _, counter, m, callbacks := getTestRewardHandler(false)
+	rh, u, _, counter, _, m, callbacks := getTestRewardHandler(false)
 
 	err := u.AddUser(&users.User{
 		TwitchID:            "12826",
@@ -363,8 +502,153 @@ func TestPublishRedeemFails(t *testing.T) {
 	assert.Equal(t, 0, event.Success)
 }
 
+func TestResumeRequests(t *testing.T) {
+	rh, u, _, counter, reqs, m, callbacks := getTestRewardHandler(true)
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+
+	// a request that was saved, but not processed before the server restarted
+	createdAt := time.Now().Add(-time.Minute)
+	err = reqs.AddRequest(&requests.Request{
+		ID:            "abc-123",
+		BroadcasterID: "12826",
+		RewardID:      "bcd-234",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusRequested,
+		CreatedAt:     &createdAt,
+	})
+	assert.NoError(t, err)
+
+	go rh.ResumeRequests()
+
+	select {
+	case event := <-m:
+		assert.Equal(t, "some song", event)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	select {
+	case status := <-callbacks:
+		assert.True(t, status)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	resumed, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusQueued, resumed.Status)
+	assert.Len(t, counter.Msgs, 1)
+}
+
+func newSignedCallback(t *testing.T, payload, messageID string, sentAt time.Time) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest("POST", "/callback", strings.NewReader(payload))
+	assert.NoError(t, err)
+
+	ts := sentAt.Format(time.RFC3339)
+	req.Header.Add(msgIDHeader, messageID)
+	req.Header.Add(msgTimestampHeader, ts)
+	req.Header.Add(msgSignatureHeader, deriveEventsubSignature(t, payload, messageID, ts, dummySecret))
+	return req
+}
+
+func TestPublishRedeemDuplicateDelivery(t *testing.T) {
+	rh, u, _, counter, _, m, callbacks := getTestRewardHandler(true)
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, generateUserInput(t), 1)
+	payload = strings.Replace(payload, rewardTitlePlaceholder, api.SongRequestsTitle, 1)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newSignedCallback(t, payload, eventSubMsgID, time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case <-m:
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	select {
+	case <-callbacks:
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	// a retry of the same message, and the same redemption in a new message
+	for _, msgID := range []string{eventSubMsgID, "another-message"} {
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newSignedCallback(t, payload, msgID, time.Now()))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	select {
+	case <-m:
+		t.Error("should not have published the song again")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Len(t, counter.Msgs, 1)
+}
+
+func TestPublishRedeemStaleMessage(t *testing.T) {
+	rh, u, _, _, reqs, m, _ := getTestRewardHandler(true)
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, generateUserInput(t), 1)
+	payload = strings.Replace(payload, rewardTitlePlaceholder, api.SongRequestsTitle, 1)
+
+	rr := httptest.NewRecorder()
+	sentAt := time.Now().Add(-api.MaxMessageAge - time.Minute)
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newSignedCallback(t, payload, eventSubMsgID, sentAt))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case <-m:
+		t.Error("should not have published a stale message")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Empty(t, reqs.Data)
+}
+
+func TestPublishRedeemMissingTimestamp(t *testing.T) {
+	rh, _, _, _, _, _, _ := getTestRewardHandler(true)
+
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, generateUserInput(t), 1)
+	req, err := http.NewRequest("POST", "/callback", strings.NewReader(payload))
+	assert.NoError(t, err)
+	req.Header.Add(msgIDHeader, eventSubMsgID)
+	req.Header.Add(msgSignatureHeader, deriveEventsubSignature(t, payload, eventSubMsgID, "", dummySecret))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
 func TestPublishRedeemInvalidSignature(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -406,7 +690,7 @@ func TestPublishRedeemInvalidSignature(t *testing.T) {
 }
 
 func TestPublishRedeemInvalidJSON(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -453,7 +737,7 @@ func TestPublishRedeemInvalidJSON(t *testing.T) {
 }
 
 func TestPublishRedeemInvalidPayload(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	userInput := generateUserInput(t)
 	payload := strings.Replace(redeemPayload, userInputPlaceholder, userInput, 1)
@@ -506,7 +790,7 @@ func TestPublishRedeemInvalidPayload(t *testing.T) {
 // The endpoint used for webhook callbacks must also verify itself:
 // https://dev.twitch.tv/docs/eventsub/handling-webhook-events/#responding-to-a-challenge-request
 func TestVerifyWebhookCallback(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	challenge := generateUserInput(t)
 	payload := strings.Replace(verificationPayload, challengePlaceholder, challenge, 1)
@@ -558,7 +842,7 @@ func TestVerifyWebhookCallback(t *testing.T) {
 }
 
 func TestSubscriptionRevoked(t *testing.T) {
-	rh, _, _, _, m, callbacks := getTestRewardHandler(true)
+	rh, _, _, _, _, m, callbacks := getTestRewardHandler(true)
 
 	challenge := generateUserInput(t)
 	payload := strings.Replace(verificationPayload, challengePlaceholder, challenge, 1)
@@ -644,17 +928,20 @@ func TestIsVerificationRequest(t *testing.T) {
 }
 
 func TestIsValidSongRequest(t *testing.T) {
-	assert.False(t, api.IsValidReward(nil, nil))
+	_, ok := api.IsValidReward(nil, nil, nil)
+	assert.False(t, ok)
 
 	e := helix.EventSubChannelPointsCustomRewardRedemptionEvent{
 		Reward: helix.EventSubReward{
 			Title: "something",
 		},
 	}
-	assert.False(t, api.IsValidReward(&e, nil))
+	_, ok = api.IsValidReward(&e, nil, nil)
+	assert.False(t, ok)
 
 	e.Reward.Title = fmt.Sprintf("Middle of %s the title", api.SongRequestsTitle)
-	assert.True(t, api.IsValidReward(&e, nil))
+	_, ok = api.IsValidReward(&e, nil, nil)
+	assert.True(t, ok)
 
 	pref := preferences.Preference{
 		CustomRewardID: "abc123",
@@ -662,11 +949,23 @@ func TestIsValidSongRequest(t *testing.T) {
 	e.Reward.Title = "something"
 	e.Reward.ID = "abc123"
 	assert.NotContains(t, e.Reward.Title, api.SongRequestsTitle)
-	assert.True(t, api.IsValidReward(&e, &pref))
+	reward, ok := api.IsValidReward(&e, &pref, nil)
+	assert.True(t, ok)
+	assert.Nil(t, reward)
 
 	e.Reward.ID = "bcd234"
 	assert.NotEqual(t, e.Reward.ID, pref.CustomRewardID)
-	assert.False(t, api.IsValidReward(&e, &pref))
+	_, ok = api.IsValidReward(&e, &pref, nil)
+	assert.False(t, ok)
+
+	// the broadcaster's other rewards have their own rules
+	tiers := []*rewards.Reward{
+		{ID: "cde345", Cost: 500},
+		{ID: "bcd234", Cost: 5000, Priority: true},
+	}
+	reward, ok = api.IsValidReward(&e, &pref, tiers)
+	assert.True(t, ok)
+	assert.Equal(t, tiers[1], reward)
 }
 
 func generateUserInput(t *testing.T) string {
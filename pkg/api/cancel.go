@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+// CancelChatCommand lets viewers cancel their own request, if the broadcaster gave them
+// time to
+const CancelChatCommand = "!cancel"
+
+const (
+	cancelledReply       = "@{user} cancelled your request for {song}, and refunded it"
+	nothingToCancelReply = "@{user} you have no request that can be cancelled"
+)
+
+var ErrNothingToCancel = errors.New("there is no request that can be cancelled")
+
+// cancellableStatuses are the requests that weren't sent to the player yet. Once a song
+// is in the Spotify queue, it can't be taken back out.
+var cancellableStatuses = []string{requests.StatusPending, requests.StatusHeld}
+
+// IsCancelCommand checks if the chat message is the cancel command. The command is matched
+// ignoring case, and anything after it is ignored.
+func IsCancelCommand(message string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(message), " ")
+	return strings.EqualFold(name, CancelChatCommand)
+}
+
+// CancelRequest cancels the viewer's most recent request that is still waiting, if it was
+// made within the window, and refunds it. Cheers aren't cancelled, since the bits can't be
+// refunded.
+func (h *RewardHandler) CancelRequest(broadcasterID, viewerID string, window time.Duration) (*requests.Request, error) {
+	cutoff := time.Now().Add(-window)
+
+	var latest *requests.Request
+	for _, status := range cancellableStatuses {
+		reqs, err := h.config.Requests.RequestsForBroadcaster(broadcasterID, status)
+		if err != nil {
+			return nil, err
+		}
+		for _, req := range reqs {
+			if req.UserID != viewerID || req.Source == requests.SourceCheer ||
+				req.CreatedAt == nil || req.CreatedAt.Before(cutoff) {
+				continue
+			}
+			if latest == nil || req.CreatedAt.After(*latest.CreatedAt) {
+				latest = req
+			}
+		}
+	}
+	if latest == nil {
+		return nil, ErrNothingToCancel
+	}
+
+	// the request can be sent to the player or refunded while it's being cancelled, and
+	// then it isn't the viewer's to cancel anymore
+	latest.Reason = requests.ReasonCancelledByViewer
+	if !h.refund(latest, requests.StatusCancelled, requests.OutcomeRefused) {
+		return nil, ErrNothingToCancel
+	}
+	zap.L().Info("Viewer cancelled song request",
+		zap.String("request", latest.ID),
+		zap.String("user", latest.UserName),
+		zap.String("input", latest.Input),
+		zap.String("id", broadcasterID),
+		zap.String("broadcaster", latest.BroadcasterLogin))
+	return latest, nil
+}
+
+// cancelFromChat handles the cancel command, and tells the viewer how it went if the
+// broadcaster turned chat replies on
+func (h *RewardHandler) cancelFromChat(w http.ResponseWriter, msg *helix.EventSubChannelChatMessageEvent, pref *preferences.Preference) {
+	w.WriteHeader(http.StatusOK)
+
+	userID := msg.BroadcasterUserID
+	broadcaster := msg.BroadcasterUserLogin
+	if !h.firstDelivery("chat:" + msg.MessageID) {
+		zap.L().Info("dropping duplicate cancel command", zap.String("request", msg.MessageID), zap.String("id", userID), zap.String("broadcaster", broadcaster))
+		return
+	}
+
+	d := ReplyData{User: msg.ChatterUserName}
+	reply := cancelledReply
+	req, err := h.CancelRequest(userID, msg.ChatterUserID, time.Duration(pref.CancelWindow)*time.Minute)
+	switch {
+	case errors.Is(err, ErrNothingToCancel):
+		reply = nothingToCancelReply
+	case err != nil:
+		zap.L().Error("failed to cancel request", zap.String("user", msg.ChatterUserLogin), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		return
+	case req.TrackName != "":
+		d.Song = req.TrackName
+	default:
+		d.Song = req.Input
+	}
+
+	if !pref.ChatReplies {
+		return
+	}
+	if err = h.SendChat(h.config.Twitch, h.config.UserStore, userID, d.Format(reply)); err != nil {
+		zap.L().Error("failed to send chat reply", zap.String("user", msg.ChatterUserLogin), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+}
@@ -0,0 +1,180 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsCancelCommand(t *testing.T) {
+	assert.True(t, api.IsCancelCommand("!cancel"))
+	assert.True(t, api.IsCancelCommand("  !CANCEL please "))
+	assert.False(t, api.IsCancelCommand("!cancelled"))
+	assert.False(t, api.IsCancelCommand("please !cancel"))
+	assert.False(t, api.IsCancelCommand(""))
+}
+
+func TestCancelCommand(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:     "12826",
+		CancelWindow: 5,
+		ChatReplies:  true,
+	})
+	msgs := captureChat(rh)
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+	// the song was already found before the request was held
+	held, err := reqs.GetRequest("held-1")
+	assert.NoError(t, err)
+	held.TrackName = "Some Song"
+	addHeldRequest(t, reqs, "held-old", "old song", now.Add(-10*time.Minute), now)
+	addRequest(t, reqs, "pending-1", "1337", requests.StatusPending, requests.SourceReward, now.Add(-2*time.Minute))
+	// bits can't be refunded, and other viewers' requests aren't theirs to cancel
+	addRequest(t, reqs, "cheer-1", "1337", requests.StatusPending, requests.SourceCheer, now.Add(-time.Second))
+	addRequest(t, reqs, "other-1", "4242", requests.StatusHeld, requests.SourceReward, now.Add(-time.Second))
+
+	refunded := make(chan bool, 1)
+	go func() { refunded <- <-callbacks }()
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newChatCallback(t, "!cancel", "subscriber"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case success := <-refunded:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not refund the redemption in time")
+	}
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @Awesome_User cancelled your request for Some Song, and refunded it", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	// only the most recent request is cancelled
+	r, err := reqs.GetRequest("held-1")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusCancelled, r.Status)
+	assert.Equal(t, requests.ReasonCancelledByViewer, r.Reason)
+	assert.Equal(t, requests.StatusPending, requestStatus(reqs, "pending-1")())
+	assert.Equal(t, requests.StatusHeld, requestStatus(reqs, "held-old")())
+	assert.Equal(t, requests.StatusPending, requestStatus(reqs, "cheer-1")())
+	assert.Equal(t, requests.StatusHeld, requestStatus(reqs, "other-1")())
+}
+
+func TestCancelCommandNothingToCancel(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:     "12826",
+		CancelWindow: 5,
+		ChatReplies:  true,
+	})
+	msgs := captureChat(rh)
+
+	// requests that were already queued can't be taken back out of Spotify's queue
+	addRequest(t, reqs, "queued-1", "1337", requests.StatusQueued, requests.SourceReward, time.Now().Add(-time.Second))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newChatCallback(t, "!cancel", "subscriber"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @Awesome_User you have no request that can be cancelled", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	select {
+	case <-callbacks:
+		t.Error("should not have refunded a redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Equal(t, requests.StatusQueued, requestStatus(reqs, "queued-1")())
+}
+
+// racingRequestStore acts like every request was moved along by something else, like the
+// held requests being flushed, right before it is saved
+type racingRequestStore struct {
+	*testutil.InMemoryRequestStore
+}
+
+func (s racingRequestStore) TransitionRequest(*requests.Request, string) error {
+	return db.ErrRequestChanged
+}
+
+func TestCancelRequestAlreadyHandled(t *testing.T) {
+	reqs := &testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:    dummySecret,
+		Publisher: &testutil.DummyPublisher{},
+		UserStore: &testutil.InMemoryUserStore{Data: make(map[string]*users.User)},
+		PrefStore: &testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)},
+		MsgCount:  &testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)},
+		Requests:  racingRequestStore{reqs},
+		Twitch:    &util.AuthConfig{},
+		Spotify:   &util.AuthConfig{},
+	})
+	rh.UpdateRedemption = func(*util.AuthConfig, db.UserStore, *helix.EventSubChannelPointsCustomRewardRedemptionEvent, string) error {
+		t.Error("should not have refunded a request that was already handled")
+		return nil
+	}
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+
+	_, err := rh.CancelRequest("12826", "1337", 5*time.Minute)
+	assert.ErrorIs(t, err, api.ErrNothingToCancel)
+	assert.Equal(t, requests.StatusHeld, requestStatus(reqs, "held-1")())
+}
+
+func TestCancelCommandTurnedOff(t *testing.T) {
+	rh, reqs, _, _ := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:    "12826",
+		ChatReplies: true,
+	})
+	msgs := captureChat(rh)
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newChatCallback(t, "!cancel", "subscriber"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case msg := <-msgs:
+		t.Errorf("should not have replied, got %q", msg)
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Equal(t, requests.StatusHeld, requestStatus(reqs, "held-1")())
+}
+
+func addRequest(t *testing.T, reqs *testutil.InMemoryRequestStore, id, userID, status, source string, createdAt time.Time) {
+	t.Helper()
+	err := reqs.AddRequest(&requests.Request{
+		ID:            id,
+		BroadcasterID: "12826",
+		UserID:        userID,
+		Input:         "some other song",
+		Status:        status,
+		Source:        source,
+		CreatedAt:     &createdAt,
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,202 @@
+package api
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/retry"
+	"github.com/saxypandabear/twitchsongrequests/pkg/spotify"
+	"go.uber.org/zap"
+)
+
+// maxChatMessageLength is the longest message that Twitch accepts
+const maxChatMessageLength = 500
+
+var (
+	ErrRequestRejected = errors.New("the request was rejected by a moderator")
+	ErrRequestExpired  = errors.New("the request was not handled in time")
+)
+
+// refundReasons are why a request was refunded, for the refunds that don't come with an error
+var refundReasons = map[string]error{
+	requests.StatusRejected: ErrRequestRejected,
+	requests.StatusExpired:  ErrRequestExpired,
+}
+
+// rejectionReasons are what viewers are told when their request is rejected. The
+// first error that matches is used.
+var rejectionReasons = []struct {
+	err    error
+	reason string
+}{
+	{spotify.ErrExplicitSong, "explicit songs are disabled"},
+	{spotify.ErrSongTooLong, "the song is too long"},
+	{spotify.ErrDuplicateSong, "the song is already in the queue or was requested recently"},
+	{spotify.ErrBlockedSong, "the song is blocked"},
+	{spotify.ErrSongNotAllowed, "the song is not on the allow list"},
+	{spotify.ErrAlbumLink, "album links can't be requested"},
+	{spotify.ErrPlaylistLink, "playlist links can't be requested"},
+	{spotify.ErrArtistLink, "artist links can't be requested"},
+	{spotify.ErrPodcastLink, "podcasts can't be requested"},
+	{spotify.ErrEmptyCollection, "there are no songs behind the link"},
+	{spotify.ErrUnsupportedLink, "links to that site can't be requested"},
+	{spotify.ErrInvalidInput, "couldn't find that song"},
+	{spotify.ErrNoSearchMatch, "couldn't find that song"},
+	{spotify.ErrTranslateLink, "couldn't find that song"},
+	{spotify.ErrUnresolvedLink, "couldn't find that song"},
+	{spotify.ErrUnsupportedInput, "couldn't find that song"},
+	{ErrViewerCooldown, "you requested a song too recently"},
+	{ErrViewerLimitReached, "you have reached your request limit"},
+	{ErrViewerTooManyPending, "you have too many requests waiting to be queued"},
+	{ErrRequestRejected, "a moderator rejected it"},
+	{ErrRequestExpired, "it wasn't handled in time"},
+	{ErrNoCheerSong, "there was no song in the message"},
+	{ErrStreamOffline, "requests are only taken while the stream is live"},
+	{ErrViewerRolesUnknown, "your roles couldn't be checked"},
+}
+
+// RejectionReason describes why a request was rejected in a way that viewers understand
+func RejectionReason(err error) string {
+	var notEligible *ViewerNotEligibleError
+	if errors.As(err, &notEligible) {
+		return notEligible.Reason()
+	}
+	for _, r := range rejectionReasons {
+		if errors.Is(err, r.err) {
+			return r.reason
+		}
+	}
+	return "the song couldn't be queued"
+}
+
+// ReplyData fills in the placeholders in a chat reply template
+type ReplyData struct {
+	User     string
+	Song     string
+	Artist   string
+	Position string
+	Reason   string
+	Bits     string
+}
+
+// Format replaces the placeholders in the template, and cuts the message down to the
+// longest message that Twitch accepts.
+func (d *ReplyData) Format(tmpl string) string {
+	msg := strings.NewReplacer(
+		"{user}", d.User,
+		"{song}", d.Song,
+		"{artist}", d.Artist,
+		"{position}", d.Position,
+		"{reason}", d.Reason,
+		"{bits}", d.Bits,
+	).Replace(tmpl)
+
+	if r := []rune(msg); len(r) > maxChatMessageLength {
+		msg = string(r[:maxChatMessageLength])
+	}
+	return msg
+}
+
+// reply tells the viewer how their request turned out in the broadcaster's chat, if the
+// broadcaster turned chat replies on. Failed cheers are always explained, since the bits
+// can't be refunded. The client is used to find the song's place in the queue, and can
+// be nil when the song wasn't queued.
+func (h *RewardHandler) reply(client queue.Queuer, req *requests.Request, pref *preferences.Preference, res queue.Result, err error) {
+	cheerFailed := req.Source == requests.SourceCheer && err != nil
+	if !cheerFailed && (pref == nil || !pref.ChatReplies) {
+		return
+	}
+
+	d := ReplyData{
+		User:   req.UserName,
+		Song:   res.Name,
+		Artist: res.Artist,
+		Bits:   strconv.Itoa(req.Bits),
+	}
+	var msg string
+	switch {
+	case err == nil:
+		tmpl := cmp.Or(pref.QueuedReply, preferences.DefaultQueuedReply)
+		if strings.Contains(tmpl, "{position}") {
+			d.Position = queuePosition(client, res.TrackID.String())
+		}
+		msg = d.Format(tmpl)
+	case cheerFailed:
+		d.Reason = RejectionReason(err)
+		msg = d.Format(cheerFailedReply)
+		zap.L().Info("Cheer did not get a song queued",
+			zap.String("request", req.ID),
+			zap.Int("bits", req.Bits),
+			zap.String("reason", d.Reason),
+			zap.String("id", req.BroadcasterID),
+			zap.String("broadcaster", req.BroadcasterLogin))
+	default:
+		d.Reason = RejectionReason(err)
+		msg = d.Format(cmp.Or(pref.RejectedReply, preferences.DefaultRejectedReply))
+	}
+
+	if err = h.SendChat(h.config.Twitch, h.config.UserStore, req.BroadcasterID, msg); err != nil {
+		zap.L().Error("failed to send chat reply", zap.String("request", req.ID), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+	}
+}
+
+// queuePosition finds where the song is in the user's Spotify queue, or "?" if it can't
+func queuePosition(client queue.Queuer, trackID string) string {
+	if client == nil {
+		return "?"
+	}
+	q, err := client.GetQueue(context.Background())
+	if err != nil || q == nil {
+		return "?"
+	}
+	for i, t := range q.Items {
+		if t.ID.String() == trackID {
+			return strconv.Itoa(i + 1)
+		}
+	}
+	return "?"
+}
+
+// DoNothingOnChat is a no-op to satisfy the function interface
+func DoNothingOnChat(auth *util.AuthConfig, userStore db.UserStore, broadcasterID, message string) error {
+	return nil
+}
+
+// SendChatMessage posts the message in the broadcaster's chat, as the broadcaster.
+// https://dev.twitch.tv/docs/api/reference/#send-chat-message
+func SendChatMessage(auth *util.AuthConfig, userStore db.UserStore, broadcasterID, message string) error {
+	client, err := util.GetTwitchClientForUserID(auth, userStore, broadcasterID)
+	if err != nil {
+		return err
+	}
+
+	params := helix.SendChatMessageParams{
+		BroadcasterID: broadcasterID,
+		SenderID:      broadcasterID,
+		Message:       message,
+	}
+	// the message may have been sent after a server error, so only retry rate limits
+	return retry.DoRateLimited(context.Background(), retry.DefaultPolicy, func() error {
+		resp, err := client.SendChatMessage(&params)
+		if err != nil {
+			return err
+		}
+		if err = retry.HelixError(&resp.ResponseCommon); err != nil {
+			return err
+		}
+		if len(resp.Data.Messages) > 0 && !resp.Data.Messages[0].IsSent {
+			return fmt.Errorf("chat message was dropped: %s", resp.Data.Messages[0].DropReasons.Data.Message)
+		}
+		return nil
+	}, zap.String("id", broadcasterID), zap.String("call", "SendChatMessage"))
+}
@@ -0,0 +1,131 @@
+package api_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/spotify"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectionReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{spotify.ErrExplicitSong, "explicit songs are disabled"},
+		{fmt.Errorf("%w. %d > %d", spotify.ErrSongTooLong, 300000, 200000), "the song is too long"},
+		{spotify.ErrInvalidInput, "couldn't find that song"},
+		{api.ErrViewerCooldown, "you requested a song too recently"},
+		{errors.New("something else"), "the song couldn't be queued"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, api.RejectionReason(test.err))
+	}
+}
+
+func TestReplyDataFormat(t *testing.T) {
+	d := api.ReplyData{
+		User:     "viewer",
+		Song:     "Under Pressure",
+		Artist:   "Queen, David Bowie",
+		Position: "3",
+	}
+	assert.Equal(t, "@viewer queued 'Under Pressure' by Queen, David Bowie (#3 in queue)", d.Format(preferences.DefaultQueuedReply))
+
+	d = api.ReplyData{User: strings.Repeat("a", 600)}
+	assert.Len(t, d.Format("{user}"), 500)
+}
+
+func addRequestedSong(t *testing.T, rh *api.RewardHandler, reqs db.RequestStore) {
+	t.Helper()
+	createdAt := time.Now().Add(-time.Second)
+	err := reqs.AddRequest(&requests.Request{
+		ID:            "abc-123",
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		UserName:      "viewer",
+		Input:         "some song",
+		Status:        requests.StatusRequested,
+		CreatedAt:     &createdAt,
+	})
+	assert.NoError(t, err)
+	rh.ResumeRequests()
+}
+
+func captureChat(rh *api.RewardHandler) chan string {
+	msgs := make(chan string, 1)
+	rh.SendChat = func(_ *util.AuthConfig, _ db.UserStore, broadcasterID, message string) error {
+		msgs <- broadcasterID + ": " + message
+		return nil
+	}
+	return msgs
+}
+
+func TestChatReplyQueued(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:    "12826",
+		ChatReplies: true,
+		QueuedReply: "@{user} your song is up next",
+	})
+	msgs := captureChat(rh)
+	go func() {
+		<-m
+		<-callbacks
+	}()
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @viewer your song is up next", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+}
+
+func TestChatReplyRejected(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, spotify.ErrExplicitSong, &preferences.Preference{
+		TwitchID:    "12826",
+		ChatReplies: true,
+	})
+	msgs := captureChat(rh)
+	go func() { <-callbacks }()
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @viewer rejected: explicit songs are disabled", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+}
+
+func TestChatRepliesOff(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, spotify.ErrExplicitSong, &preferences.Preference{TwitchID: "12826"})
+	msgs := captureChat(rh)
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case <-callbacks:
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	select {
+	case msg := <-msgs:
+		t.Errorf("should not have replied, but sent %q", msg)
+	case <-time.After(testResponseTimeout):
+		t.Log("no reply expected")
+	}
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+// chatBadgeRoles maps the chat badges that give a viewer one of the roles that the chat
+// command can be limited to
+var chatBadgeRoles = map[string]string{
+	"subscriber":     preferences.RoleSubscriber,
+	"founder":        preferences.RoleSubscriber,
+	"vip":            preferences.RoleVIP,
+	"moderator":      preferences.RoleModerator,
+	"lead_moderator": preferences.RoleModerator,
+}
+
+// ParseChatCommand checks if the chat message is the song request command, and returns
+// what was requested with it. The command is matched ignoring case.
+func ParseChatCommand(message, command string) (string, bool) {
+	command = cmp.Or(command, preferences.DefaultChatCommand)
+	name, input, _ := strings.Cut(strings.TrimSpace(message), " ")
+	if !strings.EqualFold(name, command) {
+		return "", false
+	}
+
+	input = strings.TrimSpace(input)
+	return input, input != ""
+}
+
+// CanUseChatCommand checks if the chatter has one of the roles that the command is
+// limited to. The broadcaster can always use it, and anyone can when it isn't limited.
+func CanUseChatCommand(badges []helix.EventSubChatBadge, roles []string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, b := range badges {
+		if b.SetID == "broadcaster" {
+			return true
+		}
+		if role, ok := chatBadgeRoles[b.SetID]; ok && slices.Contains(roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatMessage handles a chat message notification, and saves the song request if the
+// message is the chat command. It is called once the notification has been verified.
+func (h *RewardHandler) chatMessage(w http.ResponseWriter, event json.RawMessage) {
+	var msg helix.EventSubChannelChatMessageEvent
+	if err := json.NewDecoder(bytes.NewReader(event)).Decode(&msg); err != nil {
+		zap.L().Error("failed to unmarshal payload", zap.Error(err))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	userID := msg.BroadcasterUserID
+	broadcaster := msg.BroadcasterUserLogin
+
+	pref, err := h.config.PrefStore.GetPreference(userID)
+	if err != nil {
+		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	// viewers can cancel requests that they made with channel points, so this doesn't
+	// need chat requests to be on
+	if pref != nil && pref.CancelWindow > 0 && IsCancelCommand(msg.Message.Text) {
+		h.cancelFromChat(w, &msg, pref)
+		return
+	}
+	if pref == nil || !pref.ChatRequests {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	input, ok := ParseChatCommand(msg.Message.Text, pref.ChatCommand)
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if !CanUseChatCommand(msg.Badges, pref.ChatRoles) {
+		zap.L().Debug("chatter is not allowed to use the chat command", zap.String("user", msg.ChatterUserLogin), zap.String("id", userID), zap.String("broadcaster", broadcaster))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !h.firstDelivery("chat:" + msg.MessageID) {
+		zap.L().Info("dropping duplicate chat request", zap.String("request", msg.MessageID), zap.String("id", userID), zap.String("broadcaster", broadcaster))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	now := time.Now()
+	req := requests.Request{
+		ID:               msg.MessageID,
+		BroadcasterID:    userID,
+		BroadcasterLogin: broadcaster,
+		UserID:           msg.ChatterUserID,
+		UserLogin:        msg.ChatterUserLogin,
+		UserName:         msg.ChatterUserName,
+		Input:            input,
+		Status:           requests.StatusRequested,
+		Source:           requests.SourceChat,
+		SessionID:        h.sessionID(userID),
+		CreatedAt:        &now,
+	}
+	if err = h.config.Requests.AddRequest(&req); err != nil {
+		zap.L().Error("failed to save request", zap.String("request", req.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write([]byte("ok")); err != nil {
+		zap.L().Error("failed to write response body", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	h.submit(&req)
+}
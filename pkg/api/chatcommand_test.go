@@ -0,0 +1,175 @@
+package api_test
+
+import (
+	_ "embed"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/spotify"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+const chatRequestID = "cc106a89-1814-919d-454c-f4f2f970aae7"
+
+//go:embed testdata/chat.json
+var chatPayload string
+
+func TestParseChatCommand(t *testing.T) {
+	tests := []struct {
+		message  string
+		command  string
+		input    string
+		expected bool
+	}{
+		{"!sr never gonna give you up", "", "never gonna give you up", true},
+		{"  !SR   https://open.spotify.com/track/abc  ", "", "https://open.spotify.com/track/abc", true},
+		{"!song some song", "!song", "some song", true},
+		{"!sr", "", "", false},
+		{"!sr some song", "!song", "", false},
+		{"!srs some song", "", "", false},
+		{"please !sr some song", "", "", false},
+	}
+
+	for _, test := range tests {
+		input, ok := api.ParseChatCommand(test.message, test.command)
+		assert.Equal(t, test.expected, ok, test.message)
+		assert.Equal(t, test.input, input, test.message)
+	}
+}
+
+func TestCanUseChatCommand(t *testing.T) {
+	badges := func(ids ...string) []helix.EventSubChatBadge {
+		res := make([]helix.EventSubChatBadge, 0, len(ids))
+		for _, id := range ids {
+			res = append(res, helix.EventSubChatBadge{SetID: id})
+		}
+		return res
+	}
+	subs := []string{preferences.RoleSubscriber}
+	mods := []string{preferences.RoleModerator, preferences.RoleVIP}
+
+	assert.True(t, api.CanUseChatCommand(nil, nil))
+	assert.True(t, api.CanUseChatCommand(badges("subscriber"), subs))
+	assert.True(t, api.CanUseChatCommand(badges("founder"), subs))
+	assert.True(t, api.CanUseChatCommand(badges("broadcaster"), subs))
+	assert.False(t, api.CanUseChatCommand(badges("vip"), subs))
+	assert.False(t, api.CanUseChatCommand(nil, subs))
+	assert.True(t, api.CanUseChatCommand(badges("premium", "vip"), mods))
+	assert.True(t, api.CanUseChatCommand(badges("moderator"), mods))
+	assert.False(t, api.CanUseChatCommand(badges("subscriber"), mods))
+}
+
+func newChatCallback(t *testing.T, message, badge string) *http.Request {
+	t.Helper()
+	payload := strings.ReplaceAll(chatPayload, "TESTCHATMESSAGE", message)
+	payload = strings.Replace(payload, "TESTBADGE", badge, 1)
+	return newSignedCallback(t, payload, generateUserInput(t), time.Now())
+}
+
+func TestChatCommandRequest(t *testing.T) {
+	rh, u, prefs, _, reqs, m, callbacks := getTestRewardHandler(true)
+	assert.NoError(t, u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	}))
+	assert.NoError(t, prefs.AddPreference(&preferences.Preference{
+		TwitchID:     "12826",
+		ChatRequests: true,
+	}))
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newChatCallback(t, "!sr some song", "subscriber"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case input := <-m:
+		assert.Equal(t, "some song", input)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+
+	// there is no redemption to fulfill
+	select {
+	case <-callbacks:
+		t.Error("should not have updated a redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+
+	r, err := reqs.GetRequest(chatRequestID)
+	assert.NoError(t, err)
+	assert.Equal(t, requests.SourceChat, r.Source)
+	assert.Equal(t, "1337", r.UserID)
+	assert.Equal(t, "Awesome_User", r.UserName)
+	assert.Equal(t, requests.StatusQueued, requestStatus(reqs, chatRequestID)())
+}
+
+func TestChatCommandIgnored(t *testing.T) {
+	tests := []struct {
+		name    string
+		pref    *preferences.Preference
+		message string
+		badge   string
+	}{
+		{"chat requests off", &preferences.Preference{TwitchID: "12826"}, "!sr some song", "subscriber"},
+		{"not the command", &preferences.Preference{TwitchID: "12826", ChatRequests: true}, "hello chat", "subscriber"},
+		{"custom command", &preferences.Preference{TwitchID: "12826", ChatRequests: true, ChatCommand: "!song"}, "!sr some song", "subscriber"},
+		{"missing role", &preferences.Preference{TwitchID: "12826", ChatRequests: true, ChatRoles: []string{preferences.RoleVIP}}, "!sr some song", "subscriber"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rh, _, prefs, _, reqs, m, _ := getTestRewardHandler(true)
+			assert.NoError(t, prefs.AddPreference(test.pref))
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newChatCallback(t, test.message, test.badge))
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			select {
+			case <-m:
+				t.Error("should not have published the message")
+			case <-time.After(testResponseTimeout):
+				t.Log("no event expected")
+			}
+			_, err := reqs.GetRequest(chatRequestID)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestChatCommandFailureHasNoRedemption(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, spotify.ErrExplicitSong)
+
+	createdAt := time.Now().Add(-time.Second)
+	assert.NoError(t, reqs.AddRequest(&requests.Request{
+		ID:            chatRequestID,
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusRequested,
+		Source:        requests.SourceChat,
+		CreatedAt:     &createdAt,
+	}))
+	rh.ResumeRequests()
+
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, chatRequestID)() == requests.StatusFailed
+	}, testResponseTimeout, 10*time.Millisecond)
+	select {
+	case <-callbacks:
+		t.Error("should not have refunded a redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+}
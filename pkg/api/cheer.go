@@ -0,0 +1,112 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+// cheerFailedReply is always sent when a cheer doesn't get a song queued, because the
+// bits can't be refunded
+const cheerFailedReply = "@{user} sorry, your {bits} bits couldn't request a song because {reason}"
+
+// ErrNoCheerSong means that there was nothing left to request once the cheermotes were
+// taken out of the cheer message
+var ErrNoCheerSong = errors.New("there was no song in the cheer message")
+
+// cheermote matches the cheermotes in a cheer message, like Cheer100 or Kappa50
+var cheermote = regexp.MustCompile(`^[A-Za-z]+([0-9]+)$`)
+
+// ParseCheerMessage takes the cheermotes out of the cheer message, and returns what is
+// left to request. Words that look like cheermotes are only taken out until they add up
+// to the bits that were cheered, so that a song like "blink182" survives.
+func ParseCheerMessage(message string, bits int) string {
+	words := strings.Fields(message)
+	input := make([]string, 0, len(words))
+	cheered := 0
+	for _, w := range words {
+		if m := cheermote.FindStringSubmatch(w); m != nil {
+			if amount, err := strconv.Atoi(m[1]); err == nil && cheered+amount <= bits {
+				cheered += amount
+				continue
+			}
+		}
+		input = append(input, w)
+	}
+	return strings.Join(input, " ")
+}
+
+// cheer handles a cheer notification, and saves the song request if the cheer is big
+// enough. It is called once the notification has been verified. Cheers don't have an
+// ID, so the ID of the EventSub message is used for the request.
+func (h *RewardHandler) cheer(w http.ResponseWriter, msgID string, event json.RawMessage) {
+	var c helix.EventSubChannelCheerEvent
+	if err := json.NewDecoder(bytes.NewReader(event)).Decode(&c); err != nil {
+		zap.L().Error("failed to unmarshal payload", zap.Error(err))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	userID := c.BroadcasterUserID
+	broadcaster := c.BroadcasterUserLogin
+
+	pref, err := h.config.PrefStore.GetPreference(userID)
+	if err != nil {
+		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	if pref == nil || pref.MinCheerBits <= 0 || c.Bits < pref.MinCheerBits {
+		// just a cheer
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if msgID == "" {
+		msgID = fmt.Sprintf("cheer-%s-%d", userID, time.Now().UnixNano())
+	}
+	now := time.Now()
+	req := requests.Request{
+		ID:               msgID,
+		BroadcasterID:    userID,
+		BroadcasterLogin: broadcaster,
+		UserID:           c.UserID,
+		UserLogin:        c.UserLogin,
+		UserName:         c.UserName,
+		Input:            ParseCheerMessage(c.Message, c.Bits),
+		Status:           requests.StatusRequested,
+		Source:           requests.SourceCheer,
+		Bits:             c.Bits,
+		SessionID:        h.sessionID(userID),
+		CreatedAt:        &now,
+	}
+	if c.IsAnonymous {
+		req.UserName = "anonymous"
+	}
+	if req.Input == "" {
+		req.Status = requests.StatusFailed
+	}
+	if err = h.config.Requests.AddRequest(&req); err != nil {
+		zap.L().Error("failed to save request", zap.String("request", req.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write([]byte("ok")); err != nil {
+		zap.L().Error("failed to write response body", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	if req.Status == requests.StatusFailed {
+		h.reply(nil, &req, pref, queue.Result{}, ErrNoCheerSong)
+		return
+	}
+	h.submit(&req)
+}
@@ -0,0 +1,197 @@
+package api_test
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+const cheerMessageID = "cheer-message"
+
+//go:embed testdata/cheer.json
+var cheerPayload string
+
+func TestParseCheerMessage(t *testing.T) {
+	tests := []struct {
+		message  string
+		bits     int
+		expected string
+	}{
+		{"Cheer500 https://open.spotify.com/track/abc", 500, "https://open.spotify.com/track/abc"},
+		{"Cheer100 never gonna give you up Kappa100", 200, "never gonna give you up"},
+		{"Cheer100 all the small things blink182", 100, "all the small things blink182"},
+		{"Cheer500", 500, ""},
+		{"some song", 100, "some song"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, api.ParseCheerMessage(test.message, test.bits), test.message)
+	}
+}
+
+func newCheerCallback(t *testing.T, message string, bits int) *http.Request {
+	t.Helper()
+	payload := strings.Replace(cheerPayload, "TESTCHEERMESSAGE", message, 1)
+	payload = strings.Replace(payload, "TESTBITS", strconv.Itoa(bits), 1)
+	return newSignedCallback(t, payload, cheerMessageID, time.Now())
+}
+
+func getCheerTestHandler(t *testing.T, publishSuccess bool, pref *preferences.Preference) (*api.RewardHandler, chan string, chan string, chan bool, func() string) {
+	t.Helper()
+	rh, u, prefs, _, reqs, m, callbacks := getTestRewardHandler(publishSuccess)
+	assert.NoError(t, u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	}))
+	assert.NoError(t, prefs.AddPreference(pref))
+	return rh, m, captureChat(rh), callbacks, requestStatus(reqs, cheerMessageID)
+}
+
+func TestCheerRequest(t *testing.T) {
+	rh, m, msgs, callbacks, status := getCheerTestHandler(t, true, &preferences.Preference{TwitchID: "12826", MinCheerBits: 100})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newCheerCallback(t, "Cheer500 some song", 500))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case input := <-m:
+		assert.Equal(t, "some song", input)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	assert.Eventually(t, func() bool {
+		return status() == requests.StatusQueued
+	}, testResponseTimeout, 10*time.Millisecond)
+
+	// bits don't have a redemption, and chat replies are off
+	select {
+	case <-callbacks:
+		t.Error("should not have updated a redemption")
+	case msg := <-msgs:
+		t.Errorf("should not have replied, but sent %q", msg)
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+}
+
+func TestCheerSkipsRequestRules(t *testing.T) {
+	// none of the rules can turn down a cheer, since the bits can't be refunded
+	rh, m, _, _, status := getCheerTestHandler(t, true, &preferences.Preference{
+		TwitchID:         "12826",
+		MinCheerBits:     100,
+		Moderated:        true,
+		LiveOnly:         true,
+		RequestRoles:     []string{preferences.RoleSubscriber},
+		ViewerMaxPending: 1,
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newCheerCallback(t, "Cheer500 some song", 500))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case input := <-m:
+		assert.Equal(t, "some song", input)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	assert.Eventually(t, func() bool {
+		return status() == requests.StatusQueued
+	}, testResponseTimeout, 10*time.Millisecond)
+}
+
+func TestCheerBelowMinimum(t *testing.T) {
+	rh, m, _, _, status := getCheerTestHandler(t, true, &preferences.Preference{TwitchID: "12826", MinCheerBits: 100})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newCheerCallback(t, "Cheer50 some song", 50))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	select {
+	case <-m:
+		t.Error("should not have published the message")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Empty(t, status())
+}
+
+func TestCheerFailureExplained(t *testing.T) {
+	tests := []struct {
+		name           string
+		publishSuccess bool
+		message        string
+		expected       string
+	}{
+		{"publish failed", false, "Cheer500 some song", "12826: @Awesome_User sorry, your 500 bits couldn't request a song because the song couldn't be queued"},
+		{"no song", true, "Cheer500", "12826: @Awesome_User sorry, your 500 bits couldn't request a song because there was no song in the message"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// chat replies are off, but failed cheers are explained anyway
+			rh, m, msgs, _, status := getCheerTestHandler(t, test.publishSuccess, &preferences.Preference{TwitchID: "12826", MinCheerBits: 100})
+			go func() {
+				for range m {
+				}
+			}()
+
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newCheerCallback(t, test.message, 500))
+			assert.Equal(t, http.StatusOK, rr.Code)
+
+			select {
+			case msg := <-msgs:
+				assert.Equal(t, test.expected, msg)
+			case <-time.After(testResponseTimeout):
+				t.Error("did not receive message in time")
+			}
+			assert.Equal(t, requests.StatusFailed, status())
+		})
+	}
+}
+
+func TestFlushHeldCheerFirst(t *testing.T) {
+	rh, reqs, m, _ := getHoldTestHandler(t, nil, &preferences.Preference{TwitchID: "12826", CheerPriority: true})
+	rh.UpdateRedemption = api.DoNothingOnRedemption
+	rh.ActiveDevice = func(_ context.Context, _ string) (bool, error) { return true, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "first", "first song", now.Add(-2*time.Minute), now)
+	cheeredAt := now.Add(-time.Minute)
+	assert.NoError(t, reqs.AddRequest(&requests.Request{
+		ID:            "cheer",
+		BroadcasterID: "12826",
+		Input:         "cheer song",
+		Status:        requests.StatusHeld,
+		Source:        requests.SourceCheer,
+		Bits:          500,
+		CreatedAt:     &cheeredAt,
+		UpdatedAt:     &now,
+	}))
+
+	go rh.FlushHeldRequests()
+
+	for _, expected := range []string{"cheer song", "first song"} {
+		select {
+		case event := <-m:
+			assert.Equal(t, expected, event)
+		case <-time.After(testResponseTimeout):
+			t.Fatal("did not receive message in time")
+		}
+	}
+}
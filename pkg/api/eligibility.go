@@ -0,0 +1,190 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+const (
+	// ViewerRolesTTL is how long a viewer's roles are remembered, so that a viewer who
+	// requests a few songs in a row doesn't look them up every time
+	ViewerRolesTTL = 10 * time.Minute
+	// viewerRolesCacheSize caps how many viewers are remembered before the cache starts over
+	viewerRolesCacheSize = 5000
+)
+
+// ErrViewerRolesUnknown means that the viewer's roles couldn't be looked up, like when the
+// broadcaster hasn't granted the scopes that it needs
+var ErrViewerRolesUnknown = errors.New("the viewer's roles could not be looked up")
+
+// ViewerNotEligibleError means that the viewer doesn't have any of the roles that the song
+// request reward is limited to
+type ViewerNotEligibleError struct {
+	Roles         []string
+	MinFollowDays int
+}
+
+func (e *ViewerNotEligibleError) Error() string {
+	return "viewer does not have a role that can request songs: " + strings.Join(e.Roles, ", ")
+}
+
+// Reason describes who can request songs, in a way that viewers understand
+func (e *ViewerNotEligibleError) Reason() string {
+	names := make([]string, 0, len(e.Roles))
+	for _, r := range e.Roles {
+		switch r {
+		case preferences.RoleSubscriber:
+			names = append(names, "subscribers")
+		case preferences.RoleVIP:
+			names = append(names, "VIPs")
+		case preferences.RoleModerator:
+			names = append(names, "moderators")
+		case preferences.RoleFollower:
+			switch e.MinFollowDays {
+			case 0:
+				names = append(names, "followers")
+			case 1:
+				names = append(names, "followers of at least 1 day")
+			default:
+				names = append(names, fmt.Sprintf("followers of at least %d days", e.MinFollowDays))
+			}
+		}
+	}
+
+	who := strings.Join(names, ", ")
+	if i := strings.LastIndex(who, ", "); i >= 0 {
+		who = who[:i] + " and " + who[i+2:]
+	}
+	return "only " + who + " can request songs"
+}
+
+// CheckViewerEligibility verifies that the viewer has one of the roles that the song
+// request reward is limited to in the broadcaster's preferences. The broadcaster can
+// always request songs. Roles that couldn't be looked up are skipped.
+func CheckViewerEligibility(roles *util.ViewerRoles, p *preferences.Preference, broadcasterID, viewerID string, now time.Time) error {
+	if p == nil || len(p.RequestRoles) == 0 || broadcasterID == viewerID {
+		return nil
+	}
+
+	checked := make([]string, 0, len(p.RequestRoles))
+	for _, r := range p.RequestRoles {
+		if !roles.Known(r) {
+			// the broadcaster hasn't granted the scope to look it up, so the rule is skipped
+			continue
+		}
+		checked = append(checked, r)
+
+		switch r {
+		case preferences.RoleSubscriber:
+			if roles.Subscriber {
+				return nil
+			}
+		case preferences.RoleVIP:
+			if roles.VIP {
+				return nil
+			}
+		case preferences.RoleModerator:
+			if roles.Moderator {
+				return nil
+			}
+		case preferences.RoleFollower:
+			minFollow := time.Duration(p.MinFollowDays) * 24 * time.Hour
+			if roles.FollowedAt != nil && !roles.FollowedAt.After(now.Add(-minFollow)) {
+				return nil
+			}
+		}
+	}
+
+	if len(checked) == 0 {
+		return nil
+	}
+	return &ViewerNotEligibleError{Roles: checked, MinFollowDays: p.MinFollowDays}
+}
+
+// viewerRolesCache remembers the roles that were looked up for each viewer
+type viewerRolesCache struct {
+	mu    sync.Mutex
+	roles map[string]cachedViewerRoles
+}
+
+type cachedViewerRoles struct {
+	roles   *util.ViewerRoles
+	expires time.Time
+}
+
+func newViewerRolesCache() *viewerRolesCache {
+	return &viewerRolesCache{
+		roles: make(map[string]cachedViewerRoles),
+	}
+}
+
+func (c *viewerRolesCache) get(broadcasterID, viewerID string, now time.Time) (*util.ViewerRoles, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.roles[broadcasterID+":"+viewerID]
+	if !ok || now.After(cached.expires) {
+		return nil, false
+	}
+	return cached.roles, true
+}
+
+func (c *viewerRolesCache) add(broadcasterID, viewerID string, roles *util.ViewerRoles, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.roles) >= viewerRolesCacheSize {
+		c.roles = make(map[string]cachedViewerRoles)
+	}
+	c.roles[broadcasterID+":"+viewerID] = cachedViewerRoles{
+		roles:   roles,
+		expires: now.Add(ViewerRolesTTL),
+	}
+}
+
+// checkEligibility verifies that the viewer can redeem the song request reward, using the
+// roles that were looked up for them recently if there are any. If their roles can't be
+// looked up, the request is turned down, since the reward is limited to some viewers.
+func (h *RewardHandler) checkEligibility(req *requests.Request, pref *preferences.Preference) error {
+	if pref == nil || len(pref.RequestRoles) == 0 || req.UserID == req.BroadcasterID {
+		return nil
+	}
+
+	now := time.Now()
+	roles, ok := h.roleCache.get(req.BroadcasterID, req.UserID, now)
+	if !ok {
+		var err error
+		if roles, err = h.ViewerRoles(req.BroadcasterID, req.UserID); err != nil {
+			zap.L().Error("failed to get viewer roles", zap.String("user", req.UserID), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+			return fmt.Errorf("%w: %w", ErrViewerRolesUnknown, err)
+		}
+		h.roleCache.add(req.BroadcasterID, req.UserID, roles, now)
+	}
+	return CheckViewerEligibility(roles, pref, req.BroadcasterID, req.UserID, now)
+}
+
+// lookupViewerRoles gets the viewer's roles in the broadcaster's channel from Twitch
+func (h *RewardHandler) lookupViewerRoles(broadcasterID, viewerID string) (*util.ViewerRoles, error) {
+	client, err := util.GetTwitchClientForUserID(h.config.Twitch, h.config.UserStore, broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+
+	scopes, err := util.GrantedScopes(client)
+	if err != nil {
+		return nil, err
+	}
+	roles, err := util.GetViewerRoles(client, broadcasterID, viewerID, scopes)
+	if err == nil && len(roles.Unknown) > 0 {
+		zap.L().Warn("broadcaster did not grant the Twitch scopes to look up some roles", zap.String("id", broadcasterID), zap.Strings("roles", roles.Unknown))
+	}
+	return roles, err
+}
@@ -0,0 +1,169 @@
+package api_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckViewerEligibility(t *testing.T) {
+	now := time.Now()
+	longAgo := now.Add(-30 * 24 * time.Hour)
+	recently := now.Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		roles    util.ViewerRoles
+		pref     *preferences.Preference
+		viewer   string
+		eligible bool
+	}{
+		{"no preferences", util.ViewerRoles{}, nil, "1337", true},
+		{"not limited", util.ViewerRoles{}, &preferences.Preference{}, "1337", true},
+		{"broadcaster", util.ViewerRoles{}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber}}, "12826", true},
+		{"subscriber", util.ViewerRoles{Subscriber: true}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber}}, "1337", true},
+		{"not a subscriber", util.ViewerRoles{VIP: true}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber}}, "1337", false},
+		{"VIP", util.ViewerRoles{VIP: true}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber, preferences.RoleVIP}}, "1337", true},
+		{"moderator", util.ViewerRoles{Moderator: true}, &preferences.Preference{RequestRoles: []string{preferences.RoleModerator}}, "1337", true},
+		{"follower", util.ViewerRoles{FollowedAt: &recently}, &preferences.Preference{RequestRoles: []string{preferences.RoleFollower}}, "1337", true},
+		{"not a follower", util.ViewerRoles{}, &preferences.Preference{RequestRoles: []string{preferences.RoleFollower}}, "1337", false},
+		{"old follower", util.ViewerRoles{FollowedAt: &longAgo}, &preferences.Preference{RequestRoles: []string{preferences.RoleFollower}, MinFollowDays: 7}, "1337", true},
+		{"new follower", util.ViewerRoles{FollowedAt: &recently}, &preferences.Preference{RequestRoles: []string{preferences.RoleFollower}, MinFollowDays: 7}, "1337", false},
+		{"unknown role", util.ViewerRoles{Unknown: []string{preferences.RoleSubscriber}}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber}}, "1337", true},
+		{"unknown and missing role", util.ViewerRoles{Unknown: []string{preferences.RoleSubscriber}}, &preferences.Preference{RequestRoles: []string{preferences.RoleSubscriber, preferences.RoleVIP}}, "1337", false},
+	}
+
+	for _, test := range tests {
+		err := api.CheckViewerEligibility(&test.roles, test.pref, "12826", test.viewer, now)
+		if test.eligible {
+			assert.NoError(t, err, test.name)
+		} else {
+			var notEligible *api.ViewerNotEligibleError
+			assert.ErrorAs(t, err, &notEligible, test.name)
+		}
+	}
+}
+
+func TestViewerNotEligibleReason(t *testing.T) {
+	tests := []struct {
+		err      api.ViewerNotEligibleError
+		expected string
+	}{
+		{api.ViewerNotEligibleError{Roles: []string{preferences.RoleSubscriber}}, "only subscribers can request songs"},
+		{api.ViewerNotEligibleError{Roles: []string{preferences.RoleSubscriber, preferences.RoleVIP}}, "only subscribers and VIPs can request songs"},
+		{
+			api.ViewerNotEligibleError{Roles: []string{preferences.RoleVIP, preferences.RoleModerator, preferences.RoleFollower}, MinFollowDays: 7},
+			"only VIPs, moderators and followers of at least 7 days can request songs",
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.err.Reason())
+		assert.Equal(t, test.expected, api.RejectionReason(&test.err))
+	}
+}
+
+func TestIneligibleViewerRefunded(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:     "12826",
+		RequestRoles: []string{preferences.RoleSubscriber},
+		ChatReplies:  true,
+	})
+	rh.ViewerRoles = func(broadcasterID, viewerID string) (*util.ViewerRoles, error) {
+		return &util.ViewerRoles{VIP: true}, nil
+	}
+	msgs := captureChat(rh)
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case <-m:
+		t.Error("should not have queued a request from a viewer without a required role")
+	case success := <-callbacks:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive callback in time")
+	}
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @viewer rejected: only subscribers can request songs", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	assert.Equal(t, requests.StatusFailed, requestStatus(reqs, "abc-123")())
+}
+
+func TestEligibleViewerRolesCached(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:     "12826",
+		RequestRoles: []string{preferences.RoleSubscriber},
+	})
+	lookups := 0
+	rh.ViewerRoles = func(broadcasterID, viewerID string) (*util.ViewerRoles, error) {
+		lookups++
+		return &util.ViewerRoles{Subscriber: true}, nil
+	}
+
+	for _, id := range []string{"abc-123", "bcd-234"} {
+		createdAt := time.Now().Add(-time.Second)
+		assert.NoError(t, reqs.AddRequest(&requests.Request{
+			ID:            id,
+			BroadcasterID: "12826",
+			UserID:        "1337",
+			Input:         id,
+			Status:        requests.StatusRequested,
+			CreatedAt:     &createdAt,
+		}))
+		rh.ResumeRequests()
+
+		select {
+		case input := <-m:
+			assert.Equal(t, id, input)
+		case <-time.After(testResponseTimeout):
+			t.Fatal("did not receive message in time")
+		}
+		assert.True(t, <-callbacks)
+	}
+
+	// the second request used the roles that were looked up for the first
+	assert.Equal(t, 1, lookups)
+}
+
+func TestViewerRolesLookupFails(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:     "12826",
+		RequestRoles: []string{preferences.RoleSubscriber},
+		ChatReplies:  true,
+	})
+	rh.ViewerRoles = func(broadcasterID, viewerID string) (*util.ViewerRoles, error) {
+		return nil, errors.New("oops")
+	}
+	msgs := captureChat(rh)
+
+	addRequestedSong(t, rh, reqs)
+
+	// the reward is limited, so the request is refunded when the roles can't be looked up
+	select {
+	case <-m:
+		t.Error("should not have queued a request when the viewer's roles couldn't be looked up")
+	case success := <-callbacks:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive callback in time")
+	}
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @viewer rejected: your roles couldn't be checked", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "abc-123")() == requests.StatusFailed
+	}, testResponseTimeout, 10*time.Millisecond)
+}
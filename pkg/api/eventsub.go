@@ -1,6 +1,7 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/nicklaw5/helix/v2"
@@ -12,6 +13,7 @@ import (
 const (
 	topicVersion = "1"
 	subMethod    = "webhook"
+	rewardPrompt = "Request with a Spotify URL, or search for a song with keywords"
 )
 
 type SubscribeRequest struct {
@@ -22,14 +24,16 @@ type EventSubHandler struct {
 	auth        *util.AuthConfig
 	userStore   db.UserStore
 	prefStore   db.PreferenceStore
+	rewardStore db.RewardStore
 	callbackURL string
 	secret      string
 }
 
-func NewEventSubHandler(u db.UserStore, p db.PreferenceStore, auth *util.AuthConfig, callbackURL, secret string) *EventSubHandler {
+func NewEventSubHandler(u db.UserStore, p db.PreferenceStore, rw db.RewardStore, auth *util.AuthConfig, callbackURL, secret string) *EventSubHandler {
 	return &EventSubHandler{
 		userStore:   u,
 		prefStore:   p,
+		rewardStore: rw,
 		auth:        auth,
 		callbackURL: callbackURL,
 		secret:      secret,
@@ -74,7 +78,7 @@ func (e *EventSubHandler) SubscribeToTopic(w http.ResponseWriter, r *http.Reques
 		IsUserInputRequired: true,
 		IsEnabled:           false, // create the reward, but don't enable it by default
 		Cost:                1000,
-		Prompt:              "Request with a Spotify URL, or search for a song with keywords",
+		Prompt:              rewardPrompt,
 	}
 
 	rewardRes, err := c.CreateCustomReward(&createReward)
@@ -107,20 +111,12 @@ func (e *EventSubHandler) SubscribeToTopic(w http.ResponseWriter, r *http.Reques
 	}
 
 	// need to get a whole new client after setting the user access token, for some reason
-	c, err = util.GetNewTwitchClient(e.auth)
+	c, err = e.appClient()
 	if err != nil {
-		zap.L().Error("failed to get Twitch client", zap.String("id", id), zap.Error(err))
-		http.Redirect(w, r, e.callbackURL, http.StatusFound)
-		return
-	}
-	// creating the event sub subscription requires an app access token
-	token, err := c.RequestAppAccessToken([]string{e.auth.Scope})
-	if err != nil {
-		zap.L().Error("failed to get updated access token", zap.String("id", id), zap.Error(err))
+		zap.L().Error("failed to get Twitch client with an app access token", zap.String("id", id), zap.Error(err))
 		http.Redirect(w, r, e.callbackURL, http.StatusFound)
 		return
 	}
-	c.SetAppAccessToken(token.Data.AccessToken)
 
 	res, err := c.CreateEventSubSubscription(&createSub)
 	if err != nil {
@@ -146,6 +142,34 @@ func (e *EventSubHandler) SubscribeToTopic(w http.ResponseWriter, r *http.Reques
 	// successfully subscribed
 	user.Subscribed = true
 	user.SubscriptionID = res.Data.EventSubSubscriptions[0].ID
+
+	// the chat command, cheers, reward updates and stream changes are optional, so requests
+	// still work with channel points if these fail
+	if chatID, chatErr := e.subscribe(c, helix.EventSubTypeChannelChatMessage, helix.EventSubCondition{BroadcasterUserID: id, UserID: id}); chatErr != nil {
+		zap.L().Error("failed to subscribe to chat messages", zap.String("id", id), zap.Error(chatErr))
+	} else {
+		user.ChatSubscriptionID = chatID
+	}
+	if cheerID, cheerErr := e.subscribe(c, helix.EventSubTypeChannelCheer, helix.EventSubCondition{BroadcasterUserID: id}); cheerErr != nil {
+		zap.L().Error("failed to subscribe to cheers", zap.String("id", id), zap.Error(cheerErr))
+	} else {
+		user.CheerSubscriptionID = cheerID
+	}
+	if rewardID, rewardErr := e.subscribe(c, helix.EventSubTypeChannelPointsCustomRewardUpdate, helix.EventSubCondition{BroadcasterUserID: id}); rewardErr != nil {
+		zap.L().Error("failed to subscribe to reward updates", zap.String("id", id), zap.Error(rewardErr))
+	} else {
+		user.RewardSubscriptionID = rewardID
+	}
+	if onlineID, onlineErr := e.subscribe(c, helix.EventSubTypeStreamOnline, helix.EventSubCondition{BroadcasterUserID: id}); onlineErr != nil {
+		zap.L().Error("failed to subscribe to the stream going live", zap.String("id", id), zap.Error(onlineErr))
+	} else {
+		user.OnlineSubscriptionID = onlineID
+	}
+	if offlineID, offlineErr := e.subscribe(c, helix.EventSubTypeStreamOffline, helix.EventSubCondition{BroadcasterUserID: id}); offlineErr != nil {
+		zap.L().Error("failed to subscribe to the stream going offline", zap.String("id", id), zap.Error(offlineErr))
+	} else {
+		user.OfflineSubscriptionID = offlineID
+	}
 	err = e.userStore.UpdateUser(user)
 	if err != nil {
 		zap.L().Error("failed to update user", zap.String("id", id), zap.Error(err))
@@ -165,3 +189,40 @@ func (e *EventSubHandler) SubscribeToTopic(w http.ResponseWriter, r *http.Reques
 
 	http.Redirect(w, r, e.callbackURL, http.StatusFound)
 }
+
+// subscribe creates an EventSub subscription that is delivered to the callback, and
+// returns its ID. The client must have an app access token.
+func (e *EventSubHandler) subscribe(c *helix.Client, subType string, condition helix.EventSubCondition) (string, error) {
+	res, err := c.CreateEventSubSubscription(&helix.EventSubSubscription{
+		Type:      subType,
+		Version:   topicVersion,
+		Condition: condition,
+		Transport: helix.EventSubTransport{
+			Method:   subMethod,
+			Callback: e.callbackURL + "/callback",
+			Secret:   e.secret,
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(res.ErrorMessage) > 0 || len(res.Data.EventSubSubscriptions) < 1 {
+		return "", fmt.Errorf("failed to create %s subscription: %d %s", subType, res.ErrorStatus, res.ErrorMessage)
+	}
+	return res.Data.EventSubSubscriptions[0].ID, nil
+}
+
+// appClient gets a Twitch client with an app access token, which creating and removing
+// EventSub subscriptions requires
+func (e *EventSubHandler) appClient() (*helix.Client, error) {
+	c, err := util.GetNewTwitchClient(e.auth)
+	if err != nil {
+		return nil, err
+	}
+	token, err := c.RequestAppAccessToken([]string{e.auth.Scope})
+	if err != nil {
+		return nil, err
+	}
+	c.SetAppAccessToken(token.Data.AccessToken)
+	return c, nil
+}
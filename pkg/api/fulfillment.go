@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/spotify"
+	"go.uber.org/zap"
+)
+
+// viewerErrors are the errors for requests that asked for something that can't be queued
+var viewerErrors = []error{
+	spotify.ErrInvalidInput,
+	spotify.ErrExplicitSong,
+	spotify.ErrSongTooLong,
+	spotify.ErrDuplicateSong,
+	spotify.ErrNoSearchMatch,
+	spotify.ErrBlockedSong,
+	spotify.ErrSongNotAllowed,
+	spotify.ErrUnresolvedLink,
+	spotify.ErrAlbumLink,
+	spotify.ErrPlaylistLink,
+	spotify.ErrArtistLink,
+	spotify.ErrPodcastLink,
+	spotify.ErrEmptyCollection,
+	spotify.ErrUnsupportedInput,
+	spotify.ErrUnsupportedLink,
+	spotify.ErrTranslateLink,
+	ErrNoCheerSong,
+}
+
+// refusedErrors are the errors for requests that were turned down before they were queued
+var refusedErrors = []error{
+	ErrViewerCooldown,
+	ErrViewerLimitReached,
+	ErrViewerTooManyPending,
+	ErrRequestRejected,
+	ErrRequestExpired,
+	ErrStreamOffline,
+	ErrViewerRolesUnknown,
+}
+
+// OutcomeOf sorts the result of handling a request into how it turned out
+func OutcomeOf(err error) requests.Outcome {
+	if err == nil {
+		return requests.OutcomeQueued
+	}
+	var notEligible *ViewerNotEligibleError
+	if errors.As(err, &notEligible) {
+		return requests.OutcomeRefused
+	}
+	for _, e := range refusedErrors {
+		if errors.Is(err, e) {
+			return requests.OutcomeRefused
+		}
+	}
+	for _, e := range viewerErrors {
+		if errors.Is(err, e) {
+			return requests.OutcomeViewerError
+		}
+	}
+	return requests.OutcomeSystemError
+}
+
+// RedemptionStatus decides what to do with a redemption under the fulfillment policy,
+// once the request turned out a certain way
+func RedemptionStatus(policy preferences.FulfillmentPolicy, outcome requests.Outcome) string {
+	if outcome == requests.OutcomeRefused {
+		return requests.RedemptionCanceled
+	}
+
+	switch policy {
+	case preferences.FulfillManually:
+		return requests.RedemptionUnfulfilled
+	case preferences.FulfillOnPlay:
+		if outcome == requests.OutcomeQueued {
+			return requests.RedemptionAwaitingPlay
+		}
+	case preferences.FulfillNoViewerRefunds:
+		if outcome == requests.OutcomeViewerError {
+			return requests.RedemptionFulfilled
+		}
+	}
+
+	if outcome == requests.OutcomeQueued {
+		return requests.RedemptionFulfilled
+	}
+	return requests.RedemptionCanceled
+}
+
+// settleRedemption decides what to do with the request's redemption. The decision is kept
+// on the request, so it has to be saved afterwards, and then carried out with
+// updateRedemption.
+func (h *RewardHandler) settleRedemption(req *requests.Request, pref *preferences.Preference, outcome requests.Outcome) {
+	if !req.IsRedemption() {
+		return
+	}
+	var policy preferences.FulfillmentPolicy
+	if pref != nil {
+		policy = pref.Fulfillment
+	}
+	req.Redemption = RedemptionStatus(policy, outcome)
+}
+
+// updateRedemption fulfills or refunds the request's redemption on Twitch, unless it was
+// left unfulfilled
+func (h *RewardHandler) updateRedemption(req *requests.Request) {
+	if !req.IsRedemption() || (req.Redemption != requests.RedemptionFulfilled && req.Redemption != requests.RedemptionCanceled) {
+		return
+	}
+	var err error
+	if h.OnSuccess != nil {
+		err = h.OnSuccess(h.config.Twitch, h.config.UserStore, redemptionFromRequest(req), req.Redemption == requests.RedemptionFulfilled)
+	} else {
+		err = h.UpdateRedemption(h.config.Twitch, h.config.UserStore, redemptionFromRequest(req), req.Redemption)
+	}
+	if err != nil {
+		// don't need to fail fast here because this is housekeeping
+		zap.L().Error("failed to update Twitch reward redemption status", zap.String("request", req.ID), zap.String("status", req.Redemption), zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+	}
+}
@@ -0,0 +1,212 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/spotify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutcomeOf(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected requests.Outcome
+	}{
+		{nil, requests.OutcomeQueued},
+		{spotify.ErrInvalidInput, requests.OutcomeViewerError},
+		{fmt.Errorf("%w: too long", spotify.ErrSongTooLong), requests.OutcomeViewerError},
+		{api.ErrRequestRejected, requests.OutcomeRefused},
+		{&api.ViewerNotEligibleError{}, requests.OutcomeRefused},
+		{fmt.Errorf("%w: oops", api.ErrViewerRolesUnknown), requests.OutcomeRefused},
+		{errors.New("spotify is down"), requests.OutcomeSystemError},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, api.OutcomeOf(test.err), test.err)
+	}
+}
+
+func TestRedemptionStatus(t *testing.T) {
+	tests := []struct {
+		policy   preferences.FulfillmentPolicy
+		outcome  requests.Outcome
+		expected string
+	}{
+		{preferences.FulfillImmediately, requests.OutcomeQueued, requests.RedemptionFulfilled},
+		{preferences.FulfillImmediately, requests.OutcomeViewerError, requests.RedemptionCanceled},
+		{preferences.FulfillImmediately, requests.OutcomeSystemError, requests.RedemptionCanceled},
+		{preferences.FulfillManually, requests.OutcomeQueued, requests.RedemptionUnfulfilled},
+		{preferences.FulfillManually, requests.OutcomeSystemError, requests.RedemptionUnfulfilled},
+		{preferences.FulfillOnPlay, requests.OutcomeQueued, requests.RedemptionAwaitingPlay},
+		{preferences.FulfillOnPlay, requests.OutcomeViewerError, requests.RedemptionCanceled},
+		{preferences.FulfillNoViewerRefunds, requests.OutcomeQueued, requests.RedemptionFulfilled},
+		{preferences.FulfillNoViewerRefunds, requests.OutcomeViewerError, requests.RedemptionFulfilled},
+		{preferences.FulfillNoViewerRefunds, requests.OutcomeSystemError, requests.RedemptionCanceled},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, api.RedemptionStatus(test.policy, test.outcome), "%s %s", test.policy, test.outcome)
+	}
+
+	// refused requests are refunded whatever the policy is
+	for _, policy := range preferences.FulfillmentPolicies {
+		assert.Equal(t, requests.RedemptionCanceled, api.RedemptionStatus(policy, requests.OutcomeRefused), policy)
+	}
+}
+
+func TestManualFulfillmentLeavesRedemption(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:    "12826",
+		Fulfillment: preferences.FulfillManually,
+	})
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return true, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+	go rh.FlushHeldRequests()
+
+	select {
+	case event := <-m:
+		assert.Equal(t, "some song", event)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	select {
+	case <-callbacks:
+		t.Error("should not have updated the redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+
+	r, err := reqs.GetRequest("held-1")
+	require.NoError(t, err)
+	assert.Equal(t, requests.StatusQueued, r.Status)
+	assert.Equal(t, requests.RedemptionUnfulfilled, r.Redemption)
+}
+
+func TestNoViewerRefundsKeepsPoints(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, spotify.ErrInvalidInput, &preferences.Preference{
+		TwitchID:    "12826",
+		Fulfillment: preferences.FulfillNoViewerRefunds,
+	})
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return true, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "not a song", now.Add(-time.Minute), now)
+	go rh.FlushHeldRequests()
+
+	select {
+	case fulfilled := <-callbacks:
+		assert.True(t, fulfilled)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not update the redemption in time")
+	}
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "held-1")() == requests.StatusFailed
+	}, testResponseTimeout, 10*time.Millisecond)
+}
+
+func TestDeprecatedOnSuccess(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil)
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return true, nil }
+	successes := make(chan bool, 1)
+	rh.OnSuccess = func(_ *util.AuthConfig, _ db.UserStore, _ *helix.EventSubChannelPointsCustomRewardRedemptionEvent, success bool) error {
+		successes <- success
+		return nil
+	}
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+	go rh.FlushHeldRequests()
+
+	select {
+	case <-m:
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	select {
+	case success := <-successes:
+		assert.True(t, success)
+	case <-callbacks:
+		t.Error("should have called OnSuccess instead")
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not update the redemption in time")
+	}
+}
+
+func TestFulfillOnPlay(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:    "12826",
+		Fulfillment: preferences.FulfillOnPlay,
+	})
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return true, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "held-1", "some song", now.Add(-time.Minute), now)
+	go rh.FlushHeldRequests()
+
+	select {
+	case <-m:
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	select {
+	case <-callbacks:
+		t.Error("should not fulfill the redemption before the song plays")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	r, err := reqs.GetRequest("held-1")
+	require.NoError(t, err)
+	assert.Equal(t, requests.RedemptionAwaitingPlay, r.Redemption)
+	assert.Equal(t, "something", r.TrackID)
+
+	// the song that the publisher queued starts playing
+	rh.NowPlaying = playing(&api.Playback{TrackID: "something", Playing: true, Duration: 3 * time.Minute})
+	go rh.PollPlayback("12826", []*requests.Request{r})
+	select {
+	case fulfilled := <-callbacks:
+		assert.True(t, fulfilled)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not fulfill the redemption in time")
+	}
+}
+
+func TestFulfillOnPlayExpires(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, nil)
+	rh.NowPlaying = playing(nil)
+
+	queuedAt := time.Now().Add(-api.PlayExpiry - time.Minute)
+	r := &requests.Request{
+		ID:            "queued-1",
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusQueued,
+		TrackID:       "something",
+		Redemption:    requests.RedemptionAwaitingPlay,
+		CreatedAt:     &queuedAt,
+		UpdatedAt:     &queuedAt,
+	}
+	require.NoError(t, reqs.AddRequest(r))
+
+	go rh.PollPlayback("12826", []*requests.Request{r})
+	select {
+	case fulfilled := <-callbacks:
+		assert.False(t, fulfilled)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not refund the redemption in time")
+	}
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "queued-1")() == requests.StatusSkipped
+	}, testResponseTimeout, 10*time.Millisecond)
+}
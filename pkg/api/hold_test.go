@@ -0,0 +1,221 @@
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func getHoldTestHandler(t *testing.T, publishErr error, prefs ...*preferences.Preference) (*api.RewardHandler, *testutil.InMemoryRequestStore, chan string, chan bool) {
+	t.Helper()
+	p := testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)}
+	for _, pref := range prefs {
+		assert.NoError(t, p.AddPreference(pref))
+	}
+	m := make(chan string)
+	u := testutil.InMemoryUserStore{Data: make(map[string]*users.User)}
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	callbacks := make(chan bool)
+	c := testutil.DummyCallback{CallbackExecuted: callbacks}
+
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:        dummySecret,
+		Publisher:     &testutil.DummyPublisher{Messages: m, Err: publishErr},
+		UserStore:     &u,
+		PrefStore:     &p,
+		MsgCount:      &testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)},
+		Requests:      &reqs,
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: db.NewInMemoryViewerRequestCounter(),
+		HoldExpiry:    time.Hour,
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
+	})
+	rh.UpdateRedemption = c.Callback
+	return rh, &reqs, m, callbacks
+}
+
+func addHeldRequest(t *testing.T, reqs *testutil.InMemoryRequestStore, id, input string, createdAt, heldAt time.Time) {
+	t.Helper()
+	err := reqs.AddRequest(&requests.Request{
+		ID:            id,
+		BroadcasterID: "12826",
+		RewardID:      "bcd-234",
+		UserID:        "1337",
+		Input:         input,
+		Status:        requests.StatusHeld,
+		CreatedAt:     &createdAt,
+		UpdatedAt:     &heldAt,
+	})
+	assert.NoError(t, err)
+}
+
+func requestStatus(reqs *testutil.InMemoryRequestStore, id string) func() string {
+	return func() string {
+		r, err := reqs.GetRequest(id)
+		if err != nil {
+			return ""
+		}
+		return r.Status
+	}
+}
+
+func TestHoldRequestWithoutActiveDevice(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, fmt.Errorf("%w: player closed", queue.ErrNoActiveDevice))
+
+	createdAt := time.Now().Add(-time.Second)
+	err := reqs.AddRequest(&requests.Request{
+		ID:            "abc-123",
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusRequested,
+		CreatedAt:     &createdAt,
+	})
+	assert.NoError(t, err)
+
+	rh.ResumeRequests()
+
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "abc-123")() == requests.StatusHeld
+	}, testResponseTimeout, 10*time.Millisecond)
+
+	select {
+	case <-callbacks:
+		t.Error("held request should not be refunded")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+}
+
+func TestFlushHeldRequests(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil)
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return true, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "second", "second song", now.Add(-time.Minute), now)
+	addHeldRequest(t, reqs, "first", "first song", now.Add(-2*time.Minute), now)
+
+	go rh.FlushHeldRequests()
+
+	for _, expected := range []string{"first song", "second song"} {
+		select {
+		case event := <-m:
+			assert.Equal(t, expected, event)
+		case <-time.After(testResponseTimeout):
+			t.Fatal("did not receive message in time")
+		}
+		select {
+		case status := <-callbacks:
+			assert.True(t, status)
+		case <-time.After(testResponseTimeout):
+			t.Fatal("did not receive message in time")
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "second")() == requests.StatusQueued
+	}, testResponseTimeout, 10*time.Millisecond)
+	assert.Equal(t, requests.StatusQueued, requestStatus(reqs, "first")())
+}
+
+func TestFlushHeldRequestsNoActiveDevice(t *testing.T) {
+	rh, reqs, m, _ := getHoldTestHandler(t, nil)
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return false, nil }
+
+	now := time.Now()
+	addHeldRequest(t, reqs, "abc-123", "some song", now.Add(-time.Minute), now)
+
+	rh.FlushHeldRequests()
+
+	select {
+	case <-m:
+		t.Error("should not have queued the request")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+	assert.Equal(t, requests.StatusHeld, requestStatus(reqs, "abc-123")())
+}
+
+func TestExpireHeldRequests(t *testing.T) {
+	rh, reqs, _, callbacks := getHoldTestHandler(t, nil)
+	rh.ActiveDevice = func(context.Context, string) (bool, error) { return false, nil }
+
+	old := time.Now().Add(-2 * time.Hour)
+	addHeldRequest(t, reqs, "abc-123", "some song", old, old)
+
+	go rh.FlushHeldRequests()
+
+	select {
+	case status := <-callbacks:
+		assert.False(t, status)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	assert.Equal(t, requests.StatusExpired, requestStatus(reqs, "abc-123")())
+}
+
+// changedRequestStore fails to move any request along, like when something else
+// handled it first
+type changedRequestStore struct {
+	testutil.InMemoryRequestStore
+}
+
+func (s *changedRequestStore) TransitionRequest(*requests.Request, string) error {
+	return db.ErrRequestChanged
+}
+
+func TestHoldBehindHeldRequestsChanged(t *testing.T) {
+	reqs := changedRequestStore{testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}}
+	counter := db.NewInMemoryViewerRequestCounter()
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:        dummySecret,
+		Publisher:     &testutil.DummyPublisher{Messages: make(chan string)},
+		UserStore:     &testutil.InMemoryUserStore{Data: make(map[string]*users.User)},
+		PrefStore:     &testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)},
+		MsgCount:      &testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)},
+		Requests:      &reqs,
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: counter,
+		HoldExpiry:    time.Hour,
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
+	})
+
+	now := time.Now()
+	addHeldRequest(t, &reqs.InMemoryRequestStore, "held", "held song", now.Add(-time.Minute), now)
+	assert.NoError(t, reqs.AddRequest(&requests.Request{
+		ID:            "abc-123",
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusRequested,
+		CreatedAt:     &now,
+	}))
+
+	rh.ResumeRequests()
+
+	// the request wasn't held, so it doesn't count against the viewer
+	assert.Never(t, func() bool {
+		return len(counter.ViewerRequestsSince("12826", "1337", now.Add(-time.Hour))) > 0
+	}, testResponseTimeout, 10*time.Millisecond)
+}
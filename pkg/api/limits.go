@@ -0,0 +1,89 @@
+package api
+
+import (
+	"errors"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+// viewerLimitWindow is the window that the per-viewer request limit applies to
+const viewerLimitWindow = 24 * time.Hour
+
+// outstandingStatuses are the statuses of requests that haven't reached the queue yet
+var outstandingStatuses = []string{
+	requests.StatusRequested,
+	requests.StatusPending,
+	requests.StatusApproved,
+	requests.StatusHeld,
+}
+
+var (
+	ErrViewerCooldown       = errors.New("viewer requested a song too recently")
+	ErrViewerLimitReached   = errors.New("viewer has reached their request limit")
+	ErrViewerTooManyPending = errors.New("viewer has too many requests waiting to be queued")
+)
+
+// CheckViewerLimits verifies that the viewer is allowed to make the request, based on
+// the per-viewer limits in the broadcaster's preferences.
+func CheckViewerLimits(counter db.ViewerRequestCounter,
+	reqs db.RequestStore,
+	streams db.StreamStore,
+	p *preferences.Preference,
+	req *requests.Request,
+	now time.Time) error {
+	if p == nil {
+		return nil
+	}
+	broadcasterID, viewerID := req.BroadcasterID, req.UserID
+
+	if p.ViewerCooldown > 0 {
+		cooldown := time.Duration(p.ViewerCooldown) * time.Second
+		if len(counter.ViewerRequestsSince(broadcasterID, viewerID, now.Add(-cooldown))) > 0 {
+			return ErrViewerCooldown
+		}
+	}
+
+	if p.ViewerRequestLimit > 0 {
+		if len(counter.ViewerRequestsSince(broadcasterID, viewerID, limitWindowStart(streams, p, broadcasterID, now))) >= p.ViewerRequestLimit {
+			return ErrViewerLimitReached
+		}
+	}
+
+	if p.ViewerMaxPending > 0 {
+		count, err := reqs.CountViewerRequests(broadcasterID, viewerID, req.ID, outstandingStatuses)
+		if err != nil {
+			// don't punish the viewer if we can't tell
+			zap.L().Error("failed to count outstanding requests", zap.String("id", broadcasterID), zap.String("user", viewerID), zap.Error(err))
+			return nil
+		}
+		if count >= p.ViewerMaxPending {
+			return ErrViewerTooManyPending
+		}
+	}
+
+	return nil
+}
+
+// limitWindowStart finds when the viewer's requests start counting towards the request
+// limit. That is the last day, or with ViewerLimitPerStream, the stream that is live.
+// Requests are only remembered for a day, so long streams still count the last day.
+func limitWindowStart(streams db.StreamStore, p *preferences.Preference, broadcasterID string, now time.Time) time.Time {
+	since := now.Add(-viewerLimitWindow)
+	if !p.ViewerLimitPerStream {
+		return since
+	}
+
+	s, err := streams.LatestStream(broadcasterID)
+	if err != nil {
+		zap.L().Error("failed to get the latest stream", zap.String("id", broadcasterID), zap.Error(err))
+		return since
+	}
+	if s != nil && s.IsLive() && s.StartedAt != nil && s.StartedAt.After(since) {
+		return *s.StartedAt
+	}
+	return since
+}
@@ -0,0 +1,96 @@
+package api_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"github.com/stretchr/testify/assert"
+)
+
+func viewerRequest(broadcasterID, viewerID string) *requests.Request {
+	return &requests.Request{ID: "new", BroadcasterID: broadcasterID, UserID: viewerID, Status: requests.StatusRequested}
+}
+
+func TestCheckViewerLimitsNoPreferences(t *testing.T) {
+	counter := db.NewInMemoryViewerRequestCounter()
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	counter.AddViewerRequest("12345", "1337", time.Now())
+
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, nil, viewerRequest("12345", "1337"), time.Now()))
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &preferences.Preference{}, viewerRequest("12345", "1337"), time.Now()))
+}
+
+func TestCheckViewerLimitsCooldown(t *testing.T) {
+	counter := db.NewInMemoryViewerRequestCounter()
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	p := preferences.Preference{TwitchID: "12345", ViewerCooldown: 300}
+	now := time.Now()
+
+	counter.AddViewerRequest("12345", "1337", now.Add(-time.Minute))
+	assert.ErrorIs(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("12345", "1337"), now), api.ErrViewerCooldown)
+	// other viewers and other channels are unaffected
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("12345", "7331"), now))
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("54321", "1337"), now))
+	// cooldown is over
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("12345", "1337"), now.Add(5*time.Minute)))
+}
+
+func TestCheckViewerLimitsDailyLimit(t *testing.T) {
+	counter := db.NewInMemoryViewerRequestCounter()
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	p := preferences.Preference{TwitchID: "12345", ViewerRequestLimit: 2}
+	now := time.Now()
+
+	counter.AddViewerRequest("12345", "1337", now.Add(-25*time.Hour))
+	counter.AddViewerRequest("12345", "1337", now.Add(-2*time.Hour))
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("12345", "1337"), now))
+
+	counter.AddViewerRequest("12345", "1337", now.Add(-time.Hour))
+	assert.ErrorIs(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, viewerRequest("12345", "1337"), now), api.ErrViewerLimitReached)
+}
+
+func TestCheckViewerLimitsPerStream(t *testing.T) {
+	counter := db.NewInMemoryViewerRequestCounter()
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	ss := testutil.InMemoryStreamStore{Data: make(map[string][]*streams.Stream)}
+	p := preferences.Preference{TwitchID: "12345", ViewerRequestLimit: 1, ViewerLimitPerStream: true}
+	now := time.Now()
+
+	// requested during the last stream
+	counter.AddViewerRequest("12345", "1337", now.Add(-3*time.Hour))
+	startedAt := now.Add(-time.Hour)
+	assert.NoError(t, ss.StartStream(&streams.Stream{ID: "stream-1", BroadcasterID: "12345", StartedAt: &startedAt}))
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &ss, &p, viewerRequest("12345", "1337"), now))
+
+	counter.AddViewerRequest("12345", "1337", now.Add(-time.Minute))
+	assert.ErrorIs(t, api.CheckViewerLimits(counter, &reqs, &ss, &p, viewerRequest("12345", "1337"), now), api.ErrViewerLimitReached)
+
+	// offline, the limit is per day
+	assert.NoError(t, ss.EndStream("12345", now))
+	counter = db.NewInMemoryViewerRequestCounter()
+	counter.AddViewerRequest("12345", "1337", now.Add(-3*time.Hour))
+	assert.ErrorIs(t, api.CheckViewerLimits(counter, &reqs, &ss, &p, viewerRequest("12345", "1337"), now), api.ErrViewerLimitReached)
+}
+
+func TestCheckViewerLimitsPending(t *testing.T) {
+	counter := db.NewInMemoryViewerRequestCounter()
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	p := preferences.Preference{TwitchID: "12345", ViewerMaxPending: 2}
+	req := viewerRequest("12345", "1337")
+
+	// the request being checked, and requests that were queued, don't count
+	assert.NoError(t, reqs.AddRequest(req))
+	assert.NoError(t, reqs.AddRequest(&requests.Request{ID: "abc", BroadcasterID: "12345", UserID: "7331", Status: requests.StatusPending}))
+	assert.NoError(t, reqs.AddRequest(&requests.Request{ID: "bcd", BroadcasterID: "12345", UserID: "1337", Status: requests.StatusQueued}))
+	assert.NoError(t, reqs.AddRequest(&requests.Request{ID: "cde", BroadcasterID: "12345", UserID: "1337", Status: requests.StatusApproved}))
+	assert.NoError(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, req, time.Now()))
+
+	assert.NoError(t, reqs.AddRequest(&requests.Request{ID: "def", BroadcasterID: "12345", UserID: "1337", Status: requests.StatusHeld}))
+	assert.ErrorIs(t, api.CheckViewerLimits(counter, &reqs, &db.NoopStreamStore{}, &p, req, time.Now()), api.ErrViewerTooManyPending)
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+const (
+	PendingFormRequestKey = "request"
+	// PendingRequestTTL is how long a request can wait for approval before it
+	// expires and gets refunded.
+	PendingRequestTTL = time.Hour
+)
+
+// PendingRequestHandler lets the broadcaster and their moderators review
+// requests that are waiting for approval.
+type PendingRequestHandler struct {
+	rewards     *RewardHandler
+	redirectURL string
+}
+
+func NewPendingRequestHandler(rh *RewardHandler, redirectURL string) *PendingRequestHandler {
+	return &PendingRequestHandler{
+		rewards:     rh,
+		redirectURL: redirectURL,
+	}
+}
+
+// ApproveRequest hands the pending request off to be sent to the broadcaster's Spotify queue
+func (h *PendingRequestHandler) ApproveRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.reviewRequest(w, r)
+	if !ok {
+		return
+	}
+	userID := req.BroadcasterID
+
+	// another moderator, or the expiry, may have gotten to it first
+	if h.rewards.transition(req, requests.StatusApproved) {
+		h.rewards.submit(req)
+	}
+
+	http.Redirect(w, r, h.pendingPageURL(userID), http.StatusFound)
+}
+
+// RejectRequest drops the pending request, and refunds the viewer
+func (h *PendingRequestHandler) RejectRequest(w http.ResponseWriter, r *http.Request) {
+	req, ok := h.reviewRequest(w, r)
+	if !ok {
+		return
+	}
+
+	h.rewards.refund(req, requests.StatusRejected, requests.OutcomeRefused)
+
+	http.Redirect(w, r, h.pendingPageURL(req.BroadcasterID), http.StatusFound)
+}
+
+// ExpireRequests refunds all of the pending requests that were not reviewed in time
+func (h *PendingRequestHandler) ExpireRequests() {
+	stale, err := h.rewards.config.Requests.StaleRequests(requests.StatusPending, time.Now().Add(-PendingRequestTTL))
+	if err != nil {
+		zap.L().Error("failed to get stale requests", zap.Error(err))
+		return
+	}
+
+	for _, req := range stale {
+		h.rewards.refund(req, requests.StatusExpired, requests.OutcomeRefused)
+	}
+}
+
+// StartExpiry periodically expires pending requests in the background
+func (h *PendingRequestHandler) StartExpiry(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.ExpireRequests()
+		}
+	}()
+}
+
+// reviewRequest reads the pending request out of the submitted form, and verifies
+// that the current user is allowed to review it.
+func (h *PendingRequestHandler) reviewRequest(w http.ResponseWriter, r *http.Request) (*requests.Request, bool) {
+	userID, err := util.GetUserIDFromRequest(r)
+	if err != nil {
+		zap.L().Error("failed to get Twitch ID from request", zap.Error(err))
+		http.Redirect(w, r, h.redirectURL, http.StatusFound)
+		return nil, false
+	}
+
+	if err = r.ParseForm(); err != nil {
+		zap.L().Error("failed to parse HTML form", zap.Error(err))
+		http.Redirect(w, r, h.redirectURL, http.StatusFound)
+		return nil, false
+	}
+
+	config := h.rewards.config
+	req, err := config.Requests.GetRequest(r.Form.Get(PendingFormRequestKey))
+	if err != nil || req == nil {
+		zap.L().Error("failed to get request", zap.String("request", r.Form.Get(PendingFormRequestKey)), zap.Error(err))
+		http.Redirect(w, r, h.redirectURL, http.StatusFound)
+		return nil, false
+	}
+
+	allowed, err := util.CanManageRequests(config.Twitch, config.UserStore, req.BroadcasterID, userID)
+	if err != nil {
+		zap.L().Error("failed to verify moderator", zap.String("id", req.BroadcasterID), zap.String("user", userID), zap.Error(err))
+	}
+	if !allowed {
+		zap.L().Warn("user is not allowed to review requests", zap.String("id", req.BroadcasterID), zap.String("user", userID))
+		w.WriteHeader(http.StatusForbidden)
+		return nil, false
+	}
+
+	if req.Status != requests.StatusPending {
+		zap.L().Debug("request was already reviewed", zap.String("request", req.ID), zap.String("status", req.Status))
+		http.Redirect(w, r, h.pendingPageURL(req.BroadcasterID), http.StatusFound)
+		return nil, false
+	}
+
+	return req, true
+}
+
+func (h *PendingRequestHandler) pendingPageURL(broadcasterID string) string {
+	return fmt.Sprintf("%s/pending/%s", h.redirectURL, base64.StdEncoding.EncodeToString([]byte(broadcasterID)))
+}
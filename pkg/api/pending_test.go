@@ -0,0 +1,168 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/constants"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReviewRequest(t *testing.T, path, userID, requestID string) *http.Request {
+	t.Helper()
+	form := url.Values{api.PendingFormRequestKey: {requestID}}
+	req, err := http.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue(userID),
+	})
+	return req
+}
+
+func addPendingRequest(t *testing.T, store interface{ AddRequest(*requests.Request) error }, createdAt time.Time) {
+	t.Helper()
+	err := store.AddRequest(&requests.Request{
+		ID:            "abc-123",
+		BroadcasterID: "12826",
+		RewardID:      "bcd-234",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusPending,
+		CreatedAt:     &createdAt,
+	})
+	assert.NoError(t, err)
+}
+
+func TestApprovePendingRequest(t *testing.T) {
+	rh, u, prefs, counter, reqs, m, callbacks := getTestRewardHandler(true)
+	ph := api.NewPendingRequestHandler(rh, "http://localhost")
+
+	err := u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	})
+	assert.NoError(t, err)
+	err = prefs.AddPreference(&preferences.Preference{
+		TwitchID:  "12826",
+		Moderated: true,
+	})
+	assert.NoError(t, err)
+	addPendingRequest(t, reqs, time.Now())
+
+	rr := httptest.NewRecorder()
+	req := newReviewRequest(t, "/pending/approve", "12826", "abc-123")
+
+	go func() {
+		http.HandlerFunc(ph.ApproveRequest).ServeHTTP(rr, req)
+	}()
+
+	select {
+	case event := <-m:
+		assert.Equal(t, "some song", event)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	select {
+	case status := <-callbacks:
+		assert.True(t, status)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	approved, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusQueued, approved.Status)
+	assert.Len(t, counter.Msgs, 1)
+	assert.Equal(t, 1, counter.Msgs[0].Success)
+}
+
+func TestRejectPendingRequest(t *testing.T) {
+	rh, _, _, counter, reqs, m, callbacks := getTestRewardHandler(true)
+	ph := api.NewPendingRequestHandler(rh, "http://localhost")
+
+	addPendingRequest(t, reqs, time.Now())
+
+	rr := httptest.NewRecorder()
+	req := newReviewRequest(t, "/pending/reject", "12826", "abc-123")
+
+	go func() {
+		http.HandlerFunc(ph.RejectRequest).ServeHTTP(rr, req)
+	}()
+
+	select {
+	case <-m:
+		t.Error("should not have queued a rejected request")
+	case status := <-callbacks:
+		assert.False(t, status)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	rejected, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusRejected, rejected.Status)
+	assert.Empty(t, counter.Msgs)
+}
+
+func TestReviewPendingRequestNotAllowed(t *testing.T) {
+	rh, _, _, _, reqs, m, callbacks := getTestRewardHandler(true)
+	ph := api.NewPendingRequestHandler(rh, "http://localhost")
+
+	addPendingRequest(t, reqs, time.Now())
+
+	rr := httptest.NewRecorder()
+	// the broadcaster isn't stored, so the moderator check can't pass either
+	req := newReviewRequest(t, "/pending/approve", "99999", "abc-123")
+
+	go func() {
+		http.HandlerFunc(ph.ApproveRequest).ServeHTTP(rr, req)
+	}()
+
+	select {
+	case <-m:
+		t.Error("should not have queued the request")
+	case <-callbacks:
+		t.Error("should not have updated the redemption")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	pending, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusPending, pending.Status)
+}
+
+func TestExpirePendingRequests(t *testing.T) {
+	rh, _, _, _, reqs, _, callbacks := getTestRewardHandler(true)
+	ph := api.NewPendingRequestHandler(rh, "http://localhost")
+
+	addPendingRequest(t, reqs, time.Now().Add(-2*api.PendingRequestTTL))
+
+	go ph.ExpireRequests()
+
+	select {
+	case status := <-callbacks:
+		assert.False(t, status)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+
+	expired, err := reqs.GetRequest("abc-123")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusExpired, expired.Status)
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/zmb3/spotify/v2"
+	"go.uber.org/zap"
+)
+
+const (
+	// PlayExpiry is how long a queued song has to start playing. Songs that don't, like ones
+	// that were removed from the queue, were skipped, and the redemptions that wait for them
+	// to play are refunded.
+	PlayExpiry = 3 * time.Hour
+	// MinPlaybackInterval and MaxPlaybackInterval bound how long the watcher waits between
+	// checks of a broadcaster's player. While a song plays, the next check is right after it
+	// ends, so that the next request is seen starting.
+	MinPlaybackInterval = 5 * time.Second
+	MaxPlaybackInterval = 30 * time.Second
+	// SkipTolerance is how much of a song can be left when it stops playing, for it to still
+	// count as played
+	SkipTolerance = 10 * time.Second
+	// SpotifyRefreshMargin is how long before its token expires that the client used to
+	// check a broadcaster's player is set up again, which refreshes and saves the token
+	SpotifyRefreshMargin = 5 * time.Minute
+)
+
+// Playback is what is on the broadcaster's Spotify player
+type Playback struct {
+	TrackID  string
+	Playing  bool
+	Progress time.Duration
+	Duration time.Duration
+}
+
+// playbackWatch remembers what was last seen on each broadcaster's player, and when to
+// check it again
+type playbackWatch struct {
+	mu     sync.Mutex
+	states map[string]*playbackState
+}
+
+type playbackState struct {
+	next   time.Time
+	seen   *Playback
+	seenAt time.Time
+	// client is reused between checks until its token is about to expire
+	client *spotify.Client
+	expiry time.Time
+}
+
+func newPlaybackWatch() *playbackWatch {
+	return &playbackWatch{states: make(map[string]*playbackState)}
+}
+
+func (w *playbackWatch) state(broadcasterID string) *playbackState {
+	s, ok := w.states[broadcasterID]
+	if !ok {
+		s = &playbackState{}
+		w.states[broadcasterID] = s
+	}
+	return s
+}
+
+// watchedStatuses are the requests whose songs are on the broadcaster's player
+var watchedStatuses = []string{requests.StatusPlaying, requests.StatusQueued}
+
+// WatchPlayback checks the player of each broadcaster with requests that were sent to it,
+// when it is due, and moves the requests along as their songs play.
+func (h *RewardHandler) WatchPlayback() {
+	ids, err := h.config.Requests.BroadcastersWithRequests(watchedStatuses)
+	if err != nil {
+		zap.L().Error("failed to get broadcasters to watch", zap.Error(err))
+		return
+	}
+	watched := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		watched[id] = true
+	}
+
+	now := time.Now()
+	h.playback.mu.Lock()
+	for id := range h.playback.states {
+		if !watched[id] {
+			// nothing left to watch
+			delete(h.playback.states, id)
+		}
+	}
+	due := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !now.Before(h.playback.state(id).next) {
+			due = append(due, id)
+		}
+	}
+	h.playback.mu.Unlock()
+
+	for _, id := range due {
+		next := MaxPlaybackInterval
+		if reqs := h.watchedRequests(id); len(reqs) > 0 {
+			next = h.PollPlayback(id, reqs)
+		}
+		h.playback.mu.Lock()
+		h.playback.state(id).next = time.Now().Add(next)
+		h.playback.mu.Unlock()
+	}
+}
+
+// watchedRequests gets the broadcaster's requests whose songs are on their player
+func (h *RewardHandler) watchedRequests(broadcasterID string) []*requests.Request {
+	reqs, err := h.config.Requests.OpenRequests(broadcasterID, watchedStatuses)
+	if err != nil {
+		zap.L().Error("failed to get requests to watch", zap.String("id", broadcasterID), zap.Error(err))
+		return nil
+	}
+	// requests queued before songs were tracked can't be matched to the player
+	return slices.DeleteFunc(reqs, func(req *requests.Request) bool {
+		return req.TrackID == ""
+	})
+}
+
+// StartPlaybackWatch periodically watches the broadcasters' players in the background.
+// Each player is checked as often as its songs need, which is never more often than the
+// interval.
+func (h *RewardHandler) StartPlaybackWatch(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			h.WatchPlayback()
+		}
+	}()
+}
+
+// PollPlayback checks the broadcaster's player once, and moves their queued and playing
+// requests along: queued songs that start are playing, and playing songs that stop are
+// played or skipped, depending on how much of them was left. It returns how long to wait
+// before checking again.
+func (h *RewardHandler) PollPlayback(broadcasterID string, reqs []*requests.Request) time.Duration {
+	current, err := h.NowPlaying(context.Background(), broadcasterID)
+	if err != nil {
+		zap.L().Error("failed to get the currently playing song", zap.String("id", broadcasterID), zap.Error(err))
+		return MaxPlaybackInterval
+	}
+
+	now := time.Now()
+	h.playback.mu.Lock()
+	state := h.playback.state(broadcasterID)
+	seen, seenAt := state.seen, state.seenAt
+	state.seen, state.seenAt = current, now
+	h.playback.mu.Unlock()
+
+	// the song that is playing finishes before the next one starts, and the same song
+	// requested twice starts the oldest request
+	reqs = slices.Clone(reqs)
+	slices.SortStableFunc(reqs, func(a, b *requests.Request) int {
+		if pa, pb := a.Status == requests.StatusPlaying, b.Status == requests.StatusPlaying; pa != pb {
+			if pa {
+				return -1
+			}
+			return 1
+		}
+		if a.CreatedAt == nil || b.CreatedAt == nil {
+			return 0
+		}
+		return a.CreatedAt.Compare(*b.CreatedAt)
+	})
+
+	onPlayer := current != nil && current.TrackID != ""
+	started := false
+	cutoff := now.Add(-PlayExpiry)
+	for _, req := range reqs {
+		var status string
+		redemption := req.Redemption
+		switch {
+		case req.Status == requests.StatusPlaying && onPlayer && req.TrackID == current.TrackID:
+			// still playing, or paused
+			started = true
+			continue
+		case req.Status == requests.StatusPlaying && playedToEnd(seen, seenAt, req.TrackID, now):
+			status = requests.StatusPlayed
+		case req.Status == requests.StatusPlaying:
+			status = requests.StatusSkipped
+		case !started && onPlayer && current.Playing && req.TrackID == current.TrackID:
+			started = true
+			status = requests.StatusPlaying
+			req.PlayedAt = &now
+			if req.Redemption == requests.RedemptionAwaitingPlay {
+				req.Redemption = requests.RedemptionFulfilled
+			}
+		case req.UpdatedAt != nil && req.UpdatedAt.Before(cutoff):
+			// never started, like when it was taken out of the queue
+			status = requests.StatusSkipped
+			if req.Redemption == requests.RedemptionAwaitingPlay {
+				req.Redemption = requests.RedemptionCanceled
+			}
+		default:
+			continue
+		}
+
+		if !h.transition(req, status) {
+			req.Redemption = redemption
+			continue
+		}
+		zap.L().Info("Updated song request playback",
+			zap.String("request", req.ID),
+			zap.String("status", req.Status),
+			zap.String("user", req.UserName),
+			zap.String("track", req.TrackID),
+			zap.String("id", broadcasterID),
+			zap.String("broadcaster", req.BroadcasterLogin))
+		if req.Redemption != redemption {
+			h.updateRedemption(req)
+		}
+	}
+
+	if current == nil || !current.Playing {
+		return MaxPlaybackInterval
+	}
+	next := current.Duration - current.Progress + time.Second
+	return min(max(next, MinPlaybackInterval), MaxPlaybackInterval)
+}
+
+// playedToEnd checks if the song played until the end, going by how much of it was left
+// when the player was last checked. Songs that weren't seen on the player, like after a
+// restart, count as played.
+func playedToEnd(seen *Playback, seenAt time.Time, trackID string, now time.Time) bool {
+	if seen == nil || seen.TrackID != trackID {
+		return true
+	}
+	left := seen.Duration - seen.Progress
+	if seen.Playing {
+		left -= now.Sub(seenAt)
+	}
+	return left <= SkipTolerance
+}
+
+// nowPlaying finds what is on the broadcaster's Spotify player, or nil if there is nothing
+func (h *RewardHandler) nowPlaying(ctx context.Context, broadcasterID string) (*Playback, error) {
+	c, err := h.playbackClient(ctx, broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := c.PlayerCurrentlyPlaying(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Item == nil {
+		return nil, nil
+	}
+	return &Playback{
+		TrackID:  current.Item.ID.String(),
+		Playing:  current.Playing,
+		Progress: time.Duration(current.Progress) * time.Millisecond,
+		Duration: current.Item.TimeDuration(),
+	}, nil
+}
+
+// playbackClient gets a Spotify client for the broadcaster, reusing the one from the last
+// check of their player, so that their token is only refreshed and saved when it is about
+// to expire rather than on every check
+func (h *RewardHandler) playbackClient(ctx context.Context, broadcasterID string) (*spotify.Client, error) {
+	h.playback.mu.Lock()
+	state := h.playback.state(broadcasterID)
+	c, expiry := state.client, state.expiry
+	h.playback.mu.Unlock()
+	if c != nil && time.Until(expiry) > SpotifyRefreshMargin {
+		return c, nil
+	}
+
+	c, err := util.GetSpotifyClientForUser(ctx, h.config.UserStore, h.config.Spotify, broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+	tok, err := c.Token()
+	if err != nil {
+		// the client still works, it just can't be reused
+		zap.L().Warn("failed to get Spotify token", zap.String("id", broadcasterID), zap.Error(err))
+		return c, nil
+	}
+	h.playback.mu.Lock()
+	state = h.playback.state(broadcasterID)
+	state.client, state.expiry = c, tok.Expiry
+	h.playback.mu.Unlock()
+	return c, nil
+}
@@ -0,0 +1,148 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func playing(p *api.Playback) func(context.Context, string) (*api.Playback, error) {
+	return func(context.Context, string) (*api.Playback, error) {
+		return p, nil
+	}
+}
+
+func addQueuedRequest(t *testing.T, reqs *testutil.InMemoryRequestStore, id, trackID string, queuedAt time.Time) *requests.Request {
+	t.Helper()
+	r := &requests.Request{
+		ID:            id,
+		BroadcasterID: "12826",
+		UserID:        "1337",
+		Input:         "some song",
+		Status:        requests.StatusQueued,
+		TrackID:       trackID,
+		// already fulfilled once queued, so following the song doesn't change it
+		Redemption: requests.RedemptionFulfilled,
+		CreatedAt:  &queuedAt,
+		UpdatedAt:  &queuedAt,
+	}
+	require.NoError(t, reqs.AddRequest(r))
+	return r
+}
+
+func TestPlaybackLifecycle(t *testing.T) {
+	rh, reqs, _, _ := getHoldTestHandler(t, nil)
+
+	now := time.Now()
+	first := addQueuedRequest(t, reqs, "first", "track-a", now.Add(-2*time.Minute))
+	second := addQueuedRequest(t, reqs, "second", "track-b", now.Add(-time.Minute))
+	third := addQueuedRequest(t, reqs, "third", "track-c", now)
+	watched := []*requests.Request{first, second, third}
+
+	rh.NowPlaying = playing(&api.Playback{TrackID: "track-a", Playing: true, Progress: time.Minute, Duration: 3 * time.Minute})
+	rh.PollPlayback("12826", watched)
+	assert.Equal(t, requests.StatusPlaying, first.Status)
+	assert.NotNil(t, first.PlayedAt)
+	assert.Equal(t, requests.StatusQueued, second.Status)
+
+	// the first song had two minutes left, so it was skipped
+	rh.NowPlaying = playing(&api.Playback{TrackID: "track-b", Playing: true, Progress: 3*time.Minute - 5*time.Second, Duration: 3 * time.Minute})
+	rh.PollPlayback("12826", watched)
+	assert.Equal(t, requests.StatusSkipped, first.Status)
+	assert.Equal(t, requests.StatusPlaying, second.Status)
+
+	// the second song was nearly over, so it played
+	rh.NowPlaying = playing(&api.Playback{TrackID: "track-c", Playing: true, Duration: 3 * time.Minute})
+	rh.PollPlayback("12826", watched)
+	assert.Equal(t, requests.StatusPlayed, second.Status)
+	assert.Equal(t, requests.StatusPlaying, third.Status)
+
+	// pausing doesn't end the song
+	rh.NowPlaying = playing(&api.Playback{TrackID: "track-c", Progress: time.Minute, Duration: 3 * time.Minute})
+	rh.PollPlayback("12826", watched)
+	assert.Equal(t, requests.StatusPlaying, third.Status)
+
+	// the redemptions were already fulfilled
+	for _, r := range watched {
+		assert.Equal(t, requests.RedemptionFulfilled, r.Redemption)
+	}
+}
+
+func TestPlaybackSameSongTwice(t *testing.T) {
+	rh, reqs, _, _ := getHoldTestHandler(t, nil)
+
+	now := time.Now()
+	first := addQueuedRequest(t, reqs, "first", "track-a", now.Add(-time.Minute))
+	second := addQueuedRequest(t, reqs, "second", "track-a", now)
+	watched := []*requests.Request{second, first}
+
+	rh.NowPlaying = playing(&api.Playback{TrackID: "track-a", Playing: true, Duration: 3 * time.Minute})
+	rh.PollPlayback("12826", watched)
+	rh.PollPlayback("12826", watched)
+	assert.Equal(t, requests.StatusPlaying, first.Status)
+	assert.Equal(t, requests.StatusQueued, second.Status)
+}
+
+func TestPollPlaybackInterval(t *testing.T) {
+	rh, _, _, _ := getHoldTestHandler(t, nil)
+
+	tests := []struct {
+		playback *api.Playback
+		expected time.Duration
+	}{
+		{&api.Playback{TrackID: "track-a", Playing: true, Progress: 2 * time.Minute, Duration: 2*time.Minute + 20*time.Second}, 21 * time.Second},
+		{&api.Playback{TrackID: "track-a", Playing: true, Progress: 2 * time.Minute, Duration: 2*time.Minute + time.Second}, api.MinPlaybackInterval},
+		{&api.Playback{TrackID: "track-a", Playing: true, Duration: 3 * time.Minute}, api.MaxPlaybackInterval},
+		{&api.Playback{TrackID: "track-a", Duration: 3 * time.Minute}, api.MaxPlaybackInterval},
+		{nil, api.MaxPlaybackInterval},
+	}
+	for _, test := range tests {
+		rh.NowPlaying = playing(test.playback)
+		assert.Equal(t, test.expected, rh.PollPlayback("12826", nil))
+	}
+
+	rh.NowPlaying = func(context.Context, string) (*api.Playback, error) { return nil, errors.New("oops") }
+	assert.Equal(t, api.MaxPlaybackInterval, rh.PollPlayback("12826", nil))
+}
+
+func TestWatchPlayback(t *testing.T) {
+	rh, reqs, _, _ := getHoldTestHandler(t, nil)
+
+	now := time.Now()
+	queued := addQueuedRequest(t, reqs, "queued", "track-a", now)
+	// requests from before songs were tracked are left alone
+	legacy := addQueuedRequest(t, reqs, "legacy", "", now)
+
+	polls := 0
+	rh.NowPlaying = func(context.Context, string) (*api.Playback, error) {
+		polls++
+		return &api.Playback{TrackID: "track-a", Playing: true, Duration: 3 * time.Minute}, nil
+	}
+
+	rh.WatchPlayback()
+	assert.Equal(t, 1, polls)
+	assert.Equal(t, requests.StatusPlaying, queued.Status)
+	assert.Equal(t, requests.StatusQueued, legacy.Status)
+
+	// the player isn't checked again until the song is due to end
+	rh.WatchPlayback()
+	assert.Equal(t, 1, polls)
+}
+
+func TestWatchPlaybackOldRequests(t *testing.T) {
+	rh, reqs, _, _ := getHoldTestHandler(t, nil)
+	rh.NowPlaying = playing(nil)
+
+	// long past the play expiry, but still waiting for its song
+	old := addQueuedRequest(t, reqs, "old", "track-a", time.Now().Add(-3*api.PlayExpiry))
+
+	rh.WatchPlayback()
+	assert.Equal(t, requests.StatusSkipped, old.Status)
+}
@@ -3,16 +3,63 @@ package api
 import (
 	"log"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"go.uber.org/zap"
 )
 
 const (
 	PrefFormExplicitKey   = "explicit"
+	PrefFormCleanKey      = "clean-substitute"
 	PrefFormSongLengthKey = "song-length"
+	PrefFormModeratedKey  = "moderated"
+	// per-viewer limits, where 0 means there is no limit
+	PrefFormViewerCooldownKey  = "viewer-cooldown"
+	PrefFormViewerLimitKey     = "viewer-request-limit"
+	PrefFormViewerPerStreamKey = "viewer-limit-per-stream"
+	PrefFormViewerPendingKey   = "viewer-max-pending"
+	PrefFormDuplicateKey       = "duplicate-window"
+	// block and allow lists, with one entry per line
+	PrefFormBlockedTracksKey   = "blocked-tracks"
+	PrefFormBlockedArtistsKey  = "blocked-artists"
+	PrefFormBlockedAlbumsKey   = "blocked-albums"
+	PrefFormBlockedKeywordsKey = "blocked-keywords"
+	PrefFormAllowedTracksKey   = "allowed-tracks"
+	PrefFormAllowedArtistsKey  = "allowed-artists"
+	PrefFormAllowedAlbumsKey   = "allowed-albums"
+	PrefFormAllowedKeywordsKey = "allowed-keywords"
+	PrefFormAllowlistOnlyKey   = "allowlist-only"
+	// what to do with links to something other than a song
+	PrefFormAlbumLinksKey    = "album-links"
+	PrefFormPlaylistLinksKey = "playlist-links"
+	PrefFormArtistLinksKey   = "artist-links"
+	// the Spotify device to queue songs on, where empty means the active device
+	PrefFormDeviceKey = "device"
+	// chat replies, where an empty template means the default reply
+	PrefFormChatRepliesKey   = "chat-replies"
+	PrefFormQueuedReplyKey   = "queued-reply"
+	PrefFormRejectedReplyKey = "rejected-reply"
+	// the chat command, where the roles are checkboxes and none means everyone
+	PrefFormChatRequestsKey = "chat-requests"
+	PrefFormChatCommandKey  = "chat-command"
+	PrefFormChatRolesKey    = "chat-roles"
+	// cheers, where 0 bits means that cheers can't request songs
+	PrefFormMinCheerBitsKey  = "min-cheer-bits"
+	PrefFormCheerPriorityKey = "cheer-priority"
+	// who can redeem the song request reward, where the roles are checkboxes and none
+	// means everyone
+	PrefFormRequestRolesKey  = "request-roles"
+	PrefFormMinFollowDaysKey = "min-follow-days"
+	PrefFormLiveOnlyKey      = "live-only"
+	// how many minutes viewers have to cancel their request, where 0 means they can't
+	PrefFormCancelWindowKey = "cancel-window"
+	// what happens to the redemptions, where empty means they're fulfilled once queued
+	PrefFormFulfillmentKey = "fulfillment"
 )
 
 type PreferenceHandler struct {
@@ -56,6 +103,19 @@ func (h *PreferenceHandler) SavePreferences(w http.ResponseWriter, r *http.Reque
 	// leaving the checkbox unchecked omits it from the form,
 	// so need to always compare the value from the checkbox
 	p.ExplicitSongs = r.Form.Get(PrefFormExplicitKey) == "true"
+	p.CleanSubstitute = r.Form.Get(PrefFormCleanKey) == "true"
+	p.Moderated = r.Form.Get(PrefFormModeratedKey) == "true"
+	p.AllowlistOnly = r.Form.Get(PrefFormAllowlistOnlyKey) == "true"
+	p.AlbumFirstTrack = r.Form.Get(PrefFormAlbumLinksKey) == "true"
+	p.PlaylistFirstTrack = r.Form.Get(PrefFormPlaylistLinksKey) == "true"
+	p.ArtistTopTrack = r.Form.Get(PrefFormArtistLinksKey) == "true"
+	p.ChatReplies = r.Form.Get(PrefFormChatRepliesKey) == "true"
+	p.ChatRequests = r.Form.Get(PrefFormChatRequestsKey) == "true"
+	p.ChatRoles = readRoles(r.Form[PrefFormChatRolesKey], preferences.RoleSubscriber, preferences.RoleVIP, preferences.RoleModerator)
+	p.RequestRoles = readRoles(r.Form[PrefFormRequestRolesKey], preferences.RoleSubscriber, preferences.RoleVIP, preferences.RoleModerator, preferences.RoleFollower)
+	p.CheerPriority = r.Form.Get(PrefFormCheerPriorityKey) == "true"
+	p.LiveOnly = r.Form.Get(PrefFormLiveOnlyKey) == "true"
+	p.ViewerLimitPerStream = r.Form.Get(PrefFormViewerPerStreamKey) == "true"
 
 	// if the song length value exists, update the preference with it
 	if length := r.Form.Get(PrefFormSongLengthKey); length != "" {
@@ -68,6 +128,59 @@ func (h *PreferenceHandler) SavePreferences(w http.ResponseWriter, r *http.Reque
 		}
 	}
 
+	if cooldown, ok := parseNonNegative(r.Form.Get(PrefFormViewerCooldownKey)); ok {
+		p.ViewerCooldown = cooldown
+	}
+	if limit, ok := parseNonNegative(r.Form.Get(PrefFormViewerLimitKey)); ok {
+		p.ViewerRequestLimit = limit
+	}
+	if pending, ok := parseNonNegative(r.Form.Get(PrefFormViewerPendingKey)); ok {
+		p.ViewerMaxPending = pending
+	}
+	if window, ok := parseNonNegative(r.Form.Get(PrefFormDuplicateKey)); ok {
+		p.DuplicateWindow = window
+	}
+	if bits, ok := parseNonNegative(r.Form.Get(PrefFormMinCheerBitsKey)); ok {
+		p.MinCheerBits = bits
+	}
+	if days, ok := parseNonNegative(r.Form.Get(PrefFormMinFollowDaysKey)); ok {
+		p.MinFollowDays = days
+	}
+	if window, ok := parseNonNegative(r.Form.Get(PrefFormCancelWindowKey)); ok {
+		p.CancelWindow = window
+	}
+
+	if _, ok := r.Form[PrefFormFulfillmentKey]; ok {
+		policy := preferences.FulfillmentPolicy(r.Form.Get(PrefFormFulfillmentKey))
+		if slices.Contains(preferences.FulfillmentPolicies, policy) {
+			p.Fulfillment = policy
+		} else {
+			zap.L().Error("unknown fulfillment policy", zap.String("input", string(policy)))
+		}
+	}
+	if _, ok := r.Form[PrefFormDeviceKey]; ok {
+		p.DeviceID = strings.TrimSpace(r.Form.Get(PrefFormDeviceKey))
+	}
+	if _, ok := r.Form[PrefFormChatCommandKey]; ok {
+		// the command is the first word of a message, so it can't have spaces
+		p.ChatCommand = strings.Join(strings.Fields(r.Form.Get(PrefFormChatCommandKey)), "")
+	}
+	if _, ok := r.Form[PrefFormQueuedReplyKey]; ok {
+		p.QueuedReply = strings.TrimSpace(r.Form.Get(PrefFormQueuedReplyKey))
+	}
+	if _, ok := r.Form[PrefFormRejectedReplyKey]; ok {
+		p.RejectedReply = strings.TrimSpace(r.Form.Get(PrefFormRejectedReplyKey))
+	}
+
+	readList(r, PrefFormBlockedTracksKey, &p.Blocklist.Tracks, true)
+	readList(r, PrefFormBlockedArtistsKey, &p.Blocklist.Artists, true)
+	readList(r, PrefFormBlockedAlbumsKey, &p.Blocklist.Albums, true)
+	readList(r, PrefFormBlockedKeywordsKey, &p.Blocklist.Keywords, false)
+	readList(r, PrefFormAllowedTracksKey, &p.Allowlist.Tracks, true)
+	readList(r, PrefFormAllowedArtistsKey, &p.Allowlist.Artists, true)
+	readList(r, PrefFormAllowedAlbumsKey, &p.Allowlist.Albums, true)
+	readList(r, PrefFormAllowedKeywordsKey, &p.Allowlist.Keywords, false)
+
 	err = h.prefs.UpdatePreference(p)
 	if err != nil {
 		zap.L().Error("failed to update user preferences", zap.String("id", userID), zap.Error(err))
@@ -80,3 +193,64 @@ func (h *PreferenceHandler) SavePreferences(w http.ResponseWriter, r *http.Reque
 	// redirect this back to the home page.
 	http.Redirect(w, r, h.redirectURL, http.StatusFound)
 }
+
+// parseNonNegative reads an optional number from the form. The second return
+// value is false if the value was omitted or invalid.
+func parseNonNegative(s string) (int, bool) {
+	if s == "" {
+		return 0, false
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		zap.L().Error("failed to convert", zap.String("input", s), zap.Error(err))
+		return 0, false
+	}
+	return i, true
+}
+
+// readRoles keeps the roles that are allowed, ignoring anything else
+func readRoles(values []string, allowed ...string) []string {
+	roles := make([]string, 0, len(values))
+	for _, v := range values {
+		if slices.Contains(allowed, v) && !slices.Contains(roles, v) {
+			roles = append(roles, v)
+		}
+	}
+	return roles
+}
+
+// readList overwrites the list with the entries from the form, if the form has
+// the field. When ids is set, Spotify links are reduced to the ID that they link to.
+func readList(r *http.Request, key string, list *[]string, ids bool) {
+	if _, ok := r.Form[key]; !ok {
+		return
+	}
+
+	entries := strings.FieldsFunc(r.Form.Get(key), func(c rune) bool {
+		return c == '\n' || c == '\r' || c == ','
+	})
+	res := make([]string, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if ids {
+			e = spotifyIDFromLink(e)
+		}
+		if e != "" && !slices.Contains(res, e) {
+			res = append(res, e)
+		}
+	}
+	*list = res
+}
+
+// spotifyIDFromLink takes the ID out of a link like https://open.spotify.com/artist/{id}?si=...
+// or a URI like spotify:artist:{id}. Anything else is assumed to be an ID already.
+func spotifyIDFromLink(s string) string {
+	if i := strings.IndexAny(s, "?#"); i >= 0 {
+		s = s[:i]
+	}
+	s = strings.TrimRight(s, "/")
+	if i := strings.LastIndexAny(s, "/:"); i >= 0 {
+		s = s[i+1:]
+	}
+	return s
+}
@@ -0,0 +1,298 @@
+package api_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/constants"
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSavePreferencesLists(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {
+				TwitchID:  "12345",
+				Blocklist: preferences.SongFilter{Tracks: []string{"abc123"}},
+				Allowlist: preferences.SongFilter{Albums: []string{"bcd234"}},
+			},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{
+		api.PrefFormBlockedArtistsKey:  {"https://open.spotify.com/artist/0TnOYISbd1XYRBk9myaseg?si=abc\r\nspotify:artist:4JhsIjgg9mTYBmjJzAVDZe\n\n0TnOYISbd1XYRBk9myaseg"},
+		api.PrefFormBlockedKeywordsKey: {"Nightcore, 8d audio "},
+		api.PrefFormAllowedTracksKey:   {"https://open.spotify.com/intl-de/track/3cfOd4CMv2snFaKAnMdnvK"},
+		api.PrefFormAllowlistOnlyKey:   {"true"},
+	}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	p := prefs.Data["12345"]
+	assert.Equal(t, []string{"0TnOYISbd1XYRBk9myaseg", "4JhsIjgg9mTYBmjJzAVDZe"}, p.Blocklist.Artists)
+	assert.Equal(t, []string{"Nightcore", "8d audio"}, p.Blocklist.Keywords)
+	assert.Equal(t, []string{"3cfOd4CMv2snFaKAnMdnvK"}, p.Allowlist.Tracks)
+	assert.True(t, p.AllowlistOnly)
+
+	// lists that weren't in the form are left alone
+	assert.Equal(t, []string{"abc123"}, p.Blocklist.Tracks)
+	assert.Equal(t, []string{"bcd234"}, p.Allowlist.Albums)
+}
+
+func TestSavePreferencesDevice(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", DeviceID: "phone"},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	for _, device := range []string{"stream-pc", ""} {
+		form := url.Values{api.PrefFormDeviceKey: {device}}
+		req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{
+			Name:  constants.TwitchIDCookieKey,
+			Value: util.TwitchIDCookieValue("12345"),
+		})
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusFound, rr.Code)
+		assert.Equal(t, device, prefs.Data["12345"].DeviceID)
+	}
+}
+
+func TestSavePreferencesChatReplies(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", RejectedReply: "no thanks {user}"},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{
+		api.PrefFormChatRepliesKey: {"true"},
+		api.PrefFormQueuedReplyKey: {" @{user} queued {song} "},
+	}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	p := prefs.Data["12345"]
+	assert.True(t, p.ChatReplies)
+	assert.Equal(t, "@{user} queued {song}", p.QueuedReply)
+	// templates that weren't in the form are left alone
+	assert.Equal(t, "no thanks {user}", p.RejectedReply)
+}
+
+func TestSavePreferencesChatCommand(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", ChatRoles: []string{preferences.RoleModerator}},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{
+		api.PrefFormChatRequestsKey: {"true"},
+		api.PrefFormChatCommandKey:  {" !song request "},
+		api.PrefFormChatRolesKey:    {preferences.RoleSubscriber, "admin", preferences.RoleVIP, preferences.RoleSubscriber},
+	}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	p := prefs.Data["12345"]
+	assert.True(t, p.ChatRequests)
+	assert.Equal(t, "!songrequest", p.ChatCommand)
+	assert.Equal(t, []string{preferences.RoleSubscriber, preferences.RoleVIP}, p.ChatRoles)
+}
+
+func TestSavePreferencesCheer(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", MinCheerBits: 100},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{
+		api.PrefFormMinCheerBitsKey:  {"500"},
+		api.PrefFormCheerPriorityKey: {"true"},
+	}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	p := prefs.Data["12345"]
+	assert.Equal(t, 500, p.MinCheerBits)
+	assert.True(t, p.CheerPriority)
+}
+
+func TestSavePreferencesRequestRoles(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", RequestRoles: []string{preferences.RoleModerator}},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{
+		api.PrefFormRequestRolesKey:  {preferences.RoleFollower, "admin", preferences.RoleSubscriber},
+		api.PrefFormMinFollowDaysKey: {"7"},
+	}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+
+	p := prefs.Data["12345"]
+	assert.Equal(t, []string{preferences.RoleFollower, preferences.RoleSubscriber}, p.RequestRoles)
+	assert.Equal(t, 7, p.MinFollowDays)
+	// the chat command can't be limited to followers
+	assert.Empty(t, p.ChatRoles)
+}
+
+func TestSavePreferencesLiveOnly(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345"},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	form := url.Values{api.PrefFormLiveOnlyKey: {"true"}}
+	req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("12345"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.True(t, prefs.Data["12345"].LiveOnly)
+}
+
+func TestSavePreferencesCancelWindow(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", CancelWindow: 5},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	save := func(window string) {
+		form := url.Values{api.PrefFormCancelWindowKey: {window}}
+		req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{
+			Name:  constants.TwitchIDCookieKey,
+			Value: util.TwitchIDCookieValue("12345"),
+		})
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusFound, rr.Code)
+	}
+
+	save("10")
+	assert.Equal(t, 10, prefs.Data["12345"].CancelWindow)
+
+	// negative windows are ignored
+	save("-1")
+	assert.Equal(t, 10, prefs.Data["12345"].CancelWindow)
+
+	save("0")
+	assert.Zero(t, prefs.Data["12345"].CancelWindow)
+}
+
+func TestSavePreferencesFulfillment(t *testing.T) {
+	prefs := testutil.InMemoryPreferenceStore{
+		Data: map[string]*preferences.Preference{
+			"12345": {TwitchID: "12345", Fulfillment: preferences.FulfillManually},
+		},
+	}
+	h := api.NewPreferenceHandler(&prefs, "http://localhost")
+
+	save := func(form url.Values) {
+		req, err := http.NewRequest("POST", "/preference", strings.NewReader(form.Encode()))
+		assert.NoError(t, err)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{
+			Name:  constants.TwitchIDCookieKey,
+			Value: util.TwitchIDCookieValue("12345"),
+		})
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(h.SavePreferences).ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusFound, rr.Code)
+	}
+
+	// the policy is kept when the form doesn't have it
+	save(url.Values{})
+	assert.Equal(t, preferences.FulfillManually, prefs.Data["12345"].Fulfillment)
+
+	save(url.Values{api.PrefFormFulfillmentKey: {"on-play"}})
+	assert.Equal(t, preferences.FulfillOnPlay, prefs.Data["12345"].Fulfillment)
+
+	// unknown policies are ignored
+	save(url.Values{api.PrefFormFulfillmentKey: {"sometimes"}})
+	assert.Equal(t, preferences.FulfillOnPlay, prefs.Data["12345"].Fulfillment)
+
+	save(url.Values{api.PrefFormFulfillmentKey: {""}})
+	assert.Equal(t, preferences.FulfillImmediately, prefs.Data["12345"].Fulfillment)
+}
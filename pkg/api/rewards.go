@@ -0,0 +1,400 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"go.uber.org/zap"
+)
+
+const (
+	RewardFormIDKey         = "reward-id"
+	RewardFormTitleKey      = "reward-title"
+	RewardFormCostKey       = "reward-cost"
+	RewardFormSongLengthKey = "reward-song-length"
+	RewardFormExplicitKey   = "reward-explicit"
+	RewardFormPriorityKey   = "reward-priority"
+	// the keys for the reward's settings on Twitch
+	RewardFormPromptKey       = "reward-prompt"
+	RewardFormMaxPerStreamKey = "reward-max-per-stream"
+	RewardFormMaxPerUserKey   = "reward-max-per-user"
+	RewardFormCooldownKey     = "reward-cooldown"
+	RewardFormColorKey        = "reward-color"
+	RewardFormEnabledKey      = "reward-enabled"
+	RewardFormPausedKey       = "reward-paused"
+)
+
+// ParseRewardForm reads the reward and its rules from the form. The song length in the
+// form is in seconds, where 0 means any length.
+func ParseRewardForm(form url.Values) (*rewards.Reward, error) {
+	r := rewards.Reward{
+		Title:         strings.TrimSpace(form.Get(RewardFormTitleKey)),
+		ExplicitSongs: form.Get(RewardFormExplicitKey) == "true",
+		Priority:      form.Get(RewardFormPriorityKey) == "true",
+	}
+	if r.Title == "" || len([]rune(r.Title)) > rewards.MaxTitleLength {
+		return nil, rewards.ErrTitle
+	}
+
+	cost, err := strconv.Atoi(form.Get(RewardFormCostKey))
+	if err != nil || cost < 1 {
+		return nil, rewards.ErrCost
+	}
+	r.Cost = cost
+
+	if length, ok := parseNonNegative(form.Get(RewardFormSongLengthKey)); ok {
+		r.MaxSongLength = length * 1000 // the value is expected to be in seconds, but we store millis
+	}
+	return &r, nil
+}
+
+// ParseRewardSettingsForm reads how the reward should be set up on Twitch from the form.
+// Empty limits and cooldowns are turned off.
+func ParseRewardSettingsForm(form url.Values) (*rewards.Settings, error) {
+	s := rewards.Settings{
+		Title:           strings.TrimSpace(form.Get(RewardFormTitleKey)),
+		Prompt:          strings.TrimSpace(form.Get(RewardFormPromptKey)),
+		BackgroundColor: strings.TrimSpace(form.Get(RewardFormColorKey)),
+		Enabled:         form.Get(RewardFormEnabledKey) == "true",
+		Paused:          form.Get(RewardFormPausedKey) == "true",
+	}
+
+	var err error
+	if s.Cost, err = strconv.Atoi(form.Get(RewardFormCostKey)); err != nil {
+		return nil, rewards.ErrCost
+	}
+	if s.MaxPerStream, err = parseLimit(form.Get(RewardFormMaxPerStreamKey)); err != nil {
+		return nil, err
+	}
+	if s.MaxPerUserPerStream, err = parseLimit(form.Get(RewardFormMaxPerUserKey)); err != nil {
+		return nil, err
+	}
+	if s.GlobalCooldown, err = parseLimit(form.Get(RewardFormCooldownKey)); err != nil {
+		return nil, err
+	}
+
+	if err = s.Validate(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// parseLimit reads one of the reward's limits, where empty means the limit is off
+func parseLimit(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, rewards.ErrLimit
+	}
+	return i, nil
+}
+
+// UpdateRewardSettings changes how one of the broadcaster's song request rewards is set
+// up on Twitch
+func (e *EventSubHandler) UpdateRewardSettings(w http.ResponseWriter, r *http.Request) {
+	id, err := util.GetUserIDFromRequest(r)
+	if err != nil {
+		zap.L().Error("failed to get Twitch ID from request", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if err = r.ParseForm(); err != nil {
+		zap.L().Error("failed to parse HTML form", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+	rewardID := r.Form.Get(RewardFormIDKey)
+	settings, err := ParseRewardSettingsForm(r.Form)
+	if err != nil {
+		zap.L().Error("invalid reward settings", zap.String("id", id), zap.String("reward_id", rewardID), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	// the reward is either the one in the preferences, or one of the broadcaster's others
+	tier, err := e.ownedReward(id, rewardID)
+	if err != nil {
+		zap.L().Warn("user tried to change a reward that isn't theirs", zap.String("id", id), zap.String("reward_id", rewardID), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	c, err := util.GetTwitchClientForUserID(e.auth, e.userStore, id)
+	if err != nil {
+		zap.L().Error("failed to get Twitch client", zap.String("id", id), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if err = util.UpdateRewardSettings(e.auth, c, id, rewardID, settings); err != nil {
+		zap.L().Error("failed to update Channel Point reward", zap.String("id", id), zap.String("reward_id", rewardID), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if tier != nil {
+		tier.Title = settings.Title
+		tier.Cost = settings.Cost
+		if err = e.rewardStore.UpdateReward(tier); err != nil {
+			zap.L().Error("failed to update reward", zap.String("id", id), zap.String("reward_id", rewardID), zap.Error(err))
+		}
+	}
+
+	zap.L().Info("updated song request reward", zap.String("id", id), zap.String("reward_id", rewardID))
+	http.Redirect(w, r, e.callbackURL, http.StatusFound)
+}
+
+// ownedReward checks that the reward is one of the broadcaster's song request rewards. The
+// reward is returned if it's one of their other rewards, or nil if it's the one in their
+// preferences.
+func (e *EventSubHandler) ownedReward(broadcasterID, rewardID string) (*rewards.Reward, error) {
+	if rewardID == "" {
+		return nil, errors.New("no reward")
+	}
+	pref, err := e.prefStore.GetPreference(broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+	if pref.CustomRewardID == rewardID {
+		return nil, nil
+	}
+
+	reward, err := e.rewardStore.GetReward(rewardID)
+	if err != nil {
+		return nil, err
+	}
+	if reward == nil || reward.BroadcasterID != broadcasterID {
+		return nil, errors.New("reward belongs to another broadcaster")
+	}
+	return reward, nil
+}
+
+// AddReward creates another song request reward for the broadcaster, with its own cost
+// and rules, and subscribes to its redemptions
+func (e *EventSubHandler) AddReward(w http.ResponseWriter, r *http.Request) {
+	id, err := util.GetUserIDFromRequest(r)
+	if err != nil {
+		zap.L().Error("failed to get Twitch ID from request", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if err = r.ParseForm(); err != nil {
+		zap.L().Error("failed to parse HTML form", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+	reward, err := ParseRewardForm(r.Form)
+	if err != nil {
+		zap.L().Error("invalid reward", zap.String("id", id), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+	reward.BroadcasterID = id
+
+	c, err := util.GetTwitchClientForUserID(e.auth, e.userStore, id)
+	if err != nil {
+		zap.L().Error("failed to get Twitch client", zap.String("id", id), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	rewardRes, err := c.CreateCustomReward(&helix.ChannelCustomRewardsParams{
+		BroadcasterID:       id,
+		Title:               reward.Title,
+		IsUserInputRequired: true,
+		IsEnabled:           false, // create the reward, but don't enable it by default
+		Cost:                reward.Cost,
+		Prompt:              rewardPrompt,
+	})
+	if err != nil {
+		zap.L().Error("failed to create Channel Point reward", zap.String("id", id), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	} else if len(rewardRes.ErrorMessage) > 0 || len(rewardRes.Data.ChannelCustomRewards) < 1 {
+		zap.L().Error("error occurred while creating Custom Reward",
+			zap.String("id", id),
+			zap.Int("status", rewardRes.ErrorStatus),
+			zap.String("err", rewardRes.Error),
+			zap.String("error_msg", rewardRes.ErrorMessage))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+	reward.ID = rewardRes.Data.ChannelCustomRewards[0].ID
+
+	appClient, err := e.appClient()
+	if err == nil {
+		reward.SubscriptionID, err = e.subscribe(appClient, helix.EventSubTypeChannelPointsCustomRewardRedemptionAdd,
+			helix.EventSubCondition{BroadcasterUserID: id, RewardID: reward.ID})
+	}
+	if err != nil {
+		zap.L().Error("failed to subscribe to reward redemptions", zap.String("id", id), zap.String("reward_id", reward.ID), zap.Error(err))
+		// nothing would handle the reward's redemptions, so don't leave it behind
+		deleteCustomReward(c, id, reward.ID)
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if err = e.rewardStore.AddReward(reward); err != nil {
+		zap.L().Error("failed to save reward", zap.String("id", id), zap.String("reward_id", reward.ID), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	zap.L().Info("added song request reward", zap.String("id", id), zap.String("reward_id", reward.ID), zap.Int("cost", reward.Cost))
+	http.Redirect(w, r, e.callbackURL, http.StatusFound)
+}
+
+// RemoveReward deletes one of the broadcaster's song request rewards, along with the
+// subscription to its redemptions
+func (e *EventSubHandler) RemoveReward(w http.ResponseWriter, r *http.Request) {
+	id, err := util.GetUserIDFromRequest(r)
+	if err != nil {
+		zap.L().Error("failed to get Twitch ID from request", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	if err = r.ParseForm(); err != nil {
+		zap.L().Error("failed to parse HTML form", zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	reward, err := e.rewardStore.GetReward(r.Form.Get(RewardFormIDKey))
+	if err != nil || reward == nil {
+		zap.L().Error("failed to get reward", zap.String("id", id), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+	if reward.BroadcasterID != id {
+		zap.L().Warn("user tried to remove another broadcaster's reward", zap.String("id", id), zap.String("reward_id", reward.ID))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	// the subscription and the reward are removed on a best effort basis, since the
+	// reward can't be used once it's gone from the store anyway
+	if appClient, err := e.appClient(); err != nil {
+		zap.L().Warn("failed to get Twitch client with an app access token", zap.String("id", id), zap.Error(err))
+	} else {
+		removeSubscription(appClient, id, reward.SubscriptionID)
+	}
+	if c, err := util.GetTwitchClientForUserID(e.auth, e.userStore, id); err != nil {
+		zap.L().Warn("failed to get Twitch client", zap.String("id", id), zap.Error(err))
+	} else {
+		deleteCustomReward(c, id, reward.ID)
+	}
+
+	if err = e.rewardStore.DeleteReward(reward.ID); err != nil {
+		zap.L().Error("failed to delete reward", zap.String("id", id), zap.String("reward_id", reward.ID), zap.Error(err))
+		http.Redirect(w, r, e.callbackURL, http.StatusFound)
+		return
+	}
+
+	zap.L().Info("removed song request reward", zap.String("id", id), zap.String("reward_id", reward.ID))
+	http.Redirect(w, r, e.callbackURL, http.StatusFound)
+}
+
+// removeSubscription removes the EventSub subscription, logging instead of failing,
+// since a subscription that is left behind only sends events that are ignored.
+// The client must have an app access token.
+func removeSubscription(c *helix.Client, broadcasterID, subID string) {
+	if subID == "" {
+		return
+	}
+	res, err := c.RemoveEventSubSubscription(subID)
+	if err != nil {
+		zap.L().Warn("failed to remove eventsub subscription", zap.String("id", broadcasterID), zap.String("subscription", subID), zap.Error(err))
+	} else if len(res.ErrorMessage) > 0 {
+		zap.L().Warn("failed to remove eventsub subscription",
+			zap.String("id", broadcasterID),
+			zap.String("subscription", subID),
+			zap.Int("status", res.ErrorStatus),
+			zap.String("error_msg", res.ErrorMessage))
+	}
+}
+
+// deleteCustomReward deletes the Channel Point reward, logging instead of failing.
+// The client must be authorized as the broadcaster.
+func deleteCustomReward(c *helix.Client, broadcasterID, rewardID string) {
+	if rewardID == "" {
+		return
+	}
+	res, err := c.DeleteCustomRewards(&helix.DeleteCustomRewardsParams{
+		BroadcasterID: broadcasterID,
+		ID:            rewardID,
+	})
+	if err != nil {
+		zap.L().Warn("failed to call api to delete custom reward", zap.String("id", broadcasterID), zap.String("reward_id", rewardID), zap.Error(err))
+	} else if res.StatusCode >= 400 {
+		zap.L().Warn("failed to delete custom reward",
+			zap.String("id", broadcasterID),
+			zap.String("reward_id", rewardID),
+			zap.Int("status", res.StatusCode),
+			zap.String("error", res.Error),
+			zap.String("error_msg", res.ErrorMessage))
+	}
+}
+
+// rewardUpdate handles a change to one of the broadcaster's Channel Point rewards, which
+// can be made on Twitch directly. The song request rewards that are stored are kept in
+// line with Twitch. It is called once the notification has been verified.
+func (h *RewardHandler) rewardUpdate(w http.ResponseWriter, event json.RawMessage) {
+	w.WriteHeader(http.StatusOK)
+
+	var e helix.EventSubChannelPointsCustomRewardEvent
+	if err := json.NewDecoder(bytes.NewReader(event)).Decode(&e); err != nil {
+		zap.L().Error("failed to unmarshal payload", zap.Error(err))
+		return
+	}
+
+	userID := e.BroadcasterUserID
+	broadcaster := e.BroadcasterUserLogin
+
+	pref, err := h.config.PrefStore.GetPreference(userID)
+	if err != nil {
+		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	tiers, err := h.config.Rewards.RewardsForBroadcaster(userID)
+	if err != nil {
+		zap.L().Error("failed to get rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+
+	var tier *rewards.Reward
+	for _, r := range tiers {
+		if r.ID == e.ID {
+			tier = r
+		}
+	}
+	if tier == nil && (pref == nil || pref.CustomRewardID != e.ID) {
+		// not a song request reward
+		return
+	}
+
+	if !e.IsUserInputRequired {
+		zap.L().Warn("song request reward no longer asks viewers for a song", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.String("reward_id", e.ID))
+	}
+
+	if tier != nil && (tier.Title != e.Title || tier.Cost != e.Cost) {
+		tier.Title = e.Title
+		tier.Cost = e.Cost
+		if err = h.config.Rewards.UpdateReward(tier); err != nil {
+			zap.L().Error("failed to update reward", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.String("reward_id", e.ID), zap.Error(err))
+			return
+		}
+	}
+
+	zap.L().Info("song request reward changed on Twitch", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.String("reward_id", e.ID))
+}
@@ -0,0 +1,296 @@
+package api_test
+
+import (
+	"context"
+	_ "embed"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/constants"
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:embed testdata/reward_update.json
+var rewardUpdatePayload string
+
+func TestParseRewardForm(t *testing.T) {
+	r, err := api.ParseRewardForm(url.Values{
+		api.RewardFormTitleKey:      {" Short Song Request "},
+		api.RewardFormCostKey:       {"500"},
+		api.RewardFormSongLengthKey: {"240"},
+		api.RewardFormPriorityKey:   {"true"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Short Song Request", r.Title)
+	assert.Equal(t, 500, r.Cost)
+	assert.Equal(t, 240000, r.MaxSongLength)
+	assert.False(t, r.ExplicitSongs)
+	assert.True(t, r.Priority)
+
+	_, err = api.ParseRewardForm(url.Values{api.RewardFormCostKey: {"500"}})
+	assert.ErrorIs(t, err, rewards.ErrTitle)
+
+	for _, cost := range []string{"", "0", "lots"} {
+		_, err = api.ParseRewardForm(url.Values{api.RewardFormTitleKey: {"Song Request"}, api.RewardFormCostKey: {cost}})
+		assert.ErrorIs(t, err, rewards.ErrCost)
+	}
+}
+
+func TestRemoveRewardOfAnotherBroadcaster(t *testing.T) {
+	rs := testutil.InMemoryRewardStore{
+		Data: map[string]*rewards.Reward{
+			"abc-123": {ID: "abc-123", BroadcasterID: "12826"},
+		},
+	}
+	h := api.NewEventSubHandler(&testutil.InMemoryUserStore{Data: make(map[string]*users.User)},
+		&testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)},
+		&rs, &util.AuthConfig{}, "http://localhost", dummySecret)
+
+	form := url.Values{api.RewardFormIDKey: {"abc-123"}}
+	req, err := http.NewRequest("POST", "/rewards/remove", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("99999"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.RemoveReward).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Contains(t, rs.Data, "abc-123")
+}
+
+func getRewardTestHandler(t *testing.T, tiers ...*rewards.Reward) (*api.RewardHandler, *testutil.InMemoryRewardStore, *testutil.InMemoryRequestStore, chan string, chan bool) {
+	t.Helper()
+	p := testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)}
+	// the preferences don't allow explicit songs
+	assert.NoError(t, p.AddPreference(&preferences.Preference{TwitchID: "12826", CustomRewardID: "main"}))
+	rs := testutil.InMemoryRewardStore{Data: make(map[string]*rewards.Reward)}
+	for _, tier := range tiers {
+		assert.NoError(t, rs.AddReward(tier))
+	}
+	u := testutil.InMemoryUserStore{Data: make(map[string]*users.User)}
+	assert.NoError(t, u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	}))
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	m := make(chan string)
+	callbacks := make(chan bool)
+	c := testutil.DummyCallback{CallbackExecuted: callbacks}
+
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:        dummySecret,
+		Publisher:     &testutil.DummyPublisher{Messages: m, IsMessageExplicit: true},
+		UserStore:     &u,
+		PrefStore:     &p,
+		Rewards:       &rs,
+		MsgCount:      &testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)},
+		Requests:      &reqs,
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: db.NewInMemoryViewerRequestCounter(),
+		HoldExpiry:    time.Hour,
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
+	})
+	rh.UpdateRedemption = c.Callback
+	return rh, &rs, &reqs, m, callbacks
+}
+
+func addRewardRequest(t *testing.T, rh *api.RewardHandler, reqs *testutil.InMemoryRequestStore, id, rewardID string) {
+	t.Helper()
+	createdAt := time.Now().Add(-time.Second)
+	assert.NoError(t, reqs.AddRequest(&requests.Request{
+		ID:            id,
+		BroadcasterID: "12826",
+		RewardID:      rewardID,
+		UserID:        "1337",
+		Input:         "explicit song",
+		Status:        requests.StatusRequested,
+		Source:        requests.SourceReward,
+		CreatedAt:     &createdAt,
+	}))
+	rh.ResumeRequests()
+}
+
+func TestRewardRulesApplied(t *testing.T) {
+	rh, _, reqs, m, callbacks := getRewardTestHandler(t, &rewards.Reward{
+		ID:            "expensive",
+		BroadcasterID: "12826",
+		Cost:          5000,
+		ExplicitSongs: true,
+	})
+
+	// the main reward follows the preferences, which don't allow explicit songs
+	addRewardRequest(t, rh, reqs, "abc-123", "main")
+	select {
+	case <-m:
+		t.Error("should not have queued an explicit song with the main reward")
+	case success := <-callbacks:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive callback in time")
+	}
+
+	// the expensive reward allows them
+	addRewardRequest(t, rh, reqs, "bcd-234", "expensive")
+	select {
+	case input := <-m:
+		assert.Equal(t, "explicit song", input)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	assert.True(t, <-callbacks)
+}
+
+func TestFlushHeldPriorityRewardFirst(t *testing.T) {
+	rh, _, reqs, m, callbacks := getRewardTestHandler(t,
+		&rewards.Reward{ID: "cheap", BroadcasterID: "12826", Cost: 500, ExplicitSongs: true},
+		&rewards.Reward{ID: "expensive", BroadcasterID: "12826", Cost: 5000, ExplicitSongs: true, Priority: true},
+	)
+	rh.ActiveDevice = func(_ context.Context, _ string) (bool, error) { return true, nil }
+	go func() {
+		for range callbacks {
+		}
+	}()
+
+	now := time.Now()
+	for i, tier := range []string{"cheap", "expensive"} {
+		createdAt := now.Add(time.Duration(i-3) * time.Minute)
+		assert.NoError(t, reqs.AddRequest(&requests.Request{
+			ID:            tier,
+			BroadcasterID: "12826",
+			RewardID:      tier,
+			Input:         tier + " song",
+			Status:        requests.StatusHeld,
+			Source:        requests.SourceReward,
+			CreatedAt:     &createdAt,
+			UpdatedAt:     &now,
+		}))
+	}
+
+	go rh.FlushHeldRequests()
+
+	for _, expected := range []string{"expensive song", "cheap song"} {
+		select {
+		case event := <-m:
+			assert.Equal(t, expected, event)
+		case <-time.After(testResponseTimeout):
+			t.Fatal("did not receive message in time")
+		}
+	}
+}
+
+func TestParseRewardSettingsForm(t *testing.T) {
+	s, err := api.ParseRewardSettingsForm(url.Values{
+		api.RewardFormTitleKey:        {"Song Request"},
+		api.RewardFormPromptKey:       {" Request a song "},
+		api.RewardFormCostKey:         {"500"},
+		api.RewardFormMaxPerStreamKey: {""},
+		api.RewardFormMaxPerUserKey:   {"2"},
+		api.RewardFormCooldownKey:     {"60"},
+		api.RewardFormColorKey:        {"#9147ff"},
+		api.RewardFormEnabledKey:      {"true"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, &rewards.Settings{
+		Title:               "Song Request",
+		Prompt:              "Request a song",
+		Cost:                500,
+		MaxPerUserPerStream: 2,
+		GlobalCooldown:      60,
+		BackgroundColor:     "#9147ff",
+		Enabled:             true,
+	}, s)
+
+	_, err = api.ParseRewardSettingsForm(url.Values{api.RewardFormTitleKey: {"Song Request"}, api.RewardFormCostKey: {"500"}, api.RewardFormCooldownKey: {"soon"}})
+	assert.ErrorIs(t, err, rewards.ErrLimit)
+	_, err = api.ParseRewardSettingsForm(url.Values{api.RewardFormTitleKey: {"Song Request"}, api.RewardFormCostKey: {"500"}, api.RewardFormMaxPerStreamKey: {"-1"}})
+	assert.ErrorIs(t, err, rewards.ErrLimit)
+	_, err = api.ParseRewardSettingsForm(url.Values{api.RewardFormTitleKey: {"Song Request"}})
+	assert.ErrorIs(t, err, rewards.ErrCost)
+}
+
+func TestUpdateRewardSettingsOfAnotherBroadcaster(t *testing.T) {
+	p := testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)}
+	assert.NoError(t, p.AddPreference(&preferences.Preference{TwitchID: "99999", CustomRewardID: "mine"}))
+	rs := testutil.InMemoryRewardStore{
+		Data: map[string]*rewards.Reward{
+			"abc-123": {ID: "abc-123", BroadcasterID: "12826", Title: "Song Request", Cost: 500},
+		},
+	}
+	h := api.NewEventSubHandler(&testutil.InMemoryUserStore{Data: make(map[string]*users.User)}, &p, &rs,
+		&util.AuthConfig{}, "http://localhost", dummySecret)
+
+	form := url.Values{
+		api.RewardFormIDKey:    {"abc-123"},
+		api.RewardFormTitleKey: {"Mine Now"},
+		api.RewardFormCostKey:  {"1"},
+	}
+	req, err := http.NewRequest("POST", "/rewards/settings", strings.NewReader(form.Encode()))
+	assert.NoError(t, err)
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{
+		Name:  constants.TwitchIDCookieKey,
+		Value: util.TwitchIDCookieValue("99999"),
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(h.UpdateRewardSettings).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusFound, rr.Code)
+	assert.Equal(t, "Song Request", rs.Data["abc-123"].Title)
+	assert.Equal(t, 500, rs.Data["abc-123"].Cost)
+}
+
+func newRewardUpdateCallback(t *testing.T, rewardID, title string, cost int) *http.Request {
+	t.Helper()
+	payload := strings.Replace(rewardUpdatePayload, "TESTREWARDID", rewardID, 1)
+	payload = strings.Replace(payload, "TESTREWARDTITLE", title, 1)
+	payload = strings.Replace(payload, "TESTREWARDCOST", strconv.Itoa(cost), 1)
+	return newSignedCallback(t, payload, "update-"+rewardID, time.Now())
+}
+
+func TestRewardUpdatedOnTwitch(t *testing.T) {
+	rh, rs, _, _, _ := getRewardTestHandler(t, &rewards.Reward{
+		ID:            "expensive",
+		BroadcasterID: "12826",
+		Title:         "Explicit Song Request",
+		Cost:          5000,
+		ExplicitSongs: true,
+	})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newRewardUpdateCallback(t, "expensive", "Any Song Request", 7500))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// the stored reward follows Twitch, and keeps its rules
+	reward, err := rs.GetReward("expensive")
+	assert.NoError(t, err)
+	assert.Equal(t, "Any Song Request", reward.Title)
+	assert.Equal(t, 7500, reward.Cost)
+	assert.True(t, reward.ExplicitSongs)
+
+	// changes to rewards that aren't for song requests are ignored
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newRewardUpdateCallback(t, "hydrate", "Hydrate", 100))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, rs.Data, 1)
+	assert.Equal(t, "Any Song Request", rs.Data["expensive"].Title)
+}
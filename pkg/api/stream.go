@@ -0,0 +1,308 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+// LiveStatusTTL is how long Twitch's answer to whether a broadcaster is live is remembered,
+// so that a burst of requests while the stream looks offline doesn't ask every time
+const LiveStatusTTL = time.Minute
+
+var ErrStreamOffline = errors.New("the stream is offline")
+
+// streamOnline records that the broadcaster went live, and unpauses their song request
+// rewards in the background if they only take requests while live. It is called once the
+// notification has been verified.
+func (h *RewardHandler) streamOnline(w http.ResponseWriter, event json.RawMessage) {
+	w.WriteHeader(http.StatusOK)
+
+	var e helix.EventSubStreamOnlineEvent
+	if err := json.NewDecoder(bytes.NewReader(event)).Decode(&e); err != nil {
+		zap.L().Error("failed to unmarshal payload", zap.Error(err))
+		return
+	}
+
+	userID := e.BroadcasterUserID
+	broadcaster := e.BroadcasterUserLogin
+
+	startedAt := e.StartedAt.Time
+	if startedAt.IsZero() {
+		startedAt = time.Now()
+	}
+	if err := h.config.Streams.StartStream(&streams.Stream{ID: e.ID, BroadcasterID: userID, StartedAt: &startedAt}); err != nil {
+		zap.L().Error("failed to save stream", zap.String("stream", e.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	zap.L().Info("stream went live", zap.String("stream", e.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster))
+
+	go h.pauseForStream(userID, broadcaster, false)
+}
+
+// streamOffline records that the broadcaster went offline. Their song request rewards are
+// paused if they only take requests while live, and the stream is recapped, both in the
+// background. It is called once the notification has been verified.
+func (h *RewardHandler) streamOffline(w http.ResponseWriter, event json.RawMessage) {
+	w.WriteHeader(http.StatusOK)
+
+	var e helix.EventSubStreamOfflineEvent
+	if err := json.NewDecoder(bytes.NewReader(event)).Decode(&e); err != nil {
+		zap.L().Error("failed to unmarshal payload", zap.Error(err))
+		return
+	}
+
+	userID := e.BroadcasterUserID
+	broadcaster := e.BroadcasterUserLogin
+
+	if err := h.config.Streams.EndStream(userID, time.Now()); err != nil {
+		zap.L().Error("failed to end stream", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+	h.liveCache.forget(userID)
+	zap.L().Info("stream went offline", zap.String("id", userID), zap.String("broadcaster", broadcaster))
+
+	go func() {
+		h.pauseForStream(userID, broadcaster, true)
+		h.recapStream(userID, broadcaster)
+	}()
+}
+
+// recapStream sums up the song requests of the stream that just went offline, so that the
+// broadcaster can look back on it later
+func (h *RewardHandler) recapStream(userID, broadcaster string) {
+	s, err := h.config.Streams.LatestStream(userID)
+	if err != nil {
+		zap.L().Error("failed to get latest stream", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		return
+	}
+	if s == nil || s.IsLive() {
+		// the stream going live was missed, so there is nothing to sum up
+		return
+	}
+
+	reqs, err := h.config.Requests.RequestsForSession(s.ID)
+	if err != nil {
+		zap.L().Error("failed to get the stream's requests", zap.String("stream", s.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		return
+	}
+	recap := streams.BuildRecap(s, reqs, h.config.MsgCount.MessagesForSession(s.ID), streams.TopCount)
+	if err = h.config.Streams.SaveRecap(s.ID, recap); err != nil {
+		zap.L().Error("failed to save stream recap", zap.String("stream", s.ID), zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		return
+	}
+	zap.L().Info("recapped stream", zap.String("stream", s.ID), zap.Int("requests", recap.Requests), zap.Int("queued", recap.Queued), zap.String("id", userID), zap.String("broadcaster", broadcaster))
+}
+
+// sessionID is the stream that the broadcaster is live in, or empty if they aren't live or
+// it wasn't recorded
+func (h *RewardHandler) sessionID(broadcasterID string) string {
+	s, err := h.config.Streams.LatestStream(broadcasterID)
+	if err != nil {
+		zap.L().Error("failed to get latest stream", zap.String("id", broadcasterID), zap.Error(err))
+		return ""
+	}
+	if !s.IsLive() {
+		return ""
+	}
+	return s.ID
+}
+
+// pauseForStream pauses the broadcaster's song request rewards when the stream goes offline,
+// if they only take requests while live, and unpauses the ones that it paused when the
+// stream goes live again
+func (h *RewardHandler) pauseForStream(userID, broadcaster string, paused bool) {
+	pref, err := h.config.PrefStore.GetPreference(userID)
+	if err != nil {
+		zap.L().Error("failed to get user preferences", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		return
+	}
+	if pref == nil {
+		return
+	}
+
+	var changed []string
+	if paused {
+		if !pref.LiveOnly {
+			return
+		}
+		rewardIDs, err := h.songRequestRewards(pref)
+		if err != nil {
+			zap.L().Error("failed to get song request rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+			return
+		}
+		changed, err = h.PauseRewards(userID, rewardIDs, true)
+		if err != nil {
+			zap.L().Error("failed to pause song request rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+		}
+		// the stream going live may have been missed, so keep the rewards that are still paused
+		changed = append(pref.PausedRewards, changed...)
+	} else {
+		if len(pref.PausedRewards) == 0 {
+			return
+		}
+		if _, err = h.PauseRewards(userID, pref.PausedRewards, false); err != nil {
+			// try again when the stream next goes live
+			zap.L().Error("failed to unpause song request rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+			return
+		}
+	}
+
+	if err = h.config.PrefStore.UpdatePausedRewards(userID, slices.Compact(slices.Sorted(slices.Values(changed)))); err != nil {
+		zap.L().Error("failed to save paused song request rewards", zap.String("id", userID), zap.String("broadcaster", broadcaster), zap.Error(err))
+	}
+}
+
+// songRequestRewards lists the IDs of all of the broadcaster's song request rewards
+func (h *RewardHandler) songRequestRewards(pref *preferences.Preference) ([]string, error) {
+	rewardIDs := make([]string, 0)
+	if pref.CustomRewardID != "" {
+		rewardIDs = append(rewardIDs, pref.CustomRewardID)
+	}
+	tiers, err := h.config.Rewards.RewardsForBroadcaster(pref.TwitchID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tiers {
+		rewardIDs = append(rewardIDs, t.ID)
+	}
+	return rewardIDs, nil
+}
+
+// pauseRewards pauses or unpauses the rewards on Twitch, and returns the ones that it
+// changed. Rewards that already are the way they should be are left alone.
+func (h *RewardHandler) pauseRewards(broadcasterID string, rewardIDs []string, paused bool) ([]string, error) {
+	if len(rewardIDs) == 0 {
+		return nil, nil
+	}
+
+	client, err := util.GetTwitchClientForUserID(h.config.Twitch, h.config.UserStore, broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := util.GetRewardSettings(client, broadcasterID)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := make([]string, 0, len(rewardIDs))
+	var multi error
+	for _, id := range rewardIDs {
+		if s, ok := settings[id]; !ok || s.Paused == paused {
+			continue
+		}
+		if err = util.SetRewardPaused(h.config.Twitch, client, broadcasterID, id, paused); err != nil {
+			multi = multierr.Append(multi, err)
+			continue
+		}
+		changed = append(changed, id)
+	}
+	return changed, multi
+}
+
+// checkLive verifies that the stream is live, if the broadcaster only takes requests while
+// live. If that can't be checked, the stream is taken to be offline.
+func (h *RewardHandler) checkLive(req *requests.Request, pref *preferences.Preference) error {
+	if pref == nil || !pref.LiveOnly {
+		return nil
+	}
+
+	live, err := h.IsLive(req.BroadcasterID)
+	if err != nil {
+		zap.L().Error("failed to check if the stream is live", zap.String("id", req.BroadcasterID), zap.String("broadcaster", req.BroadcasterLogin), zap.Error(err))
+		return ErrStreamOffline
+	}
+	if !live {
+		return ErrStreamOffline
+	}
+	return nil
+}
+
+// isLive checks if the broadcaster is live with the streams that were recorded. When none
+// were recorded yet, like right after subscribing, or the latest one has ended, which it
+// also looks like when a notification was missed, Twitch is asked instead.
+func (h *RewardHandler) isLive(broadcasterID string) (bool, error) {
+	s, err := h.config.Streams.LatestStream(broadcasterID)
+	if err != nil {
+		return false, err
+	}
+	if s != nil && s.IsLive() {
+		return true, nil
+	}
+
+	now := time.Now()
+	if live, ok := h.liveCache.get(broadcasterID, now); ok {
+		return live, nil
+	}
+	live, err := h.StreamLive(broadcasterID)
+	if err != nil {
+		return false, err
+	}
+	h.liveCache.add(broadcasterID, live, now)
+	return live, nil
+}
+
+// askStreamLive asks Twitch whether the broadcaster is live right now
+func (h *RewardHandler) askStreamLive(broadcasterID string) (bool, error) {
+	client, err := util.GetTwitchClientForUserID(h.config.Twitch, h.config.UserStore, broadcasterID)
+	if err != nil {
+		return false, err
+	}
+	return util.IsStreamLive(client, broadcasterID)
+}
+
+// liveStatusCache remembers what Twitch said about whether each broadcaster is live
+type liveStatusCache struct {
+	mu   sync.Mutex
+	live map[string]cachedLiveStatus
+}
+
+type cachedLiveStatus struct {
+	live    bool
+	expires time.Time
+}
+
+func newLiveStatusCache() *liveStatusCache {
+	return &liveStatusCache{
+		live: make(map[string]cachedLiveStatus),
+	}
+}
+
+func (c *liveStatusCache) get(broadcasterID string, now time.Time) (bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.live[broadcasterID]
+	if !ok || now.After(cached.expires) {
+		return false, false
+	}
+	return cached.live, true
+}
+
+func (c *liveStatusCache) add(broadcasterID string, live bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.live[broadcasterID] = cachedLiveStatus{
+		live:    live,
+		expires: now.Add(LiveStatusTTL),
+	}
+}
+
+// forget drops what Twitch said about the broadcaster, once the stream went offline
+func (c *liveStatusCache) forget(broadcasterID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.live, broadcasterID)
+}
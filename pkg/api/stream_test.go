@@ -0,0 +1,347 @@
+package api_test
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/api"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"github.com/saxypandabear/twitchsongrequests/pkg/users"
+	"github.com/stretchr/testify/assert"
+)
+
+//go:embed testdata/stream.json
+var streamPayload string
+
+func newStreamCallback(t *testing.T, subType, streamID string, startedAt time.Time) *http.Request {
+	t.Helper()
+	payload := strings.Replace(streamPayload, "TESTSTREAMTYPE", subType, 1)
+	payload = strings.Replace(payload, "TESTSTREAMID", streamID, 1)
+	payload = strings.Replace(payload, "TESTSTARTEDAT", startedAt.Format(time.RFC3339), 1)
+	return newSignedCallback(t, payload, subType+"-"+streamID, time.Now())
+}
+
+func getStreamTestHandler(t *testing.T, pref *preferences.Preference) (*api.RewardHandler, *testutil.InMemoryStreamStore, chan bool) {
+	rh, ss, paused, _ := getStreamTestHandlerWithPrefs(t, pref)
+	return rh, ss, paused
+}
+
+func getStreamTestHandlerWithPrefs(t *testing.T, pref *preferences.Preference) (*api.RewardHandler, *testutil.InMemoryStreamStore, chan bool, *testutil.InMemoryPreferenceStore) {
+	t.Helper()
+	p := testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)}
+	assert.NoError(t, p.AddPreference(pref))
+	ss := testutil.InMemoryStreamStore{Data: make(map[string][]*streams.Stream)}
+
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:        dummySecret,
+		Publisher:     &testutil.DummyPublisher{},
+		UserStore:     &testutil.InMemoryUserStore{Data: make(map[string]*users.User)},
+		PrefStore:     &p,
+		MsgCount:      &testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)},
+		Requests:      &testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)},
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: db.NewInMemoryViewerRequestCounter(),
+		Streams:       &ss,
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
+	})
+	paused := make(chan bool, 2)
+	rh.PauseRewards = func(broadcasterID string, rewardIDs []string, p bool) ([]string, error) {
+		assert.Equal(t, "12826", broadcasterID)
+		assert.Equal(t, []string{"abc-123"}, rewardIDs)
+		paused <- p
+		return rewardIDs, nil
+	}
+	return rh, &ss, paused, &p
+}
+
+// pausedRewards checks that the broadcaster's paused rewards were saved
+func pausedRewards(prefs *testutil.InMemoryPreferenceStore, expected ...string) func() bool {
+	return func() bool {
+		pref, err := prefs.GetPreference("12826")
+		return err == nil && slices.Equal(expected, pref.PausedRewards)
+	}
+}
+
+func TestStreamOnlineAndOffline(t *testing.T) {
+	rh, ss, paused, prefs := getStreamTestHandlerWithPrefs(t, &preferences.Preference{TwitchID: "12826", CustomRewardID: "abc-123", LiveOnly: true})
+	startedAt := time.Now().Add(-time.Minute).UTC().Truncate(time.Second)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOffline, "stream-0", startedAt.Add(-time.Hour)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, <-paused)
+	assert.Eventually(t, pausedRewards(prefs, "abc-123"), testResponseTimeout, 10*time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOnline, "stream-1", startedAt))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	s, err := ss.LatestStream("12826")
+	assert.NoError(t, err)
+	assert.Equal(t, "stream-1", s.ID)
+	assert.Equal(t, startedAt, s.StartedAt.UTC())
+	assert.True(t, s.IsLive())
+	assert.False(t, <-paused)
+	assert.Eventually(t, pausedRewards(prefs), testResponseTimeout, 10*time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOffline, "stream-1", startedAt))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	s, err = ss.LatestStream("12826")
+	assert.NoError(t, err)
+	assert.False(t, s.IsLive())
+	assert.True(t, <-paused)
+}
+
+func TestStreamOnlineLeavesRewardsPausedByHand(t *testing.T) {
+	rh, _, paused, prefs := getStreamTestHandlerWithPrefs(t, &preferences.Preference{TwitchID: "12826", CustomRewardID: "abc-123", LiveOnly: true})
+	// the broadcaster already paused the reward themselves, so going offline didn't change it
+	rh.PauseRewards = func(broadcasterID string, rewardIDs []string, p bool) ([]string, error) {
+		paused <- p
+		return nil, nil
+	}
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOffline, "stream-0", time.Now().Add(-time.Hour)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, <-paused)
+	pref, err := prefs.GetPreference("12826")
+	assert.NoError(t, err)
+	assert.Empty(t, pref.PausedRewards)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOnline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	select {
+	case <-paused:
+		t.Error("rewards paused by hand should stay paused")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+}
+
+func TestStreamChangesWithoutLiveOnly(t *testing.T) {
+	rh, ss, paused := getStreamTestHandler(t, &preferences.Preference{TwitchID: "12826"})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOnline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// the stream is still recorded, but the rewards are left alone
+	s, err := ss.LatestStream("12826")
+	assert.NoError(t, err)
+	assert.True(t, s.IsLive())
+	select {
+	case <-paused:
+		t.Error("rewards should be left alone")
+	case <-time.After(testResponseTimeout):
+		t.Log("no event expected")
+	}
+}
+
+func TestRequestWhileOfflineRefunded(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID:    "12826",
+		LiveOnly:    true,
+		ChatReplies: true,
+	})
+	rh.IsLive = func(broadcasterID string) (bool, error) {
+		return false, nil
+	}
+	msgs := captureChat(rh)
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case <-m:
+		t.Error("should not have queued a request while the stream is offline")
+	case success := <-callbacks:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive callback in time")
+	}
+	select {
+	case msg := <-msgs:
+		assert.Equal(t, "12826: @viewer rejected: requests are only taken while the stream is live", msg)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive message in time")
+	}
+	assert.Equal(t, requests.StatusFailed, requestStatus(reqs, "abc-123")())
+}
+
+func TestRequestWhileLive(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID: "12826",
+		LiveOnly: true,
+	})
+	rh.IsLive = func(broadcasterID string) (bool, error) {
+		return true, nil
+	}
+
+	addRequestedSong(t, rh, reqs)
+
+	select {
+	case input := <-m:
+		assert.Equal(t, "some song", input)
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	assert.True(t, <-callbacks)
+}
+
+func TestLiveCheckFails(t *testing.T) {
+	rh, reqs, m, callbacks := getHoldTestHandler(t, nil, &preferences.Preference{
+		TwitchID: "12826",
+		LiveOnly: true,
+	})
+	rh.IsLive = func(broadcasterID string) (bool, error) {
+		return false, errors.New("oops")
+	}
+
+	addRequestedSong(t, rh, reqs)
+
+	// the stream is taken to be offline when it can't be checked, and the viewer is refunded
+	select {
+	case <-m:
+		t.Error("should not have queued a request when the stream couldn't be checked")
+	case success := <-callbacks:
+		assert.False(t, success)
+	case <-time.After(testResponseTimeout):
+		t.Error("did not receive callback in time")
+	}
+	assert.Eventually(t, func() bool {
+		return requestStatus(reqs, "abc-123")() == requests.StatusFailed
+	}, testResponseTimeout, 10*time.Millisecond)
+}
+
+func TestIsLiveAsksTwitchWhenStreamEnded(t *testing.T) {
+	rh, ss, paused := getStreamTestHandler(t, &preferences.Preference{TwitchID: "12826", CustomRewardID: "abc-123", LiveOnly: true})
+	asked := 0
+	rh.StreamLive = func(broadcasterID string) (bool, error) {
+		assert.Equal(t, "12826", broadcasterID)
+		asked++
+		return true, nil
+	}
+
+	// the offline notification for this stream was the last one received, but the
+	// broadcaster went live again without one
+	startedAt := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, ss.StartStream(&streams.Stream{ID: "stream-0", BroadcasterID: "12826", StartedAt: &startedAt}))
+	assert.NoError(t, ss.EndStream("12826", time.Now().Add(-time.Hour)))
+
+	for range 3 {
+		live, err := rh.IsLive("12826")
+		assert.NoError(t, err)
+		assert.True(t, live)
+	}
+	assert.Equal(t, 1, asked)
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOnline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	live, err := rh.IsLive("12826")
+	assert.NoError(t, err)
+	assert.True(t, live)
+	assert.Equal(t, 1, asked)
+
+	// once the stream goes offline, Twitch is asked again rather than using what it said before
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOffline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.True(t, <-paused)
+	_, err = rh.IsLive("12826")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, asked)
+}
+
+func TestRequestsRecappedWhenStreamEnds(t *testing.T) {
+	p := testutil.InMemoryPreferenceStore{Data: make(map[string]*preferences.Preference)}
+	assert.NoError(t, p.AddPreference(&preferences.Preference{TwitchID: "12826", MinCheerBits: 100}))
+	u := testutil.InMemoryUserStore{Data: make(map[string]*users.User)}
+	assert.NoError(t, u.AddUser(&users.User{
+		TwitchID:            "12826",
+		SpotifyAccessToken:  "foo",
+		SpotifyRefreshToken: "bar",
+		SpotifyExpiry:       &time.Time{},
+	}))
+	m := make(chan string)
+	callbacks := make(chan bool)
+	c := testutil.DummyCallback{CallbackExecuted: callbacks}
+	reqs := testutil.InMemoryRequestStore{Data: make(map[string]*requests.Request)}
+	msgCount := testutil.InMemoryMessageCounter{Msgs: make([]*metrics.Message, 0)}
+	ss := testutil.InMemoryStreamStore{Data: make(map[string][]*streams.Stream)}
+
+	rh := api.NewRewardHandler(&api.RewardHandlerConfig{
+		Secret:        dummySecret,
+		Publisher:     &testutil.DummyPublisher{Messages: m},
+		UserStore:     &u,
+		PrefStore:     &p,
+		MsgCount:      &msgCount,
+		Requests:      &reqs,
+		Dedup:         db.NewInMemoryDedupStore(),
+		ViewerCounter: db.NewInMemoryViewerRequestCounter(),
+		Streams:       &ss,
+		Twitch:        &util.AuthConfig{},
+		Spotify:       &util.AuthConfig{},
+	})
+	rh.UpdateRedemption = c.Callback
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOnline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	payload := strings.Replace(redeemPayload, userInputPlaceholder, "some song", 1)
+	payload = strings.Replace(payload, rewardTitlePlaceholder, api.SongRequestsTitle, 1)
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newSignedCallback(t, payload, "redeem-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	select {
+	case <-m:
+	case <-time.After(testResponseTimeout):
+		t.Fatal("did not receive message in time")
+	}
+	assert.True(t, <-callbacks)
+
+	// a cheer without a song is turned down, but still counts
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newCheerCallback(t, "Cheer500", 500))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// both requests belong to the stream
+	session, err := reqs.RequestsForSession("stream-1")
+	assert.NoError(t, err)
+	assert.Len(t, session, 2)
+	assert.Len(t, msgCount.Msgs, 1)
+	assert.Equal(t, "stream-1", msgCount.Msgs[0].SessionID)
+
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(rh.ChannelPointRedeem).ServeHTTP(rr, newStreamCallback(t, helix.EventSubTypeStreamOffline, "stream-1", time.Now()))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	var s *streams.Stream
+	assert.Eventually(t, func() bool {
+		s, _ = ss.GetStream("12826", "stream-1")
+		return s != nil && s.Recap != nil
+	}, testResponseTimeout, 10*time.Millisecond)
+	if assert.NotNil(t, s) && assert.NotNil(t, s.Recap) {
+		assert.Equal(t, 2, s.Recap.Requests)
+		assert.Equal(t, 1, s.Recap.Queued)
+		assert.Equal(t, []streams.Count{{Name: "Awesome_User", Count: 2}}, s.Recap.TopRequesters)
+		assert.Len(t, s.Recap.Tracks, 1)
+	}
+}
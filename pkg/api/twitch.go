@@ -1,7 +1,6 @@
 package api
 
 import (
-	"encoding/base64"
 	"log"
 	"net/http"
 
@@ -86,6 +85,12 @@ func (h *TwitchAuthZHandler) Authorize(w http.ResponseWriter, r *http.Request) {
 
 	log.Printf("validated token for %v:%s\n", data.Data.UserID, data.Data.Login)
 
+	// the user can leave out scopes, which the preferences page lists until they connect
+	// again, and viewer roles that need them aren't checked
+	if missing := util.MissingScopes(data.Data.Scopes, h.auth.Scope); len(missing) > 0 {
+		zap.L().Warn("user did not grant all of the Twitch scopes", zap.String("id", data.Data.UserID), zap.Strings("missing", missing))
+	}
+
 	// Check that the user is affiliated or partnered before letting them continue
 	res, err := client.GetUsers(&helix.UsersParams{
 		IDs: []string{data.Data.UserID},
@@ -129,7 +134,7 @@ func (h *TwitchAuthZHandler) Authorize(w http.ResponseWriter, r *http.Request) {
 	twitchCookie := http.Cookie{
 		Name:     constants.TwitchIDCookieKey,
 		Path:     "/",
-		Value:    base64.StdEncoding.EncodeToString([]byte(user.TwitchID)),
+		Value:    util.TwitchIDCookieValue(user.TwitchID),
 		Secure:   true,
 		SameSite: http.SameSiteLaxMode, // Lax so it can be passed around other domains
 	}
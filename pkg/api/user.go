@@ -6,7 +6,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/nicklaw5/helix/v2"
 	"github.com/saxypandabear/twitchsongrequests/internal/constants"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
@@ -16,15 +15,17 @@ import (
 type UserHandler struct {
 	users       db.UserStore
 	prefs       db.PreferenceStore
+	rewards     db.RewardStore
 	redirectURL string
 	twitch      *util.AuthConfig
 	spotify     *util.AuthConfig
 }
 
-func NewUserHandler(d db.UserStore, p db.PreferenceStore, redirectURL string, twitch, spotify *util.AuthConfig) *UserHandler {
+func NewUserHandler(d db.UserStore, p db.PreferenceStore, rw db.RewardStore, redirectURL string, twitch, spotify *util.AuthConfig) *UserHandler {
 	return &UserHandler{
 		users:       d,
 		prefs:       p,
+		rewards:     rw,
 		redirectURL: redirectURL,
 		twitch:      twitch,
 		spotify:     spotify,
@@ -77,6 +78,21 @@ func (h *UserHandler) RevokeUserAccesses(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// the chat, cheer, reward update and stream subscriptions, and the other rewards, are
+	// optional, so failing to remove them doesn't stop the rest
+	tiers, err := h.rewards.RewardsForBroadcaster(userID)
+	if err != nil {
+		zap.L().Warn("failed to get rewards", zap.String("id", userID), zap.Error(err))
+	}
+	removeSubscription(c, userID, u.ChatSubscriptionID)
+	removeSubscription(c, userID, u.CheerSubscriptionID)
+	removeSubscription(c, userID, u.RewardSubscriptionID)
+	removeSubscription(c, userID, u.OnlineSubscriptionID)
+	removeSubscription(c, userID, u.OfflineSubscriptionID)
+	for _, reward := range tiers {
+		removeSubscription(c, userID, reward.SubscriptionID)
+	}
+
 	tok, err := db.FetchTwitchToken(h.users, userID)
 	if err != nil {
 		zap.L().Error("failed to get user token", zap.Error(err))
@@ -93,27 +109,19 @@ func (h *UserHandler) RevokeUserAccesses(w http.ResponseWriter, r *http.Request)
 	}
 	c.SetUserAccessToken(tokenResp.Data.AccessToken)
 
-	// attempt to remove the reward, if the reward ID is non-empty
+	// attempt to remove the rewards, if the reward ID is non-empty. If this fails it's
+	// really a non-issue, so deleteCustomReward logs and moves on.
 	prefs, err := h.prefs.GetPreference(userID)
 	if err != nil {
 		// This is really a non-issue. Log and move on.
 		zap.L().Warn("failed to get user preferences", zap.String("id", userID), zap.Error(err))
-	} else if len(prefs.CustomRewardID) > 0 {
-		var dcrResponse *helix.DeleteCustomRewardsResponse
-		dcrResponse, err = c.DeleteCustomRewards(&helix.DeleteCustomRewardsParams{
-			BroadcasterID: userID,
-			ID:            prefs.CustomRewardID,
-		})
-		// again, if this fails it's really a non-issue. log and move on.
-		if err != nil {
-			zap.L().Warn("failed to call api to delete custom reward", zap.String("id", userID), zap.String("reward_id", prefs.CustomRewardID), zap.Error(err))
-		} else if dcrResponse.StatusCode >= 400 {
-			zap.L().Warn("failed to delete custom reward",
-				zap.String("id", userID),
-				zap.String("reward_id", prefs.CustomRewardID),
-				zap.Int("status", dcrResponse.StatusCode),
-				zap.String("error", dcrResponse.Error),
-				zap.String("error_msg", dcrResponse.ErrorMessage))
+	} else {
+		deleteCustomReward(c, userID, prefs.CustomRewardID)
+	}
+	for _, reward := range tiers {
+		deleteCustomReward(c, userID, reward.ID)
+		if err = h.rewards.DeleteReward(reward.ID); err != nil {
+			zap.L().Warn("failed to delete reward", zap.String("id", userID), zap.String("reward_id", reward.ID), zap.Error(err))
 		}
 	}
 
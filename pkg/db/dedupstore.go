@@ -0,0 +1,70 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// DedupStore remembers keys, like EventSub message IDs, for a limited time so that
+// something that is delivered more than once is only processed once.
+type DedupStore interface {
+	// Claim records the key until the TTL passes, and reports whether this is the
+	// first time the key was claimed since it last expired.
+	Claim(key string, ttl time.Duration) (bool, error)
+	// PurgeExpired forgets all of the keys that have expired.
+	PurgeExpired() error
+}
+
+type NoopDedupStore struct{}
+
+// Claim implements DedupStore.
+func (n *NoopDedupStore) Claim(string, time.Duration) (bool, error) {
+	return true, nil
+}
+
+// PurgeExpired implements DedupStore.
+func (n *NoopDedupStore) PurgeExpired() error {
+	return nil
+}
+
+var _ DedupStore = (*NoopDedupStore)(nil)
+var _ DedupStore = (*InMemoryDedupStore)(nil)
+
+// InMemoryDedupStore is a DedupStore that is not shared across instances
+type InMemoryDedupStore struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+func NewInMemoryDedupStore() *InMemoryDedupStore {
+	return &InMemoryDedupStore{
+		keys: make(map[string]time.Time),
+	}
+}
+
+// Claim implements DedupStore.
+func (s *InMemoryDedupStore) Claim(key string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if expiry, ok := s.keys[key]; ok && expiry.After(now) {
+		return false, nil
+	}
+	s.keys[key] = now.Add(ttl)
+	return true, nil
+}
+
+// PurgeExpired implements DedupStore.
+func (s *InMemoryDedupStore) PurgeExpired() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for key, expiry := range s.keys {
+		if !expiry.After(now) {
+			delete(s.keys, key)
+		}
+	}
+	return nil
+}
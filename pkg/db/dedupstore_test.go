@@ -0,0 +1,51 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryDedupClaim(t *testing.T) {
+	s := db.NewInMemoryDedupStore()
+
+	ok, err := s.Claim("message:abc", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.Claim("message:abc", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	ok, err = s.Claim("message:def", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestInMemoryDedupClaimExpired(t *testing.T) {
+	s := db.NewInMemoryDedupStore()
+
+	ok, err := s.Claim("message:abc", -time.Minute)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	// the first claim already expired, so it can be claimed again
+	ok, err = s.Claim("message:abc", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestInMemoryDedupPurgeExpired(t *testing.T) {
+	s := db.NewInMemoryDedupStore()
+
+	_, _ = s.Claim("message:abc", -time.Minute)
+	_, _ = s.Claim("message:def", time.Hour)
+	assert.NoError(t, s.PurgeExpired())
+
+	ok, _ := s.Claim("message:abc", time.Hour)
+	assert.True(t, ok)
+	ok, _ = s.Claim("message:def", time.Hour)
+	assert.False(t, ok)
+}
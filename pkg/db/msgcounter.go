@@ -1,6 +1,8 @@
 package db
 
 import (
+	"time"
+
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
 )
 
@@ -9,6 +11,12 @@ type MessageCounter interface {
 	TotalMessages() uint64
 	RunningCount(int) uint64
 	MessagesForUser(string) []*metrics.Message
+	// RecentTracks returns the IDs of the songs that were successfully requested
+	// for the broadcaster after the given time, most recent first.
+	RecentTracks(broadcasterID string, since time.Time) []string
+	// MessagesForSession returns the requests that were processed during the stream,
+	// in the order they were made.
+	MessagesForSession(sessionID string) []*metrics.Message
 }
 
 type NoopMessageCounter struct{}
@@ -21,6 +29,16 @@ func (n *NoopMessageCounter) MessagesForUser(string) []*metrics.Message {
 	return nil
 }
 
+// MessagesForSession implements MessageCounter.
+func (n *NoopMessageCounter) MessagesForSession(string) []*metrics.Message {
+	return nil
+}
+
+// RecentTracks implements MessageCounter.
+func (n *NoopMessageCounter) RecentTracks(string, time.Time) []string {
+	return nil
+}
+
 // RunningCount implements MessageCounter.
 func (n *NoopMessageCounter) RunningCount(int) uint64 {
 	return 0
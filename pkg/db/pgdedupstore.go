@@ -0,0 +1,43 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+var _ DedupStore = (*PostgresDedupStore)(nil)
+
+func NewPostgresDedupStore(pool *pgxpool.Pool) *PostgresDedupStore {
+	return &PostgresDedupStore{
+		pool: pool,
+	}
+}
+
+type PostgresDedupStore struct {
+	pool *pgxpool.Pool
+}
+
+// Claim inserts the key, or takes over the key if it already expired. Both happen in
+// one statement, so only one instance can claim the key.
+func (p *PostgresDedupStore) Claim(key string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	tag, err := p.pool.Exec(context.Background(),
+		"INSERT INTO dedup_keys(id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET expires_at = EXCLUDED.expires_at WHERE dedup_keys.expires_at <= $3",
+		key, now.Add(ttl), now)
+	if err != nil {
+		zap.L().Error("failed to claim key", zap.String("key", key), zap.Error(err))
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+func (p *PostgresDedupStore) PurgeExpired() error {
+	if _, err := p.pool.Exec(context.Background(), "DELETE FROM dedup_keys WHERE expires_at <= $1", time.Now()); err != nil {
+		zap.L().Error("failed to purge expired keys", zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package db_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+var dedupOnce sync.Once
+
+func TestPostgresDedupClaim(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	dedupOnce.Do(connect)
+
+	s := db.NewPostgresDedupStore(pool)
+
+	ok, err := s.Claim("message:active", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// an expired key can be claimed again
+	ok, err = s.Claim("message:expired", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = s.Claim("message:new", time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	ok, err = s.Claim("message:new", time.Hour)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestPostgresDedupPurgeExpired(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	dedupOnce.Do(connect)
+
+	s := db.NewPostgresDedupStore(pool)
+
+	_, err := s.Claim("message:purged", -time.Minute)
+	assert.NoError(t, err)
+	assert.NoError(t, s.PurgeExpired())
+
+	var count int
+	err = pool.QueryRow(context.Background(), "select count(id) from dedup_keys WHERE id = 'message:purged'").Scan(&count)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
@@ -2,6 +2,7 @@ package db
 
 import (
 	"context"
+	"time"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
@@ -26,7 +27,8 @@ type PostgresMessageCounter struct {
 }
 
 func (p *PostgresMessageCounter) AddMessage(m *metrics.Message) {
-	if _, err := p.pool.Exec(context.Background(), "insert into messages(created_at, success, broadcaster_id, spotify_track) values ($1, $2, $3, $4)", m.CreatedAt, m.Success, m.BroadcasterID, m.SpotifyTrack); err != nil {
+	if _, err := p.pool.Exec(context.Background(), "insert into messages(created_at, success, broadcaster_id, spotify_track, original_track, session_id, user_name, track_name, artist) values ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		m.CreatedAt, m.Success, m.BroadcasterID, m.SpotifyTrack, m.OriginalTrack, m.SessionID, m.UserName, m.TrackName, m.Artist); err != nil {
 		zap.L().Error("failed to add message", zap.Error(err))
 	}
 }
@@ -52,7 +54,7 @@ func (p *PostgresMessageCounter) RunningCount(days int) uint64 {
 // MessagesForUser reads out of the database of queued songs to track successful queues, but doesn't provide a lot of user
 // value. Leaving this here for now, but might remove in the future.
 func (p *PostgresMessageCounter) MessagesForUser(id string) []*metrics.Message {
-	rows, err := p.pool.Query(context.Background(), "SELECT spotify_track, success FROM messages WHERE broadcaster_id = $1 AND spotify_track != '' ORDER BY id DESC LIMIT 100", id)
+	rows, err := p.pool.Query(context.Background(), "SELECT spotify_track, COALESCE(original_track, ''), success FROM messages WHERE broadcaster_id = $1 AND spotify_track != '' ORDER BY id DESC LIMIT 100", id)
 	if err != nil {
 		zap.L().Error("failed to query for messages", zap.Error(err))
 		return []*metrics.Message{}
@@ -61,7 +63,7 @@ func (p *PostgresMessageCounter) MessagesForUser(id string) []*metrics.Message {
 	var multi error
 	for rows.Next() {
 		var msg metrics.Message
-		if err = rows.Scan(&msg.SpotifyTrack, &msg.Success); err != nil {
+		if err = rows.Scan(&msg.SpotifyTrack, &msg.OriginalTrack, &msg.Success); err != nil {
 			multi = multierr.Append(multi, err)
 		} else {
 			m = append(m, &msg)
@@ -73,3 +75,57 @@ func (p *PostgresMessageCounter) MessagesForUser(id string) []*metrics.Message {
 
 	return m
 }
+
+func (p *PostgresMessageCounter) RecentTracks(broadcasterID string, since time.Time) []string {
+	rows, err := p.pool.Query(context.Background(),
+		"SELECT spotify_track FROM messages WHERE broadcaster_id = $1 AND success = 1 AND spotify_track != '' AND created_at > $2 ORDER BY id DESC LIMIT 50",
+		broadcasterID, since)
+	if err != nil {
+		zap.L().Error("failed to query for recent tracks", zap.String("id", broadcasterID), zap.Error(err))
+		return []string{}
+	}
+	defer rows.Close()
+
+	tracks := make([]string, 0)
+	var multi error
+	for rows.Next() {
+		var t string
+		if err = rows.Scan(&t); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			tracks = append(tracks, t)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning recent tracks", zap.Error(multi))
+	}
+
+	return tracks
+}
+
+func (p *PostgresMessageCounter) MessagesForSession(sessionID string) []*metrics.Message {
+	rows, err := p.pool.Query(context.Background(),
+		"SELECT created_at, success, broadcaster_id, COALESCE(spotify_track, ''), COALESCE(original_track, ''), session_id, COALESCE(user_name, ''), COALESCE(track_name, ''), COALESCE(artist, '') FROM messages WHERE session_id = $1 ORDER BY id ASC",
+		sessionID)
+	if err != nil {
+		zap.L().Error("failed to query for session messages", zap.String("stream", sessionID), zap.Error(err))
+		return []*metrics.Message{}
+	}
+	defer rows.Close()
+
+	m := make([]*metrics.Message, 0)
+	var multi error
+	for rows.Next() {
+		var msg metrics.Message
+		if err = rows.Scan(&msg.CreatedAt, &msg.Success, &msg.BroadcasterID, &msg.SpotifyTrack, &msg.OriginalTrack, &msg.SessionID, &msg.UserName, &msg.TrackName, &msg.Artist); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			m = append(m, &msg)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning session messages", zap.Error(multi))
+	}
+
+	return m
+}
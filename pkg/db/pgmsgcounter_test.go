@@ -4,6 +4,7 @@ import (
 	"context"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
 	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
@@ -104,3 +105,76 @@ func TestPostgresRunningCount(t *testing.T) {
 	assert.Greater(t, total, count)
 	assert.NotZero(t, count)
 }
+
+func TestPostgresRecentTracks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	msgOnce.Do(connect)
+
+	store := db.NewPostgresMessageCounter(pool)
+
+	tracks := store.RecentTracks("12345", time.Now().Add(-time.Hour))
+	assert.Contains(t, tracks, "abc")
+	assert.Contains(t, tracks, "bcd")
+	// requested before the window
+	assert.NotContains(t, tracks, "cde")
+
+	tracks = store.RecentTracks("12345", time.Now().Add(-3*time.Hour))
+	assert.Contains(t, tracks, "cde")
+
+	// failed requests aren't included
+	assert.Empty(t, store.RecentTracks("23456", time.Now().Add(-3*time.Hour)))
+}
+
+func TestPostgresMessageOriginalTrack(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	msgOnce.Do(connect)
+
+	store := db.NewPostgresMessageCounter(pool)
+
+	msgs := store.MessagesForUser("34567")
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "def", msgs[0].SpotifyTrack)
+	assert.Equal(t, "efg", msgs[0].OriginalTrack)
+
+	// most messages were queued as requested
+	for _, m := range store.MessagesForUser("12345") {
+		assert.Empty(t, m.OriginalTrack)
+	}
+}
+
+func TestPostgresMessagesForSession(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	msgOnce.Do(connect)
+
+	store := db.NewPostgresMessageCounter(pool)
+
+	msgs := store.MessagesForSession("stream-old")
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "fgh", msgs[0].SpotifyTrack)
+	assert.Equal(t, "viewer", msgs[0].UserName)
+	assert.Equal(t, "Song A", msgs[0].TrackName)
+	assert.Equal(t, "Artist A", msgs[0].Artist)
+	assert.Equal(t, 0, msgs[1].Success)
+
+	store.AddMessage(&metrics.Message{
+		Success:       1,
+		BroadcasterID: "23456",
+		SpotifyTrack:  "ghi",
+		SessionID:     "stream-new",
+		UserName:      "viewer",
+	})
+	msgs = store.MessagesForSession("stream-new")
+	assert.Len(t, msgs, 1)
+	assert.Equal(t, "ghi", msgs[0].SpotifyTrack)
+
+	assert.Empty(t, store.MessagesForSession("does-not-exist"))
+}
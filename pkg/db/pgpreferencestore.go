@@ -26,8 +26,21 @@ func (s *PostgresPreferenceStore) GetPreference(id string) (*preferences.Prefere
 		TwitchID: id,
 	}
 
-	err := s.pool.QueryRow(context.Background(), "select COALESCE(explicit, false), COALESCE(reward_id, ''), COALESCE(max_song_length, 0) from preferences where id=$1", id).
-		Scan(&p.ExplicitSongs, &p.CustomRewardID, &p.MaxSongLength)
+	err := s.pool.QueryRow(context.Background(), "select COALESCE(explicit, false), COALESCE(reward_id, ''), COALESCE(max_song_length, 0), COALESCE(moderated, false), "+
+		"COALESCE(viewer_cooldown, 0), COALESCE(viewer_request_limit, 0), COALESCE(viewer_limit_per_stream, false), COALESCE(viewer_max_pending, 0), COALESCE(duplicate_window, 0), "+
+		"COALESCE(blocked_tracks, '{}'), COALESCE(blocked_artists, '{}'), COALESCE(blocked_albums, '{}'), COALESCE(blocked_keywords, '{}'), "+
+		"COALESCE(allowed_tracks, '{}'), COALESCE(allowed_artists, '{}'), COALESCE(allowed_albums, '{}'), COALESCE(allowed_keywords, '{}'), "+
+		"COALESCE(allowlist_only, false), COALESCE(clean_substitute, false), "+
+		"COALESCE(album_first_track, false), COALESCE(playlist_first_track, false), COALESCE(artist_top_track, false), "+
+		"COALESCE(device_id, ''), COALESCE(chat_replies, false), COALESCE(queued_reply, ''), COALESCE(rejected_reply, ''), "+
+		"COALESCE(chat_requests, false), COALESCE(chat_command, ''), COALESCE(chat_roles, '{}'), COALESCE(min_cheer_bits, 0), COALESCE(cheer_priority, false), "+
+		"COALESCE(request_roles, '{}'), COALESCE(min_follow_days, 0), COALESCE(live_only, false), COALESCE(cancel_window, 0), COALESCE(fulfillment, ''), COALESCE(paused_rewards, '{}') from preferences where id=$1", id).
+		Scan(&p.ExplicitSongs, &p.CustomRewardID, &p.MaxSongLength, &p.Moderated, &p.ViewerCooldown, &p.ViewerRequestLimit, &p.ViewerLimitPerStream, &p.ViewerMaxPending, &p.DuplicateWindow,
+			&p.Blocklist.Tracks, &p.Blocklist.Artists, &p.Blocklist.Albums, &p.Blocklist.Keywords,
+			&p.Allowlist.Tracks, &p.Allowlist.Artists, &p.Allowlist.Albums, &p.Allowlist.Keywords,
+			&p.AllowlistOnly, &p.CleanSubstitute, &p.AlbumFirstTrack, &p.PlaylistFirstTrack, &p.ArtistTopTrack, &p.DeviceID,
+			&p.ChatReplies, &p.QueuedReply, &p.RejectedReply, &p.ChatRequests, &p.ChatCommand, &p.ChatRoles, &p.MinCheerBits, &p.CheerPriority,
+			&p.RequestRoles, &p.MinFollowDays, &p.LiveOnly, &p.CancelWindow, &p.Fulfillment, &p.PausedRewards)
 	if err != nil {
 		zap.L().Error("failed to get user", zap.String("id", id), zap.Error(err))
 		return nil, err
@@ -38,11 +51,49 @@ func (s *PostgresPreferenceStore) GetPreference(id string) (*preferences.Prefere
 
 func (s *PostgresPreferenceStore) AddPreference(p *preferences.Preference) error {
 	if _, err := s.pool.Exec(context.Background(),
-		"insert into preferences(id, reward_id, explicit, max_song_length, last_updated) values ($1, $2, $3, $4, $5) on conflict do nothing",
+		"insert into preferences(id, reward_id, explicit, max_song_length, moderated, viewer_cooldown, viewer_request_limit, viewer_limit_per_stream, viewer_max_pending, duplicate_window, "+
+			"blocked_tracks, blocked_artists, blocked_albums, blocked_keywords, allowed_tracks, allowed_artists, allowed_albums, allowed_keywords, allowlist_only, clean_substitute, "+
+			"album_first_track, playlist_first_track, artist_top_track, device_id, chat_replies, queued_reply, rejected_reply, "+
+			"chat_requests, chat_command, chat_roles, min_cheer_bits, cheer_priority, request_roles, min_follow_days, live_only, cancel_window, fulfillment, paused_rewards, last_updated) "+
+			"values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25, $26, $27, $28, $29, $30, $31, $32, $33, $34, $35, $36, $37, $38, $39) on conflict do nothing",
 		p.TwitchID,
 		p.CustomRewardID,
 		p.ExplicitSongs,
 		p.MaxSongLength,
+		p.Moderated,
+		p.ViewerCooldown,
+		p.ViewerRequestLimit,
+		p.ViewerLimitPerStream,
+		p.ViewerMaxPending,
+		p.DuplicateWindow,
+		p.Blocklist.Tracks,
+		p.Blocklist.Artists,
+		p.Blocklist.Albums,
+		p.Blocklist.Keywords,
+		p.Allowlist.Tracks,
+		p.Allowlist.Artists,
+		p.Allowlist.Albums,
+		p.Allowlist.Keywords,
+		p.AllowlistOnly,
+		p.CleanSubstitute,
+		p.AlbumFirstTrack,
+		p.PlaylistFirstTrack,
+		p.ArtistTopTrack,
+		p.DeviceID,
+		p.ChatReplies,
+		p.QueuedReply,
+		p.RejectedReply,
+		p.ChatRequests,
+		p.ChatCommand,
+		p.ChatRoles,
+		p.MinCheerBits,
+		p.CheerPriority,
+		p.RequestRoles,
+		p.MinFollowDays,
+		p.LiveOnly,
+		p.CancelWindow,
+		p.Fulfillment,
+		p.PausedRewards,
 		time.Now().Format(time.RFC3339)); err != nil {
 		zap.L().Error("failed to insert preferences", zap.String("id", p.TwitchID), zap.Error(err))
 		return err
@@ -52,10 +103,48 @@ func (s *PostgresPreferenceStore) AddPreference(p *preferences.Preference) error
 
 func (s *PostgresPreferenceStore) UpdatePreference(p *preferences.Preference) error {
 	if _, err := s.pool.Exec(context.Background(),
-		"update preferences set reward_id=$1, explicit=$2, max_song_length=$3, last_updated=$4 where id=$5",
+		"update preferences set reward_id=$1, explicit=$2, max_song_length=$3, moderated=$4, viewer_cooldown=$5, viewer_request_limit=$6, viewer_limit_per_stream=$7, viewer_max_pending=$8, "+
+			"duplicate_window=$9, blocked_tracks=$10, blocked_artists=$11, blocked_albums=$12, blocked_keywords=$13, "+
+			"allowed_tracks=$14, allowed_artists=$15, allowed_albums=$16, allowed_keywords=$17, allowlist_only=$18, "+
+			"clean_substitute=$19, album_first_track=$20, playlist_first_track=$21, artist_top_track=$22, device_id=$23, "+
+			"chat_replies=$24, queued_reply=$25, rejected_reply=$26, chat_requests=$27, chat_command=$28, chat_roles=$29, "+
+			"min_cheer_bits=$30, cheer_priority=$31, request_roles=$32, min_follow_days=$33, live_only=$34, cancel_window=$35, fulfillment=$36, last_updated=$37 where id=$38",
 		p.CustomRewardID,
 		p.ExplicitSongs,
 		p.MaxSongLength,
+		p.Moderated,
+		p.ViewerCooldown,
+		p.ViewerRequestLimit,
+		p.ViewerLimitPerStream,
+		p.ViewerMaxPending,
+		p.DuplicateWindow,
+		p.Blocklist.Tracks,
+		p.Blocklist.Artists,
+		p.Blocklist.Albums,
+		p.Blocklist.Keywords,
+		p.Allowlist.Tracks,
+		p.Allowlist.Artists,
+		p.Allowlist.Albums,
+		p.Allowlist.Keywords,
+		p.AllowlistOnly,
+		p.CleanSubstitute,
+		p.AlbumFirstTrack,
+		p.PlaylistFirstTrack,
+		p.ArtistTopTrack,
+		p.DeviceID,
+		p.ChatReplies,
+		p.QueuedReply,
+		p.RejectedReply,
+		p.ChatRequests,
+		p.ChatCommand,
+		p.ChatRoles,
+		p.MinCheerBits,
+		p.CheerPriority,
+		p.RequestRoles,
+		p.MinFollowDays,
+		p.LiveOnly,
+		p.CancelWindow,
+		p.Fulfillment,
 		time.Now().Format(time.RFC3339),
 		p.TwitchID); err != nil {
 		zap.L().Error("failed to update preferences", zap.String("id", p.TwitchID), zap.Error(err))
@@ -64,6 +153,14 @@ func (s *PostgresPreferenceStore) UpdatePreference(p *preferences.Preference) er
 	return nil
 }
 
+func (s *PostgresPreferenceStore) UpdatePausedRewards(id string, rewardIDs []string) error {
+	if _, err := s.pool.Exec(context.Background(), "update preferences set paused_rewards=$1 where id=$2", rewardIDs, id); err != nil {
+		zap.L().Error("failed to update paused rewards", zap.String("id", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
 func (s *PostgresPreferenceStore) DeletePreference(id string) error {
 	if _, err := s.pool.Exec(context.Background(), "delete from preferences where id=$1", id); err != nil {
 		zap.L().Error("failed to delete user", zap.String("id", id), zap.Error(err))
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -25,9 +26,53 @@ func TestPostgresGetPreference(t *testing.T) {
 	assert.Equal(t, "abc-123", p.CustomRewardID)
 	assert.False(t, p.ExplicitSongs)
 	assert.Equal(t, "12345", p.TwitchID)
+	assert.Empty(t, p.DeviceID)
+	assert.False(t, p.ChatReplies)
+	assert.Empty(t, p.QueuedReply)
 	assert.Zero(t, p.MaxSongLength)
 }
 
+func TestPostgresGetPreferenceLists(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	prefOnce.Do(connect)
+
+	store := db.NewPostgresPreferenceStore(pool)
+
+	p, err := store.GetPreference("23456")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"0TnOYISbd1XYRBk9myaseg"}, p.Blocklist.Artists)
+	assert.Equal(t, []string{"nightcore", "8d audio"}, p.Blocklist.Keywords)
+	assert.Equal(t, []string{"3cfOd4CMv2snFaKAnMdnvK"}, p.Allowlist.Tracks)
+	assert.Empty(t, p.Blocklist.Tracks)
+	assert.Empty(t, p.Allowlist.Artists)
+	assert.False(t, p.AllowlistOnly)
+	assert.Equal(t, "stream-pc", p.DeviceID)
+	assert.True(t, p.ChatReplies)
+	assert.Equal(t, "queued {song}", p.QueuedReply)
+	assert.Empty(t, p.RejectedReply)
+	assert.True(t, p.ChatRequests)
+	assert.Empty(t, p.ChatCommand)
+	assert.Equal(t, []string{"moderator", "vip"}, p.ChatRoles)
+	assert.Equal(t, 500, p.MinCheerBits)
+	assert.Equal(t, []string{"subscriber", "follower"}, p.RequestRoles)
+	assert.Equal(t, 7, p.MinFollowDays)
+	assert.True(t, p.LiveOnly)
+	assert.Equal(t, 5, p.CancelWindow)
+	assert.Equal(t, preferences.FulfillOnPlay, p.Fulfillment)
+	assert.True(t, p.ViewerLimitPerStream)
+	assert.Equal(t, []string{"bcd-234"}, p.PausedRewards)
+	assert.False(t, p.CheerPriority)
+
+	// missing lists are read as empty
+	p, err = store.GetPreference("12345")
+	assert.NoError(t, err)
+	assert.True(t, p.Blocklist.IsEmpty())
+	assert.True(t, p.Allowlist.IsEmpty())
+}
+
 func TestPostgresGetPreferenceMissing(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping integ test")
@@ -41,3 +86,24 @@ func TestPostgresGetPreferenceMissing(t *testing.T) {
 	assert.Error(t, err)
 	assert.Nil(t, p)
 }
+
+func TestPostgresUpdatePausedRewards(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	prefOnce.Do(connect)
+
+	store := db.NewPostgresPreferenceStore(pool)
+
+	assert.NoError(t, store.AddPreference(&preferences.Preference{TwitchID: "56789"}))
+	assert.NoError(t, store.UpdatePausedRewards("56789", []string{"abc-123"}))
+
+	// saving the other preferences leaves the paused rewards alone
+	assert.NoError(t, store.UpdatePreference(&preferences.Preference{TwitchID: "56789", LiveOnly: true}))
+
+	p, err := store.GetPreference("56789")
+	assert.NoError(t, err)
+	assert.True(t, p.LiveOnly)
+	assert.Equal(t, []string{"abc-123"}, p.PausedRewards)
+}
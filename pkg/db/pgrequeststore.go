@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const requestColumns = "id, broadcaster_id, COALESCE(broadcaster_login, ''), COALESCE(reward_id, ''), COALESCE(user_id, ''), COALESCE(user_login, ''), COALESCE(user_name, ''), COALESCE(user_input, ''), status, COALESCE(source, ''), COALESCE(bits, 0), COALESCE(reason, ''), COALESCE(track_id, ''), COALESCE(track_name, ''), COALESCE(device, ''), COALESCE(session_id, ''), COALESCE(redemption_status, ''), played_at, created_at, updated_at"
+
+var _ RequestStore = (*PostgresRequestStore)(nil)
+
+type PostgresRequestStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresRequestStore(pool *pgxpool.Pool) *PostgresRequestStore {
+	return &PostgresRequestStore{
+		pool: pool,
+	}
+}
+
+func (s *PostgresRequestStore) GetRequest(id string) (*requests.Request, error) {
+	var r requests.Request
+	err := scanRequest(s.pool.QueryRow(context.Background(), "SELECT "+requestColumns+" FROM requests WHERE id=$1", id), &r)
+	if err != nil {
+		zap.L().Error("failed to get request", zap.String("request", id), zap.Error(err))
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *PostgresRequestStore) AddRequest(r *requests.Request) error {
+	if _, err := s.insert(r, ""); err != nil {
+		zap.L().Error("failed to insert request", zap.String("request", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// insert saves a new request, with the given ON CONFLICT clause if there is one.
+func (s *PostgresRequestStore) insert(r *requests.Request, onConflict string) (pgconn.CommandTag, error) {
+	now := time.Now()
+	if r.CreatedAt == nil {
+		r.CreatedAt = &now
+	}
+	tag, err := s.pool.Exec(context.Background(),
+		"INSERT INTO requests(id, broadcaster_id, broadcaster_login, reward_id, user_id, user_login, user_name, user_input, status, source, bits, reason, track_id, track_name, device, session_id, redemption_status, played_at, created_at, updated_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)"+onConflict,
+		r.ID,
+		r.BroadcasterID,
+		r.BroadcasterLogin,
+		r.RewardID,
+		r.UserID,
+		r.UserLogin,
+		r.UserName,
+		r.Input,
+		r.Status,
+		r.Source,
+		r.Bits,
+		r.Reason,
+		r.TrackID,
+		r.TrackName,
+		r.Device,
+		r.SessionID,
+		r.Redemption,
+		r.PlayedAt,
+		r.CreatedAt,
+		now)
+	if err == nil {
+		r.UpdatedAt = &now
+	}
+	return tag, err
+}
+
+func (s *PostgresRequestStore) UpdateRequest(r *requests.Request) error {
+	now := time.Now()
+	if _, err := s.pool.Exec(context.Background(),
+		"UPDATE requests SET status=$1, reason=$2, track_id=$3, track_name=$4, device=$5, redemption_status=$6, played_at=$7, updated_at=$8 WHERE id=$9",
+		r.Status,
+		r.Reason,
+		r.TrackID,
+		r.TrackName,
+		r.Device,
+		r.Redemption,
+		r.PlayedAt,
+		now,
+		r.ID); err != nil {
+		zap.L().Error("failed to update request", zap.String("request", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+		return err
+	}
+	r.UpdatedAt = &now
+	return nil
+}
+
+func (s *PostgresRequestStore) TransitionRequest(r *requests.Request, from string) error {
+	now := time.Now()
+	tag, err := s.pool.Exec(context.Background(),
+		"UPDATE requests SET status=$1, reason=$2, track_id=$3, track_name=$4, device=$5, redemption_status=$6, played_at=$7, updated_at=$8 WHERE id=$9 AND status=$10",
+		r.Status,
+		r.Reason,
+		r.TrackID,
+		r.TrackName,
+		r.Device,
+		r.Redemption,
+		r.PlayedAt,
+		now,
+		r.ID,
+		from)
+	if err != nil {
+		zap.L().Error("failed to update request", zap.String("request", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		// either something else changed the status, or the request was never saved
+		if tag, err = s.insert(r, " ON CONFLICT (id) DO NOTHING"); err != nil {
+			zap.L().Error("failed to insert request", zap.String("request", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrRequestChanged
+		}
+		return nil
+	}
+	r.UpdatedAt = &now
+	return nil
+}
+
+func (s *PostgresRequestStore) RequestsForBroadcaster(id, status string) ([]*requests.Request, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+requestColumns+" FROM requests WHERE broadcaster_id = $1 AND status = $2 ORDER BY created_at ASC LIMIT 100", id, status)
+	if err != nil {
+		zap.L().Error("failed to query for requests", zap.String("id", id), zap.Error(err))
+		return nil, err
+	}
+	return collectRequests(rows), nil
+}
+
+func (s *PostgresRequestStore) CountViewerRequests(broadcasterID, viewerID, exceptID string, statuses []string) (int, error) {
+	var count int
+	if err := s.pool.QueryRow(context.Background(),
+		"SELECT COUNT(*) FROM requests WHERE broadcaster_id = $1 AND user_id = $2 AND status = ANY($3) AND id <> $4",
+		broadcasterID, viewerID, statuses, exceptID).Scan(&count); err != nil {
+		zap.L().Error("failed to count requests", zap.String("id", broadcasterID), zap.String("user", viewerID), zap.Error(err))
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *PostgresRequestStore) LatestRequests(id string, limit int) ([]*requests.Request, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+requestColumns+" FROM requests WHERE broadcaster_id = $1 ORDER BY created_at DESC LIMIT $2", id, limit)
+	if err != nil {
+		zap.L().Error("failed to query for latest requests", zap.String("id", id), zap.Error(err))
+		return nil, err
+	}
+	return collectRequests(rows), nil
+}
+
+func (s *PostgresRequestStore) RequestsForSession(sessionID string) ([]*requests.Request, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+requestColumns+" FROM requests WHERE session_id = $1 ORDER BY created_at ASC", sessionID)
+	if err != nil {
+		zap.L().Error("failed to query for session requests", zap.String("stream", sessionID), zap.Error(err))
+		return nil, err
+	}
+	return collectRequests(rows), nil
+}
+
+func (s *PostgresRequestStore) StaleRequests(status string, before time.Time) ([]*requests.Request, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+requestColumns+" FROM requests WHERE status = $1 AND created_at < $2 ORDER BY created_at ASC LIMIT 100", status, before)
+	if err != nil {
+		zap.L().Error("failed to query for stale requests", zap.String("status", status), zap.Error(err))
+		return nil, err
+	}
+	return collectRequests(rows), nil
+}
+
+func (s *PostgresRequestStore) BroadcastersWithRequests(statuses []string) ([]string, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT DISTINCT broadcaster_id FROM requests WHERE status = ANY($1)", statuses)
+	if err != nil {
+		zap.L().Error("failed to query for broadcasters with requests", zap.Strings("status", statuses), zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]string, 0)
+	var multi error
+	for rows.Next() {
+		var id string
+		if err = rows.Scan(&id); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			ids = append(ids, id)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning broadcasters with requests", zap.Error(multi))
+	}
+	return ids, nil
+}
+
+func (s *PostgresRequestStore) OpenRequests(id string, statuses []string) ([]*requests.Request, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+requestColumns+" FROM requests WHERE broadcaster_id = $1 AND status = ANY($2) ORDER BY created_at ASC", id, statuses)
+	if err != nil {
+		zap.L().Error("failed to query for open requests", zap.String("id", id), zap.Strings("status", statuses), zap.Error(err))
+		return nil, err
+	}
+	return collectRequests(rows), nil
+}
+
+func scanRequest(row pgx.Row, r *requests.Request) error {
+	return row.Scan(&r.ID, &r.BroadcasterID, &r.BroadcasterLogin, &r.RewardID, &r.UserID, &r.UserLogin, &r.UserName, &r.Input, &r.Status, &r.Source, &r.Bits, &r.Reason, &r.TrackID, &r.TrackName, &r.Device, &r.SessionID, &r.Redemption, &r.PlayedAt, &r.CreatedAt, &r.UpdatedAt)
+}
+
+func collectRequests(rows pgx.Rows) []*requests.Request {
+	defer rows.Close()
+	reqs := make([]*requests.Request, 0)
+	var multi error
+	for rows.Next() {
+		var r requests.Request
+		if err := scanRequest(rows, &r); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			reqs = append(reqs, &r)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning requests", zap.Error(multi))
+	}
+	return reqs
+}
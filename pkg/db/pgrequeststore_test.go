@@ -0,0 +1,324 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/stretchr/testify/assert"
+)
+
+var requestOnce sync.Once
+
+func TestPostgresGetRequest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	r, err := store.GetRequest("req-1")
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, "23456", r.BroadcasterID)
+	assert.Equal(t, "bcd-234", r.RewardID)
+	assert.Equal(t, "1337", r.UserID)
+	assert.Equal(t, "some song", r.Input)
+	assert.Equal(t, requests.StatusPending, r.Status)
+	assert.Equal(t, requests.SourceCheer, r.Source)
+	assert.Equal(t, 500, r.Bits)
+	assert.NotNil(t, r.CreatedAt)
+}
+
+func TestPostgresGetRequestMissing(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	r, err := store.GetRequest("does-not-exist")
+	assert.Error(t, err)
+	assert.Nil(t, r)
+}
+
+func TestPostgresAddAndUpdateRequest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	err := store.AddRequest(&requests.Request{
+		ID:            "req-3",
+		BroadcasterID: "12345",
+		Input:         "foo",
+		Status:        requests.StatusPending,
+		Source:        requests.SourceCheer,
+		Bits:          500,
+	})
+	assert.NoError(t, err)
+
+	r, err := store.GetRequest("req-3")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusPending, r.Status)
+
+	r.Status = requests.StatusRejected
+	r.Device = "Stream PC"
+	r.TrackName = "Some Song"
+	assert.NoError(t, store.UpdateRequest(r))
+
+	r, err = store.GetRequest("req-3")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusRejected, r.Status)
+	assert.Equal(t, "Stream PC", r.Device)
+	assert.Equal(t, "Some Song", r.TrackName)
+}
+
+func TestPostgresLatestRequests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	reqs, err := store.LatestRequests("23456", 1)
+	assert.NoError(t, err)
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "req-1", reqs[0].ID)
+
+	reqs, err = store.LatestRequests("23456", 10)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, len(reqs), 2)
+}
+
+func TestPostgresRequestsForSession(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	for _, r := range []*requests.Request{
+		{ID: "session-1", BroadcasterID: "34567", Status: requests.StatusQueued, SessionID: "stream-9"},
+		{ID: "session-2", BroadcasterID: "34567", Status: requests.StatusFailed, SessionID: "stream-9"},
+		{ID: "session-3", BroadcasterID: "34567", Status: requests.StatusQueued},
+	} {
+		assert.NoError(t, store.AddRequest(r))
+	}
+
+	reqs, err := store.RequestsForSession("stream-9")
+	assert.NoError(t, err)
+	assert.Len(t, reqs, 2)
+	for _, r := range reqs {
+		assert.Equal(t, "stream-9", r.SessionID)
+	}
+}
+
+func TestPostgresRequestsForBroadcaster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	reqs, err := store.RequestsForBroadcaster("23456", requests.StatusPending)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reqs)
+	for _, r := range reqs {
+		assert.Equal(t, "23456", r.BroadcasterID)
+		assert.Equal(t, requests.StatusPending, r.Status)
+	}
+}
+
+func TestPostgresCountViewerRequests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	for _, r := range []*requests.Request{
+		{ID: "req-count-1", BroadcasterID: "34567", UserID: "1337", Status: requests.StatusPending},
+		{ID: "req-count-2", BroadcasterID: "34567", UserID: "1337", Status: requests.StatusHeld},
+		{ID: "req-count-3", BroadcasterID: "34567", UserID: "1337", Status: requests.StatusQueued},
+		{ID: "req-count-4", BroadcasterID: "34567", UserID: "7331", Status: requests.StatusPending},
+	} {
+		assert.NoError(t, store.AddRequest(r))
+	}
+
+	count, err := store.CountViewerRequests("34567", "1337", "", []string{requests.StatusPending, requests.StatusHeld})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	count, err = store.CountViewerRequests("34567", "1337", "req-count-1", []string{requests.StatusPending, requests.StatusHeld})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestPostgresStaleRequests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	reqs, err := store.StaleRequests(requests.StatusPending, time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.NotEmpty(t, reqs)
+
+	reqs, err = store.StaleRequests(requests.StatusPending, time.Now().Add(-24*time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, reqs)
+}
+
+func TestPostgresRequestReason(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	err := store.AddRequest(&requests.Request{
+		ID:            "req-cancel",
+		BroadcasterID: "12345",
+		UserID:        "1337",
+		Input:         "foo",
+		Status:        requests.StatusHeld,
+	})
+	assert.NoError(t, err)
+
+	r, err := store.GetRequest("req-cancel")
+	assert.NoError(t, err)
+	assert.Empty(t, r.Reason)
+
+	r.Status = requests.StatusCancelled
+	r.Reason = requests.ReasonCancelledByViewer
+	assert.NoError(t, store.UpdateRequest(r))
+
+	r, err = store.GetRequest("req-cancel")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusCancelled, r.Status)
+	assert.Equal(t, "cancelled by viewer", r.Reason)
+}
+
+func TestPostgresOpenRequests(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+	watched := []string{requests.StatusPlaying, requests.StatusQueued}
+
+	// requests stay open however long ago they were queued
+	queuedAt := time.Now().Add(-48 * time.Hour)
+	err := store.AddRequest(&requests.Request{
+		ID:            "req-on-play",
+		BroadcasterID: "45678",
+		UserID:        "1337",
+		Input:         "foo",
+		Status:        requests.StatusQueued,
+		TrackID:       "track-1",
+		Redemption:    requests.RedemptionAwaitingPlay,
+		CreatedAt:     &queuedAt,
+	})
+	assert.NoError(t, err)
+
+	ids, err := store.BroadcastersWithRequests(watched)
+	assert.NoError(t, err)
+	assert.Contains(t, ids, "45678")
+
+	reqs, err := store.OpenRequests("45678", watched)
+	assert.NoError(t, err)
+	assert.Len(t, reqs, 1)
+	assert.Equal(t, "req-on-play", reqs[0].ID)
+	assert.Equal(t, "track-1", reqs[0].TrackID)
+	assert.Equal(t, requests.RedemptionAwaitingPlay, reqs[0].Redemption)
+	assert.Nil(t, reqs[0].PlayedAt)
+
+	playedAt := time.Now().Truncate(time.Second)
+	reqs[0].Status = requests.StatusPlaying
+	reqs[0].Redemption = requests.RedemptionFulfilled
+	reqs[0].PlayedAt = &playedAt
+	assert.NoError(t, store.UpdateRequest(reqs[0]))
+
+	r, err := store.GetRequest("req-on-play")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusPlaying, r.Status)
+	assert.Equal(t, requests.RedemptionFulfilled, r.Redemption)
+	assert.True(t, playedAt.Equal(*r.PlayedAt))
+
+	reqs, err = store.OpenRequests("45678", []string{requests.StatusQueued})
+	assert.NoError(t, err)
+	assert.Empty(t, reqs)
+
+	r.Status = requests.StatusPlayed
+	assert.NoError(t, store.UpdateRequest(r))
+	ids, err = store.BroadcastersWithRequests(watched)
+	assert.NoError(t, err)
+	assert.NotContains(t, ids, "45678")
+}
+
+func TestPostgresTransitionRequest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	requestOnce.Do(connect)
+
+	store := db.NewPostgresRequestStore(pool)
+
+	err := store.AddRequest(&requests.Request{
+		ID:            "req-review",
+		BroadcasterID: "12345",
+		UserID:        "1337",
+		Input:         "foo",
+		Status:        requests.StatusPending,
+	})
+	assert.NoError(t, err)
+
+	approved, err := store.GetRequest("req-review")
+	assert.NoError(t, err)
+	rejected, err := store.GetRequest("req-review")
+	assert.NoError(t, err)
+
+	approved.Status = requests.StatusApproved
+	assert.NoError(t, store.TransitionRequest(approved, requests.StatusPending))
+
+	// the other moderator read it while it was still pending
+	rejected.Status = requests.StatusRejected
+	assert.ErrorIs(t, store.TransitionRequest(rejected, requests.StatusPending), db.ErrRequestChanged)
+
+	r, err := store.GetRequest("req-review")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusApproved, r.Status)
+
+	// requests that were never saved have nothing to race with
+	assert.NoError(t, store.TransitionRequest(&requests.Request{ID: "req-unsaved", BroadcasterID: "12345", Status: requests.StatusQueued}, requests.StatusApproved))
+
+	r, err = store.GetRequest("req-unsaved")
+	assert.NoError(t, err)
+	assert.Equal(t, requests.StatusQueued, r.Status)
+}
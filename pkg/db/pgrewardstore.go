@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+const rewardColumns = "id, broadcaster_id, COALESCE(title, ''), COALESCE(cost, 0), COALESCE(subscription_id, ''), COALESCE(max_song_length, 0), COALESCE(explicit, false), COALESCE(priority, false)"
+
+var _ RewardStore = (*PostgresRewardStore)(nil)
+
+type PostgresRewardStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresRewardStore(pool *pgxpool.Pool) *PostgresRewardStore {
+	return &PostgresRewardStore{
+		pool: pool,
+	}
+}
+
+func (s *PostgresRewardStore) GetReward(id string) (*rewards.Reward, error) {
+	var r rewards.Reward
+	err := scanReward(s.pool.QueryRow(context.Background(), "SELECT "+rewardColumns+" FROM rewards WHERE id=$1", id), &r)
+	if err != nil {
+		zap.L().Error("failed to get reward", zap.String("reward_id", id), zap.Error(err))
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (s *PostgresRewardStore) RewardsForBroadcaster(broadcasterID string) ([]*rewards.Reward, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+rewardColumns+" FROM rewards WHERE broadcaster_id = $1 ORDER BY cost ASC", broadcasterID)
+	if err != nil {
+		zap.L().Error("failed to query for rewards", zap.String("id", broadcasterID), zap.Error(err))
+		return nil, err
+	}
+	return collectRewards(rows), nil
+}
+
+func (s *PostgresRewardStore) AddReward(r *rewards.Reward) error {
+	if _, err := s.pool.Exec(context.Background(),
+		"INSERT INTO rewards(id, broadcaster_id, title, cost, subscription_id, max_song_length, explicit, priority) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		r.ID,
+		r.BroadcasterID,
+		r.Title,
+		r.Cost,
+		r.SubscriptionID,
+		r.MaxSongLength,
+		r.ExplicitSongs,
+		r.Priority); err != nil {
+		zap.L().Error("failed to insert reward", zap.String("reward_id", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresRewardStore) UpdateReward(r *rewards.Reward) error {
+	if _, err := s.pool.Exec(context.Background(),
+		"UPDATE rewards SET title=$1, cost=$2, subscription_id=$3, max_song_length=$4, explicit=$5, priority=$6 WHERE id=$7",
+		r.Title,
+		r.Cost,
+		r.SubscriptionID,
+		r.MaxSongLength,
+		r.ExplicitSongs,
+		r.Priority,
+		r.ID); err != nil {
+		zap.L().Error("failed to update reward", zap.String("reward_id", r.ID), zap.String("id", r.BroadcasterID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresRewardStore) DeleteReward(id string) error {
+	if _, err := s.pool.Exec(context.Background(), "DELETE FROM rewards WHERE id=$1", id); err != nil {
+		zap.L().Error("failed to delete reward", zap.String("reward_id", id), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func scanReward(row pgx.Row, r *rewards.Reward) error {
+	return row.Scan(&r.ID, &r.BroadcasterID, &r.Title, &r.Cost, &r.SubscriptionID, &r.MaxSongLength, &r.ExplicitSongs, &r.Priority)
+}
+
+func collectRewards(rows pgx.Rows) []*rewards.Reward {
+	defer rows.Close()
+	rs := make([]*rewards.Reward, 0)
+	var multi error
+	for rows.Next() {
+		var r rewards.Reward
+		if err := scanReward(rows, &r); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			rs = append(rs, &r)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning rewards", zap.Error(multi))
+	}
+	return rs
+}
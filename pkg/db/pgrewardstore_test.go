@@ -0,0 +1,95 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+	"github.com/stretchr/testify/assert"
+)
+
+var rewardOnce sync.Once
+
+func TestPostgresGetReward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	rewardOnce.Do(connect)
+
+	store := db.NewPostgresRewardStore(pool)
+
+	r, err := store.GetReward("reward-cheap")
+	assert.NoError(t, err)
+	assert.NotNil(t, r)
+	assert.Equal(t, "23456", r.BroadcasterID)
+	assert.Equal(t, "Short Song Request", r.Title)
+	assert.Equal(t, 500, r.Cost)
+	assert.Equal(t, "sub-cheap", r.SubscriptionID)
+	assert.Equal(t, 240000, r.MaxSongLength)
+	assert.False(t, r.ExplicitSongs)
+	assert.False(t, r.Priority)
+
+	r, err = store.GetReward("does-not-exist")
+	assert.Error(t, err)
+	assert.Nil(t, r)
+}
+
+func TestPostgresRewardsForBroadcaster(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	rewardOnce.Do(connect)
+
+	store := db.NewPostgresRewardStore(pool)
+
+	rs, err := store.RewardsForBroadcaster("23456")
+	assert.NoError(t, err)
+	assert.Len(t, rs, 2)
+	// cheapest first
+	assert.Equal(t, "reward-cheap", rs[0].ID)
+	assert.Equal(t, "reward-expensive", rs[1].ID)
+	assert.True(t, rs[1].Priority)
+
+	rs, err = store.RewardsForBroadcaster("12345")
+	assert.NoError(t, err)
+	assert.Empty(t, rs)
+}
+
+func TestPostgresAddUpdateDeleteReward(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	rewardOnce.Do(connect)
+
+	store := db.NewPostgresRewardStore(pool)
+
+	err := store.AddReward(&rewards.Reward{
+		ID:            "reward-new",
+		BroadcasterID: "34567",
+		Title:         "Song Request",
+		Cost:          1000,
+	})
+	assert.NoError(t, err)
+
+	r, err := store.GetReward("reward-new")
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, r.Cost)
+	assert.Empty(t, r.SubscriptionID)
+
+	r.SubscriptionID = "sub-new"
+	r.Priority = true
+	assert.NoError(t, store.UpdateReward(r))
+
+	r, err = store.GetReward("reward-new")
+	assert.NoError(t, err)
+	assert.Equal(t, "sub-new", r.SubscriptionID)
+	assert.True(t, r.Priority)
+
+	assert.NoError(t, store.DeleteReward("reward-new"))
+	_, err = store.GetReward("reward-new")
+	assert.Error(t, err)
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+var _ StreamStore = (*PostgresStreamStore)(nil)
+
+type PostgresStreamStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresStreamStore(pool *pgxpool.Pool) *PostgresStreamStore {
+	return &PostgresStreamStore{
+		pool: pool,
+	}
+}
+
+func (s *PostgresStreamStore) StartStream(stream *streams.Stream) error {
+	if _, err := s.pool.Exec(context.Background(),
+		"UPDATE streams SET ended_at=$1 WHERE broadcaster_id=$2 AND ended_at IS NULL AND id != $3",
+		stream.StartedAt,
+		stream.BroadcasterID,
+		stream.ID); err != nil {
+		zap.L().Error("failed to end previous streams", zap.String("id", stream.BroadcasterID), zap.Error(err))
+		return err
+	}
+
+	// Twitch can send the same notification more than once
+	if _, err := s.pool.Exec(context.Background(),
+		"INSERT INTO streams(id, broadcaster_id, started_at) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING",
+		stream.ID,
+		stream.BroadcasterID,
+		stream.StartedAt); err != nil {
+		zap.L().Error("failed to insert stream", zap.String("stream", stream.ID), zap.String("id", stream.BroadcasterID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+func (s *PostgresStreamStore) EndStream(broadcasterID string, endedAt time.Time) error {
+	if _, err := s.pool.Exec(context.Background(),
+		"UPDATE streams SET ended_at=$1 WHERE broadcaster_id=$2 AND ended_at IS NULL",
+		endedAt,
+		broadcasterID); err != nil {
+		zap.L().Error("failed to end stream", zap.String("id", broadcasterID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+const streamColumns = "id, broadcaster_id, started_at, ended_at, recap"
+
+func (s *PostgresStreamStore) LatestStream(broadcasterID string) (*streams.Stream, error) {
+	stream, err := scanStream(s.pool.QueryRow(context.Background(),
+		"SELECT "+streamColumns+" FROM streams WHERE broadcaster_id=$1 ORDER BY started_at DESC LIMIT 1", broadcasterID))
+	if err != nil {
+		zap.L().Error("failed to get latest stream", zap.String("id", broadcasterID), zap.Error(err))
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *PostgresStreamStore) GetStream(broadcasterID, streamID string) (*streams.Stream, error) {
+	stream, err := scanStream(s.pool.QueryRow(context.Background(),
+		"SELECT "+streamColumns+" FROM streams WHERE broadcaster_id=$1 AND id=$2", broadcasterID, streamID))
+	if err != nil {
+		zap.L().Error("failed to get stream", zap.String("stream", streamID), zap.String("id", broadcasterID), zap.Error(err))
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *PostgresStreamStore) StreamsForBroadcaster(broadcasterID string, limit int) ([]*streams.Stream, error) {
+	rows, err := s.pool.Query(context.Background(),
+		"SELECT "+streamColumns+" FROM streams WHERE broadcaster_id=$1 ORDER BY started_at DESC LIMIT $2", broadcasterID, limit)
+	if err != nil {
+		zap.L().Error("failed to get streams", zap.String("id", broadcasterID), zap.Error(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	all := make([]*streams.Stream, 0)
+	var multi error
+	for rows.Next() {
+		stream, err := scanStream(rows)
+		if err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			all = append(all, stream)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning streams", zap.String("id", broadcasterID), zap.Error(multi))
+	}
+	return all, nil
+}
+
+func (s *PostgresStreamStore) SaveRecap(streamID string, recap *streams.Recap) error {
+	b, err := json.Marshal(recap)
+	if err != nil {
+		return err
+	}
+	if _, err := s.pool.Exec(context.Background(), "UPDATE streams SET recap=$1 WHERE id=$2", string(b), streamID); err != nil {
+		zap.L().Error("failed to save recap", zap.String("stream", streamID), zap.Error(err))
+		return err
+	}
+	return nil
+}
+
+// scanStream reads a row of streamColumns. The recap is kept as JSON, since it's only ever
+// read back as a whole.
+func scanStream(row pgx.Row) (*streams.Stream, error) {
+	var stream streams.Stream
+	var recap *string
+	err := row.Scan(&stream.ID, &stream.BroadcasterID, &stream.StartedAt, &stream.EndedAt, &recap)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if recap != nil && *recap != "" {
+		if err = json.Unmarshal([]byte(*recap), &stream.Recap); err != nil {
+			return nil, err
+		}
+	}
+	return &stream, nil
+}
@@ -0,0 +1,104 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"github.com/stretchr/testify/assert"
+)
+
+var streamOnce sync.Once
+
+func TestPostgresLatestStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	streamOnce.Do(connect)
+
+	store := db.NewPostgresStreamStore(pool)
+
+	s, err := store.LatestStream("23456")
+	assert.NoError(t, err)
+	assert.Equal(t, "stream-old", s.ID)
+	assert.False(t, s.IsLive())
+
+	s, err = store.LatestStream("does-not-exist")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+}
+
+func TestPostgresStartEndStream(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	streamOnce.Do(connect)
+
+	store := db.NewPostgresStreamStore(pool)
+
+	started := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	first := streams.Stream{ID: "stream-1", BroadcasterID: "34567", StartedAt: &started}
+	assert.NoError(t, store.StartStream(&first))
+	// a repeated notification doesn't start another stream
+	assert.NoError(t, store.StartStream(&first))
+
+	s, err := store.LatestStream("34567")
+	assert.NoError(t, err)
+	assert.Equal(t, "stream-1", s.ID)
+	assert.True(t, s.IsLive())
+
+	// the offline notification was missed, so the next stream ends this one
+	restarted := time.Now().UTC().Truncate(time.Second)
+	assert.NoError(t, store.StartStream(&streams.Stream{ID: "stream-2", BroadcasterID: "34567", StartedAt: &restarted}))
+	s, err = store.LatestStream("34567")
+	assert.NoError(t, err)
+	assert.Equal(t, "stream-2", s.ID)
+	assert.True(t, s.IsLive())
+
+	assert.NoError(t, store.EndStream("34567", time.Now()))
+	s, err = store.LatestStream("34567")
+	assert.NoError(t, err)
+	assert.False(t, s.IsLive())
+}
+
+func TestPostgresStreamRecap(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	streamOnce.Do(connect)
+
+	store := db.NewPostgresStreamStore(pool)
+
+	s, err := store.GetStream("23456", "stream-old")
+	assert.NoError(t, err)
+	assert.Nil(t, s.Recap)
+
+	assert.NoError(t, store.SaveRecap("stream-old", &streams.Recap{
+		StreamID:      "stream-old",
+		Requests:      2,
+		Queued:        1,
+		SuccessRate:   0.5,
+		TopRequesters: []streams.Count{{Name: "viewer", Count: 1}},
+	}))
+
+	s, err = store.GetStream("23456", "stream-old")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, s.Recap.Requests)
+	assert.Equal(t, 0.5, s.Recap.SuccessRate)
+	assert.Equal(t, "viewer", s.Recap.TopRequesters[0].Name)
+
+	// streams of other broadcasters aren't found
+	s, err = store.GetStream("12345", "stream-old")
+	assert.NoError(t, err)
+	assert.Nil(t, s)
+
+	all, err := store.StreamsForBroadcaster("23456", 10)
+	assert.NoError(t, err)
+	assert.Len(t, all, 1)
+	assert.Equal(t, "stream-old", all[0].ID)
+}
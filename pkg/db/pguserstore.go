@@ -27,8 +27,8 @@ func (s *PostgresUserStore) GetUser(id string) (*users.User, error) {
 	}
 
 	err := s.pool.QueryRow(context.Background(),
-		"SELECT COALESCE(twitch_access, ''), COALESCE(twitch_refresh, ''), COALESCE(spotify_access, ''), COALESCE(spotify_refresh, ''), spotify_expiry, COALESCE(subscribed, FALSE), COALESCE(subscription_id, ''), COALESCE(email, '') FROM users WHERE id=$1", id).
-		Scan(&u.TwitchAccessToken, &u.TwitchRefreshToken, &u.SpotifyAccessToken, &u.SpotifyRefreshToken, &u.SpotifyExpiry, &u.Subscribed, &u.SubscriptionID, &u.Email)
+		"SELECT COALESCE(twitch_access, ''), COALESCE(twitch_refresh, ''), COALESCE(spotify_access, ''), COALESCE(spotify_refresh, ''), spotify_expiry, COALESCE(subscribed, FALSE), COALESCE(subscription_id, ''), COALESCE(email, ''), COALESCE(chat_subscription_id, ''), COALESCE(cheer_subscription_id, ''), COALESCE(reward_subscription_id, ''), COALESCE(online_subscription_id, ''), COALESCE(offline_subscription_id, '') FROM users WHERE id=$1", id).
+		Scan(&u.TwitchAccessToken, &u.TwitchRefreshToken, &u.SpotifyAccessToken, &u.SpotifyRefreshToken, &u.SpotifyExpiry, &u.Subscribed, &u.SubscriptionID, &u.Email, &u.ChatSubscriptionID, &u.CheerSubscriptionID, &u.RewardSubscriptionID, &u.OnlineSubscriptionID, &u.OfflineSubscriptionID)
 
 	if err != nil {
 		zap.L().Error("failed to get user", zap.String("id", id), zap.Error(err))
@@ -52,7 +52,7 @@ func (s *PostgresUserStore) AddUser(user *users.User) error {
 
 func (s *PostgresUserStore) UpdateUser(user *users.User) error {
 	if _, err := s.pool.Exec(context.Background(),
-		"update users set twitch_access=$1, twitch_refresh=$2, spotify_access=$3, spotify_refresh=$4, spotify_expiry=$5, last_updated=$6, subscribed=$7, subscription_id=$8, email=$9 where id=$10",
+		"update users set twitch_access=$1, twitch_refresh=$2, spotify_access=$3, spotify_refresh=$4, spotify_expiry=$5, last_updated=$6, subscribed=$7, subscription_id=$8, email=$9, chat_subscription_id=$10, cheer_subscription_id=$11, reward_subscription_id=$12, online_subscription_id=$13, offline_subscription_id=$14 where id=$15",
 		user.TwitchAccessToken,
 		user.TwitchRefreshToken,
 		user.SpotifyAccessToken,
@@ -62,6 +62,11 @@ func (s *PostgresUserStore) UpdateUser(user *users.User) error {
 		user.Subscribed,
 		user.SubscriptionID,
 		user.Email,
+		user.ChatSubscriptionID,
+		user.CheerSubscriptionID,
+		user.RewardSubscriptionID,
+		user.OnlineSubscriptionID,
+		user.OfflineSubscriptionID,
 		user.TwitchID); err != nil {
 		zap.L().Error("failed to update user", zap.String("id", user.TwitchID), zap.Error(err))
 		return err
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/multierr"
+	"go.uber.org/zap"
+)
+
+var _ ViewerRequestCounter = (*PostgresViewerRequestCounter)(nil)
+
+func NewPostgresViewerRequestCounter(pool *pgxpool.Pool) *PostgresViewerRequestCounter {
+	return &PostgresViewerRequestCounter{
+		pool: pool,
+	}
+}
+
+type PostgresViewerRequestCounter struct {
+	pool *pgxpool.Pool
+}
+
+func (p *PostgresViewerRequestCounter) AddViewerRequest(broadcasterID, viewerID string, at time.Time) {
+	if _, err := p.pool.Exec(context.Background(), "INSERT INTO viewer_requests(broadcaster_id, viewer_id, created_at) VALUES ($1, $2, $3)", broadcasterID, viewerID, at); err != nil {
+		zap.L().Error("failed to add viewer request", zap.String("id", broadcasterID), zap.String("viewer", viewerID), zap.Error(err))
+	}
+}
+
+func (p *PostgresViewerRequestCounter) ViewerRequestsSince(broadcasterID, viewerID string, since time.Time) []time.Time {
+	rows, err := p.pool.Query(context.Background(),
+		"SELECT created_at FROM viewer_requests WHERE broadcaster_id = $1 AND viewer_id = $2 AND created_at > $3 ORDER BY created_at DESC LIMIT 100",
+		broadcasterID, viewerID, since)
+	if err != nil {
+		zap.L().Error("failed to query for viewer requests", zap.String("id", broadcasterID), zap.String("viewer", viewerID), zap.Error(err))
+		return []time.Time{}
+	}
+	defer rows.Close()
+
+	times := make([]time.Time, 0)
+	var multi error
+	for rows.Next() {
+		var t time.Time
+		if err = rows.Scan(&t); err != nil {
+			multi = multierr.Append(multi, err)
+		} else {
+			times = append(times, t)
+		}
+	}
+	if multi != nil {
+		zap.L().Error("errors occurred while scanning viewer requests", zap.Error(multi))
+	}
+	return times
+}
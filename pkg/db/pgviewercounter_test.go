@@ -0,0 +1,42 @@
+package db_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+var viewerOnce sync.Once
+
+func TestPostgresViewerRequestsSince(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	viewerOnce.Do(connect)
+
+	c := db.NewPostgresViewerRequestCounter(pool)
+
+	assert.Len(t, c.ViewerRequestsSince("12345", "1337", time.Now().Add(-time.Hour)), 1)
+	assert.Len(t, c.ViewerRequestsSince("12345", "1337", time.Now().Add(-24*time.Hour)), 2)
+	assert.Len(t, c.ViewerRequestsSince("12345", "1337", time.Now().Add(-7*24*time.Hour)), 3)
+	assert.Empty(t, c.ViewerRequestsSince("12345", "does-not-exist", time.Now().Add(-7*24*time.Hour)))
+}
+
+func TestPostgresAddViewerRequest(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integ test")
+	}
+
+	viewerOnce.Do(connect)
+
+	c := db.NewPostgresViewerRequestCounter(pool)
+
+	assert.Empty(t, c.ViewerRequestsSince("98765", "4242", time.Now().Add(-time.Hour)))
+	c.AddViewerRequest("98765", "4242", time.Now())
+	times := c.ViewerRequestsSince("98765", "4242", time.Now().Add(-time.Hour))
+	assert.Len(t, times, 1)
+}
@@ -5,7 +5,12 @@ import "github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 type PreferenceStore interface {
 	GetPreference(string) (*preferences.Preference, error)
 	AddPreference(*preferences.Preference) error
+	// UpdatePreference saves the preferences that the broadcaster sets. PausedRewards is
+	// left alone, since it's only saved with UpdatePausedRewards.
 	UpdatePreference(*preferences.Preference) error
+	// UpdatePausedRewards saves the song request rewards that were paused when the stream
+	// went offline.
+	UpdatePausedRewards(id string, rewardIDs []string) error
 	DeletePreference(string) error
 }
 
@@ -31,4 +36,9 @@ func (n *NoopPreferenceStore) UpdatePreference(*preferences.Preference) error {
 	return nil
 }
 
+// UpdatePausedRewards implements PreferenceStore.
+func (n *NoopPreferenceStore) UpdatePausedRewards(string, []string) error {
+	return nil
+}
+
 var _ PreferenceStore = (*NoopPreferenceStore)(nil)
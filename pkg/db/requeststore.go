@@ -0,0 +1,101 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+)
+
+// ErrRequestChanged means that the request's status changed since it was read, because
+// something else handled it first
+var ErrRequestChanged = errors.New("request status changed")
+
+type RequestStore interface {
+	GetRequest(id string) (*requests.Request, error)
+	AddRequest(*requests.Request) error
+	UpdateRequest(*requests.Request) error
+	// TransitionRequest saves the request only if its saved status is still the given one,
+	// so that two handlers can't both move it along. It returns ErrRequestChanged if the
+	// status changed. Requests that were never saved are saved as they are.
+	TransitionRequest(r *requests.Request, from string) error
+	// RequestsForBroadcaster returns the broadcaster's requests with the given status,
+	// oldest first.
+	RequestsForBroadcaster(id, status string) ([]*requests.Request, error)
+	// CountViewerRequests counts the viewer's requests to the broadcaster with any of the
+	// given statuses, leaving out the request with the given ID.
+	CountViewerRequests(broadcasterID, viewerID, exceptID string, statuses []string) (int, error)
+	// LatestRequests returns the broadcaster's most recent requests, newest first.
+	LatestRequests(id string, limit int) ([]*requests.Request, error)
+	// RequestsForSession returns the requests that were made during the stream, whatever
+	// happened to them, oldest first.
+	RequestsForSession(sessionID string) ([]*requests.Request, error)
+	// StaleRequests returns all requests with the given status that were created
+	// before the given time.
+	StaleRequests(status string, before time.Time) ([]*requests.Request, error)
+	// BroadcastersWithRequests returns the broadcasters that have requests with any of the
+	// given statuses.
+	BroadcastersWithRequests(statuses []string) ([]string, error)
+	// OpenRequests returns all of the broadcaster's requests with any of the given statuses,
+	// however old they are, oldest first.
+	OpenRequests(id string, statuses []string) ([]*requests.Request, error)
+}
+
+type NoopRequestStore struct{}
+
+// AddRequest implements RequestStore.
+func (n *NoopRequestStore) AddRequest(*requests.Request) error {
+	return nil
+}
+
+// GetRequest implements RequestStore.
+func (n *NoopRequestStore) GetRequest(string) (*requests.Request, error) {
+	return nil, nil
+}
+
+// RequestsForBroadcaster implements RequestStore.
+func (n *NoopRequestStore) RequestsForBroadcaster(string, string) ([]*requests.Request, error) {
+	return nil, nil
+}
+
+// CountViewerRequests implements RequestStore.
+func (n *NoopRequestStore) CountViewerRequests(string, string, string, []string) (int, error) {
+	return 0, nil
+}
+
+// LatestRequests implements RequestStore.
+func (n *NoopRequestStore) LatestRequests(string, int) ([]*requests.Request, error) {
+	return nil, nil
+}
+
+// RequestsForSession implements RequestStore.
+func (n *NoopRequestStore) RequestsForSession(string) ([]*requests.Request, error) {
+	return nil, nil
+}
+
+// StaleRequests implements RequestStore.
+func (n *NoopRequestStore) StaleRequests(string, time.Time) ([]*requests.Request, error) {
+	return nil, nil
+}
+
+// BroadcastersWithRequests implements RequestStore.
+func (n *NoopRequestStore) BroadcastersWithRequests([]string) ([]string, error) {
+	return nil, nil
+}
+
+// OpenRequests implements RequestStore.
+func (n *NoopRequestStore) OpenRequests(string, []string) ([]*requests.Request, error) {
+	return nil, nil
+}
+
+// UpdateRequest implements RequestStore.
+func (n *NoopRequestStore) UpdateRequest(*requests.Request) error {
+	return nil
+}
+
+// TransitionRequest implements RequestStore.
+func (n *NoopRequestStore) TransitionRequest(*requests.Request, string) error {
+	return nil
+}
+
+var _ RequestStore = (*NoopRequestStore)(nil)
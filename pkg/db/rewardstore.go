@@ -0,0 +1,41 @@
+package db
+
+import "github.com/saxypandabear/twitchsongrequests/pkg/rewards"
+
+type RewardStore interface {
+	GetReward(id string) (*rewards.Reward, error)
+	// RewardsForBroadcaster returns all of the broadcaster's rewards, cheapest first.
+	RewardsForBroadcaster(broadcasterID string) ([]*rewards.Reward, error)
+	AddReward(*rewards.Reward) error
+	UpdateReward(*rewards.Reward) error
+	DeleteReward(id string) error
+}
+
+type NoopRewardStore struct{}
+
+// AddReward implements RewardStore.
+func (n *NoopRewardStore) AddReward(*rewards.Reward) error {
+	return nil
+}
+
+// DeleteReward implements RewardStore.
+func (n *NoopRewardStore) DeleteReward(string) error {
+	return nil
+}
+
+// GetReward implements RewardStore.
+func (n *NoopRewardStore) GetReward(string) (*rewards.Reward, error) {
+	return nil, nil
+}
+
+// RewardsForBroadcaster implements RewardStore.
+func (n *NoopRewardStore) RewardsForBroadcaster(string) ([]*rewards.Reward, error) {
+	return nil, nil
+}
+
+// UpdateReward implements RewardStore.
+func (n *NoopRewardStore) UpdateReward(*rewards.Reward) error {
+	return nil
+}
+
+var _ RewardStore = (*NoopRewardStore)(nil)
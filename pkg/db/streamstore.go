@@ -0,0 +1,57 @@
+package db
+
+import (
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+)
+
+type StreamStore interface {
+	// StartStream records that the broadcaster went live. Any of their streams that
+	// didn't go offline are ended when the new one starts.
+	StartStream(*streams.Stream) error
+	// EndStream records that the broadcaster went offline
+	EndStream(broadcasterID string, endedAt time.Time) error
+	// LatestStream returns the broadcaster's most recent stream, or nil if none were recorded.
+	LatestStream(broadcasterID string) (*streams.Stream, error)
+	// GetStream returns one of the broadcaster's streams, or nil if it wasn't recorded.
+	GetStream(broadcasterID, streamID string) (*streams.Stream, error)
+	// StreamsForBroadcaster returns up to limit of the broadcaster's streams, most recent first.
+	StreamsForBroadcaster(broadcasterID string, limit int) ([]*streams.Stream, error)
+	// SaveRecap stores the recap of a stream that went offline
+	SaveRecap(streamID string, recap *streams.Recap) error
+}
+
+type NoopStreamStore struct{}
+
+// StartStream implements StreamStore.
+func (n *NoopStreamStore) StartStream(*streams.Stream) error {
+	return nil
+}
+
+// EndStream implements StreamStore.
+func (n *NoopStreamStore) EndStream(string, time.Time) error {
+	return nil
+}
+
+// LatestStream implements StreamStore.
+func (n *NoopStreamStore) LatestStream(string) (*streams.Stream, error) {
+	return nil, nil
+}
+
+// GetStream implements StreamStore.
+func (n *NoopStreamStore) GetStream(string, string) (*streams.Stream, error) {
+	return nil, nil
+}
+
+// StreamsForBroadcaster implements StreamStore.
+func (n *NoopStreamStore) StreamsForBroadcaster(string, int) ([]*streams.Stream, error) {
+	return nil, nil
+}
+
+// SaveRecap implements StreamStore.
+func (n *NoopStreamStore) SaveRecap(string, *streams.Recap) error {
+	return nil
+}
+
+var _ StreamStore = (*NoopStreamStore)(nil)
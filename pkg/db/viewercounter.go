@@ -0,0 +1,68 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// ViewerRequestCounter keeps track of when each viewer made requests to a broadcaster,
+// so that per-viewer limits can be enforced.
+type ViewerRequestCounter interface {
+	AddViewerRequest(broadcasterID, viewerID string, at time.Time)
+	// ViewerRequestsSince returns the times of the viewer's requests to the broadcaster
+	// after the given time, newest first.
+	ViewerRequestsSince(broadcasterID, viewerID string, since time.Time) []time.Time
+}
+
+// ViewerRequestRetention is how long the in-memory counter holds on to requests.
+// Nothing needs to look back further than a day.
+const ViewerRequestRetention = 24 * time.Hour
+
+var _ ViewerRequestCounter = (*InMemoryViewerRequestCounter)(nil)
+
+// InMemoryViewerRequestCounter is a ViewerRequestCounter that is not shared across instances
+type InMemoryViewerRequestCounter struct {
+	mu       sync.Mutex
+	requests map[string][]time.Time
+}
+
+func NewInMemoryViewerRequestCounter() *InMemoryViewerRequestCounter {
+	return &InMemoryViewerRequestCounter{
+		requests: make(map[string][]time.Time),
+	}
+}
+
+// AddViewerRequest implements ViewerRequestCounter.
+func (c *InMemoryViewerRequestCounter) AddViewerRequest(broadcasterID, viewerID string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := viewerKey(broadcasterID, viewerID)
+	cutoff := time.Now().Add(-ViewerRequestRetention)
+	kept := make([]time.Time, 0, len(c.requests[key])+1)
+	for _, t := range c.requests[key] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	c.requests[key] = append(kept, at)
+}
+
+// ViewerRequestsSince implements ViewerRequestCounter.
+func (c *InMemoryViewerRequestCounter) ViewerRequestsSince(broadcasterID, viewerID string, since time.Time) []time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	times := c.requests[viewerKey(broadcasterID, viewerID)]
+	res := make([]time.Time, 0, len(times))
+	for i := len(times) - 1; i >= 0; i-- {
+		if times[i].After(since) {
+			res = append(res, times[i])
+		}
+	}
+	return res
+}
+
+func viewerKey(broadcasterID, viewerID string) string {
+	return broadcasterID + ":" + viewerID
+}
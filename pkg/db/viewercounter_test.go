@@ -0,0 +1,36 @@
+package db_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInMemoryViewerRequestsSince(t *testing.T) {
+	c := db.NewInMemoryViewerRequestCounter()
+	now := time.Now()
+
+	c.AddViewerRequest("12345", "1337", now.Add(-2*time.Hour))
+	c.AddViewerRequest("12345", "1337", now.Add(-time.Minute))
+	c.AddViewerRequest("12345", "7331", now)
+
+	times := c.ViewerRequestsSince("12345", "1337", now.Add(-3*time.Hour))
+	assert.Len(t, times, 2)
+	assert.Equal(t, now.Add(-time.Minute), times[0])
+	assert.Equal(t, now.Add(-2*time.Hour), times[1])
+
+	assert.Len(t, c.ViewerRequestsSince("12345", "1337", now.Add(-time.Hour)), 1)
+	assert.Empty(t, c.ViewerRequestsSince("54321", "1337", now.Add(-time.Hour)))
+}
+
+func TestInMemoryViewerRequestsPrunesOldRequests(t *testing.T) {
+	c := db.NewInMemoryViewerRequestCounter()
+	now := time.Now()
+
+	c.AddViewerRequest("12345", "1337", now.Add(-2*db.ViewerRequestRetention))
+	c.AddViewerRequest("12345", "1337", now)
+
+	assert.Len(t, c.ViewerRequestsSince("12345", "1337", time.Time{}), 1)
+}
@@ -7,4 +7,12 @@ type Message struct {
 	Success       int        `json:"success" column:"success"` // 0 = failure, 1 = success
 	BroadcasterID string     `json:"broadcaster_id" column:"broadcaster_id"`
 	SpotifyTrack  string     `json:"spotify_track" column:"spotify_track"`
+	// OriginalTrack is the song that was requested, if a different song was queued in its place
+	OriginalTrack string `json:"original_track,omitempty" column:"original_track"`
+	// SessionID is the stream that the request was made in, or empty if the broadcaster wasn't live
+	SessionID string `json:"session_id,omitempty" column:"session_id"`
+	// UserName is the viewer that made the request
+	UserName  string `json:"user_name,omitempty" column:"user_name"`
+	TrackName string `json:"track_name,omitempty" column:"track_name"`
+	Artist    string `json:"artist,omitempty" column:"artist"`
 }
@@ -1,8 +1,130 @@
 package preferences
 
+// The default chat replies. {user} is the viewer, {song} and {artist} describe the song,
+// {position} is the song's place in the queue, and {reason} is why the request was rejected.
+const (
+	DefaultQueuedReply   = "@{user} queued '{song}' by {artist} (#{position} in queue)"
+	DefaultRejectedReply = "@{user} rejected: {reason}"
+)
+
+// FulfillmentPolicy decides what happens to a channel point redemption once its request
+// was handled. Requests that were refused, like ones that a moderator rejected or that the
+// viewer cancelled, are always refunded.
+type FulfillmentPolicy string
+
+const (
+	// FulfillImmediately fulfills the redemption once the song is queued, and refunds it
+	// otherwise
+	FulfillImmediately FulfillmentPolicy = ""
+	// FulfillManually leaves the redemption for the broadcaster to fulfill or refund in
+	// the Twitch dashboard
+	FulfillManually FulfillmentPolicy = "manual"
+	// FulfillOnPlay fulfills the redemption once the song starts playing, and refunds it
+	// if the song couldn't be queued
+	FulfillOnPlay FulfillmentPolicy = "on-play"
+	// FulfillNoViewerRefunds keeps the viewer's points when they asked for something that
+	// can't be queued, like an invalid link, but still refunds them when the song
+	// couldn't be queued for other reasons
+	FulfillNoViewerRefunds FulfillmentPolicy = "no-viewer-refunds"
+)
+
+// FulfillmentPolicies are all of the fulfillment policies that can be picked
+var FulfillmentPolicies = []FulfillmentPolicy{FulfillImmediately, FulfillManually, FulfillOnPlay, FulfillNoViewerRefunds}
+
+// DefaultChatCommand is the chat command for song requests, when the user hasn't picked one
+const DefaultChatCommand = "!sr"
+
+// The roles that the chat command and the song request reward can be limited to.
+// Only the reward can be limited to followers.
+const (
+	RoleSubscriber = "subscriber"
+	RoleVIP        = "vip"
+	RoleModerator  = "moderator"
+	RoleFollower   = "follower"
+)
+
 type Preference struct {
-	TwitchID       string `column:"id"`
-	ExplicitSongs  bool   `column:"explicit"`
-	CustomRewardID string `column:"reward_id"`
-	MaxSongLength  int    `column:"max_song_length" unit:"milliseconds"`
+	TwitchID      string `column:"id"`
+	ExplicitSongs bool   `column:"explicit"`
+	// CleanSubstitute queues the clean version of an explicit song, when explicit songs aren't allowed
+	CleanSubstitute bool   `column:"clean_substitute"`
+	CustomRewardID  string `column:"reward_id"`
+	MaxSongLength   int    `column:"max_song_length" unit:"milliseconds"`
+	// Moderated requests are held for approval instead of being queued immediately
+	Moderated bool `column:"moderated"`
+	// Per-viewer limits. A value of 0 means there is no limit. The request limit is per day,
+	// or per stream with ViewerLimitPerStream, and ViewerMaxPending counts the requests that
+	// haven't been queued yet.
+	ViewerCooldown       int  `column:"viewer_cooldown" unit:"seconds"`
+	ViewerRequestLimit   int  `column:"viewer_request_limit" unit:"requests per day or stream"`
+	ViewerLimitPerStream bool `column:"viewer_limit_per_stream"`
+	ViewerMaxPending     int  `column:"viewer_max_pending"`
+	// DuplicateWindow is how long a song has to wait before it can be requested again.
+	// A value of 0 only rejects songs that are already in the queue.
+	DuplicateWindow int `column:"duplicate_window" unit:"minutes"`
+	// Songs that match the block list are rejected, unless they also match the allow list.
+	// When AllowlistOnly is set, only songs that match the allow list can be requested.
+	// The lists are stored in the blocked_* and allowed_* columns.
+	Blocklist     SongFilter
+	Allowlist     SongFilter
+	AllowlistOnly bool `column:"allowlist_only"`
+	// What to queue for links to something other than a song. When these are off,
+	// the request is rejected.
+	AlbumFirstTrack    bool `column:"album_first_track"`
+	PlaylistFirstTrack bool `column:"playlist_first_track"`
+	ArtistTopTrack     bool `column:"artist_top_track"`
+	// DeviceID is the Spotify device that songs are queued on. When it is empty, or the
+	// device is offline, songs are queued on whichever device is active.
+	DeviceID string `column:"device_id"`
+	// ChatReplies posts the outcome of each request in the broadcaster's chat. The replies
+	// are templates, and the default reply is used when one is empty.
+	ChatReplies   bool   `column:"chat_replies"`
+	QueuedReply   string `column:"queued_reply"`
+	RejectedReply string `column:"rejected_reply"`
+	// ChatRequests lets viewers request songs with a chat command, as well as with
+	// channel points. ChatCommand defaults to DefaultChatCommand, and when ChatRoles is
+	// set, only viewers with one of the roles can use it.
+	ChatRequests bool     `column:"chat_requests"`
+	ChatCommand  string   `column:"chat_command"`
+	ChatRoles    []string `column:"chat_roles"`
+	// MinCheerBits is the fewest bits that a cheer needs to request a song, where 0 means
+	// that cheers can't request songs. With CheerPriority, cheers are queued before the
+	// channel point and chat requests that are still waiting. Bits can't be refunded, so
+	// cheers are never held for approval, or turned down by the request rules.
+	MinCheerBits  int  `column:"min_cheer_bits"`
+	CheerPriority bool `column:"cheer_priority"`
+	// RequestRoles limits the song request reward to viewers with one of the roles, and
+	// anyone can redeem it when it is empty. Followers only count once they have followed
+	// for at least MinFollowDays.
+	RequestRoles  []string `column:"request_roles"`
+	MinFollowDays int      `column:"min_follow_days" unit:"days"`
+	// LiveOnly only takes requests while the stream is live. The song request rewards are
+	// paused when the stream goes offline, and unpaused when it goes live.
+	LiveOnly bool `column:"live_only"`
+	// PausedRewards are the song request rewards that were paused when the stream went
+	// offline. Only they are unpaused when it goes live, and not the ones that the
+	// broadcaster paused themselves. It is saved on its own, so that saving the other
+	// preferences doesn't undo it.
+	PausedRewards []string `column:"paused_rewards"`
+	// CancelWindow is how long viewers have to cancel their own request with the cancel
+	// chat command, where 0 means that viewers can't cancel. Only requests that are still
+	// waiting for approval, or for the Spotify player to be open, can be cancelled.
+	CancelWindow int `column:"cancel_window" unit:"minutes"`
+	// Fulfillment decides what happens to the channel point redemptions of the song
+	// request rewards
+	Fulfillment FulfillmentPolicy `column:"fulfillment"`
+}
+
+// SongFilter is a list of Spotify IDs and keywords that a song can match
+type SongFilter struct {
+	Tracks  []string
+	Artists []string
+	Albums  []string
+	// Keywords are matched against the song's title, ignoring case
+	Keywords []string
+}
+
+// IsEmpty checks if there is nothing in the filter to match against
+func (f *SongFilter) IsEmpty() bool {
+	return len(f.Tracks) == 0 && len(f.Artists) == 0 && len(f.Albums) == 0 && len(f.Keywords) == 0
 }
@@ -2,15 +2,27 @@ package queue
 
 import (
 	"context"
+	"errors"
 
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"github.com/zmb3/spotify/v2"
 )
 
+// ErrNoActiveDevice means that the song couldn't be queued because the user's Spotify
+// player isn't open anywhere. The request can be tried again once it is.
+var ErrNoActiveDevice = errors.New("no active Spotify device")
+
 // Queuer is the interface facade around the Spotify client to allow for local unit test mocking.
 type Queuer interface {
 	QueueSong(ctx context.Context, trackID spotify.ID) error
+	QueueSongOpt(ctx context.Context, trackID spotify.ID, opt *spotify.PlayOptions) error
+	PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error)
 	GetTrack(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.FullTrack, error)
+	GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error)
+	GetQueue(ctx context.Context) (*spotify.Queue, error)
+	GetAlbumTracks(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.SimpleTrackPage, error)
+	GetPlaylistItems(ctx context.Context, playlistID spotify.ID, opts ...spotify.RequestOption) (*spotify.PlaylistItemPage, error)
+	GetArtistsTopTracks(ctx context.Context, artistID spotify.ID, country string) ([]spotify.FullTrack, error)
 	Search(ctx context.Context, query string, t spotify.SearchType, opts ...spotify.RequestOption) (*spotify.SearchResult, error)
 }
 
@@ -18,5 +30,39 @@ type Publisher interface {
 	// Publish takes a Spotify client and a value (the URL for the Spotify track)
 	// and attempts to queue the song to the user's player. The client parameter is tied
 	// to an individual user's access token.
-	Publish(client Queuer, input string, p *preferences.Preference) (spotify.ID, error)
+	Publish(client Queuer, input string, p *preferences.Preference) (Result, error)
+}
+
+// InputKind is what the input for a request was recognized as
+type InputKind string
+
+const (
+	// InputSearch is input that isn't a link, so it gets searched for
+	InputSearch    InputKind = "search"
+	InputTrack     InputKind = "track"
+	InputAlbum     InputKind = "album"
+	InputPlaylist  InputKind = "playlist"
+	InputArtist    InputKind = "artist"
+	InputEpisode   InputKind = "episode"
+	InputShow      InputKind = "show"
+	InputShortLink InputKind = "short link"
+	// InputLink is a link to a site that isn't supported. Links to other music
+	// services that are supported are reported with the name of the service.
+	InputLink InputKind = "link"
+)
+
+// Result describes the song that a request resolved to
+type Result struct {
+	// Kind is what the input was recognized as
+	Kind InputKind
+	// TrackID is the song that was queued, or that failed to queue
+	TrackID spotify.ID
+	// OriginalTrackID is the song that was requested, when a different
+	// song was queued in its place
+	OriginalTrackID spotify.ID
+	// Name and Artist describe the song in TrackID, once it was found
+	Name   string
+	Artist string
+	// Device is the name of the Spotify device that the song was queued on, if it's known
+	Device string
 }
@@ -0,0 +1,19 @@
+package requests
+
+// Outcome is how a request was handled, which decides what happens to its channel point
+// redemption
+type Outcome string
+
+const (
+	// OutcomeQueued is a request whose song was sent to the player
+	OutcomeQueued Outcome = "queued"
+	// OutcomeViewerError is a request for something that can't be queued, like an invalid
+	// link, or a song that is blocked or too long
+	OutcomeViewerError Outcome = "viewer_error"
+	// OutcomeRefused is a request that was turned down by the broadcaster's rules or
+	// moderators, cancelled by the viewer, or not handled in time
+	OutcomeRefused Outcome = "refused"
+	// OutcomeSystemError is a request that failed for reasons that aren't the viewer's
+	// fault, like Spotify or Twitch not responding
+	OutcomeSystemError Outcome = "system_error"
+)
@@ -0,0 +1,117 @@
+package requests
+
+import "time"
+
+const (
+	// StatusRequested is a request that was received from Twitch, and is waiting
+	// to be processed.
+	StatusRequested = "requested"
+	// StatusPending is a request that is waiting for the broadcaster, or one of
+	// their moderators, to approve it before it gets queued.
+	StatusPending = "pending"
+	// StatusApproved is a request that was approved, and is waiting to be sent
+	// to the player.
+	StatusApproved = "approved"
+	// StatusHeld is a request that is waiting for the broadcaster's Spotify player
+	// to be open, before it is sent to the player.
+	StatusHeld = "held"
+	// StatusQueued is a request that was sent to the player.
+	StatusQueued = "queued"
+	// StatusPlaying is a request whose song is playing on the player.
+	StatusPlaying = "playing"
+	// StatusPlayed is a request whose song played until the end.
+	StatusPlayed = "played"
+	// StatusSkipped is a request whose song was skipped, either while it was playing
+	// or before it started.
+	StatusSkipped = "skipped"
+	// StatusFailed is a request that could not be sent to the player.
+	StatusFailed = "failed"
+	// StatusRejected is a request that was rejected, and refunded.
+	StatusRejected = "rejected"
+	// StatusExpired is a request that was not reviewed in time, and refunded.
+	StatusExpired = "expired"
+	// StatusCancelled is a request that the viewer cancelled before it was queued,
+	// and refunded.
+	StatusCancelled = "cancelled"
+)
+
+// What was done with a channel point redemption. All but RedemptionAwaitingPlay are the
+// statuses of a redemption on Twitch.
+const (
+	// RedemptionUnfulfilled is a redemption that was left for the broadcaster to
+	// fulfill or refund
+	RedemptionUnfulfilled = "UNFULFILLED"
+	RedemptionFulfilled   = "FULFILLED"
+	// RedemptionCanceled is a redemption that was refunded
+	RedemptionCanceled = "CANCELED"
+	// RedemptionAwaitingPlay is a redemption that is unfulfilled on Twitch until the
+	// song starts playing
+	RedemptionAwaitingPlay = "AWAITING_PLAY"
+)
+
+// ReasonCancelledByViewer is the reason that is recorded for requests that the viewer
+// cancelled themselves
+const ReasonCancelledByViewer = "cancelled by viewer"
+
+const (
+	// SourceReward is a request that was made by redeeming the channel point reward
+	SourceReward = "reward"
+	// SourceChat is a request that was made with the chat command
+	SourceChat = "chat"
+	// SourceCheer is a request that was paid for with bits
+	SourceCheer = "cheer"
+)
+
+// Request is a single song request from a viewer. The ID is the ID of the
+// channel point redemption that created it, so that the redemption can still
+// be fulfilled or refunded after the request is persisted. Requests made in
+// chat use the ID of the chat message instead, and cheers use the ID of the
+// EventSub message.
+type Request struct {
+	ID               string `column:"id"`
+	BroadcasterID    string `column:"broadcaster_id"`
+	BroadcasterLogin string `column:"broadcaster_login"`
+	RewardID         string `column:"reward_id"`
+	UserID           string `column:"user_id"`
+	UserLogin        string `column:"user_login"`
+	UserName         string `column:"user_name"`
+	Input            string `column:"user_input"`
+	Status           string `column:"status"`
+	Source           string `column:"source"`
+	// Bits is how many bits were cheered for the request, which can't be refunded
+	Bits int `column:"bits"`
+	// Reason is why the request was closed without being queued, if that was recorded
+	Reason string `column:"reason"`
+	// TrackID is the Spotify song that was queued for the request
+	TrackID string `column:"track_id"`
+	// TrackName is the name of the Spotify song that the request was for, once it was found
+	TrackName string `column:"track_name"`
+	// Device is the name of the Spotify device that the song was queued on, if it's known
+	Device string `column:"device"`
+	// SessionID is the stream that the request was made in, or empty if the broadcaster
+	// wasn't live
+	SessionID string `column:"session_id"`
+	// Redemption is what was done with the channel point redemption, or empty if there is
+	// no redemption or nothing was done with it yet
+	Redemption string `column:"redemption_status"`
+	// PlayedAt is when the song started playing on the player
+	PlayedAt  *time.Time `column:"played_at"`
+	CreatedAt *time.Time `column:"created_at"`
+	UpdatedAt *time.Time `column:"updated_at"`
+}
+
+// WasQueued checks if the request's song was sent to the player, whether or not it played
+func (r *Request) WasQueued() bool {
+	switch r.Status {
+	case StatusQueued, StatusPlaying, StatusPlayed, StatusSkipped:
+		return true
+	}
+	return false
+}
+
+// IsRedemption checks if the request was made with channel points, which means that
+// there is a redemption to fulfill or refund. Requests saved before there were other
+// sources have no source.
+func (r *Request) IsRedemption() bool {
+	return r.Source == "" || r.Source == SourceReward
+}
@@ -0,0 +1,121 @@
+package retry
+
+import (
+	"context"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/zmb3/spotify/v2"
+	"go.uber.org/zap"
+)
+
+var _ queue.Queuer = (*Queuer)(nil)
+
+// Queuer retries the calls that the wrapped Queuer makes to Spotify
+type Queuer struct {
+	queue  queue.Queuer
+	policy Policy
+	fields []zap.Field
+}
+
+// NewQueuer wraps the Queuer, and logs its retries with the given fields
+func NewQueuer(q queue.Queuer, p Policy, fields ...zap.Field) *Queuer {
+	return &Queuer{
+		queue:  q,
+		policy: p,
+		fields: fields,
+	}
+}
+
+// QueueSong is only retried when it is rate limited. After a server error, the song
+// may have been queued already, and queueing it again would play it twice.
+func (q *Queuer) QueueSong(ctx context.Context, trackID spotify.ID) error {
+	return do(ctx, q.policy, RateLimited, func() error {
+		return q.queue.QueueSong(ctx, trackID)
+	}, q.with("QueueSong")...)
+}
+
+// QueueSongOpt is only retried when it is rate limited, like QueueSong
+func (q *Queuer) QueueSongOpt(ctx context.Context, trackID spotify.ID, opt *spotify.PlayOptions) error {
+	return do(ctx, q.policy, RateLimited, func() error {
+		return q.queue.QueueSongOpt(ctx, trackID, opt)
+	}, q.with("QueueSongOpt")...)
+}
+
+func (q *Queuer) PlayerDevices(ctx context.Context) ([]spotify.PlayerDevice, error) {
+	var res []spotify.PlayerDevice
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.PlayerDevices(ctx)
+		return err
+	}, q.with("PlayerDevices")...)
+	return res, err
+}
+
+func (q *Queuer) GetTrack(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.FullTrack, error) {
+	var res *spotify.FullTrack
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetTrack(ctx, id, opts...)
+		return err
+	}, q.with("GetTrack")...)
+	return res, err
+}
+
+func (q *Queuer) GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error) {
+	var res []*spotify.FullTrack
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetTracks(ctx, ids, opts...)
+		return err
+	}, q.with("GetTracks")...)
+	return res, err
+}
+
+func (q *Queuer) GetQueue(ctx context.Context) (*spotify.Queue, error) {
+	var res *spotify.Queue
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetQueue(ctx)
+		return err
+	}, q.with("GetQueue")...)
+	return res, err
+}
+
+func (q *Queuer) GetAlbumTracks(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.SimpleTrackPage, error) {
+	var res *spotify.SimpleTrackPage
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetAlbumTracks(ctx, id, opts...)
+		return err
+	}, q.with("GetAlbumTracks")...)
+	return res, err
+}
+
+func (q *Queuer) GetPlaylistItems(ctx context.Context, playlistID spotify.ID, opts ...spotify.RequestOption) (*spotify.PlaylistItemPage, error) {
+	var res *spotify.PlaylistItemPage
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetPlaylistItems(ctx, playlistID, opts...)
+		return err
+	}, q.with("GetPlaylistItems")...)
+	return res, err
+}
+
+func (q *Queuer) GetArtistsTopTracks(ctx context.Context, artistID spotify.ID, country string) ([]spotify.FullTrack, error) {
+	var res []spotify.FullTrack
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.GetArtistsTopTracks(ctx, artistID, country)
+		return err
+	}, q.with("GetArtistsTopTracks")...)
+	return res, err
+}
+
+func (q *Queuer) Search(ctx context.Context, query string, t spotify.SearchType, opts ...spotify.RequestOption) (*spotify.SearchResult, error) {
+	var res *spotify.SearchResult
+	err := Do(ctx, q.policy, func() (err error) {
+		res, err = q.queue.Search(ctx, query, t, opts...)
+		return err
+	}, q.with("Search")...)
+	return res, err
+}
+
+// with adds the name of the call to the log fields
+func (q *Queuer) with(call string) []zap.Field {
+	fields := make([]zap.Field, 0, len(q.fields)+1)
+	fields = append(fields, q.fields...)
+	return append(fields, zap.String("call", call))
+}
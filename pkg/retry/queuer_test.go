@@ -0,0 +1,70 @@
+package retry_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify/v2"
+)
+
+var queuerPolicy = retry.Policy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    5 * time.Millisecond,
+	Deadline:    time.Second,
+}
+
+// flakyQueuer fails the first calls with the given error
+type flakyQueuer struct {
+	testutil.MockQueuer
+	failures int
+	err      error
+	calls    int
+}
+
+func (q *flakyQueuer) QueueSong(ctx context.Context, id spotify.ID) error {
+	q.calls++
+	if q.calls <= q.failures {
+		return q.err
+	}
+	return nil
+}
+
+func (q *flakyQueuer) GetTrack(ctx context.Context, id spotify.ID, opts ...spotify.RequestOption) (*spotify.FullTrack, error) {
+	q.calls++
+	if q.calls <= q.failures {
+		return nil, q.err
+	}
+	return &spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: id}}, nil
+}
+
+func TestQueuerRetriesGetTrack(t *testing.T) {
+	f := flakyQueuer{failures: 2, err: &retry.Error{StatusCode: http.StatusBadGateway}}
+	q := retry.NewQueuer(&f, queuerPolicy)
+
+	track, err := q.GetTrack(context.Background(), "abc")
+	assert.NoError(t, err)
+	assert.Equal(t, spotify.ID("abc"), track.ID)
+	assert.Equal(t, 3, f.calls)
+}
+
+func TestQueuerRetriesQueueSongRateLimit(t *testing.T) {
+	f := flakyQueuer{failures: 1, err: &retry.Error{StatusCode: http.StatusTooManyRequests}}
+	q := retry.NewQueuer(&f, queuerPolicy)
+
+	assert.NoError(t, q.QueueSong(context.Background(), "abc"))
+	assert.Equal(t, 2, f.calls)
+}
+
+func TestQueuerDoesNotRetryQueueSongServerError(t *testing.T) {
+	f := flakyQueuer{failures: 1, err: &retry.Error{StatusCode: http.StatusInternalServerError}}
+	q := retry.NewQueuer(&f, queuerPolicy)
+
+	assert.Error(t, q.QueueSong(context.Background(), "abc"))
+	assert.Equal(t, 1, f.calls)
+}
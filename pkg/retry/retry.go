@@ -0,0 +1,196 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/zmb3/spotify/v2"
+	"go.uber.org/zap"
+)
+
+// Policy controls how many times, and for how long, a call is retried
+type Policy struct {
+	// MaxAttempts is the most times the call is made, including the first time
+	MaxAttempts int
+	// BaseDelay is the wait before the first retry, which doubles for every retry after
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between two attempts
+	MaxDelay time.Duration
+	// Deadline caps the total time spent on the call, including waits. A retry that
+	// would have to wait past the deadline is not made.
+	Deadline time.Duration
+}
+
+// DefaultPolicy is short enough that a song request doesn't hold up the requests
+// behind it for long
+var DefaultPolicy = Policy{
+	MaxAttempts: 4,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    5 * time.Second,
+	Deadline:    20 * time.Second,
+}
+
+// Error is an error response from an API, with how long the API asked to wait
+// before trying again.
+type Error struct {
+	StatusCode int
+	RetryAfter time.Duration
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("HTTP %d: %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// Retryable reports whether the error is temporary, and how long the API asked to
+// wait before trying again, if it did. Rate limits, server errors and timeouts are
+// temporary. Everything else, like a missing track or a revoked token, is permanent.
+func Retryable(err error) (bool, time.Duration) {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+
+	var re *Error
+	if errors.As(err, &re) {
+		return retryableStatus(re.StatusCode), re.RetryAfter
+	}
+	var se spotify.Error
+	if errors.As(err, &se) {
+		return retryableStatus(se.Status), 0
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true, 0
+	}
+	return false, 0
+}
+
+// RateLimited reports whether the error is a rate limit, and how long the API asked
+// to wait before trying again. The call was turned away before it did anything, so it
+// is safe to retry even when repeating the call would not be.
+func RateLimited(err error) (bool, time.Duration) {
+	var re *Error
+	if errors.As(err, &re) && re.StatusCode == http.StatusTooManyRequests {
+		return true, re.RetryAfter
+	}
+	var se spotify.Error
+	if errors.As(err, &se) && se.Status == http.StatusTooManyRequests {
+		return true, 0
+	}
+	return false, 0
+}
+
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// Do calls fn until it succeeds, fails with a permanent error, or runs out of attempts
+// or time. Retries and the final outcome are logged with the given fields.
+func Do(ctx context.Context, p Policy, fn func() error, fields ...zap.Field) error {
+	return do(ctx, p, Retryable, fn, fields...)
+}
+
+// DoRateLimited is like Do, but only retries rate limits, for calls that aren't safe
+// to repeat after a server error
+func DoRateLimited(ctx context.Context, p Policy, fn func() error, fields ...zap.Field) error {
+	return do(ctx, p, RateLimited, fn, fields...)
+}
+
+func do(ctx context.Context, p Policy, retryable func(error) (bool, time.Duration), fn func() error, fields ...zap.Field) error {
+	deadline := time.Now().Add(p.Deadline)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			if attempt > 1 {
+				zap.L().Info("call succeeded after retrying", append(fields, zap.Int("attempts", attempt))...)
+			}
+			return nil
+		}
+
+		ok, wait := retryable(err)
+		if !ok {
+			if attempt > 1 {
+				zap.L().Error("call failed permanently after retrying", append(fields, zap.Int("attempts", attempt), zap.Error(err))...)
+			}
+			return err
+		}
+		if attempt >= p.MaxAttempts {
+			zap.L().Error("giving up after too many attempts", append(fields, zap.Int("attempts", attempt), zap.Error(err))...)
+			return err
+		}
+		if wait <= 0 {
+			wait = p.backoff(attempt)
+		}
+		if time.Now().Add(wait).After(deadline) {
+			zap.L().Error("giving up because the retry would pass the deadline", append(fields, zap.Int("attempts", attempt), zap.Duration("wait", wait), zap.Error(err))...)
+			return err
+		}
+
+		zap.L().Warn("retrying failed call", append(fields, zap.Int("attempt", attempt), zap.Duration("wait", wait), zap.Error(err))...)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff doubles the delay for every attempt, and then picks a random wait between
+// half of the delay and all of it, so that calls that failed together don't all
+// retry together.
+func (p Policy) backoff(attempt int) time.Duration {
+	d := p.BaseDelay << (attempt - 1)
+	if d <= 0 || d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + rand.N(half+1)
+}
+
+// HelixError converts a failed Twitch API response into an Error, honoring Twitch's
+// rate limit reset time. It returns nil for successful responses.
+func HelixError(r *helix.ResponseCommon) error {
+	if r.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	e := Error{
+		StatusCode: r.StatusCode,
+		Message:    r.ErrorMessage,
+		RetryAfter: retryAfter(r.Header),
+	}
+	if e.RetryAfter == 0 && r.StatusCode == http.StatusTooManyRequests {
+		// https://dev.twitch.tv/docs/api/guide/#twitch-rate-limits
+		if reset, err := strconv.ParseInt(r.Header.Get("Ratelimit-Reset"), 10, 64); err == nil {
+			e.RetryAfter = max(time.Until(time.Unix(reset, 0)), 0)
+		}
+	}
+	return &e
+}
+
+// retryAfter reads the Retry-After header, which is either a number of seconds or a date
+func retryAfter(h http.Header) time.Duration {
+	raw := h.Get("Retry-After")
+	if raw == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(raw); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
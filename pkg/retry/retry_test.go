@@ -0,0 +1,142 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nicklaw5/helix/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify/v2"
+)
+
+var testPolicy = Policy{
+	MaxAttempts: 3,
+	BaseDelay:   time.Millisecond,
+	MaxDelay:    5 * time.Millisecond,
+	Deadline:    time.Second,
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+		wait      time.Duration
+	}{
+		{nil, false, 0},
+		{errors.New("foo"), false, 0},
+		{context.Canceled, false, 0},
+		{&Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Second}, true, time.Second},
+		{fmt.Errorf("wrapped: %w", &Error{StatusCode: http.StatusBadGateway}), true, 0},
+		{&Error{StatusCode: http.StatusNotFound}, false, 0},
+		{spotify.Error{Status: http.StatusServiceUnavailable}, true, 0},
+		{spotify.Error{Status: http.StatusUnauthorized}, false, 0},
+	}
+
+	for _, test := range tests {
+		retryable, wait := Retryable(test.err)
+		assert.Equal(t, test.retryable, retryable, test.err)
+		assert.Equal(t, test.wait, wait, test.err)
+	}
+}
+
+func TestRateLimited(t *testing.T) {
+	ok, _ := RateLimited(&Error{StatusCode: http.StatusTooManyRequests})
+	assert.True(t, ok)
+	ok, _ = RateLimited(spotify.Error{Status: http.StatusTooManyRequests})
+	assert.True(t, ok)
+	ok, _ = RateLimited(&Error{StatusCode: http.StatusInternalServerError})
+	assert.False(t, ok)
+}
+
+func TestDoRetriesTemporaryErrors(t *testing.T) {
+	var calls int
+	err := Do(context.Background(), testPolicy, func() error {
+		calls++
+		if calls < 3 {
+			return &Error{StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, calls)
+}
+
+func TestDoStopsOnPermanentError(t *testing.T) {
+	var calls int
+	err := Do(context.Background(), testPolicy, func() error {
+		calls++
+		return &Error{StatusCode: http.StatusNotFound}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestDoGivesUpAfterMaxAttempts(t *testing.T) {
+	var calls int
+	err := Do(context.Background(), testPolicy, func() error {
+		calls++
+		return &Error{StatusCode: http.StatusInternalServerError}
+	})
+	var re *Error
+	assert.ErrorAs(t, err, &re)
+	assert.Equal(t, testPolicy.MaxAttempts, calls)
+}
+
+func TestDoHonorsRetryAfter(t *testing.T) {
+	var calls int
+	start := time.Now()
+	err := Do(context.Background(), testPolicy, func() error {
+		calls++
+		if calls == 1 {
+			return &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: 50 * time.Millisecond}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+func TestDoStopsBeforeDeadline(t *testing.T) {
+	var calls int
+	err := Do(context.Background(), testPolicy, func() error {
+		calls++
+		return &Error{StatusCode: http.StatusTooManyRequests, RetryAfter: time.Hour}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestBackoff(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt := 1; attempt < 10; attempt++ {
+		d := p.backoff(attempt)
+		assert.LessOrEqual(t, d, p.MaxDelay)
+		assert.Greater(t, d, time.Duration(0))
+	}
+	assert.LessOrEqual(t, p.backoff(1), 100*time.Millisecond)
+	assert.GreaterOrEqual(t, p.backoff(1), 50*time.Millisecond)
+}
+
+func TestHelixError(t *testing.T) {
+	assert.NoError(t, HelixError(&helix.ResponseCommon{StatusCode: http.StatusOK}))
+
+	reset := time.Now().Add(30 * time.Second).Unix()
+	err := HelixError(&helix.ResponseCommon{
+		StatusCode:   http.StatusTooManyRequests,
+		ErrorMessage: "slow down",
+		Header:       http.Header{"Ratelimit-Reset": []string{strconv.FormatInt(reset, 10)}},
+	})
+	retryable, wait := Retryable(err)
+	assert.True(t, retryable)
+	assert.Greater(t, wait, 20*time.Second)
+	assert.Contains(t, err.Error(), "slow down")
+
+	err = HelixError(&helix.ResponseCommon{StatusCode: http.StatusBadRequest, ErrorMessage: "bad"})
+	retryable, _ = Retryable(err)
+	assert.False(t, retryable)
+}
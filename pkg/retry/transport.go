@@ -0,0 +1,37 @@
+package retry
+
+import (
+	"io"
+	"net/http"
+)
+
+// maxErrorBody caps how much of an error response is read into the error message
+const maxErrorBody = 1024
+
+// Transport turns rate limited and server error responses into an Error, so that
+// the Retry-After header is still available to Retryable after an API client decodes
+// the response. Other responses are passed through as is.
+type Transport struct {
+	// Base makes the requests. If it is nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	resp, err := base.RoundTrip(req)
+	if err != nil || !retryableStatus(resp.StatusCode) {
+		return resp, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return nil, &Error{
+		StatusCode: resp.StatusCode,
+		RetryAfter: retryAfter(resp.Header),
+		Message:    string(body),
+	}
+}
@@ -0,0 +1,35 @@
+package rewards
+
+import "github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+
+// Reward is one of a broadcaster's song request rewards. Each reward has its own cost,
+// and its own rules for the songs that can be requested with it, which take the place
+// of the same rules in the broadcaster's preferences.
+type Reward struct {
+	// ID is the ID of the Channel Point reward on Twitch
+	ID            string `column:"id"`
+	BroadcasterID string `column:"broadcaster_id"`
+	Title         string `column:"title"`
+	Cost          int    `column:"cost"`
+	// SubscriptionID is the EventSub subscription for redemptions of this reward
+	SubscriptionID string `column:"subscription_id"`
+	// MaxSongLength is the longest song that can be requested, where 0 means any length
+	MaxSongLength int  `column:"max_song_length" unit:"milliseconds"`
+	ExplicitSongs bool `column:"explicit"`
+	// Priority requests are queued before the requests that are still waiting
+	Priority bool `column:"priority"`
+}
+
+// Apply returns a copy of the preferences, with the reward's rules in place of the
+// broadcaster's. The preferences can be nil, and are left untouched.
+func (r *Reward) Apply(p *preferences.Preference) *preferences.Preference {
+	var applied preferences.Preference
+	if p != nil {
+		applied = *p
+	} else {
+		applied.TwitchID = r.BroadcasterID
+	}
+	applied.MaxSongLength = r.MaxSongLength
+	applied.ExplicitSongs = r.ExplicitSongs
+	return &applied
+}
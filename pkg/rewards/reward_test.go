@@ -0,0 +1,44 @@
+package rewards
+
+import (
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	p := preferences.Preference{
+		TwitchID:        "12345",
+		MaxSongLength:   600000,
+		ExplicitSongs:   true,
+		CleanSubstitute: true,
+	}
+	r := Reward{
+		ID:            "abc-123",
+		BroadcasterID: "12345",
+		MaxSongLength: 240000,
+	}
+
+	applied := r.Apply(&p)
+	assert.Equal(t, 240000, applied.MaxSongLength)
+	assert.False(t, applied.ExplicitSongs)
+	// everything else comes from the preferences
+	assert.True(t, applied.CleanSubstitute)
+	// and the preferences are left alone
+	assert.Equal(t, 600000, p.MaxSongLength)
+	assert.True(t, p.ExplicitSongs)
+}
+
+func TestApplyNoPreferences(t *testing.T) {
+	r := Reward{
+		ID:            "abc-123",
+		BroadcasterID: "12345",
+		ExplicitSongs: true,
+	}
+
+	applied := r.Apply(nil)
+	assert.Equal(t, "12345", applied.TwitchID)
+	assert.True(t, applied.ExplicitSongs)
+	assert.Zero(t, applied.MaxSongLength)
+}
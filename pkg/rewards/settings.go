@@ -0,0 +1,65 @@
+package rewards
+
+import (
+	"errors"
+	"regexp"
+)
+
+const (
+	// MaxTitleLength is the longest title that Twitch allows for a reward
+	MaxTitleLength = 45
+	// MaxPromptLength is the longest prompt that Twitch allows for a reward
+	MaxPromptLength = 200
+)
+
+var (
+	ErrTitle           = errors.New("the reward needs a title of at most 45 characters")
+	ErrPrompt          = errors.New("the reward's prompt can be at most 200 characters")
+	ErrCost            = errors.New("the reward needs to cost at least 1 channel point")
+	ErrLimit           = errors.New("the reward's limits and cooldown can't be negative")
+	ErrBackgroundColor = errors.New("the reward's background color needs to be a hex color like #9147FF")
+
+	backgroundColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// Settings are how a song request reward is set up on Twitch. They are kept on Twitch,
+// not in the database, so that changes made on either side don't have to be merged.
+type Settings struct {
+	Title  string
+	Prompt string
+	Cost   int
+	// MaxPerStream is how many times the reward can be redeemed in a stream, where 0
+	// means there is no limit
+	MaxPerStream int
+	// MaxPerUserPerStream is how many times each viewer can redeem the reward in a
+	// stream, where 0 means there is no limit
+	MaxPerUserPerStream int
+	// GlobalCooldown is how long the reward can't be redeemed after a redemption, where
+	// 0 means there is no cooldown
+	GlobalCooldown int `unit:"seconds"`
+	// BackgroundColor is a hex color like #9147FF, where empty means Twitch's default
+	BackgroundColor string
+	Enabled         bool
+	Paused          bool
+}
+
+// Validate checks the settings against Twitch's rules for rewards, so that the broadcaster
+// finds out what's wrong before Twitch rejects them
+func (s *Settings) Validate() error {
+	if s.Title == "" || len([]rune(s.Title)) > MaxTitleLength {
+		return ErrTitle
+	}
+	if len([]rune(s.Prompt)) > MaxPromptLength {
+		return ErrPrompt
+	}
+	if s.Cost < 1 {
+		return ErrCost
+	}
+	if s.MaxPerStream < 0 || s.MaxPerUserPerStream < 0 || s.GlobalCooldown < 0 {
+		return ErrLimit
+	}
+	if s.BackgroundColor != "" && !backgroundColor.MatchString(s.BackgroundColor) {
+		return ErrBackgroundColor
+	}
+	return nil
+}
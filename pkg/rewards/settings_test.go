@@ -0,0 +1,33 @@
+package rewards
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Settings{Title: "Song Request", Prompt: "Request a song", Cost: 1000, BackgroundColor: "#9147FF"}
+	assert.NoError(t, valid.Validate())
+
+	tests := []struct {
+		name     string
+		change   func(s *Settings)
+		expected error
+	}{
+		{"no title", func(s *Settings) { s.Title = "" }, ErrTitle},
+		{"long title", func(s *Settings) { s.Title = strings.Repeat("a", MaxTitleLength+1) }, ErrTitle},
+		{"long prompt", func(s *Settings) { s.Prompt = strings.Repeat("a", MaxPromptLength+1) }, ErrPrompt},
+		{"free", func(s *Settings) { s.Cost = 0 }, ErrCost},
+		{"negative limit", func(s *Settings) { s.MaxPerUserPerStream = -1 }, ErrLimit},
+		{"negative cooldown", func(s *Settings) { s.GlobalCooldown = -1 }, ErrLimit},
+		{"color name", func(s *Settings) { s.BackgroundColor = "purple" }, ErrBackgroundColor},
+	}
+
+	for _, test := range tests {
+		s := valid
+		test.change(&s)
+		assert.ErrorIs(t, s.Validate(), test.expected, test.name)
+	}
+}
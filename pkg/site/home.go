@@ -1,21 +1,27 @@
 package site
 
 import (
+	"encoding/base64"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 
-	"github.com/saxypandabear/twitchsongrequests/internal/constants"
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
 	"go.uber.org/zap"
 )
 
 var homePage = template.Must(template.ParseFiles("pkg/site/home.html"))
 
+// latestRequestLimit is how many of the user's latest requests are looked through for the
+// device that songs were last queued on
+const latestRequestLimit = 10
+
 type HomePageRenderer struct {
 	userStore db.UserStore
+	requests  db.RequestStore
 	twitch    *util.AuthConfig
 	spotify   *util.AuthConfig
 	siteURL   string
@@ -28,16 +34,23 @@ type HomePageData struct {
 	UnsubscribeURL string
 	SpotifyAuthURL string
 	PreferencesURL string
+	PendingURL     string
+	RecapURL       string
 	Authenticated  bool
 	Subscribed     bool
 	Error          string
 	BrowserSource  string
+	// HeldRequests is how many requests are waiting for the user's Spotify player to be open
+	HeldRequests int
+	// LastDevice is the Spotify device that the user's last song request was queued on
+	LastDevice string
 }
 
-func NewHomePageRenderer(siteURL string, u db.UserStore, twitch, spotify *util.AuthConfig) *HomePageRenderer {
+func NewHomePageRenderer(siteURL string, u db.UserStore, r db.RequestStore, twitch, spotify *util.AuthConfig) *HomePageRenderer {
 	return &HomePageRenderer{
 		siteURL:   siteURL,
 		userStore: u,
+		requests:  r,
 		twitch:    twitch,
 		spotify:   spotify,
 	}
@@ -79,8 +92,27 @@ func (h *HomePageRenderer) getHomePageData(r *http.Request) *HomePageData {
 
 	if d.Subscribed {
 		// They're subscribed, so display the OBS source link
-		c, _ := r.Cookie(constants.TwitchIDCookieKey) // At this point, the cookie is already valid
-		d.BrowserSource = fmt.Sprintf("%s/queue/%s", h.siteURL, c.Value)
+		encodedID := base64.StdEncoding.EncodeToString([]byte(id))
+		d.BrowserSource = fmt.Sprintf("%s/queue/%s", h.siteURL, encodedID)
+		d.PendingURL = fmt.Sprintf("%s/pending/%s", h.siteURL, encodedID)
+		d.RecapURL = fmt.Sprintf("%s/recap/%s", h.siteURL, encodedID)
+
+		held, err := h.requests.RequestsForBroadcaster(id, requests.StatusHeld)
+		if err != nil {
+			zap.L().Error("failed to get held requests", zap.String("id", id), zap.Error(err))
+		}
+		d.HeldRequests = len(held)
+
+		latest, err := h.requests.LatestRequests(id, latestRequestLimit)
+		if err != nil {
+			zap.L().Error("failed to get latest requests", zap.String("id", id), zap.Error(err))
+		}
+		for _, req := range latest {
+			if req.Device != "" {
+				d.LastDevice = req.Device
+				break
+			}
+		}
 	}
 
 	// check if there is an error in the request body
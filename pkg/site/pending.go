@@ -0,0 +1,77 @@
+package site
+
+import (
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saxypandabear/twitchsongrequests/internal/util"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"go.uber.org/zap"
+)
+
+var pendingPage = template.Must(template.ParseFiles("pkg/site/pending.html"))
+
+type PendingPageRenderer struct {
+	siteURL   string
+	twitch    *util.AuthConfig
+	userStore db.UserStore
+	requests  db.RequestStore
+}
+
+type PendingPageData struct {
+	ApproveURL string
+	RejectURL  string
+	Allowed    bool
+	Requests   []*requests.Request
+}
+
+func NewPendingPageRenderer(siteURL string, u db.UserStore, r db.RequestStore, twitch *util.AuthConfig) *PendingPageRenderer {
+	return &PendingPageRenderer{
+		siteURL:   siteURL,
+		twitch:    twitch,
+		userStore: u,
+		requests:  r,
+	}
+}
+
+func (p *PendingPageRenderer) PendingPage(w http.ResponseWriter, r *http.Request) {
+	d := PendingPageData{
+		ApproveURL: fmt.Sprintf("%s/pending/approve", p.siteURL),
+		RejectURL:  fmt.Sprintf("%s/pending/reject", p.siteURL),
+	}
+
+	// Like the queue page, the ID parameter is the b64 encoding of the broadcaster's user ID
+	// so that the broadcaster can share the page with their moderators.
+	decoded, err := base64.StdEncoding.DecodeString(chi.URLParam(r, "id"))
+	if err != nil {
+		zap.L().Warn("Unable to decode ID", zap.String("encoded", chi.URLParam(r, "id")))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	broadcasterID := string(decoded)
+
+	id, err := util.GetUserIDFromRequest(r)
+	if err != nil {
+		zap.L().Error("failed to get Twitch ID from request", zap.Error(err))
+	}
+
+	d.Allowed, err = util.CanManageRequests(p.twitch, p.userStore, broadcasterID, id)
+	if err != nil {
+		zap.L().Error("failed to verify moderator", zap.String("id", broadcasterID), zap.String("user", id), zap.Error(err))
+	}
+
+	if d.Allowed {
+		d.Requests, err = p.requests.RequestsForBroadcaster(broadcasterID, requests.StatusPending)
+		if err != nil {
+			zap.L().Error("failed to get pending requests", zap.String("id", broadcasterID), zap.Error(err))
+		}
+	}
+
+	if err := pendingPage.Execute(w, &d); err != nil {
+		zap.L().Error("error occurred while executing template", zap.Error(err))
+	}
+}
@@ -1,20 +1,29 @@
 package site
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"net/http"
+	"slices"
+	"strings"
 
 	"github.com/saxypandabear/twitchsongrequests/internal/util"
 	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/zmb3/spotify/v2"
 	"go.uber.org/zap"
 )
 
 var preferencesPage = template.Must(template.ParseFiles("pkg/site/preferences.html"))
 
 type PreferencesRenderer struct {
-	siteURL string
-	pref    db.PreferenceStore
+	siteURL   string
+	pref      db.PreferenceStore
+	rewards   db.RewardStore
+	userStore db.UserStore
+	twitch    *util.AuthConfig
+	spotify   *util.AuthConfig
 }
 
 type PreferencePageData struct {
@@ -22,20 +31,131 @@ type PreferencePageData struct {
 	Authenticated   bool
 	RewardID        string
 	Explicit        bool
+	CleanSubstitute bool
 	SongLengthLimit int `unit:"seconds"`
+	Moderated       bool
+	ViewerCooldown  int `unit:"seconds"`
+	ViewerLimit     int
+	ViewerPerStream bool
+	ViewerPending   int
+	DuplicateWindow int `unit:"minutes"`
+	Blocklist       SongFilterData
+	Allowlist       SongFilterData
+	AllowlistOnly   bool
+	AlbumLinks      bool
+	PlaylistLinks   bool
+	ArtistLinks     bool
+	DeviceID        string
+	Devices         []DeviceOption
+	ChatReplies     bool
+	QueuedReply     string
+	RejectedReply   string
+	ChatRequests    bool
+	ChatCommand     string
+	ChatSubscribers bool
+	ChatVIPs        bool
+	ChatModerators  bool
+	MinCheerBits    int
+	CheerPriority   bool
+	// who can redeem the song request reward
+	RequestSubscribers bool
+	RequestVIPs        bool
+	RequestModerators  bool
+	RequestFollowers   bool
+	MinFollowDays      int `unit:"days"`
+	// the Twitch scopes that the broadcaster has to connect again to grant
+	MissingScopes []string
+	TwitchAuthURL string
+	LiveOnly      bool
+	CancelWindow  int `unit:"minutes"`
+	Fulfillment   string
+	// the broadcaster's other song request rewards
+	Rewards         []RewardData
+	AddRewardURL    string
+	RemoveRewardURL string
+	// how the song request rewards are set up on Twitch
+	RewardSettings  []RewardSettingsData
+	UpdateRewardURL string
+	// the defaults that are used when the fields are empty
+	DefaultChatCommand   string
+	DefaultQueuedReply   string
+	DefaultRejectedReply string
 }
 
-func NewPreferencesRenderer(p db.PreferenceStore, siteURL string) *PreferencesRenderer {
+// DeviceOption is one of the broadcaster's Spotify devices that songs can be queued on
+type DeviceOption struct {
+	ID       string
+	Name     string
+	Type     string
+	Selected bool
+	// Offline is set for the preferred device when Spotify doesn't list it right now
+	Offline bool
+}
+
+// RewardData is one of the broadcaster's song request rewards, and its rules
+type RewardData struct {
+	ID              string
+	Title           string
+	Cost            int
+	SongLengthLimit int `unit:"seconds"`
+	Explicit        bool
+	Priority        bool
+}
+
+// RewardSettingsData is how one of the broadcaster's song request rewards is set up on
+// Twitch, where a limit of 0 means the limit is off
+type RewardSettingsData struct {
+	ID                  string
+	Title               string
+	Prompt              string
+	Cost                int
+	MaxPerStream        int
+	MaxPerUserPerStream int
+	GlobalCooldown      int `unit:"seconds"`
+	BackgroundColor     string
+	Enabled             bool
+	Paused              bool
+}
+
+// SongFilterData is a song filter with each list rendered one entry per line
+type SongFilterData struct {
+	Tracks   string
+	Artists  string
+	Albums   string
+	Keywords string
+}
+
+func newSongFilterData(f *preferences.SongFilter) SongFilterData {
+	return SongFilterData{
+		Tracks:   strings.Join(f.Tracks, "\n"),
+		Artists:  strings.Join(f.Artists, "\n"),
+		Albums:   strings.Join(f.Albums, "\n"),
+		Keywords: strings.Join(f.Keywords, "\n"),
+	}
+}
+
+func NewPreferencesRenderer(p db.PreferenceStore, rw db.RewardStore, u db.UserStore, twitch, spotify *util.AuthConfig, siteURL string) *PreferencesRenderer {
 	return &PreferencesRenderer{
-		pref:    p,
-		siteURL: siteURL,
+		pref:      p,
+		rewards:   rw,
+		userStore: u,
+		twitch:    twitch,
+		spotify:   spotify,
+		siteURL:   siteURL,
 	}
 }
 
 func (p *PreferencesRenderer) PreferencesPage(w http.ResponseWriter, r *http.Request) {
 	d := PreferencePageData{
-		SaveURL:       fmt.Sprintf("%s/preference", p.siteURL),
-		Authenticated: true,
+		SaveURL:              fmt.Sprintf("%s/preference", p.siteURL),
+		AddRewardURL:         fmt.Sprintf("%s/rewards", p.siteURL),
+		RemoveRewardURL:      fmt.Sprintf("%s/rewards/remove", p.siteURL),
+		UpdateRewardURL:      fmt.Sprintf("%s/rewards/settings", p.siteURL),
+		TwitchAuthURL:        util.GenerateAuthURL("id.twitch.tv", "oauth2/authorize", p.twitch),
+		Authenticated:        true,
+		DefaultQueuedReply:   preferences.DefaultQueuedReply,
+		DefaultRejectedReply: preferences.DefaultRejectedReply,
+		DefaultChatCommand:   preferences.DefaultChatCommand,
 	}
 
 	id, err := util.GetUserIDFromRequest(r)
@@ -50,12 +170,169 @@ func (p *PreferencesRenderer) PreferencesPage(w http.ResponseWriter, r *http.Req
 			zap.L().Error("failed to get user preferences", zap.String("id", id), zap.Error(err))
 		} else {
 			d.Explicit = pref.ExplicitSongs
+			d.CleanSubstitute = pref.CleanSubstitute
 			d.RewardID = pref.CustomRewardID
 			d.SongLengthLimit = pref.MaxSongLength / 1000 // stored as millis
+			d.Moderated = pref.Moderated
+			d.ViewerCooldown = pref.ViewerCooldown
+			d.ViewerLimit = pref.ViewerRequestLimit
+			d.ViewerPerStream = pref.ViewerLimitPerStream
+			d.ViewerPending = pref.ViewerMaxPending
+			d.DuplicateWindow = pref.DuplicateWindow
+			d.Blocklist = newSongFilterData(&pref.Blocklist)
+			d.Allowlist = newSongFilterData(&pref.Allowlist)
+			d.AllowlistOnly = pref.AllowlistOnly
+			d.AlbumLinks = pref.AlbumFirstTrack
+			d.PlaylistLinks = pref.PlaylistFirstTrack
+			d.ArtistLinks = pref.ArtistTopTrack
+			d.DeviceID = pref.DeviceID
+			d.ChatReplies = pref.ChatReplies
+			d.QueuedReply = pref.QueuedReply
+			d.RejectedReply = pref.RejectedReply
+			d.ChatRequests = pref.ChatRequests
+			d.ChatCommand = pref.ChatCommand
+			d.ChatSubscribers = slices.Contains(pref.ChatRoles, preferences.RoleSubscriber)
+			d.ChatVIPs = slices.Contains(pref.ChatRoles, preferences.RoleVIP)
+			d.ChatModerators = slices.Contains(pref.ChatRoles, preferences.RoleModerator)
+			d.MinCheerBits = pref.MinCheerBits
+			d.CheerPriority = pref.CheerPriority
+			d.RequestSubscribers = slices.Contains(pref.RequestRoles, preferences.RoleSubscriber)
+			d.RequestVIPs = slices.Contains(pref.RequestRoles, preferences.RoleVIP)
+			d.RequestModerators = slices.Contains(pref.RequestRoles, preferences.RoleModerator)
+			d.RequestFollowers = slices.Contains(pref.RequestRoles, preferences.RoleFollower)
+			d.MinFollowDays = pref.MinFollowDays
+			d.LiveOnly = pref.LiveOnly
+			d.CancelWindow = pref.CancelWindow
+			d.Fulfillment = string(pref.Fulfillment)
 		}
+		d.Devices = p.devices(r.Context(), id, d.DeviceID)
+		d.MissingScopes = p.missingScopes(id)
+
+		tiers, err := p.rewards.RewardsForBroadcaster(id)
+		if err != nil {
+			zap.L().Error("failed to get rewards", zap.String("id", id), zap.Error(err))
+		}
+		for _, t := range tiers {
+			d.Rewards = append(d.Rewards, RewardData{
+				ID:              t.ID,
+				Title:           t.Title,
+				Cost:            t.Cost,
+				SongLengthLimit: t.MaxSongLength / 1000, // stored as millis
+				Explicit:        t.ExplicitSongs,
+				Priority:        t.Priority,
+			})
+		}
+
+		rewardIDs := make([]string, 0, len(tiers)+1)
+		if d.RewardID != "" {
+			rewardIDs = append(rewardIDs, d.RewardID)
+		}
+		for _, t := range tiers {
+			rewardIDs = append(rewardIDs, t.ID)
+		}
+		d.RewardSettings = p.rewardSettings(id, rewardIDs)
 	}
 
 	if err := preferencesPage.Execute(w, &d); err != nil {
 		zap.L().Error("error occurred while executing template", zap.Error(err))
 	}
 }
+
+// missingScopes finds the Twitch scopes that the broadcaster hasn't granted, like the
+// ones that were added since they last connected Twitch
+func (p *PreferencesRenderer) missingScopes(id string) []string {
+	c, err := util.GetTwitchClientForUserID(p.twitch, p.userStore, id)
+	if err != nil {
+		zap.L().Error("failed to get Twitch client", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+
+	granted, err := util.GrantedScopes(c)
+	if err != nil {
+		zap.L().Error("failed to get the granted Twitch scopes", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+	return util.MissingScopes(granted, p.twitch.Scope)
+}
+
+// rewardSettings gets how the song request rewards are set up on Twitch right now, so
+// that changes made on Twitch directly show up. Rewards that Twitch doesn't have any more
+// are left out.
+func (p *PreferencesRenderer) rewardSettings(id string, rewardIDs []string) []RewardSettingsData {
+	if len(rewardIDs) == 0 {
+		return nil
+	}
+
+	c, err := util.GetTwitchClientForUserID(p.twitch, p.userStore, id)
+	if err != nil {
+		zap.L().Error("failed to get Twitch client", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+
+	settings, err := util.GetRewardSettings(c, id)
+	if err != nil {
+		zap.L().Error("failed to get Channel Point rewards", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+
+	data := make([]RewardSettingsData, 0, len(rewardIDs))
+	for _, rewardID := range rewardIDs {
+		s, ok := settings[rewardID]
+		if !ok {
+			continue
+		}
+		data = append(data, RewardSettingsData{
+			ID:                  rewardID,
+			Title:               s.Title,
+			Prompt:              s.Prompt,
+			Cost:                s.Cost,
+			MaxPerStream:        s.MaxPerStream,
+			MaxPerUserPerStream: s.MaxPerUserPerStream,
+			GlobalCooldown:      s.GlobalCooldown,
+			BackgroundColor:     s.BackgroundColor,
+			Enabled:             s.Enabled,
+			Paused:              s.Paused,
+		})
+	}
+	return data
+}
+
+// devices lists the user's Spotify devices. The preferred device is always listed,
+// even when it is offline, so that saving the page doesn't clear it.
+func (p *PreferencesRenderer) devices(ctx context.Context, id, preferred string) []DeviceOption {
+	opts := make([]DeviceOption, 0)
+	found := false
+	for _, d := range p.playerDevices(ctx, id) {
+		if d.ID == "" || d.Restricted {
+			// restricted devices can't be controlled through the Web API
+			continue
+		}
+		selected := d.ID.String() == preferred
+		found = found || selected
+		opts = append(opts, DeviceOption{
+			ID:       d.ID.String(),
+			Name:     d.Name,
+			Type:     d.Type,
+			Selected: selected,
+		})
+	}
+
+	if preferred != "" && !found {
+		opts = append(opts, DeviceOption{ID: preferred, Name: preferred, Type: "Unknown", Selected: true, Offline: true})
+	}
+	return opts
+}
+
+func (p *PreferencesRenderer) playerDevices(ctx context.Context, id string) []spotify.PlayerDevice {
+	c, err := util.GetSpotifyClientForUser(ctx, p.userStore, p.spotify, id)
+	if err != nil {
+		zap.L().Error("failed to get Spotify client for user", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+	devices, err := c.PlayerDevices(ctx)
+	if err != nil {
+		zap.L().Error("failed to get Spotify devices for user", zap.String("id", id), zap.Error(err))
+		return nil
+	}
+	return devices
+}
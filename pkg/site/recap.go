@@ -0,0 +1,151 @@
+package site
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"go.uber.org/zap"
+)
+
+const (
+	// RecapStreamKey is the query parameter that picks which stream to recap
+	RecapStreamKey = "stream"
+	streamLimit    = 10 // only the most recent streams are listed
+)
+
+var recapPage = template.Must(template.ParseFiles("pkg/site/recap.html"))
+
+type RecapPageRenderer struct {
+	siteURL  string
+	streams  db.StreamStore
+	requests db.RequestStore
+	msgCount db.MessageCounter
+}
+
+type RecapPageData struct {
+	Recap          *streams.Recap
+	SuccessPercent int
+	Live           bool
+	DownloadURL    string
+	Streams        []StreamLink
+}
+
+// StreamLink is one of the broadcaster's past streams that can be recapped
+type StreamLink struct {
+	StartedAt string
+	URL       string
+	Selected  bool
+}
+
+func NewRecapPageRenderer(siteURL string, s db.StreamStore, r db.RequestStore, m db.MessageCounter) *RecapPageRenderer {
+	return &RecapPageRenderer{
+		siteURL:  siteURL,
+		streams:  s,
+		requests: r,
+		msgCount: m,
+	}
+}
+
+func (p *RecapPageRenderer) RecapPage(w http.ResponseWriter, r *http.Request) {
+	encoded := chi.URLParam(r, "id")
+	s, all, ok := p.stream(w, r)
+	if !ok {
+		return
+	}
+
+	d := RecapPageData{}
+	for _, other := range all {
+		d.Streams = append(d.Streams, StreamLink{
+			StartedAt: other.StartedAt.Format("Jan 2, 2006 15:04 MST"),
+			URL:       fmt.Sprintf("%s/recap/%s?%s=%s", p.siteURL, url.PathEscape(encoded), RecapStreamKey, url.QueryEscape(other.ID)),
+			Selected:  s != nil && other.ID == s.ID,
+		})
+	}
+	if s != nil {
+		d.Recap = p.recap(s)
+		d.SuccessPercent = int(math.Round(d.Recap.SuccessRate * 100))
+		d.Live = s.IsLive()
+		d.DownloadURL = fmt.Sprintf("%s/recap/%s/json?%s=%s", p.siteURL, url.PathEscape(encoded), RecapStreamKey, url.QueryEscape(s.ID))
+	}
+
+	if err := recapPage.Execute(w, &d); err != nil {
+		zap.L().Error("error occurred while executing template", zap.Error(err))
+	}
+}
+
+// RecapJSON downloads the recap of a stream, so that the broadcaster can keep it or share
+// it elsewhere
+func (p *RecapPageRenderer) RecapJSON(w http.ResponseWriter, r *http.Request) {
+	s, _, ok := p.stream(w, r)
+	if !ok {
+		return
+	}
+	if s == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "recap-"+s.ID+".json"))
+	if err := json.NewEncoder(w).Encode(p.recap(s)); err != nil {
+		zap.L().Error("failed to write recap", zap.String("stream", s.ID), zap.Error(err))
+	}
+}
+
+// stream finds the stream that was asked for, or the most recent one, along with the
+// broadcaster's other recent streams. It writes the response when that fails.
+func (p *RecapPageRenderer) stream(w http.ResponseWriter, r *http.Request) (*streams.Stream, []*streams.Stream, bool) {
+	// Like the queue page, the ID parameter is the b64 encoding of the broadcaster's user ID
+	// so that the broadcaster can share their recaps.
+	decoded, err := base64.StdEncoding.DecodeString(chi.URLParam(r, "id"))
+	if err != nil {
+		zap.L().Warn("Unable to decode ID", zap.String("encoded", chi.URLParam(r, "id")))
+		w.WriteHeader(http.StatusBadRequest)
+		return nil, nil, false
+	}
+	broadcasterID := string(decoded)
+
+	all, err := p.streams.StreamsForBroadcaster(broadcasterID, streamLimit)
+	if err != nil {
+		zap.L().Error("failed to get streams", zap.String("id", broadcasterID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+
+	streamID := r.URL.Query().Get(RecapStreamKey)
+	if streamID == "" {
+		if len(all) == 0 {
+			return nil, all, true
+		}
+		return all[0], all, true
+	}
+
+	s, err := p.streams.GetStream(broadcasterID, streamID)
+	if err != nil {
+		zap.L().Error("failed to get stream", zap.String("stream", streamID), zap.String("id", broadcasterID), zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return nil, nil, false
+	}
+	return s, all, true
+}
+
+// recap is the stream's saved recap. Streams that are still live, or whose end was missed,
+// are summed up so far.
+func (p *RecapPageRenderer) recap(s *streams.Stream) *streams.Recap {
+	if s.Recap != nil {
+		return s.Recap
+	}
+	reqs, err := p.requests.RequestsForSession(s.ID)
+	if err != nil {
+		zap.L().Error("failed to get the stream's requests", zap.String("stream", s.ID), zap.Error(err))
+	}
+	return streams.BuildRecap(s, reqs, p.msgCount.MessagesForSession(s.ID), streams.TopCount)
+}
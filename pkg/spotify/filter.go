@@ -0,0 +1,61 @@
+package spotify
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/zmb3/spotify/v2"
+)
+
+var (
+	ErrBlockedSong    = errors.New("song is on the user's block list")
+	ErrSongNotAllowed = errors.New("song is not on the user's allow list")
+)
+
+// checkLists verifies the track against the user's block and allow lists
+func checkLists(track *spotify.FullTrack, p *preferences.Preference) error {
+	if p == nil {
+		return nil
+	}
+
+	allowed := matchesFilter(track, &p.Allowlist)
+	if p.AllowlistOnly && !allowed {
+		return ErrSongNotAllowed
+	}
+	if !allowed && matchesFilter(track, &p.Blocklist) {
+		return ErrBlockedSong
+	}
+
+	return nil
+}
+
+// matchesFilter checks if the track, its album, any of its artists, or its title
+// matches an entry in the filter
+func matchesFilter(track *spotify.FullTrack, f *preferences.SongFilter) bool {
+	if track == nil || f.IsEmpty() {
+		return false
+	}
+
+	if slices.Contains(f.Tracks, track.ID.String()) {
+		return true
+	}
+	if track.Album.ID != "" && slices.Contains(f.Albums, track.Album.ID.String()) {
+		return true
+	}
+	for _, a := range track.Artists {
+		if slices.Contains(f.Artists, a.ID.String()) {
+			return true
+		}
+	}
+
+	title := strings.ToLower(track.Name)
+	for _, k := range f.Keywords {
+		if k != "" && strings.Contains(title, strings.ToLower(k)) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,89 @@
+package spotify
+
+import (
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify/v2"
+)
+
+func filterTestTrack() *spotify.FullTrack {
+	return &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			ID:   "3cfOd4CMv2snFaKAnMdnvK",
+			Name: "All Star (Nightcore Remix)",
+			Artists: []spotify.SimpleArtist{
+				{ID: "4JhsIjgg9mTYBmjJzAVDZe"},
+				{ID: "0TnOYISbd1XYRBk9myaseg"},
+			},
+		},
+		Album: spotify.SimpleAlbum{ID: "5nNxoHQHZqvI7bWcDhTB7O"},
+	}
+}
+
+func TestMatchesFilter(t *testing.T) {
+	track := filterTestTrack()
+
+	tests := map[string]struct {
+		filter   preferences.SongFilter
+		expected bool
+	}{
+		"empty":          {preferences.SongFilter{}, false},
+		"track":          {preferences.SongFilter{Tracks: []string{"3cfOd4CMv2snFaKAnMdnvK"}}, true},
+		"other track":    {preferences.SongFilter{Tracks: []string{"abc123"}}, false},
+		"first artist":   {preferences.SongFilter{Artists: []string{"4JhsIjgg9mTYBmjJzAVDZe"}}, true},
+		"second artist":  {preferences.SongFilter{Artists: []string{"0TnOYISbd1XYRBk9myaseg"}}, true},
+		"album":          {preferences.SongFilter{Albums: []string{"5nNxoHQHZqvI7bWcDhTB7O"}}, true},
+		"keyword":        {preferences.SongFilter{Keywords: []string{"nightcore"}}, true},
+		"other keyword":  {preferences.SongFilter{Keywords: []string{"8d audio"}}, false},
+		"blank keyword":  {preferences.SongFilter{Keywords: []string{""}}, false},
+		"mixed no match": {preferences.SongFilter{Tracks: []string{"abc123"}, Artists: []string{"bcd234"}, Keywords: []string{"sped up"}}, false},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, matchesFilter(track, &test.filter))
+		})
+	}
+}
+
+func TestCheckLists(t *testing.T) {
+	track := filterTestTrack()
+
+	assert.NoError(t, checkLists(track, nil))
+	assert.NoError(t, checkLists(track, &preferences.Preference{}))
+
+	p := preferences.Preference{
+		Blocklist: preferences.SongFilter{Artists: []string{"0TnOYISbd1XYRBk9myaseg"}},
+	}
+	assert.ErrorIs(t, checkLists(track, &p), ErrBlockedSong)
+
+	// the allow list takes priority over the block list
+	p.Allowlist.Tracks = []string{"3cfOd4CMv2snFaKAnMdnvK"}
+	assert.NoError(t, checkLists(track, &p))
+
+	p = preferences.Preference{AllowlistOnly: true}
+	assert.ErrorIs(t, checkLists(track, &p), ErrSongNotAllowed)
+	p.Allowlist.Artists = []string{"4JhsIjgg9mTYBmjJzAVDZe"}
+	assert.NoError(t, checkLists(track, &p))
+}
+
+func TestShouldQueueBlockedSong(t *testing.T) {
+	q := testutil.MockQueuer{
+		Messages: make([]spotify.ID, 0, 1),
+		GetTrackFunc: func(i spotify.ID) (*spotify.FullTrack, error) {
+			return filterTestTrack(), nil
+		},
+	}
+
+	p := preferences.Preference{
+		Blocklist: preferences.SongFilter{Keywords: []string{"NIGHTCORE"}},
+	}
+	assert.ErrorIs(t, ShouldQueue(&q, spotify.ID("3cfOd4CMv2snFaKAnMdnvK"), &p), ErrBlockedSong)
+
+	s := NewSpotifyPlayerQueue()
+	_, err := s.Publish(&q, testSpotifyTrackURL, &p)
+	assert.ErrorIs(t, err, ErrBlockedSong)
+	assert.Empty(t, q.Messages)
+}
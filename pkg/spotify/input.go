@@ -0,0 +1,148 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/zmb3/spotify/v2"
+)
+
+// artistTopTracksCountry is the market that an artist's top tracks are looked up in
+const artistTopTracksCountry = "US"
+
+var (
+	// Matches links like https://open.spotify.com/track/{id}?si=..., including links with
+	// a locale like https://open.spotify.com/intl-de/track/{id}
+	openSpotifyURLPattern = regexp.MustCompile(`https://open\.spotify\.com/(?:[A-Za-z0-9_-]+/)*?(track|album|playlist|artist|episode|show)/([A-Za-z0-9]+)`)
+	// New Spotify URLs don't include the track ID in them anymore because they hate developers
+	// https://community.spotify.com/t5/Spotify-for-Developers/How-to-see-through-shortened-https-spotify-link-links/m-p/5521244
+	opaqueSpotifyURLPattern = regexp.MustCompile(`https://spotify.link/([A-Za-z0-9]+)`)
+	// Matches URIs like spotify:track:{id}
+	spotifyURIPattern = regexp.MustCompile(`spotify:(track|album|playlist|artist|episode|show):([A-Za-z0-9]+)`)
+	// Spotify IDs are 22 characters of base 62
+	spotifyIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{22}$`)
+
+	ErrUnresolvedLink   = errors.New("could not find a Spotify link behind the shortened link")
+	ErrAlbumLink        = errors.New("album links can't be requested")
+	ErrPlaylistLink     = errors.New("playlist links can't be requested")
+	ErrArtistLink       = errors.New("artist links can't be requested")
+	ErrPodcastLink      = errors.New("podcasts can't be requested")
+	ErrEmptyCollection  = errors.New("there are no songs to request behind the link")
+	ErrUnsupportedInput = errors.New("unsupported Spotify link")
+)
+
+// parseInput recognizes what the user input links to, and returns the Spotify ID
+// from the link. Input that isn't a link is searched for. The resolver is used to
+// look up where a shortened spotify.link link goes.
+func parseInput(s string, resolver func(string) string) (queue.InputKind, string) {
+	// need to check for the opaque link first
+	if link := opaqueSpotifyURLPattern.FindString(s); link != "" {
+		if kind, id := parseLink(resolver(link)); kind != "" {
+			return kind, id
+		}
+		return queue.InputShortLink, ""
+	}
+
+	if kind, id := parseLink(s); kind != "" {
+		return kind, id
+	}
+
+	// a bare ID is assumed to be a track. Real IDs have mixed case letters, which
+	// tells them apart from someone searching for one long word.
+	if id := strings.TrimSpace(s); spotifyIDPattern.MatchString(id) && strings.ToLower(id) != id && strings.ToUpper(id) != id {
+		return queue.InputTrack, id
+	}
+
+	return queue.InputSearch, ""
+}
+
+// parseLink finds the first Spotify link or URI in the text
+func parseLink(s string) (queue.InputKind, string) {
+	link := openSpotifyURLPattern.FindStringSubmatchIndex(s)
+	uri := spotifyURIPattern.FindStringSubmatchIndex(s)
+
+	groups := link
+	if groups == nil || (uri != nil && uri[0] < link[0]) {
+		groups = uri
+	}
+	if groups == nil {
+		return "", ""
+	}
+
+	return queue.InputKind(s[groups[2]:groups[3]]), s[groups[4]:groups[5]]
+}
+
+// resolveTrack picks the song to queue for the user input, based on what the
+// input links to and the user's preferences.
+func resolveTrack(client queue.Queuer, kind queue.InputKind, id, input string, pref *preferences.Preference) (string, error) {
+	switch kind {
+	case queue.InputTrack:
+		return id, nil
+	case queue.InputSearch:
+		return Search(client, input, pref)
+	case queue.InputShortLink:
+		return "", ErrUnresolvedLink
+	case queue.InputAlbum:
+		if pref == nil || !pref.AlbumFirstTrack {
+			return "", ErrAlbumLink
+		}
+		return firstAlbumTrack(client, spotify.ID(id))
+	case queue.InputPlaylist:
+		if pref == nil || !pref.PlaylistFirstTrack {
+			return "", ErrPlaylistLink
+		}
+		return firstPlaylistTrack(client, spotify.ID(id))
+	case queue.InputArtist:
+		if pref == nil || !pref.ArtistTopTrack {
+			return "", ErrArtistLink
+		}
+		return artistTopTrack(client, spotify.ID(id))
+	case queue.InputEpisode, queue.InputShow:
+		return "", ErrPodcastLink
+	}
+
+	return "", ErrUnsupportedInput
+}
+
+func firstAlbumTrack(client queue.Queuer, id spotify.ID) (string, error) {
+	page, err := client.GetAlbumTracks(context.Background(), id, spotify.Limit(1))
+	if err != nil {
+		return "", err
+	}
+	if page == nil || len(page.Tracks) < 1 {
+		return "", ErrEmptyCollection
+	}
+	return page.Tracks[0].ID.String(), nil
+}
+
+func firstPlaylistTrack(client queue.Queuer, id spotify.ID) (string, error) {
+	page, err := client.GetPlaylistItems(context.Background(), id, spotify.Limit(searchLimit))
+	if err != nil {
+		return "", err
+	}
+	if page == nil {
+		return "", ErrEmptyCollection
+	}
+	// playlists can have podcast episodes, and songs that aren't available anymore
+	for _, item := range page.Items {
+		if item.Track.Track != nil {
+			return item.Track.Track.ID.String(), nil
+		}
+	}
+	return "", ErrEmptyCollection
+}
+
+func artistTopTrack(client queue.Queuer, id spotify.ID) (string, error) {
+	tracks, err := client.GetArtistsTopTracks(context.Background(), id, artistTopTracksCountry)
+	if err != nil {
+		return "", err
+	}
+	if len(tracks) < 1 {
+		return "", ErrEmptyCollection
+	}
+	return tracks[0].ID.String(), nil
+}
@@ -0,0 +1,130 @@
+package spotify
+
+import (
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestParseInput(t *testing.T) {
+	tests := map[string]struct {
+		kind queue.InputKind
+		id   string
+	}{
+		"https://open.spotify.com/track/3cfOd4CMv2snFaKAnMdnvK?si=a99029531fa04a00":           {queue.InputTrack, "3cfOd4CMv2snFaKAnMdnvK"},
+		"https://open.spotify.com/intl-pt-BR/track/5Sk39LuvdwuvL84jD01Dum":                    {queue.InputTrack, "5Sk39LuvdwuvL84jD01Dum"},
+		"https://open.spotify.com/embed/track/3cfOd4CMv2snFaKAnMdnvK?utm_source=generator":    {queue.InputTrack, "3cfOd4CMv2snFaKAnMdnvK"},
+		"spotify:track:3cfOd4CMv2snFaKAnMdnvK":                                                {queue.InputTrack, "3cfOd4CMv2snFaKAnMdnvK"},
+		"play spotify:track:3cfOd4CMv2snFaKAnMdnvK please":                                    {queue.InputTrack, "3cfOd4CMv2snFaKAnMdnvK"},
+		" 3cfOd4CMv2snFaKAnMdnvK ":                                                            {queue.InputTrack, "3cfOd4CMv2snFaKAnMdnvK"},
+		"https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O?si=abc":                        {queue.InputAlbum, "5nNxoHQHZqvI7bWcDhTB7O"},
+		"https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M":                            {queue.InputPlaylist, "37i9dQZF1DXcBWIGoYBM5M"},
+		"spotify:artist:0TnOYISbd1XYRBk9myaseg":                                               {queue.InputArtist, "0TnOYISbd1XYRBk9myaseg"},
+		"https://open.spotify.com/episode/4rOoJ6Egrf8K2IrywzwOMk":                             {queue.InputEpisode, "4rOoJ6Egrf8K2IrywzwOMk"},
+		"https://open.spotify.com/show/4rOoJ6Egrf8K2IrywzwOMk":                                {queue.InputShow, "4rOoJ6Egrf8K2IrywzwOMk"},
+		"this one spotify:album:5nNxoHQHZqvI7bWcDhTB7O or https://open.spotify.com/track/abc": {queue.InputAlbum, "5nNxoHQHZqvI7bWcDhTB7O"},
+		"never gonna give you up":                                                             {queue.InputSearch, ""},
+		"http://open.spotify.com/track/3cfOd4CMv2snFaKAnMdnvK":                                {queue.InputSearch, ""},
+		// too uniform to be an ID
+		"pneumonoultramicroscop":           {queue.InputSearch, ""},
+		"https://spotify.link/8qo05dnCrDb": {queue.InputTrack, "0RM0BeXRRIz1LExEl83GhA"},
+	}
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			kind, id := parseInput(input, respondWithHTML)
+			assert.Equal(t, expected.kind, kind)
+			assert.Equal(t, expected.id, id)
+		})
+	}
+}
+
+func TestParseInputShortLinkInMessage(t *testing.T) {
+	var resolved string
+	kind, id := parseInput("play this https://spotify.link/8qo05dnCrDb pls", func(link string) string {
+		resolved = link
+		return sampleHTML
+	})
+	assert.Equal(t, "https://spotify.link/8qo05dnCrDb", resolved)
+	assert.Equal(t, queue.InputTrack, kind)
+	assert.Equal(t, "0RM0BeXRRIz1LExEl83GhA", id)
+}
+
+func TestParseInputUnresolvedShortLink(t *testing.T) {
+	kind, id := parseInput("https://spotify.link/8qo05dnCrDb", func(string) string { return "" })
+	assert.Equal(t, queue.InputShortLink, kind)
+	assert.Empty(t, id)
+}
+
+func TestPublishUnsupportedLinks(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+	}
+
+	tests := map[string]error{
+		"https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O":    ErrAlbumLink,
+		"https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M": ErrPlaylistLink,
+		"https://open.spotify.com/artist/0TnOYISbd1XYRBk9myaseg":   ErrArtistLink,
+		"https://open.spotify.com/episode/4rOoJ6Egrf8K2IrywzwOMk":  ErrPodcastLink,
+		"spotify:show:4rOoJ6Egrf8K2IrywzwOMk":                      ErrPodcastLink,
+	}
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			res, err := s.Publish(&q, input, &preferences.Preference{})
+			assert.ErrorIs(t, err, expected)
+			assert.NotEqual(t, queue.InputTrack, res.Kind)
+			assert.Empty(t, q.Messages)
+		})
+	}
+
+	s.OpaqueLinkResolver = func(string) string { return "" }
+	res, err := s.Publish(&q, "https://spotify.link/8qo05dnCrDb", &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrUnresolvedLink)
+	assert.Equal(t, queue.InputShortLink, res.Kind)
+}
+
+func TestPublishCollectionLinks(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 3),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		AlbumTracks:  []spotify.SimpleTrack{{ID: "albumtrack"}},
+		PlaylistTracks: []spotify.PlaylistItem{
+			{Track: spotify.PlaylistItemTrack{Episode: &spotify.EpisodePage{}}},
+			{Track: spotify.PlaylistItemTrack{Track: &spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: "playlisttrack"}}}},
+		},
+		TopTracks: []spotify.FullTrack{{SimpleTrack: spotify.SimpleTrack{ID: "toptrack"}}},
+	}
+	pref := preferences.Preference{
+		AlbumFirstTrack:    true,
+		PlaylistFirstTrack: true,
+		ArtistTopTrack:     true,
+	}
+
+	res, err := s.Publish(&q, "https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O", &pref)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.InputAlbum, res.Kind)
+	assert.Equal(t, "albumtrack", res.TrackID.String())
+
+	res, err = s.Publish(&q, "https://open.spotify.com/playlist/37i9dQZF1DXcBWIGoYBM5M", &pref)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.InputPlaylist, res.Kind)
+	assert.Equal(t, "playlisttrack", res.TrackID.String())
+
+	res, err = s.Publish(&q, "spotify:artist:0TnOYISbd1XYRBk9myaseg", &pref)
+	assert.NoError(t, err)
+	assert.Equal(t, queue.InputArtist, res.Kind)
+	assert.Equal(t, "toptrack", res.TrackID.String())
+
+	assert.Equal(t, []spotify.ID{"albumtrack", "playlisttrack", "toptrack"}, q.Messages)
+
+	q.AlbumTracks = nil
+	_, err = s.Publish(&q, "https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O", &pref)
+	assert.ErrorIs(t, err, ErrEmptyCollection)
+	assert.Len(t, q.Messages, 3)
+}
@@ -4,23 +4,41 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"io"
 	"net/http"
-	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
 
+	"github.com/saxypandabear/twitchsongrequests/pkg/db"
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
 	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
 	"github.com/zmb3/spotify/v2"
+	"go.uber.org/zap"
 )
 
 var (
-	openSpotifyURLPattern = regexp.MustCompile(`https://open.spotify.com/(.+?/)*?track/([A-Za-z0-9]+)`)
-	// New Spotify URLs don't include the track ID in them anymore because they hate developers
-	// https://community.spotify.com/t5/Spotify-for-Developers/How-to-see-through-shortened-https-spotify-link-links/m-p/5521244
-	opaqueSpotifyURLPattern = regexp.MustCompile(`https://spotify.link/([A-Za-z0-9]+)`)
-	ErrInvalidInput         = errors.New("invalid user input for Spotify URI")
-	ErrExplicitSong         = errors.New("user does not allow adding explicit songs to the queue")
-	ErrSongTooLong          = errors.New("song is too long")
+	ErrInvalidInput  = errors.New("invalid user input for Spotify URI")
+	ErrExplicitSong  = errors.New("user does not allow adding explicit songs to the queue")
+	ErrSongTooLong   = errors.New("song is too long")
+	ErrDuplicateSong = errors.New("song is already in the queue or was requested recently")
+	ErrNoSearchMatch = errors.New("no search results were a close enough match")
+	// searchFillerWords are ignored when matching search results
+	searchFillerWords = []string{"by", "feat", "ft", "featuring", "song"}
+)
+
+// maxHistoryTracks caps how many recently requested songs are compared against,
+// which is also the most tracks that Spotify returns in one request.
+const maxHistoryTracks = 50
+
+const (
+	// searchLimit is how many search results are considered for a request
+	searchLimit = 10
+	// minSearchScore is the lowest relevance that a search result can have to be queued
+	minSearchScore = 0.5
+	// cleanDurationTolerance is how different in length, in milliseconds, a clean
+	// version of a song can be from the explicit version
+	cleanDurationTolerance = 10000
 )
 
 // ensure struct implements queue.Publisher
@@ -28,59 +46,245 @@ var _ queue.Publisher = (*SpotifyPlayerQueue)(nil)
 
 // TODO: Publisher is an unnecessary struct because there is no state that the publisher tracks here.
 type SpotifyPlayerQueue struct {
+	// OpaqueLinkResolver finds the Spotify link behind a shortened spotify.link link
 	OpaqueLinkResolver func(string) string
+	// Translators find the Spotify song for links to other music services
+	Translators []LinkTranslator
+	// History is used to find songs that were requested recently. If it is nil,
+	// only the Spotify queue is checked for duplicates.
+	History db.MessageCounter
 }
 
-func httpRequestResolver(s string) string {
-	if resp, err := http.Get(s); err == nil { //nolint: gosec,noctx
-		defer resp.Body.Close()
-		bytes, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return ""
+func NewSpotifyPlayerQueue() *SpotifyPlayerQueue {
+	return &SpotifyPlayerQueue{
+		OpaqueLinkResolver: NewLinkResolver().Resolve,
+		Translators:        DefaultTranslators(),
+	}
+}
+
+// Publish will work out which song the input refers to, validate it against the user's
+// preferences, and then attempt to queue it in the user's Spotify player. If the song is explicit
+// and the user prefers clean versions, the clean version is queued instead.
+func (s *SpotifyPlayerQueue) Publish(client queue.Queuer, input string, pref *preferences.Preference) (queue.Result, error) {
+	kind, id, err := s.resolveInput(client, input, pref)
+	res := queue.Result{Kind: kind}
+	if err != nil {
+		return res, err
+	}
+	res.TrackID = spotify.ID(id)
+
+	track, err := client.GetTrack(context.Background(), res.TrackID)
+	if err != nil {
+		return res, fmt.Errorf("failed to get track %s: %w", res.TrackID.String(), err)
+	}
+	res.Name, res.Artist = track.Name, artistNames(track)
+
+	if err = checkTrack(track, pref); err != nil {
+		if !errors.Is(err, ErrExplicitSong) || pref == nil || !pref.CleanSubstitute {
+			return res, err
+		}
+		clean := findCleanVersion(client, track, pref)
+		if clean == nil {
+			return res, err
 		}
+		res.OriginalTrackID = res.TrackID
+		res.TrackID = clean.ID
+		res.Name, res.Artist = clean.Name, artistNames(clean)
+		track = clean
+	}
 
-		return string(bytes)
+	if err = s.checkDuplicate(client, track, pref); err != nil {
+		return res, err
 	}
 
-	return ""
+	var opt *spotify.PlayOptions
+	res.Device, opt = pickDevice(client, pref)
+	if err = client.QueueSongOpt(context.Background(), res.TrackID, opt); isNoActiveDevice(err) {
+		return res, fmt.Errorf("%w: %w", queue.ErrNoActiveDevice, err)
+	}
+	return res, err
 }
 
-func NewSpotifyPlayerQueue() *SpotifyPlayerQueue {
-	return &SpotifyPlayerQueue{
-		OpaqueLinkResolver: httpRequestResolver,
+// artistNames lists the song's artists the way Spotify shows them
+func artistNames(track *spotify.FullTrack) string {
+	names := make([]string, 0, len(track.Artists))
+	for _, a := range track.Artists {
+		names = append(names, a.Name)
 	}
+	return strings.Join(names, ", ")
 }
 
-// Publish will validate that the input matches a valid Spotify URL scheme,
-// and then attempt to queue it in the user's Spotify player.
-func (s *SpotifyPlayerQueue) Publish(client queue.Queuer, input string, pref *preferences.Preference) (spotify.ID, error) {
-	id := parseSpotifyTrackID(input, s.OpaqueLinkResolver)
-	if id == "" {
-		var err error
-		id, err = Search(client, input, pref)
-		if err != nil {
-			return "", err
+// pickDevice finds the device to queue the song on. That's the user's preferred device
+// when it's online, and otherwise whichever device is active, which is what Spotify uses
+// when no device is given. It returns the name of the device, if it can be found.
+func pickDevice(client queue.Queuer, pref *preferences.Preference) (string, *spotify.PlayOptions) {
+	var id, preferred string
+	if pref != nil {
+		id, preferred = pref.TwitchID, pref.DeviceID
+	}
+
+	devices, err := client.PlayerDevices(context.Background())
+	if err != nil {
+		zap.L().Warn("failed to get Spotify devices", zap.String("id", id), zap.Error(err))
+		return "", nil
+	}
+
+	var active string
+	for _, d := range devices {
+		if preferred != "" && d.ID.String() == preferred && !d.Restricted {
+			return d.Name, &spotify.PlayOptions{DeviceID: &d.ID}
+		}
+		if d.Active {
+			active = d.Name
 		}
 	}
 
-	sID := spotify.ID(id)
+	if preferred != "" {
+		zap.L().Info("preferred Spotify device is offline, so using the active device",
+			zap.String("device", preferred),
+			zap.String("active", active),
+			zap.String("id", id))
+	}
+	return active, nil
+}
 
-	if err := ShouldQueue(client, sID, pref); err != nil {
-		return sID, err
+// isNoActiveDevice checks if Spotify rejected the player command because the player
+// isn't open on any device
+func isNoActiveDevice(err error) bool {
+	var se spotify.Error
+	return errors.As(err, &se) && se.Status == http.StatusNotFound && strings.Contains(strings.ToLower(se.Message), "no active device")
+}
+
+// findCleanVersion searches for a non-explicit release of the explicit track, with the same
+// title, the same artists, and close to the same length, that the user's preferences allow.
+func findCleanVersion(client queue.Queuer, explicit *spotify.FullTrack, pref *preferences.Preference) *spotify.FullTrack {
+	query := fmt.Sprintf("track:%s", explicit.Name)
+	if len(explicit.Artists) > 0 {
+		query = fmt.Sprintf("%s artist:%s", query, explicit.Artists[0].Name)
 	}
 
-	return sID, client.QueueSong(context.Background(), sID)
+	res, err := client.Search(context.Background(), query, spotify.SearchTypeTrack, spotify.Limit(searchLimit))
+	if err != nil {
+		zap.L().Warn("failed to search for clean version", zap.String("track", explicit.ID.String()), zap.Error(err))
+		return nil
+	}
+	if res.Tracks == nil {
+		return nil
+	}
+
+	for i := range res.Tracks.Tracks {
+		t := &res.Tracks.Tracks[i]
+		if t.Explicit || t.ID == explicit.ID || !strings.EqualFold(t.Name, explicit.Name) || !sameArtists(t, explicit) {
+			continue
+		}
+		if diff := int(t.Duration) - int(explicit.Duration); diff > cleanDurationTolerance || diff < -cleanDurationTolerance {
+			continue
+		}
+		if checkTrack(t, pref) == nil {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// sameArtists checks if both tracks are credited to the same set of artists
+func sameArtists(a, b *spotify.FullTrack) bool {
+	if len(a.Artists) != len(b.Artists) {
+		return false
+	}
+	for _, artist := range a.Artists {
+		if !slices.ContainsFunc(b.Artists, func(o spotify.SimpleArtist) bool { return o.ID == artist.ID }) {
+			return false
+		}
+	}
+	return true
 }
 
+// Search looks for the song that best matches the input, out of the search results
+// that the user's preferences allow. Results that don't match enough of the input are
+// ignored, so that a vague request doesn't queue a random song.
 func Search(client queue.Queuer, input string, pref *preferences.Preference) (string, error) {
-	res, err := client.Search(context.Background(), input, spotify.SearchTypeTrack)
+	return searchTracks(client, input, searchTerms(input), pref)
+}
+
+// searchTracks runs the search query, and picks the allowed result that matches the most terms
+func searchTracks(client queue.Queuer, query string, terms []string, pref *preferences.Preference) (string, error) {
+	res, err := client.Search(context.Background(), query, spotify.SearchTypeTrack, spotify.Limit(searchLimit))
 	if err != nil {
 		return "", err
 	}
-	if len(res.Tracks.Tracks) < 1 {
+	if res.Tracks == nil || len(res.Tracks.Tracks) < 1 {
 		return "", ErrInvalidInput // no search results found, so most likely a malformed original input
 	}
-	return res.Tracks.Tracks[0].ID.String(), nil
+
+	var best *spotify.FullTrack
+	var bestScore float64
+	var filterErr error
+	for i := range res.Tracks.Tracks {
+		track := &res.Tracks.Tracks[i]
+		score := relevance(terms, track)
+		if score < minSearchScore {
+			continue
+		}
+		if err = checkTrack(track, pref); err != nil {
+			// hold on to the reason that the top result was rejected
+			if filterErr == nil {
+				filterErr = err
+			}
+			continue
+		}
+		// Spotify already sorts its results, so a tie keeps the earlier result
+		if best == nil || score > bestScore {
+			best = track
+			bestScore = score
+		}
+	}
+
+	if best == nil {
+		if filterErr != nil {
+			return "", filterErr
+		}
+		return "", ErrNoSearchMatch
+	}
+	return best.ID.String(), nil
+}
+
+// searchTerms splits the input into lowercase words, without punctuation and
+// filler words that people use when they type out a request
+func searchTerms(s string) []string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsNumber(c)
+	})
+	terms := make([]string, 0, len(words))
+	for _, w := range words {
+		if !slices.Contains(searchFillerWords, w) {
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// relevance is the fraction of the search terms that show up in the track's title,
+// artists, or album, from 0 to 1
+func relevance(terms []string, track *spotify.FullTrack) float64 {
+	if len(terms) == 0 {
+		return 0
+	}
+
+	text := []string{track.Name, track.Album.Name}
+	for _, a := range track.Artists {
+		text = append(text, a.Name)
+	}
+	words := searchTerms(strings.Join(text, " "))
+
+	var found int
+	for _, t := range terms {
+		if slices.Contains(words, t) {
+			found++
+		}
+	}
+	return float64(found) / float64(len(terms))
 }
 
 // TODO: this should be in the queuer
@@ -90,30 +294,100 @@ func ShouldQueue(client queue.Queuer, id spotify.ID, p *preferences.Preference)
 		return fmt.Errorf("failed to get track %s: %w", id.String(), err)
 	}
 
+	return checkTrack(track, p)
+}
+
+// checkTrack verifies the track against the user's preferences
+func checkTrack(track *spotify.FullTrack, p *preferences.Preference) error {
 	if (p == nil || !p.ExplicitSongs) && track.Explicit {
 		return ErrExplicitSong
 	}
 
 	if p != nil && p.MaxSongLength > 0 && int(track.Duration) > p.MaxSongLength {
-		return fmt.Errorf("song is too long. %d > %d", track.Duration, p.MaxSongLength)
+		return fmt.Errorf("%w. %d > %d", ErrSongTooLong, track.Duration, p.MaxSongLength)
+	}
+
+	return checkLists(track, p)
+}
+
+// checkDuplicate rejects the track if it, or another release of the same recording,
+// is already in the user's Spotify queue, or was successfully requested within
+// the user's duplicate window.
+func (s *SpotifyPlayerQueue) checkDuplicate(client queue.Queuer, track *spotify.FullTrack, p *preferences.Preference) error {
+	q, err := client.GetQueue(context.Background())
+	if err != nil {
+		// not being able to read the queue shouldn't stop the request
+		zap.L().Warn("failed to get Spotify queue", zap.Error(err))
+	} else if q != nil {
+		if isSameTrack(track, &q.CurrentlyPlaying) {
+			return ErrDuplicateSong
+		}
+		for i := range q.Items {
+			if isSameTrack(track, &q.Items[i]) {
+				return ErrDuplicateSong
+			}
+		}
+	}
+
+	if s.History == nil || p == nil || p.DuplicateWindow <= 0 {
+		return nil
+	}
+
+	since := time.Now().Add(-time.Duration(p.DuplicateWindow) * time.Minute)
+	recent := s.History.RecentTracks(p.TwitchID, since)
+	if len(recent) == 0 {
+		return nil
+	}
+
+	ids := make([]spotify.ID, 0, len(recent))
+	for _, r := range recent {
+		if r == track.ID.String() {
+			return ErrDuplicateSong
+		}
+		if len(ids) < maxHistoryTracks {
+			ids = append(ids, spotify.ID(r))
+		}
+	}
+
+	// the same recording can be released under different track IDs, which
+	// can only be matched up by comparing ISRCs
+	if isrc(track) == "" {
+		return nil
+	}
+	tracks, err := client.GetTracks(context.Background(), ids)
+	if err != nil {
+		zap.L().Warn("failed to get recently requested tracks", zap.String("id", p.TwitchID), zap.Error(err))
+		return nil
+	}
+	for _, t := range tracks {
+		if isSameTrack(track, t) {
+			return ErrDuplicateSong
+		}
 	}
 
 	return nil
 }
 
+// isSameTrack checks if both tracks have the same Spotify ID or ISRC
+func isSameTrack(a, b *spotify.FullTrack) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	if a.ID != "" && a.ID == b.ID {
+		return true
+	}
+	return isrc(a) != "" && isrc(a) == isrc(b)
+}
+
+func isrc(t *spotify.FullTrack) string {
+	return t.ExternalIDs["isrc"]
+}
+
 // parseSpotifyTrackID takes an input string and tries to match it to the URL that you
 // get from sharing a Spotify track externally
-// TODO: make this implemented by the queuer
 func parseSpotifyTrackID(s string, resolver func(string) string) string {
-	// need to check for the opaque link first
-	if opaqueSpotifyURLPattern.MatchString(s) {
-		s = resolver(s)
-	}
-
-	groups := openSpotifyURLPattern.FindStringSubmatch(s)
-	if len(groups) < 1 {
-		return ""
+	if kind, id := parseInput(s, resolver); kind == queue.InputTrack {
+		return id
 	}
-
-	return groups[len(groups)-1]
+	return ""
 }
@@ -2,11 +2,14 @@ package spotify
 
 import (
 	_ "embed"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
 	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
 	"github.com/stretchr/testify/assert"
 	"github.com/zmb3/spotify/v2"
 )
@@ -48,11 +51,32 @@ func TestPublish(t *testing.T) {
 		ExplicitSongs: false,
 	}
 
-	id, err := s.Publish(&q, testSpotifyTrackURL, &pref)
+	res, err := s.Publish(&q, testSpotifyTrackURL, &pref)
 	assert.NoError(t, err)
 	assert.Len(t, q.Messages, 1)
 	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", q.Messages[0].String())
-	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", id.String())
+	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", res.TrackID.String())
+}
+
+func TestPublishSongDetails(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages: make([]spotify.ID, 0, 1),
+		GetTrackFunc: func(id spotify.ID) (*spotify.FullTrack, error) {
+			return &spotify.FullTrack{
+				SimpleTrack: spotify.SimpleTrack{
+					ID:      id,
+					Name:    "Under Pressure",
+					Artists: []spotify.SimpleArtist{{Name: "Queen"}, {Name: "David Bowie"}},
+				},
+			}, nil
+		},
+	}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.NoError(t, err)
+	assert.Equal(t, "Under Pressure", res.Name)
+	assert.Equal(t, "Queen, David Bowie", res.Artist)
 }
 
 func TestPublishNotUrlFoundSearchResult(t *testing.T) {
@@ -87,6 +111,76 @@ func TestPublishFails(t *testing.T) {
 	assert.Empty(t, q.Messages)
 }
 
+func TestPublishNoActiveDevice(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		QueueErr:     spotify.Error{Status: http.StatusNotFound, Message: "Player command failed: No active device found"},
+	}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.ErrorIs(t, err, queue.ErrNoActiveDevice)
+	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", res.TrackID.String())
+
+	// other player errors are not retried later
+	q.QueueErr = spotify.Error{Status: http.StatusNotFound, Message: "Non existing id"}
+	_, err = s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, queue.ErrNoActiveDevice)
+}
+
+func TestPublishPreferredDevice(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		Devices: []spotify.PlayerDevice{
+			{ID: "phone", Name: "Phone", Active: true},
+			{ID: "stream-pc", Name: "Stream PC"},
+		},
+	}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{DeviceID: "stream-pc"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"stream-pc"}, q.QueuedOn)
+	assert.Equal(t, "Stream PC", res.Device)
+}
+
+func TestPublishPreferredDeviceOffline(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		Devices: []spotify.PlayerDevice{
+			{ID: "phone", Name: "Phone", Active: true},
+		},
+	}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{DeviceID: "stream-pc"})
+	assert.NoError(t, err)
+	// falls back to the active device
+	assert.Equal(t, []string{""}, q.QueuedOn)
+	assert.Equal(t, "Phone", res.Device)
+}
+
+func TestPublishNoPreferredDevice(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		Devices: []spotify.PlayerDevice{
+			{ID: "phone", Name: "Phone", Active: true},
+		},
+	}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, q.QueuedOn)
+	// the active device is still reported
+	assert.Equal(t, "Phone", res.Device)
+}
+
 func TestPublishExplicitSongNotAllowed(t *testing.T) {
 	s := NewSpotifyPlayerQueue()
 	q := testutil.MockQueuer{
@@ -190,3 +284,291 @@ func TestShouldQueueMaxSongLength(t *testing.T) {
 	}
 	assert.NoError(t, ShouldQueue(&q, spotify.ID("cde345"), &p))
 }
+
+func TestPublishAlreadyInQueue(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: trackWithISRC("USRC17607839"),
+		Queue: &spotify.Queue{
+			Items: []spotify.FullTrack{
+				{SimpleTrack: spotify.SimpleTrack{ID: "3cfOd4CMv2snFaKAnMdnvK"}},
+			},
+		},
+	}
+
+	_, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrDuplicateSong)
+	assert.Empty(t, q.Messages)
+
+	// currently playing song counts as well
+	q.Queue = &spotify.Queue{
+		CurrentlyPlaying: spotify.FullTrack{SimpleTrack: spotify.SimpleTrack{ID: "3cfOd4CMv2snFaKAnMdnvK"}},
+	}
+	_, err = s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrDuplicateSong)
+	assert.Empty(t, q.Messages)
+}
+
+func TestPublishSameRecordingInQueue(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: trackWithISRC("USRC17607839"),
+		Queue: &spotify.Queue{
+			Items: []spotify.FullTrack{
+				{SimpleTrack: spotify.SimpleTrack{ID: "somethingelse"}, ExternalIDs: map[string]string{"isrc": "USRC17607839"}},
+			},
+		},
+	}
+
+	_, err := s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrDuplicateSong)
+	assert.Empty(t, q.Messages)
+
+	q.Queue.Items[0].ExternalIDs["isrc"] = "GBAYE0601498"
+	_, err = s.Publish(&q, testSpotifyTrackURL, &preferences.Preference{})
+	assert.NoError(t, err)
+	assert.Len(t, q.Messages, 1)
+}
+
+func TestPublishRecentlyRequested(t *testing.T) {
+	history := testutil.InMemoryMessageCounter{}
+	s := NewSpotifyPlayerQueue()
+	s.History = &history
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: trackWithISRC("USRC17607839"),
+	}
+	pref := preferences.Preference{
+		TwitchID:        "12345",
+		DuplicateWindow: 30,
+	}
+
+	recent := time.Now().Add(-10 * time.Minute)
+	old := time.Now().Add(-time.Hour)
+	history.AddMessage(&metrics.Message{CreatedAt: &old, Success: 1, BroadcasterID: "12345", SpotifyTrack: "3cfOd4CMv2snFaKAnMdnvK"})
+	history.AddMessage(&metrics.Message{CreatedAt: &recent, Success: 0, BroadcasterID: "12345", SpotifyTrack: "3cfOd4CMv2snFaKAnMdnvK"})
+	history.AddMessage(&metrics.Message{CreatedAt: &recent, Success: 1, BroadcasterID: "23456", SpotifyTrack: "3cfOd4CMv2snFaKAnMdnvK"})
+
+	// only failed requests, requests outside of the window, or requests in other channels
+	_, err := s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.NoError(t, err)
+	assert.Len(t, q.Messages, 1)
+
+	history.AddMessage(&metrics.Message{CreatedAt: &recent, Success: 1, BroadcasterID: "12345", SpotifyTrack: "3cfOd4CMv2snFaKAnMdnvK"})
+	_, err = s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.ErrorIs(t, err, ErrDuplicateSong)
+	assert.Len(t, q.Messages, 1)
+
+	// the history check is turned off without a window
+	pref.DuplicateWindow = 0
+	_, err = s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.NoError(t, err)
+	assert.Len(t, q.Messages, 2)
+}
+
+func TestPublishSameRecordingRecentlyRequested(t *testing.T) {
+	history := testutil.InMemoryMessageCounter{}
+	s := NewSpotifyPlayerQueue()
+	s.History = &history
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: trackWithISRC("USRC17607839"),
+	}
+	pref := preferences.Preference{
+		TwitchID:        "12345",
+		DuplicateWindow: 30,
+	}
+
+	// a different track ID for the same recording
+	recent := time.Now().Add(-10 * time.Minute)
+	history.AddMessage(&metrics.Message{CreatedAt: &recent, Success: 1, BroadcasterID: "12345", SpotifyTrack: "abc123"})
+
+	_, err := s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.ErrorIs(t, err, ErrDuplicateSong)
+	assert.Empty(t, q.Messages)
+}
+
+// trackWithISRC returns tracks that all share the same ISRC
+func trackWithISRC(isrc string) func(spotify.ID) (*spotify.FullTrack, error) {
+	return func(id spotify.ID) (*spotify.FullTrack, error) {
+		return &spotify.FullTrack{
+			SimpleTrack: spotify.SimpleTrack{ID: id},
+			ExternalIDs: map[string]string{"isrc": isrc},
+		}, nil
+	}
+}
+
+func searchResult(id, name, artist string, explicit bool, duration int) spotify.FullTrack {
+	return spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			ID:       spotify.ID(id),
+			Name:     name,
+			Artists:  []spotify.SimpleArtist{{Name: artist}},
+			Explicit: explicit,
+			Duration: spotify.Numeric(duration),
+		},
+	}
+}
+
+func TestSearchSkipsFilteredResults(t *testing.T) {
+	q := testutil.MockQueuer{
+		SearchResults: []spotify.FullTrack{
+			searchResult("explicit", "Lose Yourself", "Eminem", true, 1000),
+			searchResult("clean", "Lose Yourself", "Eminem", false, 1000),
+		},
+	}
+
+	id, err := Search(&q, "lose yourself by eminem", &preferences.Preference{})
+	assert.NoError(t, err)
+	assert.Equal(t, "clean", id)
+
+	id, err = Search(&q, "lose yourself by eminem", &preferences.Preference{ExplicitSongs: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "explicit", id)
+}
+
+func TestSearchPrefersBetterMatch(t *testing.T) {
+	q := testutil.MockQueuer{
+		SearchResults: []spotify.FullTrack{
+			searchResult("cover", "Africa", "Weezer", false, 1000),
+			searchResult("original", "Africa", "TOTO", false, 1000),
+		},
+	}
+
+	id, err := Search(&q, "Africa - Toto", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "original", id)
+
+	// ties go to the first result
+	id, err = Search(&q, "africa", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "cover", id)
+}
+
+func TestSearchNoConfidentMatch(t *testing.T) {
+	q := testutil.MockQueuer{
+		SearchResults: []spotify.FullTrack{
+			searchResult("abc123", "Never Gonna Give You Up", "Rick Astley", false, 1000),
+		},
+	}
+
+	_, err := Search(&q, "that one song from the tiktok thing", nil)
+	assert.ErrorIs(t, err, ErrNoSearchMatch)
+
+	q.SearchResults = []spotify.FullTrack{}
+	_, err = Search(&q, "never gonna give you up", nil)
+	assert.ErrorIs(t, err, ErrInvalidInput)
+}
+
+func TestSearchAllResultsFiltered(t *testing.T) {
+	q := testutil.MockQueuer{
+		SearchResults: []spotify.FullTrack{
+			searchResult("long", "Thick as a Brick", "Jethro Tull", false, 2600000),
+			searchResult("explicit", "Thick as a Brick", "Jethro Tull", true, 1000),
+		},
+	}
+
+	_, err := Search(&q, "thick as a brick", &preferences.Preference{MaxSongLength: 600000})
+	assert.ErrorIs(t, err, ErrSongTooLong)
+}
+
+func TestRelevance(t *testing.T) {
+	track := searchResult("abc123", "Don't Stop Me Now - Remastered 2011", "Queen", false, 1000)
+
+	assert.Equal(t, 1.0, relevance(searchTerms("don't stop me now by queen"), &track))
+	assert.Equal(t, 1.0, relevance(searchTerms("QUEEN: Don't Stop Me Now!"), &track))
+	assert.Equal(t, 0.5, relevance(searchTerms("stop queen hamilton musical"), &track))
+	assert.Equal(t, 0.0, relevance(searchTerms("by"), &track))
+	assert.Equal(t, 0.0, relevance(searchTerms("bohemian rhapsody"), &track))
+}
+
+func explicitTrack() *spotify.FullTrack {
+	return &spotify.FullTrack{
+		SimpleTrack: spotify.SimpleTrack{
+			ID:       "3cfOd4CMv2snFaKAnMdnvK",
+			Name:     "Gold Digger",
+			Artists:  []spotify.SimpleArtist{{ID: "5K4W6rqBFWDnAN6FQUkS6x", Name: "Kanye West"}, {ID: "4OBJLual30L7gRl5UkeRcT", Name: "Jamie Foxx"}},
+			Explicit: true,
+			Duration: 207626,
+		},
+	}
+}
+
+func TestPublishCleanSubstitute(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	original := explicitTrack()
+	clean := *original
+	clean.ID = "cleanversion"
+	clean.Explicit = false
+	clean.Duration = 207000
+
+	q := testutil.MockQueuer{
+		Messages: make([]spotify.ID, 0, 1),
+		GetTrackFunc: func(i spotify.ID) (*spotify.FullTrack, error) {
+			return original, nil
+		},
+		SearchResults: []spotify.FullTrack{*original, clean},
+	}
+	pref := preferences.Preference{CleanSubstitute: true}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.NoError(t, err)
+	assert.Equal(t, "cleanversion", res.TrackID.String())
+	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", res.OriginalTrackID.String())
+	assert.Equal(t, []spotify.ID{"cleanversion"}, q.Messages)
+
+	// substitution is opt in
+	pref.CleanSubstitute = false
+	res, err = s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.ErrorIs(t, err, ErrExplicitSong)
+	assert.Empty(t, res.OriginalTrackID)
+	assert.Len(t, q.Messages, 1)
+}
+
+func TestPublishCleanSubstituteNoMatch(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	original := explicitTrack()
+
+	differentLength := *original
+	differentLength.ID = "radioedit"
+	differentLength.Explicit = false
+	differentLength.Duration = 180000
+
+	differentArtists := *original
+	differentArtists.ID = "solo"
+	differentArtists.Explicit = false
+	differentArtists.Artists = original.Artists[:1]
+
+	differentName := *original
+	differentName.ID = "remix"
+	differentName.Explicit = false
+	differentName.Name = "Gold Digger (Remix)"
+
+	q := testutil.MockQueuer{
+		Messages: make([]spotify.ID, 0, 1),
+		GetTrackFunc: func(i spotify.ID) (*spotify.FullTrack, error) {
+			return original, nil
+		},
+		SearchResults: []spotify.FullTrack{differentLength, differentArtists, differentName},
+	}
+	pref := preferences.Preference{CleanSubstitute: true}
+
+	res, err := s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.ErrorIs(t, err, ErrExplicitSong)
+	assert.Equal(t, "3cfOd4CMv2snFaKAnMdnvK", res.TrackID.String())
+	assert.Empty(t, res.OriginalTrackID)
+	assert.Empty(t, q.Messages)
+
+	// the clean version still has to pass the rest of the filters
+	clean := *original
+	clean.ID = "cleanversion"
+	clean.Explicit = false
+	q.SearchResults = []spotify.FullTrack{clean}
+	pref.Blocklist.Tracks = []string{"cleanversion"}
+
+	_, err = s.Publish(&q, testSpotifyTrackURL, &pref)
+	assert.ErrorIs(t, err, ErrExplicitSong)
+	assert.Empty(t, q.Messages)
+}
@@ -0,0 +1,150 @@
+package spotify
+
+import (
+	"context"
+	"errors"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// resolverTimeout bounds the whole lookup, including redirects
+	resolverTimeout = 5 * time.Second
+	// resolverMaxBodySize is how much of the page is read when there is no redirect
+	// straight to the song. The song link is near the top of the page.
+	resolverMaxBodySize  = 512 * 1024
+	resolverMaxRedirects = 5
+	// resolverCacheSize caps how many links are remembered before the cache starts over
+	resolverCacheSize = 1000
+)
+
+var (
+	ogURLPattern        = regexp.MustCompile(`<meta[^>]+property="og:url"[^>]+content="([^"]+)"`)
+	ogURLReversePattern = regexp.MustCompile(`<meta[^>]+content="([^"]+)"[^>]+property="og:url"`)
+
+	errHostNotAllowed = errors.New("host is not allowed")
+)
+
+// LinkResolver looks up the Spotify link that a shortened spotify.link link points to.
+// It only talks to Spotify's hosts, and caches what it finds.
+type LinkResolver struct {
+	// AllowedHosts are the only hosts that the resolver makes requests to
+	AllowedHosts []string
+	client       *http.Client
+	mu           sync.Mutex
+	cache        map[string]string
+}
+
+func NewLinkResolver() *LinkResolver {
+	r := &LinkResolver{
+		AllowedHosts: []string{"spotify.link", "spotify.app.link", "open.spotify.com"},
+		cache:        make(map[string]string),
+	}
+	r.client = &http.Client{
+		Timeout:       resolverTimeout,
+		CheckRedirect: r.checkRedirect,
+	}
+	return r
+}
+
+// Resolve returns the Spotify link behind the short link, or an empty string if
+// it can't be found.
+func (r *LinkResolver) Resolve(link string) string {
+	r.mu.Lock()
+	if res, ok := r.cache[link]; ok {
+		r.mu.Unlock()
+		return res
+	}
+	r.mu.Unlock()
+
+	res, err := r.resolve(link)
+	if err != nil {
+		zap.L().Warn("failed to resolve short link", zap.String("link", link), zap.Error(err))
+		return ""
+	}
+	if res == "" {
+		return ""
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.cache) >= resolverCacheSize {
+		r.cache = make(map[string]string)
+	}
+	r.cache[link] = res
+	return res
+}
+
+func (r *LinkResolver) resolve(link string) (string, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return "", err
+	}
+	if !r.isAllowed(u) {
+		return "", errHostNotAllowed
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolverTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// the redirect chain stops as soon as it reaches a song, album, etc. link
+	if loc, err := resp.Location(); err == nil && openSpotifyURLPattern.MatchString(loc.String()) {
+		return loc.String(), nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, resolverMaxBodySize))
+	if err != nil {
+		return "", err
+	}
+	return canonicalLink(string(body)), nil
+}
+
+// checkRedirect only follows redirects to Spotify, and stops following once the
+// redirect goes to a link that can be parsed.
+func (r *LinkResolver) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= resolverMaxRedirects {
+		return errors.New("too many redirects")
+	}
+	if !r.isAllowed(req.URL) {
+		return errHostNotAllowed
+	}
+	if openSpotifyURLPattern.MatchString(req.URL.String()) {
+		return http.ErrUseLastResponse
+	}
+	return nil
+}
+
+func (r *LinkResolver) isAllowed(u *url.URL) bool {
+	return u.Scheme == "https" && slices.Contains(r.AllowedHosts, u.Host)
+}
+
+// canonicalLink finds the link for the page, preferring the og:url metadata over
+// the first Spotify link on the page.
+func canonicalLink(page string) string {
+	for _, p := range []*regexp.Regexp{ogURLPattern, ogURLReversePattern} {
+		if groups := p.FindStringSubmatch(page); len(groups) > 1 {
+			if link := html.UnescapeString(groups[1]); openSpotifyURLPattern.MatchString(link) {
+				return link
+			}
+		}
+	}
+	return openSpotifyURLPattern.FindString(page)
+}
@@ -0,0 +1,119 @@
+package spotify
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestResolver returns a resolver that is allowed to talk to the test server
+func newTestResolver(t *testing.T, handler http.HandlerFunc) (*LinkResolver, *httptest.Server) {
+	t.Helper()
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	u, err := url.Parse(server.URL)
+	assert.NoError(t, err)
+
+	r := NewLinkResolver()
+	r.AllowedHosts = append(r.AllowedHosts, u.Host)
+	r.client.Transport = server.Client().Transport
+	return r, server
+}
+
+func TestResolveRedirect(t *testing.T) {
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, "https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA?si=abc", http.StatusTemporaryRedirect)
+	})
+
+	assert.Equal(t, "https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA?si=abc", r.Resolve(server.URL+"/8qo05dnCrDb"))
+}
+
+func TestResolveOpenGraph(t *testing.T) {
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, `<html><head>
+			<meta property="og:url" content="https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O?si=a&amp;b=c">
+			</head><body><a href="https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA">other</a></body></html>`)
+	})
+
+	assert.Equal(t, "https://open.spotify.com/album/5nNxoHQHZqvI7bWcDhTB7O?si=a&b=c", r.Resolve(server.URL+"/abc"))
+}
+
+func TestResolvePageLink(t *testing.T) {
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, sampleHTML)
+	})
+
+	link := r.Resolve(server.URL + "/abc")
+	assert.Equal(t, "https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA", link)
+	assert.Equal(t, "0RM0BeXRRIz1LExEl83GhA", parseSpotifyTrackID(link, nil))
+}
+
+func TestResolveOnlySpotifyHosts(t *testing.T) {
+	var calls atomic.Int32
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		http.Redirect(w, req, "https://example.com/track/0RM0BeXRRIz1LExEl83GhA", http.StatusFound)
+	})
+
+	// redirects off of Spotify aren't followed
+	assert.Empty(t, r.Resolve(server.URL+"/abc"))
+	assert.Equal(t, int32(1), calls.Load())
+
+	// and links that don't start on Spotify aren't requested at all
+	r.AllowedHosts = []string{"spotify.link"}
+	assert.Empty(t, r.Resolve(server.URL+"/abc"))
+	assert.Empty(t, r.Resolve("http://spotify.link/abc"))
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestResolveCaches(t *testing.T) {
+	var calls atomic.Int32
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		calls.Add(1)
+		if strings.HasSuffix(req.URL.Path, "missing") {
+			fmt.Fprint(w, "<html></html>")
+			return
+		}
+		http.Redirect(w, req, "https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA", http.StatusFound)
+	})
+
+	for i := 0; i < 3; i++ {
+		assert.NotEmpty(t, r.Resolve(server.URL+"/abc"))
+	}
+	assert.Equal(t, int32(1), calls.Load())
+
+	// failed lookups are tried again
+	assert.Empty(t, r.Resolve(server.URL+"/missing"))
+	assert.Empty(t, r.Resolve(server.URL+"/missing"))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestResolveBodyLimit(t *testing.T) {
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, strings.Repeat(" ", resolverMaxBodySize))
+		fmt.Fprint(w, `<a href="https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA">`)
+	})
+
+	assert.Empty(t, r.Resolve(server.URL+"/abc"))
+}
+
+func TestResolveTimeout(t *testing.T) {
+	r, server := newTestResolver(t, func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-req.Context().Done():
+		}
+		http.Redirect(w, req, "https://open.spotify.com/track/0RM0BeXRRIz1LExEl83GhA", http.StatusFound)
+	})
+	r.client.Timeout = 50 * time.Millisecond
+
+	assert.Empty(t, r.Resolve(server.URL+"/abc"))
+}
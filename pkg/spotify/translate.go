@@ -0,0 +1,270 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+)
+
+var (
+	// any link that wasn't recognized as Spotify or another music service
+	linkPattern = regexp.MustCompile(`https?://\S+`)
+	// decorations on video titles that aren't part of the song's name
+	titleNoisePattern     = regexp.MustCompile(`(?i)\s*[\(\[][^\)\]]*(official|video|audio|lyric|visuali[sz]er|hd|4k|mv)[^\)\]]*[\)\]]`)
+	ogTitlePattern        = regexp.MustCompile(`<meta[^>]+property="og:title"[^>]+content="([^"]+)"`)
+	ogTitleReversePattern = regexp.MustCompile(`<meta[^>]+content="([^"]+)"[^>]+property="og:title"`)
+
+	ErrUnsupportedLink = errors.New("links to this site can't be requested")
+	ErrTranslateLink   = errors.New("could not find the song behind the link")
+)
+
+// SongInfo is what is known about a song on another music service
+type SongInfo struct {
+	Title  string
+	Artist string
+}
+
+// LinkTranslator finds the song behind a link to another music service, so that
+// the same song can be found on Spotify.
+type LinkTranslator interface {
+	// Service is the name of the music service, which is reported as the input kind
+	Service() string
+	// FindLink returns the link to the service in the input, or an empty string
+	FindLink(input string) string
+	// Lookup fetches the title and artist of the song behind the link
+	Lookup(ctx context.Context, link string) (*SongInfo, error)
+}
+
+// DefaultTranslators handles links from YouTube, Apple Music, Deezer and Tidal
+func DefaultTranslators() []LinkTranslator {
+	return []LinkTranslator{
+		NewOEmbedTranslator("youtube",
+			regexp.MustCompile(`https://(?:www\.|m\.|music\.)?(?:youtube\.com/(?:watch\?|shorts/)|youtu\.be/)\S+`),
+			"https://www.youtube.com/oembed"),
+		NewOpenGraphTranslator("apple music",
+			regexp.MustCompile(`https://music\.apple\.com/\S+`)),
+		NewOEmbedTranslator("deezer",
+			regexp.MustCompile(`https://(?:www\.)?deezer\.com/(?:[a-z]{2}/)?track/\d+\S*`),
+			"https://api.deezer.com/oembed"),
+		NewOEmbedTranslator("tidal",
+			regexp.MustCompile(`https://(?:www\.|listen\.)?tidal\.com/(?:browse/)?track/\d+\S*`),
+			"https://oembed.tidal.com/"),
+	}
+}
+
+// ensure the translators implement the interface
+var (
+	_ LinkTranslator = (*OEmbedTranslator)(nil)
+	_ LinkTranslator = (*OpenGraphTranslator)(nil)
+)
+
+// OEmbedTranslator looks up songs with the music service's oEmbed endpoint
+type OEmbedTranslator struct {
+	// AllowedHosts are the hosts that the endpoint can redirect to, besides its own
+	AllowedHosts []string
+	name         string
+	pattern      *regexp.Regexp
+	endpoint     string
+	client       *http.Client
+}
+
+func NewOEmbedTranslator(name string, pattern *regexp.Regexp, endpoint string) *OEmbedTranslator {
+	t := &OEmbedTranslator{
+		name:     name,
+		pattern:  pattern,
+		endpoint: endpoint,
+	}
+	t.client = &http.Client{
+		Timeout: resolverTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkRedirectHost(t.AllowedHosts, req, via)
+		},
+	}
+	return t
+}
+
+// Service implements LinkTranslator.
+func (t *OEmbedTranslator) Service() string {
+	return t.name
+}
+
+// FindLink implements LinkTranslator.
+func (t *OEmbedTranslator) FindLink(input string) string {
+	return t.pattern.FindString(input)
+}
+
+// Lookup implements LinkTranslator.
+func (t *OEmbedTranslator) Lookup(ctx context.Context, link string) (*SongInfo, error) {
+	body, err := fetch(ctx, t.client, fmt.Sprintf("%s?format=json&url=%s", t.endpoint, url.QueryEscape(link)))
+	if err != nil {
+		return nil, err
+	}
+
+	var res struct {
+		Title      string `json:"title"`
+		AuthorName string `json:"author_name"`
+	}
+	if err = json.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return parseSongInfo(res.Title, res.AuthorName), nil
+}
+
+// OpenGraphTranslator looks up songs by reading the og:title metadata on the song's page
+type OpenGraphTranslator struct {
+	// AllowedHosts are the hosts that the song's page can redirect to, besides its own
+	AllowedHosts []string
+	name         string
+	pattern      *regexp.Regexp
+	client       *http.Client
+}
+
+func NewOpenGraphTranslator(name string, pattern *regexp.Regexp) *OpenGraphTranslator {
+	t := &OpenGraphTranslator{
+		name:    name,
+		pattern: pattern,
+	}
+	t.client = &http.Client{
+		Timeout: resolverTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return checkRedirectHost(t.AllowedHosts, req, via)
+		},
+	}
+	return t
+}
+
+// Service implements LinkTranslator.
+func (t *OpenGraphTranslator) Service() string {
+	return t.name
+}
+
+// FindLink implements LinkTranslator.
+func (t *OpenGraphTranslator) FindLink(input string) string {
+	return t.pattern.FindString(input)
+}
+
+// Lookup implements LinkTranslator.
+func (t *OpenGraphTranslator) Lookup(ctx context.Context, link string) (*SongInfo, error) {
+	body, err := fetch(ctx, t.client, link)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range []*regexp.Regexp{ogTitlePattern, ogTitleReversePattern} {
+		if groups := p.FindSubmatch(body); len(groups) > 1 {
+			return parseSongInfo(html.UnescapeString(string(groups[1])), ""), nil
+		}
+	}
+	return nil, errors.New("page has no og:title")
+}
+
+// fetch reads the page, up to the same size limit as the short link resolver
+func fetch(ctx context.Context, client *http.Client, link string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d from %s", resp.StatusCode, req.URL.Host)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, resolverMaxBodySize))
+}
+
+// checkRedirectHost only follows redirects that stay on the host of the first request, or
+// go to one of the allowed hosts, so that a link in chat can't send requests anywhere
+func checkRedirectHost(allowed []string, req *http.Request, via []*http.Request) error {
+	if len(via) >= resolverMaxRedirects {
+		return errors.New("too many redirects")
+	}
+	first := via[0].URL
+	if req.URL.Scheme != first.Scheme {
+		return errHostNotAllowed
+	}
+	if req.URL.Host != first.Host && !slices.Contains(allowed, req.URL.Host) {
+		return errHostNotAllowed
+	}
+	return nil
+}
+
+// parseSongInfo picks the title and artist out of a page title, which is usually
+// "Artist - Title" for videos, or "Title by Artist" for music services. The author
+// is used as the artist when the title doesn't name one.
+func parseSongInfo(title, author string) *SongInfo {
+	title = strings.Trim(title, " \u200e\u200f") // Apple Music pads titles with direction marks
+	title = strings.TrimSuffix(title, " on Apple Music")
+	title = strings.TrimSpace(titleNoisePattern.ReplaceAllString(title, ""))
+
+	if artist, song, ok := strings.Cut(title, " - "); ok {
+		return &SongInfo{Title: strings.TrimSpace(song), Artist: strings.TrimSpace(artist)}
+	}
+	if i := strings.LastIndex(title, " by "); i > 0 {
+		return &SongInfo{Title: strings.TrimSpace(title[:i]), Artist: strings.TrimSpace(title[i+len(" by "):])}
+	}
+
+	// YouTube's auto-generated artist channels are named "Artist - Topic"
+	author = strings.TrimSuffix(author, " - Topic")
+	author = strings.TrimSuffix(author, "VEVO")
+	return &SongInfo{Title: title, Artist: strings.TrimSpace(author)}
+}
+
+// translateLink finds the Spotify song that matches the song behind the link
+func translateLink(client queue.Queuer, t LinkTranslator, link string, pref *preferences.Preference) (string, error) {
+	info, err := t.Lookup(context.Background(), link)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrTranslateLink, err)
+	}
+	if info.Title == "" {
+		return "", ErrTranslateLink
+	}
+
+	query := fmt.Sprintf("track:%s", info.Title)
+	if info.Artist != "" {
+		query = fmt.Sprintf("%s artist:%s", query, info.Artist)
+	}
+	return searchTracks(client, query, searchTerms(info.Title+" "+info.Artist), pref)
+}
+
+// resolveInput works out what the input is, including links to other music services,
+// and returns the ID of the song to queue for it.
+func (s *SpotifyPlayerQueue) resolveInput(client queue.Queuer, input string, pref *preferences.Preference) (queue.InputKind, string, error) {
+	kind, id := parseInput(input, s.OpaqueLinkResolver)
+	if kind != queue.InputSearch {
+		id, err := resolveTrack(client, kind, id, input, pref)
+		return kind, id, err
+	}
+
+	for _, t := range s.Translators {
+		if link := t.FindLink(input); link != "" {
+			id, err := translateLink(client, t, link, pref)
+			return queue.InputKind(t.Service()), id, err
+		}
+	}
+
+	// searching for the text of a link only finds garbage
+	if linkPattern.MatchString(input) {
+		return queue.InputLink, "", ErrUnsupportedLink
+	}
+
+	id, err := resolveTrack(client, kind, id, input, pref)
+	return kind, id, err
+}
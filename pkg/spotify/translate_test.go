@@ -0,0 +1,216 @@
+package spotify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/internal/testutil"
+	"github.com/saxypandabear/twitchsongrequests/pkg/preferences"
+	"github.com/saxypandabear/twitchsongrequests/pkg/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/zmb3/spotify/v2"
+)
+
+func TestParseSongInfo(t *testing.T) {
+	tests := map[string]struct {
+		title    string
+		author   string
+		expected SongInfo
+	}{
+		"video":         {"Rick Astley - Never Gonna Give You Up (Official Music Video)", "Rick Astley", SongInfo{"Never Gonna Give You Up", "Rick Astley"}},
+		"brackets":      {"Daft Punk - Get Lucky [Official Audio] (feat. Pharrell Williams)", "", SongInfo{"Get Lucky (feat. Pharrell Williams)", "Daft Punk"}},
+		"topic channel": {"Blinding Lights", "The Weeknd - Topic", SongInfo{"Blinding Lights", "The Weeknd"}},
+		"vevo channel":  {"Hello (Lyric Video)", "AdeleVEVO", SongInfo{"Hello", "Adele"}},
+		"apple music":   {"‎Blinding Lights by The Weeknd on Apple Music", "", SongInfo{"Blinding Lights", "The Weeknd"}},
+		"by in title":   {"Stand by Me by Ben E. King", "", SongInfo{"Stand by Me", "Ben E. King"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, &test.expected, parseSongInfo(test.title, test.author))
+		})
+	}
+}
+
+func TestOEmbedTranslator(t *testing.T) {
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Query().Get("url")
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"title":       "Rick Astley - Never Gonna Give You Up (Official Music Video)",
+			"author_name": "Rick Astley",
+		})
+	}))
+	defer server.Close()
+
+	tr := NewOEmbedTranslator("youtube", regexp.MustCompile(`https://youtu\.be/\S+`), server.URL)
+	link := tr.FindLink("check this out https://youtu.be/dQw4w9WgXcQ?si=abc lol")
+	assert.Equal(t, "https://youtu.be/dQw4w9WgXcQ?si=abc", link)
+
+	info, err := tr.Lookup(context.Background(), link)
+	assert.NoError(t, err)
+	assert.Equal(t, link, requested)
+	assert.Equal(t, &SongInfo{Title: "Never Gonna Give You Up", Artist: "Rick Astley"}, info)
+}
+
+func TestOEmbedTranslatorFails(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	tr := NewOEmbedTranslator("youtube", regexp.MustCompile(`https://youtu\.be/\S+`), server.URL)
+	_, err := tr.Lookup(context.Background(), "https://youtu.be/dQw4w9WgXcQ")
+	assert.Error(t, err)
+}
+
+func TestOpenGraphTranslator(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><head><meta content="&lrm;Blinding Lights by The Weeknd on Apple Music" property="og:title"></head></html>`)
+	}))
+	defer server.Close()
+
+	tr := NewOpenGraphTranslator("apple music", regexp.MustCompile(regexp.QuoteMeta(server.URL)+`/\S+`))
+	link := tr.FindLink(server.URL + "/us/album/blinding-lights/1488408555?i=1488408568")
+	assert.NotEmpty(t, link)
+
+	info, err := tr.Lookup(context.Background(), link)
+	assert.NoError(t, err)
+	assert.Equal(t, &SongInfo{Title: "Blinding Lights", Artist: "The Weeknd"}, info)
+}
+
+func TestTranslatorRedirects(t *testing.T) {
+	var elsewhere atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere.Add(1)
+		fmt.Fprint(w, `<html><head><meta property="og:title" content="Blinding Lights by The Weeknd"></head></html>`)
+	}))
+	defer other.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/moved":
+			http.Redirect(w, r, "/song", http.StatusFound)
+		case "/song":
+			fmt.Fprint(w, `<html><head><meta property="og:title" content="Blinding Lights by The Weeknd"></head></html>`)
+		default:
+			http.Redirect(w, r, other.URL+"/song", http.StatusFound)
+		}
+	}))
+	defer server.Close()
+
+	tr := NewOpenGraphTranslator("apple music", regexp.MustCompile(regexp.QuoteMeta(server.URL)+`/\S+`))
+
+	// redirects on the same site are followed
+	info, err := tr.Lookup(context.Background(), server.URL+"/moved")
+	assert.NoError(t, err)
+	assert.Equal(t, "Blinding Lights", info.Title)
+
+	// redirects to other sites aren't
+	_, err = tr.Lookup(context.Background(), server.URL+"/elsewhere")
+	assert.ErrorIs(t, err, errHostNotAllowed)
+	assert.Zero(t, elsewhere.Load())
+
+	// unless the site is allowed
+	tr.AllowedHosts = []string{strings.TrimPrefix(other.URL, "http://")}
+	_, err = tr.Lookup(context.Background(), server.URL+"/elsewhere")
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), elsewhere.Load())
+}
+
+// stubTranslator stands in for a music service
+type stubTranslator struct {
+	info *SongInfo
+	err  error
+}
+
+func (s *stubTranslator) Service() string { return "stub" }
+
+func (s *stubTranslator) FindLink(input string) string {
+	return regexp.MustCompile(`https://stub\.music/\S+`).FindString(input)
+}
+
+func (s *stubTranslator) Lookup(context.Context, string) (*SongInfo, error) {
+	return s.info, s.err
+}
+
+func TestPublishTranslatedLink(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	s.Translators = []LinkTranslator{&stubTranslator{info: &SongInfo{Title: "Africa", Artist: "TOTO"}}}
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+		SearchResults: []spotify.FullTrack{
+			searchResult("cover", "Africa", "Weezer", false, 1000),
+			searchResult("original", "Africa", "TOTO", false, 1000),
+		},
+	}
+
+	res, err := s.Publish(&q, "https://stub.music/track/123", &preferences.Preference{})
+	assert.NoError(t, err)
+	assert.Equal(t, queue.InputKind("stub"), res.Kind)
+	assert.Equal(t, "original", res.TrackID.String())
+	assert.Equal(t, []spotify.ID{"original"}, q.Messages)
+}
+
+func TestPublishTranslatedLinkNoMatch(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	s.Translators = []LinkTranslator{&stubTranslator{info: &SongInfo{Title: "Some Obscure Bootleg", Artist: "Nobody"}}}
+	q := testutil.MockQueuer{
+		Messages:      make([]spotify.ID, 0, 1),
+		GetTrackFunc:  testutil.DefaultMockQueuerGetTrackFunc,
+		SearchResults: []spotify.FullTrack{searchResult("abc123", "Africa", "TOTO", false, 1000)},
+	}
+
+	_, err := s.Publish(&q, "https://stub.music/track/123", &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrNoSearchMatch)
+	assert.Empty(t, q.Messages)
+
+	s.Translators = []LinkTranslator{&stubTranslator{err: fmt.Errorf("service is down")}}
+	_, err = s.Publish(&q, "https://stub.music/track/123", &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrTranslateLink)
+	assert.Empty(t, q.Messages)
+}
+
+func TestPublishUnsupportedLink(t *testing.T) {
+	s := NewSpotifyPlayerQueue()
+	s.Translators = []LinkTranslator{&stubTranslator{}}
+	q := testutil.MockQueuer{
+		Messages:     make([]spotify.ID, 0, 1),
+		GetTrackFunc: testutil.DefaultMockQueuerGetTrackFunc,
+	}
+
+	res, err := s.Publish(&q, "https://soundcloud.com/artist/song", &preferences.Preference{})
+	assert.ErrorIs(t, err, ErrUnsupportedLink)
+	assert.Equal(t, queue.InputLink, res.Kind)
+	assert.Empty(t, q.Messages)
+}
+
+func TestDefaultTranslatorsFindLinks(t *testing.T) {
+	tests := map[string]string{
+		"https://www.youtube.com/watch?v=dQw4w9WgXcQ":                              "youtube",
+		"https://youtu.be/dQw4w9WgXcQ":                                             "youtube",
+		"https://music.youtube.com/watch?v=dQw4w9WgXcQ":                            "youtube",
+		"https://music.apple.com/us/album/blinding-lights/1488408555?i=1488408568": "apple music",
+		"https://www.deezer.com/en/track/3135556":                                  "deezer",
+		"https://tidal.com/browse/track/77640617":                                  "tidal",
+		"https://soundcloud.com/artist/song":                                       "",
+	}
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			var found string
+			for _, tr := range DefaultTranslators() {
+				if tr.FindLink(input) != "" {
+					found = tr.Service()
+					break
+				}
+			}
+			assert.Equal(t, expected, found)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package streams
+
+import (
+	"sort"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+)
+
+// TopCount is how many requesters and artists are listed in a recap
+const TopCount = 5
+
+// Recap sums up the song requests that were made during a stream
+type Recap struct {
+	StreamID  string     `json:"stream_id"`
+	StartedAt *time.Time `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at,omitempty"`
+	// Requests is how many requests were made, whether they were queued or not
+	Requests int `json:"requests"`
+	Queued   int `json:"queued"`
+	// SuccessRate is the share of requests that were queued, from 0 to 1
+	SuccessRate   float64      `json:"success_rate"`
+	TopRequesters []Count      `json:"top_requesters"`
+	TopArtists    []Count      `json:"top_artists"`
+	Tracks        []RecapTrack `json:"tracks"`
+}
+
+// Count is how many songs a viewer requested, or how many songs by an artist were queued
+type Count struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// RecapTrack is a song that was queued during the stream
+type RecapTrack struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	Artist      string     `json:"artist"`
+	RequestedBy string     `json:"requested_by"`
+	RequestedAt *time.Time `json:"requested_at"`
+}
+
+// BuildRecap sums up the requests that were made during the stream, whatever happened to
+// them. The names and artists of the songs come from the messages that were recorded when
+// they were queued. Only the top requesters and artists are kept.
+func BuildRecap(s *Stream, reqs []*requests.Request, msgs []*metrics.Message, top int) *Recap {
+	r := Recap{
+		StreamID:  s.ID,
+		StartedAt: s.StartedAt,
+		EndedAt:   s.EndedAt,
+		Tracks:    make([]RecapTrack, 0),
+	}
+
+	queued := make(map[string]*metrics.Message, len(msgs))
+	for _, m := range msgs {
+		if m.Success == 1 && m.SpotifyTrack != "" {
+			queued[m.SpotifyTrack] = m
+		}
+	}
+
+	requesters := make(map[string]int)
+	artists := make(map[string]int)
+	for _, req := range reqs {
+		r.Requests++
+		if req.UserName != "" {
+			requesters[req.UserName]++
+		}
+		if !req.WasQueued() {
+			continue
+		}
+
+		r.Queued++
+		t := RecapTrack{
+			ID:          req.TrackID,
+			RequestedBy: req.UserName,
+			RequestedAt: req.CreatedAt,
+		}
+		if m, ok := queued[req.TrackID]; ok {
+			t.Name, t.Artist = m.TrackName, m.Artist
+		}
+		if t.Artist != "" {
+			artists[t.Artist]++
+		}
+		r.Tracks = append(r.Tracks, t)
+	}
+
+	if r.Requests > 0 {
+		r.SuccessRate = float64(r.Queued) / float64(r.Requests)
+	}
+	r.TopRequesters = topCounts(requesters, top)
+	r.TopArtists = topCounts(artists, top)
+	return &r
+}
+
+// topCounts sorts the counts from most to least, breaking ties by name so that the
+// recap doesn't change between views
+func topCounts(counts map[string]int, top int) []Count {
+	c := make([]Count, 0, len(counts))
+	for name, n := range counts {
+		c = append(c, Count{Name: name, Count: n})
+	}
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].Count != c[j].Count {
+			return c[i].Count > c[j].Count
+		}
+		return c[i].Name < c[j].Name
+	})
+	if len(c) > top {
+		c = c[:top]
+	}
+	return c
+}
@@ -0,0 +1,67 @@
+package streams_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/o11y/metrics"
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/streams"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildRecap(t *testing.T) {
+	started := time.Date(2024, time.January, 1, 20, 0, 0, 0, time.UTC)
+	ended := started.Add(3 * time.Hour)
+	s := &streams.Stream{ID: "stream-1", BroadcasterID: "12345", StartedAt: &started, EndedAt: &ended}
+
+	at := started.Add(time.Minute)
+	reqs := []*requests.Request{
+		{CreatedAt: &at, Status: requests.StatusPlayed, TrackID: "abc", UserName: "viewer"},
+		{CreatedAt: &at, Status: requests.StatusQueued, TrackID: "bcd", UserName: "other"},
+		{CreatedAt: &at, Status: requests.StatusFailed, UserName: "viewer"},
+		{CreatedAt: &at, Status: requests.StatusSkipped, TrackID: "cde", UserName: "viewer"},
+		// turned down before it was queued, so no message was recorded for it
+		{CreatedAt: &at, Status: requests.StatusRejected, UserName: "viewer"},
+	}
+	msgs := []*metrics.Message{
+		{CreatedAt: &at, Success: 1, SpotifyTrack: "abc", TrackName: "Song A", Artist: "Artist A", UserName: "viewer"},
+		{CreatedAt: &at, Success: 1, SpotifyTrack: "bcd", TrackName: "Song B", Artist: "Artist A", UserName: "other"},
+		{CreatedAt: &at, Success: 0, UserName: "viewer"},
+		{CreatedAt: &at, Success: 1, SpotifyTrack: "cde", TrackName: "Song C", Artist: "Artist B", UserName: "viewer"},
+	}
+
+	r := streams.BuildRecap(s, reqs, msgs, 1)
+	assert.Equal(t, "stream-1", r.StreamID)
+	assert.Equal(t, &started, r.StartedAt)
+	assert.Equal(t, &ended, r.EndedAt)
+	assert.Equal(t, 5, r.Requests)
+	assert.Equal(t, 3, r.Queued)
+	assert.Equal(t, 0.6, r.SuccessRate)
+	// only the top one is kept
+	assert.Equal(t, []streams.Count{{Name: "viewer", Count: 4}}, r.TopRequesters)
+	assert.Equal(t, []streams.Count{{Name: "Artist A", Count: 2}}, r.TopArtists)
+
+	// requests that weren't queued aren't in the track list
+	require.Len(t, r.Tracks, 3)
+	assert.Equal(t, "abc", r.Tracks[0].ID)
+	assert.Equal(t, "Song B", r.Tracks[1].Name)
+	assert.Equal(t, "viewer", r.Tracks[2].RequestedBy)
+}
+
+func TestBuildRecapWithoutRequests(t *testing.T) {
+	started := time.Now()
+	r := streams.BuildRecap(&streams.Stream{ID: "stream-1", StartedAt: &started}, nil, nil, streams.TopCount)
+	assert.Zero(t, r.Requests)
+	assert.Zero(t, r.SuccessRate)
+	assert.Empty(t, r.TopRequesters)
+	assert.Empty(t, r.Tracks)
+
+	// the lists are still arrays in the download
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"tracks":[]`)
+	assert.Contains(t, string(b), `"top_artists":[]`)
+}
@@ -0,0 +1,21 @@
+package streams
+
+import "time"
+
+// Stream is one of a broadcaster's streams, from going live until going offline. Requests
+// that were made between the two belong to the stream.
+type Stream struct {
+	// ID is the ID of the stream on Twitch
+	ID            string     `column:"id"`
+	BroadcasterID string     `column:"broadcaster_id"`
+	StartedAt     *time.Time `column:"started_at"`
+	// EndedAt is when the stream went offline, or nil while it's live
+	EndedAt *time.Time `column:"ended_at"`
+	// Recap sums up the stream's song requests once it went offline, or nil before then
+	Recap *Recap `column:"recap"`
+}
+
+// IsLive reports whether the stream hasn't gone offline yet
+func (s *Stream) IsLive() bool {
+	return s != nil && s.EndedAt == nil
+}
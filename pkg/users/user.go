@@ -14,6 +14,19 @@ type User struct {
 	Subscribed          bool       `column:"subscribed"`
 	SubscriptionID      string     `column:"subscription_id"`
 	Email               string     `column:"email"`
+	// ChatSubscriptionID is the EventSub subscription for chat messages, which is
+	// used for the chat command
+	ChatSubscriptionID string `column:"chat_subscription_id"`
+	// CheerSubscriptionID is the EventSub subscription for cheers, which is used for
+	// requests that are paid for with bits
+	CheerSubscriptionID string `column:"cheer_subscription_id"`
+	// RewardSubscriptionID is the EventSub subscription for changes to the broadcaster's
+	// Channel Point rewards, which keeps their song request rewards up to date
+	RewardSubscriptionID string `column:"reward_subscription_id"`
+	// OnlineSubscriptionID and OfflineSubscriptionID are the EventSub subscriptions for the
+	// broadcaster going live and offline, which are used to tell their streams apart
+	OnlineSubscriptionID  string `column:"online_subscription_id"`
+	OfflineSubscriptionID string `column:"offline_subscription_id"`
 }
 
 func (u *User) IsAuthenticated() bool {
@@ -0,0 +1,155 @@
+package worker
+
+import (
+	"hash/fnv"
+	"sync"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+)
+
+const (
+	// DefaultWorkers is how many requests are processed at the same time
+	DefaultWorkers = 4
+	// DefaultQueueSize is how many requests can wait for each worker
+	DefaultQueueSize = 100
+)
+
+// Pool processes song requests in the background. All of a broadcaster's requests
+// are handled by the same worker, so they're processed in the order that they
+// were submitted, while different broadcasters' requests are processed side by side.
+// Requests submitted with SubmitFirst skip ahead of the ones submitted with Submit.
+type Pool struct {
+	process  func(*requests.Request)
+	queues   []chan *requests.Request
+	priority []chan *requests.Request
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// inFlight holds the IDs of the requests that were submitted but not finished
+	// processing, so that the same request isn't submitted twice
+	inFlight map[string]struct{}
+	stopped  bool
+}
+
+func NewPool(workers, queueSize int, process func(*requests.Request)) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := Pool{
+		process:  process,
+		queues:   make([]chan *requests.Request, workers),
+		priority: make([]chan *requests.Request, workers),
+		inFlight: make(map[string]struct{}),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan *requests.Request, queueSize)
+		p.priority[i] = make(chan *requests.Request, queueSize)
+	}
+	return &p
+}
+
+// Start runs the workers in the background
+func (p *Pool) Start() {
+	for i := range p.queues {
+		p.wg.Add(1)
+		go p.work(p.queues[i], p.priority[i])
+	}
+}
+
+// Stop waits for the submitted requests to finish processing, and then stops the
+// workers. Requests can't be submitted after the pool is stopped.
+func (p *Pool) Stop() {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return
+	}
+	p.stopped = true
+	for i := range p.queues {
+		close(p.queues[i])
+		close(p.priority[i])
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+// Submit hands the request to the broadcaster's worker without waiting for it to be
+// processed. It returns false if the request is already being processed, or if the
+// worker has too many requests waiting.
+func (p *Pool) Submit(r *requests.Request) bool {
+	return p.submit(p.queues, r)
+}
+
+// SubmitFirst is like Submit, but the request is processed before the broadcaster's
+// requests that were submitted with Submit and haven't started processing yet.
+func (p *Pool) SubmitFirst(r *requests.Request) bool {
+	return p.submit(p.priority, r)
+}
+
+func (p *Pool) submit(queues []chan *requests.Request, r *requests.Request) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		return false
+	}
+	if _, ok := p.inFlight[r.ID]; ok {
+		return false
+	}
+
+	select {
+	case queues[p.shard(r.BroadcasterID)] <- r:
+		p.inFlight[r.ID] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *Pool) work(q, priority chan *requests.Request) {
+	defer p.wg.Done()
+	// a channel is set to nil once it's closed and empty, which stops it from being selected
+	for q != nil || priority != nil {
+		// always take a priority request first, if there is one waiting
+		select {
+		case r, ok := <-priority:
+			if !ok {
+				priority = nil
+			} else {
+				p.run(r)
+			}
+			continue
+		default:
+		}
+
+		select {
+		case r, ok := <-priority:
+			if !ok {
+				priority = nil
+			} else {
+				p.run(r)
+			}
+		case r, ok := <-q:
+			if !ok {
+				q = nil
+			} else {
+				p.run(r)
+			}
+		}
+	}
+}
+
+func (p *Pool) run(r *requests.Request) {
+	p.process(r)
+
+	p.mu.Lock()
+	delete(p.inFlight, r.ID)
+	p.mu.Unlock()
+}
+
+// shard picks the worker for the broadcaster
+func (p *Pool) shard(broadcasterID string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(broadcasterID))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
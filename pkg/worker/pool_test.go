@@ -0,0 +1,87 @@
+package worker_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/saxypandabear/twitchsongrequests/pkg/requests"
+	"github.com/saxypandabear/twitchsongrequests/pkg/worker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolProcessesBroadcasterInOrder(t *testing.T) {
+	var mu sync.Mutex
+	processed := make(map[string][]string)
+	p := worker.NewPool(3, 50, func(r *requests.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		processed[r.BroadcasterID] = append(processed[r.BroadcasterID], r.ID)
+	})
+	p.Start()
+
+	expected := make(map[string][]string)
+	for i := 0; i < 20; i++ {
+		for _, b := range []string{"12345", "23456", "34567"} {
+			id := fmt.Sprintf("%s-%d", b, i)
+			assert.True(t, p.Submit(&requests.Request{ID: id, BroadcasterID: b}))
+			expected[b] = append(expected[b], id)
+		}
+	}
+	p.Stop()
+
+	assert.Equal(t, expected, processed)
+}
+
+func TestPoolSkipsRequestInFlight(t *testing.T) {
+	block := make(chan struct{})
+	var count int
+	p := worker.NewPool(1, 10, func(r *requests.Request) {
+		<-block
+		count++
+	})
+	p.Start()
+
+	r := requests.Request{ID: "abc-123", BroadcasterID: "12345"}
+	assert.True(t, p.Submit(&r))
+	assert.False(t, p.Submit(&r))
+
+	close(block)
+	p.Stop()
+	assert.Equal(t, 1, count)
+}
+
+func TestPoolQueueFull(t *testing.T) {
+	block := make(chan struct{})
+	p := worker.NewPool(1, 1, func(r *requests.Request) {
+		<-block
+	})
+
+	// the workers aren't started, so nothing leaves the queue
+	assert.True(t, p.Submit(&requests.Request{ID: "abc", BroadcasterID: "12345"}))
+	assert.False(t, p.Submit(&requests.Request{ID: "def", BroadcasterID: "12345"}))
+
+	p.Start()
+	close(block)
+	p.Stop()
+
+	assert.False(t, p.Submit(&requests.Request{ID: "ghi", BroadcasterID: "12345"}))
+}
+
+func TestPoolSubmitFirst(t *testing.T) {
+	var processed []string
+	p := worker.NewPool(1, 10, func(r *requests.Request) {
+		processed = append(processed, r.ID)
+	})
+
+	// the workers aren't started, so everything waits in the queues
+	assert.True(t, p.Submit(&requests.Request{ID: "first", BroadcasterID: "12345"}))
+	assert.True(t, p.Submit(&requests.Request{ID: "second", BroadcasterID: "12345"}))
+	assert.True(t, p.SubmitFirst(&requests.Request{ID: "cheer", BroadcasterID: "12345"}))
+	assert.False(t, p.SubmitFirst(&requests.Request{ID: "first", BroadcasterID: "12345"}))
+
+	p.Start()
+	p.Stop()
+
+	assert.Equal(t, []string{"cheer", "first", "second"}, processed)
+}
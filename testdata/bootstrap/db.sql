@@ -9,7 +9,12 @@ CREATE TABLE IF NOT EXISTS users (
     spotify_expiry DATE NULL,
     subscribed BOOLEAN NULL,
     subscription_id TEXT NULL,
-    email TEXT NULL
+    email TEXT NULL,
+    chat_subscription_id TEXT NULL,
+    cheer_subscription_id TEXT NULL,
+    reward_subscription_id TEXT NULL,
+    online_subscription_id TEXT NULL,
+    offline_subscription_id TEXT NULL
 );
 
 CREATE TABLE IF NOT EXISTS preferences (
@@ -17,13 +22,163 @@ CREATE TABLE IF NOT EXISTS preferences (
     `explicit` BOOLEAN NULL,
     reward_id TEXT NULL,
     last_updated DATE NULL,
-    max_song_length INT NULL
+    max_song_length INT NULL,
+    moderated BOOLEAN NULL,
+    viewer_cooldown INT NULL,
+    viewer_request_limit INT NULL,
+    viewer_limit_per_stream BOOLEAN NULL,
+    viewer_max_pending INT NULL,
+    duplicate_window INT NULL,
+    blocked_tracks TEXT[] NULL,
+    blocked_artists TEXT[] NULL,
+    blocked_albums TEXT[] NULL,
+    blocked_keywords TEXT[] NULL,
+    allowed_tracks TEXT[] NULL,
+    allowed_artists TEXT[] NULL,
+    allowed_albums TEXT[] NULL,
+    allowed_keywords TEXT[] NULL,
+    allowlist_only BOOLEAN NULL,
+    clean_substitute BOOLEAN NULL,
+    album_first_track BOOLEAN NULL,
+    playlist_first_track BOOLEAN NULL,
+    artist_top_track BOOLEAN NULL,
+    device_id TEXT NULL,
+    chat_replies BOOLEAN NULL,
+    queued_reply TEXT NULL,
+    rejected_reply TEXT NULL,
+    chat_requests BOOLEAN NULL,
+    chat_command TEXT NULL,
+    chat_roles TEXT[] NULL,
+    min_cheer_bits INT NULL,
+    cheer_priority BOOLEAN NULL,
+    request_roles TEXT[] NULL,
+    min_follow_days INT NULL,
+    live_only BOOLEAN NULL,
+    cancel_window INT NULL,
+    fulfillment TEXT NULL,
+    paused_rewards TEXT[] NULL
 );
 
 CREATE TABLE IF NOT EXISTS messages (
     id SERIAL PRIMARY KEY,
-    created_at DATE NULL,
+    created_at TIMESTAMP NULL,
     success TINYINT NULL,
     broadcaster_id TEXT NULL,
-    spotify_track TEXT NULL
-);
\ No newline at end of file
+    spotify_track TEXT NULL,
+    original_track TEXT NULL,
+    session_id TEXT NULL,
+    user_name TEXT NULL,
+    track_name TEXT NULL,
+    artist TEXT NULL
+);
+
+CREATE TABLE IF NOT EXISTS requests (
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    broadcaster_login TEXT NULL,
+    reward_id TEXT NULL,
+    user_id TEXT NULL,
+    user_login TEXT NULL,
+    user_name TEXT NULL,
+    user_input TEXT NULL,
+    status TEXT NOT NULL,
+    source TEXT NULL,
+    bits INT NULL,
+    reason TEXT NULL,
+    track_id TEXT NULL,
+    track_name TEXT NULL,
+    device TEXT NULL,
+    session_id TEXT NULL,
+    redemption_status TEXT NULL,
+    played_at TIMESTAMP NULL,
+    created_at TIMESTAMP NULL,
+    updated_at TIMESTAMP NULL
+);
+
+CREATE TABLE IF NOT EXISTS viewer_requests (
+    id SERIAL PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    viewer_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS dedup_keys (
+    id TEXT PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS rewards (
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    title TEXT NULL,
+    cost INT NULL,
+    subscription_id TEXT NULL,
+    max_song_length INT NULL,
+    explicit BOOLEAN NULL,
+    priority BOOLEAN NULL
+);
+
+CREATE TABLE IF NOT EXISTS streams (
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP NULL,
+    recap TEXT NULL
+);
+
+-- Upgrade tables created by an earlier version of this file
+ALTER TABLE users ADD COLUMN IF NOT EXISTS chat_subscription_id TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS cheer_subscription_id TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS reward_subscription_id TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS online_subscription_id TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS offline_subscription_id TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS moderated BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS viewer_cooldown INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS viewer_request_limit INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS viewer_limit_per_stream BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS viewer_max_pending INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS duplicate_window INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS blocked_tracks TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS blocked_artists TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS blocked_albums TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS blocked_keywords TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS allowed_tracks TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS allowed_artists TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS allowed_albums TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS allowed_keywords TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS allowlist_only BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS clean_substitute BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS album_first_track BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS playlist_first_track BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS artist_top_track BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS device_id TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS chat_replies BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS queued_reply TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS rejected_reply TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS chat_requests BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS chat_command TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS chat_roles TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS min_cheer_bits INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS cheer_priority BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS request_roles TEXT[] NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS min_follow_days INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS live_only BOOLEAN NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS cancel_window INT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS fulfillment TEXT NULL;
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS paused_rewards TEXT[] NULL;
+ALTER TABLE messages ALTER COLUMN created_at TYPE TIMESTAMP;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS original_track TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS session_id TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS user_name TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS track_name TEXT NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS artist TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS source TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS bits INT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS reason TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS track_id TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS track_name TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS device TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS session_id TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS redemption_status TEXT NULL;
+ALTER TABLE requests ADD COLUMN IF NOT EXISTS played_at TIMESTAMP NULL;
+ALTER TABLE streams ADD COLUMN IF NOT EXISTS recap TEXT NULL;
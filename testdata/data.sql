@@ -8,7 +8,12 @@ CREATE TABLE users(
     spotify_expiry DATE, 
     subscribed BOOLEAN, 
     subscription_id TEXT, 
-    email TEXT
+    email TEXT,
+    chat_subscription_id TEXT,
+    cheer_subscription_id TEXT,
+    reward_subscription_id TEXT,
+    online_subscription_id TEXT,
+    offline_subscription_id TEXT
 );
 
 INSERT INTO users(
@@ -29,19 +34,140 @@ CREATE TABLE preferences(
     explicit BOOLEAN,
     reward_id TEXT,
     last_updated DATE, 
-    max_song_length INT
+    max_song_length INT,
+    moderated BOOLEAN,
+    viewer_cooldown INT,
+    viewer_request_limit INT,
+    viewer_limit_per_stream BOOLEAN,
+    viewer_max_pending INT,
+    duplicate_window INT,
+    blocked_tracks TEXT[],
+    blocked_artists TEXT[],
+    blocked_albums TEXT[],
+    blocked_keywords TEXT[],
+    allowed_tracks TEXT[],
+    allowed_artists TEXT[],
+    allowed_albums TEXT[],
+    allowed_keywords TEXT[],
+    allowlist_only BOOLEAN,
+    clean_substitute BOOLEAN,
+    album_first_track BOOLEAN,
+    playlist_first_track BOOLEAN,
+    artist_top_track BOOLEAN,
+    device_id TEXT,
+    chat_replies BOOLEAN,
+    queued_reply TEXT,
+    rejected_reply TEXT,
+    chat_requests BOOLEAN,
+    chat_command TEXT,
+    chat_roles TEXT[],
+    min_cheer_bits INT,
+    cheer_priority BOOLEAN,
+    request_roles TEXT[],
+    min_follow_days INT,
+    live_only BOOLEAN,
+    cancel_window INT,
+    fulfillment TEXT,
+    paused_rewards TEXT[]
 );
 
-INSERT INTO preferences(id, explicit, reward_id, max_song_length, last_updated)
-VALUES ('12345', false, 'abc-123', 0, now()), ('23456', true, 'bcd-234', 50000, now());
+INSERT INTO preferences(id, explicit, reward_id, max_song_length, moderated, last_updated)
+VALUES ('12345', false, 'abc-123', 0, false, now());
+
+INSERT INTO preferences(id, explicit, reward_id, max_song_length, moderated, blocked_artists, blocked_keywords, allowed_tracks, allowlist_only, device_id, chat_replies, queued_reply, chat_requests, chat_roles, min_cheer_bits, request_roles, min_follow_days, live_only, cancel_window, fulfillment, viewer_limit_per_stream, paused_rewards, last_updated)
+VALUES ('23456', true, 'bcd-234', 50000, true, '{"0TnOYISbd1XYRBk9myaseg"}', '{"nightcore", "8d audio"}', '{"3cfOd4CMv2snFaKAnMdnvK"}', false, 'stream-pc', true, 'queued {song}', true, '{"moderator", "vip"}', 500, '{"subscriber", "follower"}', 7, true, 5, 'on-play', true, '{"bcd-234"}', now());
 
 CREATE TABLE messages(
     id SERIAL PRIMARY KEY,
-    created_at DATE,
+    created_at TIMESTAMP,
     success INT,
     broadcaster_id TEXT, 
-    spotify_track TEXT
+    spotify_track TEXT,
+    original_track TEXT,
+    session_id TEXT,
+    user_name TEXT,
+    track_name TEXT,
+    artist TEXT
 );
 
 INSERT INTO messages(success, broadcaster_id, spotify_track, created_at)
-VALUES (1, '12345', 'abc', now()), (0, '23456', '', now()), (1, '12345', 'bcd', now());
+VALUES (1, '12345', 'abc', now()), (0, '23456', '', now()), (1, '12345', 'bcd', now()), (1, '12345', 'cde', now() - INTERVAL '2 hours');
+
+INSERT INTO messages(success, broadcaster_id, spotify_track, original_track, created_at)
+VALUES (1, '34567', 'def', 'efg', now());
+
+INSERT INTO messages(success, broadcaster_id, spotify_track, session_id, user_name, track_name, artist, created_at)
+VALUES (1, '23456', 'fgh', 'stream-old', 'viewer', 'Song A', 'Artist A', now() - interval '2 days' + interval '1 hour'),
+    (0, '23456', '', 'stream-old', 'other', '', '', now() - interval '2 days' + interval '2 hours');
+
+
+CREATE TABLE requests(
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    broadcaster_login TEXT,
+    reward_id TEXT,
+    user_id TEXT,
+    user_login TEXT,
+    user_name TEXT,
+    user_input TEXT,
+    status TEXT NOT NULL,
+    source TEXT,
+    bits INT,
+    reason TEXT,
+    track_id TEXT,
+    track_name TEXT,
+    device TEXT,
+    session_id TEXT,
+    redemption_status TEXT,
+    played_at TIMESTAMP,
+    created_at TIMESTAMP,
+    updated_at TIMESTAMP
+);
+
+INSERT INTO requests(id, broadcaster_id, broadcaster_login, reward_id, user_id, user_login, user_name, user_input, status, created_at, updated_at)
+VALUES ('req-1', '23456', 'foo', 'bcd-234', '1337', 'viewer', 'Viewer', 'some song', 'pending', now() - INTERVAL '2 hours', now()),
+    ('req-2', '23456', 'foo', 'bcd-234', '1337', 'viewer', 'Viewer', 'other song', 'approved', now() - INTERVAL '3 hours', now());
+
+CREATE TABLE viewer_requests(
+    id SERIAL PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    viewer_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO viewer_requests(broadcaster_id, viewer_id, created_at)
+VALUES ('12345', '1337', now() - INTERVAL '1 minute'), ('12345', '1337', now() - INTERVAL '2 hours'), ('12345', '1337', now() - INTERVAL '3 days');
+
+CREATE TABLE dedup_keys(
+    id TEXT PRIMARY KEY,
+    expires_at TIMESTAMP NOT NULL
+);
+
+INSERT INTO dedup_keys(id, expires_at)
+VALUES ('message:active', now() + INTERVAL '1 hour'), ('message:expired', now() - INTERVAL '1 hour');
+
+CREATE TABLE rewards(
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    title TEXT,
+    cost INT,
+    subscription_id TEXT,
+    max_song_length INT,
+    explicit BOOLEAN,
+    priority BOOLEAN
+);
+
+INSERT INTO rewards(id, broadcaster_id, title, cost, subscription_id, max_song_length, explicit, priority)
+VALUES ('reward-cheap', '23456', 'Short Song Request', 500, 'sub-cheap', 240000, false, false),
+    ('reward-expensive', '23456', 'Priority Song Request', 5000, 'sub-expensive', 0, true, true);
+
+CREATE TABLE streams(
+    id TEXT PRIMARY KEY,
+    broadcaster_id TEXT NOT NULL,
+    started_at TIMESTAMP NOT NULL,
+    ended_at TIMESTAMP,
+    recap TEXT
+);
+
+INSERT INTO streams(id, broadcaster_id, started_at, ended_at)
+VALUES ('stream-old', '23456', now() - interval '2 days', now() - interval '2 days' + interval '3 hours');